@@ -0,0 +1,293 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// ResultAggregator collects the results of completed smuggling tests into a summary of the scan, along with the
+// best finding for each host. It is safe for concurrent use
+type ResultAggregator struct {
+	// The thresholds a finding must meet to be reported
+	minSeverity   Severity
+	minConfidence float64
+
+	// The number of findings which can be reported for each mutation, or 0 for no limit, and the number reported
+	// so far for each mutation
+	mutationLimit  int
+	mutationCounts map[string]int
+
+	// The hosts with reported findings of each desync type
+	statusHosts map[SmuggleType]map[string]bool
+
+	// Whether findings which are likely false positives aren't reported, and the number of tests completed and
+	// desyncs found against each host, whether or not they were reported, to judge them by. If hideSuspect is set,
+	// the findings against a host are held until enough tests have completed to judge them
+	hideSuspect bool
+	hostTests   map[string]int
+	hostDesyncs map[string]int
+	held        map[string][]SmuggleTest
+
+	summary *Summary
+	best    map[string]SmuggleTest
+	mux     sync.Mutex
+}
+
+// ClassSummary is the number of reported findings of a single desync type, and the hosts they were found on
+type ClassSummary struct {
+	Status   SmuggleType
+	Findings int
+	Hosts    []string
+}
+
+// NewResultAggregator returns an aggregator for a scan, to which the URLs scanned and the number of tests to
+// perform are added as they become known. Findings below minSeverity or minConfidence, using a mutation which has
+// already had mutationLimit findings reported if it isn't 0, or marked as suspect if hideSuspect is set, are
+// counted as completed tests, but not as findings
+func NewResultAggregator(minSeverity Severity, minConfidence float64, mutationLimit int, hideSuspect bool) *ResultAggregator {
+	return &ResultAggregator{
+		minSeverity:    minSeverity,
+		minConfidence:  minConfidence,
+		mutationLimit:  mutationLimit,
+		mutationCounts: make(map[string]int, 0),
+		statusHosts:    make(map[SmuggleType]map[string]bool, 0),
+		hideSuspect:    hideSuspect,
+		hostTests:      make(map[string]int, 0),
+		hostDesyncs:    make(map[string]int, 0),
+		held:           make(map[string][]SmuggleTest, 0),
+		summary:        NewSummary(nil, 0),
+		best:           make(map[string]SmuggleTest, 0),
+	}
+}
+
+// AddURL adds a URL being scanned to the summary
+func (a *ResultAggregator) AddURL(u *url.URL) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.summary.URLs++
+	a.summary.host(u).URLs++
+}
+
+// AddTests adds n to the number of tests to perform
+func (a *ResultAggregator) AddTests(n int) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.summary.Tests += n
+}
+
+// Reported returns whether t is a finding which meets the aggregator's thresholds, wasn't rejected in triage, uses
+// a mutation which hasn't reached its limit of findings, and isn't hidden as a suspect
+func (a *ResultAggregator) Reported(t SmuggleTest) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.reported(t)
+}
+
+// reported returns whether t would be reported. The aggregator must be locked
+func (a *ResultAggregator) reported(t SmuggleTest) bool {
+	return t.Status != SAFE && t.Status.Severity() >= a.minSeverity && t.Confidence >= a.minConfidence &&
+		t.Triage != TriageRejected && (a.mutationLimit == 0 || a.mutationCounts[t.Mutation] < a.mutationLimit) &&
+		!(a.hideSuspect && len(t.Suspect) > 0)
+}
+
+// suspectMinTests is the number of tests against a host which must all have found a desync for its findings to be
+// suspected of being caused by the host rather than the mutations
+const suspectMinTests = 10
+
+// suspectConfidence is the confidence below which timed findings are suspected of being caused by a slow or
+// variable host
+const suspectConfidence = 0.25
+
+// Settle counts a completed test against its host, and returns the completed tests which are ready to be
+// suspected and added, in the order they completed. If hideSuspect is set, the findings against a host are held
+// while every test against it has found a desync, until suspectMinTests tests have completed, so that none of them
+// are reported if the host keeps desyncing. A test which found no desync releases the host's findings straight
+// away. Otherwise, tests are released as they complete, and Settle also returns whether the test was the one to
+// show that every test against the host finds a desync, so the findings already released against it are now
+// suspect too. The best finding against the host is marked by Settle, and the others are left to the caller
+func (a *ResultAggregator) Settle(t SmuggleTest) ([]SmuggleTest, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	host := t.Url.Host
+	a.hostTests[host]++
+	if t.Status != SAFE {
+		a.hostDesyncs[host]++
+	}
+
+	if !a.hideSuspect {
+		everyTest := a.hostTests[host] == suspectMinTests && a.hostDesyncs[host] == suspectMinTests
+		if b, ok := a.best[host]; ok && everyTest {
+			b.Suspect = addReason(b.Suspect, "every-test")
+			a.best[host] = b
+		}
+		return []SmuggleTest{t}, everyTest
+	}
+
+	if a.hostDesyncs[host] == a.hostTests[host] && a.hostTests[host] < suspectMinTests {
+		a.held[host] = append(a.held[host], t)
+		return nil, false
+	}
+
+	ready := append(a.held[host], t)
+	delete(a.held, host)
+	return ready, false
+}
+
+// Flush returns the findings still held by Settle, sorted by host, once no more tests will complete. Their hosts
+// had too few tests to judge whether every test found a desync
+func (a *ResultAggregator) Flush() []SmuggleTest {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	hosts := make([]string, 0, len(a.held))
+	for h := range a.held {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	var ready []SmuggleTest
+	for _, h := range hosts {
+		ready = append(ready, a.held[h]...)
+	}
+	a.held = make(map[string][]SmuggleTest, 0)
+
+	return ready
+}
+
+// Suspect returns the reasons the finding t is likely to be a false positive, given the tests against its host
+// counted by Settle, or nil if there are none. TE.CL findings are expected to be confirmed if confirming is set:
+//   - "every-test": every test against the host, of at least suspectMinTests, found a desync, so the host is more
+//     likely to be answering slowly than to be vulnerable to every mutation
+//   - "low-confidence": the base time or verification time was close to the timeout, as with a host whose response
+//     times vary widely
+//   - "unconfirmed": smuggling a request to confirm a TE.CL desync failed
+func (a *ResultAggregator) Suspect(t SmuggleTest, confirming bool) []string {
+	if t.Status == SAFE {
+		return nil
+	}
+
+	a.mux.Lock()
+	tests, desyncs := a.hostTests[t.Url.Host], a.hostDesyncs[t.Url.Host]
+	a.mux.Unlock()
+
+	var reasons []string
+	if tests >= suspectMinTests && desyncs == tests {
+		reasons = append(reasons, "every-test")
+	}
+	if (t.Status == CLTE || t.Status == TECL || t.Status == ZEROCL) && t.Confidence < suspectConfidence {
+		reasons = append(reasons, "low-confidence")
+	}
+	if t.Status == TECL && confirming && !t.Confirmed {
+		reasons = append(reasons, "unconfirmed")
+	}
+
+	return reasons
+}
+
+// addReason returns reasons with reason added to the end, unless it's already there
+func addReason(reasons []string, reason string) []string {
+	for _, r := range reasons {
+		if r == reason {
+			return reasons
+		}
+	}
+
+	return append(reasons, reason)
+}
+
+// Add adds a completed test to the aggregated results, and returns whether it was reported as a finding
+func (a *ResultAggregator) Add(t SmuggleTest) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	reported := a.reported(t)
+	a.summary.Add(t, reported)
+	if reported {
+		a.mutationCounts[t.Mutation]++
+		if a.statusHosts[t.Status] == nil {
+			a.statusHosts[t.Status] = make(map[string]bool, 0)
+		}
+		a.statusHosts[t.Status][t.Url.Host] = true
+		if b, ok := a.best[t.Url.Host]; !ok || betterFinding(t, b) {
+			a.best[t.Url.Host] = t
+		}
+	}
+
+	return reported
+}
+
+// Summary returns a copy of the summary of the results added so far
+func (a *ResultAggregator) Summary() *Summary {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	s := *a.summary
+	s.Statuses = make(map[string]int, len(a.summary.Statuses))
+	for k, v := range a.summary.Statuses {
+		s.Statuses[k] = v
+	}
+	s.Mutations = make(map[string]int, len(a.summary.Mutations))
+	for k, v := range a.summary.Mutations {
+		s.Mutations[k] = v
+	}
+	s.Hosts = make(map[string]*HostSummary, len(a.summary.Hosts))
+	for k, v := range a.summary.Hosts {
+		h := *v
+		s.Hosts[k] = &h
+	}
+
+	return &s
+}
+
+// Classes returns the reported findings grouped by desync type, with the most common first, and types with the
+// same number of findings ordered by severity and then name. The hosts of each are sorted
+func (a *ResultAggregator) Classes() []ClassSummary {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	classes := make([]ClassSummary, 0, len(a.statusHosts))
+	for status, hosts := range a.statusHosts {
+		c := ClassSummary{
+			Status:   status,
+			Findings: a.summary.Statuses[string(status)],
+			Hosts:    make([]string, 0, len(hosts)),
+		}
+		for h := range hosts {
+			c.Hosts = append(c.Hosts, h)
+		}
+		sort.Strings(c.Hosts)
+		classes = append(classes, c)
+	}
+
+	sort.Slice(classes, func(i, j int) bool {
+		a, b := classes[i], classes[j]
+		if a.Findings != b.Findings {
+			return a.Findings > b.Findings
+		}
+		if a.Status.Severity() != b.Status.Severity() {
+			return a.Status.Severity() > b.Status.Severity()
+		}
+		return a.Status < b.Status
+	})
+
+	return classes
+}
+
+// Best returns the best reported finding against each host, as chosen by betterFinding, sorted by host
+func (a *ResultAggregator) Best() []SmuggleTest {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	hosts := make([]string, 0, len(a.best))
+	for h := range a.best {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	best := make([]SmuggleTest, 0, len(hosts))
+	for _, h := range hosts {
+		best = append(best, a.best[h])
+	}
+
+	return best
+}
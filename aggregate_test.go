@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestResultAggregator(t *testing.T) {
+	a, _ := url.Parse("http://a.example.com/")
+	b, _ := url.Parse("http://b.example.com/")
+	agg := NewResultAggregator(HIGH, 0.5, 0, false)
+	agg.AddURL(a)
+	agg.AddURL(b)
+	agg.AddTests(40)
+
+	// Half the tests against each host find a desync, of which half are too unlikely to be reported
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		for _, u := range []*url.URL{a, b} {
+			wg.Add(1)
+			go func(u *url.URL, i int) {
+				defer wg.Done()
+				test := SmuggleTest{Url: u, Method: "POST", Mutation: fmt.Sprintf("m%d", i%2), Status: SAFE}
+				if i%2 == 0 {
+					test.Status = CLTE
+					test.Confidence = float64(i) / 20
+				}
+				if reported := agg.Add(test); reported != agg.Reported(test) {
+					t.Errorf("%+v: got reported %v", test, reported)
+				}
+			}(u, i)
+		}
+	}
+	wg.Wait()
+
+	want := &Summary{
+		URLs:      2,
+		Tests:     40,
+		Completed: 40,
+		Findings:  10,
+		Statuses:  map[string]int{string(CLTE): 10},
+		Hosts: map[string]*HostSummary{
+			a.Host: {URLs: 1, Completed: 20, Findings: 5},
+			b.Host: {URLs: 1, Completed: 20, Findings: 5},
+		},
+		Mutations: map[string]int{"m0": 10},
+	}
+	s := agg.Summary()
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got summary %+v, want %+v", s, want)
+	}
+
+	// The summary returned is a copy
+	s.Hosts[a.Host].Findings = 0
+	s.Statuses[string(CLTE)] = 0
+	if again := agg.Summary(); !reflect.DeepEqual(again, want) {
+		t.Errorf("changing a returned summary changed the aggregator's to %+v", again)
+	}
+
+	best := agg.Best()
+	if len(best) != 2 || best[0].Url != a || best[1].Url != b {
+		t.Fatalf("got best findings %+v, want one for each host in order", best)
+	}
+	for _, f := range best {
+		if f.Confidence != 0.9 {
+			t.Errorf("%s: got best finding with confidence %v, want 0.9", f.Url, f.Confidence)
+		}
+	}
+}
+
+func TestResultAggregatorMutationLimit(t *testing.T) {
+	agg := NewResultAggregator(NONE, 0, 2, false)
+	for i := 0; i < 5; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://%d.example.com/", i))
+		agg.AddURL(u)
+		agg.AddTests(2)
+		for _, m := range []string{"m0", "m1"} {
+			test := SmuggleTest{Url: u, Method: "POST", Mutation: m, Status: CLTE, Confidence: 1}
+			if m == "m1" && i > 0 {
+				test.Status = SAFE
+			}
+			reported := agg.Add(test)
+			want := test.Status != SAFE && (m == "m1" || i < 2)
+			if reported != want {
+				t.Errorf("%s %s: got reported %v, want %v", u.Host, m, reported, want)
+			}
+		}
+	}
+
+	s := agg.Summary()
+	if s.Completed != 10 || s.Findings != 3 {
+		t.Errorf("got %d completed tests and %d findings, want 10 and 3", s.Completed, s.Findings)
+	}
+	if want := map[string]int{"m0": 2, "m1": 1}; !reflect.DeepEqual(s.Mutations, want) {
+		t.Errorf("got mutation findings %v, want %v", s.Mutations, want)
+	}
+}
+
+func TestResultAggregatorClasses(t *testing.T) {
+	agg := NewResultAggregator(NONE, 0, 0, false)
+	findings := []struct {
+		host   string
+		status SmuggleType
+	}{
+		{"a.example.com", CLTE},
+		{"b.example.com", ZEROCL},
+		{"c.example.com", TECL},
+		{"a.example.com", ZEROCL},
+		{"b.example.com", CLTE},
+		{"a.example.com", CLTE},
+		{"c.example.com", TECL},
+		{"c.example.com", SAFE},
+	}
+	for _, f := range findings {
+		u, _ := url.Parse("http://" + f.host + "/")
+		agg.Add(SmuggleTest{Url: u, Method: "POST", Mutation: "m", Status: f.status, Confidence: 1})
+	}
+
+	// TE.CL and 0.CL findings are tied on their number, so are ordered by severity
+	want := []ClassSummary{
+		{CLTE, 3, []string{"a.example.com", "b.example.com"}},
+		{TECL, 2, []string{"c.example.com"}},
+		{ZEROCL, 2, []string{"a.example.com", "b.example.com"}},
+	}
+	if got := agg.Classes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got classes %+v, want %+v", got, want)
+	}
+}
+
+// aggregatorTest returns a completed test against the given host with the given status
+func aggregatorTest(host string, n int, status SmuggleType) SmuggleTest {
+	u, _ := url.Parse("http://" + host + "/")
+	return SmuggleTest{Url: u, Method: "POST", Mutation: fmt.Sprintf("m%d", n), Status: status, Confidence: 1}
+}
+
+func hasReason(reasons []string, reason string) bool {
+	for _, r := range reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSuspect(t *testing.T) {
+	a := NewResultAggregator(NONE, 0, 0, false)
+	tests := []struct {
+		name       string
+		test       SmuggleTest
+		confidence float64
+		confirmed  bool
+		want       []string
+	}{
+		{"confident CL.TE", aggregatorTest("example.com", 1, CLTE), 1, false, nil},
+		{"low confidence CL.TE", aggregatorTest("example.com", 2, CLTE), 0.1, false, []string{"low-confidence"}},
+		{"unconfirmed TE.CL", aggregatorTest("example.com", 3, TECL), 1, false, []string{"unconfirmed"}},
+		{"confirmed TE.CL", aggregatorTest("example.com", 4, TECL), 1, true, nil},
+		{"low confidence pipelining", aggregatorTest("example.com", 5, PIPELINE), 0.1, false, nil},
+		{"safe", aggregatorTest("example.com", 6, SAFE), 0, false, nil},
+	}
+
+	for _, test := range tests {
+		test.test.Confidence = test.confidence
+		test.test.Confirmed = test.confirmed
+		a.Settle(test.test)
+		if got := a.Suspect(test.test, true); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got reasons %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSettleMarksEveryTestHost(t *testing.T) {
+	a := NewResultAggregator(NONE, 0, 0, false)
+
+	// Findings are released straight away, and the test which shows every test desyncs is pointed out
+	for i := 1; i <= suspectMinTests+1; i++ {
+		f := aggregatorTest("slow.example.com", i, CLTE)
+		ready, everyTest := a.Settle(f)
+		if len(ready) != 1 {
+			t.Fatalf("finding %d: got %d tests released, want it released straight away", i, len(ready))
+		}
+		if everyTest != (i == suspectMinTests) {
+			t.Errorf("finding %d: got every-test shown %t", i, everyTest)
+		}
+		f.Suspect = a.Suspect(f, false)
+		if hasReason(f.Suspect, "every-test") != (i >= suspectMinTests) {
+			t.Errorf("finding %d: got suspect reasons %v", i, f.Suspect)
+		}
+		if !a.Add(f) {
+			t.Errorf("finding %d wasn't reported without --hide-suspect", i)
+		}
+	}
+
+	// The best finding was added before the host was known to desync on every test, but is marked as well
+	if best := a.Best(); len(best) != 1 || !hasReason(best[0].Suspect, "every-test") {
+		t.Errorf("got best findings %v, want one marked every-test", best)
+	}
+	if n := len(a.Flush()); n != 0 {
+		t.Errorf("got %d findings held without --hide-suspect, want none", n)
+	}
+}
+
+func TestSettleHoldsEveryTestHost(t *testing.T) {
+	a := NewResultAggregator(NONE, 0, 0, true)
+
+	// The first findings are held until it's known that every test desyncs, so are hidden too
+	for i := 1; i < suspectMinTests; i++ {
+		if ready, _ := a.Settle(aggregatorTest("slow.example.com", i, CLTE)); len(ready) != 0 {
+			t.Fatalf("finding %d was released before %d tests completed", i, suspectMinTests)
+		}
+	}
+	ready, _ := a.Settle(aggregatorTest("slow.example.com", suspectMinTests, CLTE))
+	if len(ready) != suspectMinTests {
+		t.Fatalf("got %d findings released, want %d", len(ready), suspectMinTests)
+	}
+	more, _ := a.Settle(aggregatorTest("slow.example.com", suspectMinTests+1, CLTE))
+	for _, f := range append(ready, more...) {
+		f.Suspect = a.Suspect(f, false)
+		if !hasReason(f.Suspect, "every-test") {
+			t.Errorf("%s got suspect reasons %v, want every-test", f.Mutation, f.Suspect)
+		}
+		if a.Add(f) {
+			t.Errorf("%s was reported despite --hide-suspect", f.Mutation)
+		}
+	}
+	if n := len(a.Flush()); n != 0 {
+		t.Errorf("got %d findings still held, want none", n)
+	}
+}
+
+func TestSettleReleasesOnSafeTest(t *testing.T) {
+	a := NewResultAggregator(NONE, 0, 0, true)
+	a.Settle(aggregatorTest("example.com", 1, CLTE))
+	a.Settle(aggregatorTest("example.com", 2, TECL))
+
+	// Findings against another host aren't affected
+	a.Settle(aggregatorTest("other.example.com", 1, CLTE))
+
+	ready, _ := a.Settle(aggregatorTest("example.com", 3, SAFE))
+	if len(ready) != 3 || ready[0].Mutation != "m1" || ready[2].Status != SAFE {
+		t.Fatalf("got %v, want both findings and the safe test in order", ready)
+	}
+	for _, f := range ready[:2] {
+		if hasReason(a.Suspect(f, false), "every-test") {
+			t.Errorf("%s was marked every-test on a host with a safe test", f.Mutation)
+		}
+		if !a.Add(f) {
+			t.Errorf("%s wasn't reported", f.Mutation)
+		}
+	}
+
+	// Once the host has had a safe test, its tests are released straight away
+	if ready, _ := a.Settle(aggregatorTest("example.com", 4, SAFE)); len(ready) != 1 {
+		t.Errorf("got %d tests released, want the safe test", len(ready))
+	}
+	if ready, _ := a.Settle(aggregatorTest("example.com", 5, CLTE)); len(ready) != 1 {
+		t.Errorf("got %d tests released, want the finding as the host has had a safe test", len(ready))
+	}
+}
+
+func TestFlushReleasesSmallHosts(t *testing.T) {
+	a := NewResultAggregator(NONE, 0, 0, true)
+	for i := 1; i <= 3; i++ {
+		a.Settle(aggregatorTest("b.example.com", i, CLTE))
+		a.Settle(aggregatorTest("a.example.com", i, CLTE))
+	}
+
+	held := a.Flush()
+	if len(held) != 6 || held[0].Url.Host != "a.example.com" || held[5].Url.Host != "b.example.com" {
+		t.Fatalf("got %v, want the findings of each host sorted by host", held)
+	}
+	for _, f := range held {
+		if hasReason(a.Suspect(f, false), "every-test") {
+			t.Errorf("%s %s was marked every-test with fewer than %d tests", f.Url.Host, f.Mutation, suspectMinTests)
+		}
+	}
+	if n := len(a.Flush()); n != 0 {
+		t.Errorf("got %d findings on a second flush, want none", n)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RequestBudget is a limit on the total number of requests sent by all workers. It is safe for concurrent use
+type RequestBudget struct {
+	limit int64
+	used  int64
+
+	// Called the first time a request is refused
+	onSpent func()
+	once    sync.Once
+}
+
+// NewRequestBudget returns a budget of limit requests, which calls onSpent the first time a request is refused
+// because the budget has been spent
+func NewRequestBudget(limit int64, onSpent func()) *RequestBudget {
+	return &RequestBudget{limit: limit, onSpent: onSpent}
+}
+
+// Take takes n requests from the budget, and returns whether there were enough left to send them
+func (b *RequestBudget) Take(n int) bool {
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used+int64(n) > b.limit {
+			b.once.Do(b.onSpent)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+int64(n)) {
+			return true
+		}
+	}
+}
+
+// Used returns the number of requests taken from the budget
+func (b *RequestBudget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
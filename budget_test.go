@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestBudgetConcurrent(t *testing.T) {
+	const limit = 1000
+	var spent int32
+	b := NewRequestBudget(limit, func() { atomic.AddInt32(&spent, 1) })
+
+	// Many more requests than the limit are taken at once, some several at a time
+	var taken int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if b.Take(n) {
+					atomic.AddInt64(&taken, int64(n))
+				}
+			}
+		}(i%3 + 1)
+	}
+	wg.Wait()
+
+	if taken > limit {
+		t.Errorf("took %d requests from a budget of %d", taken, limit)
+	}
+	if b.Used() != taken {
+		t.Errorf("budget used %d, want the %d taken", b.Used(), taken)
+	}
+	// Requests of 1 at a time keep going until the budget is exactly spent
+	if taken != limit {
+		t.Errorf("took %d requests, want the whole budget of %d", taken, limit)
+	}
+	if spent != 1 {
+		t.Errorf("onSpent called %d times, want once", spent)
+	}
+}
+
+func TestRequestBudgetTakeSeveral(t *testing.T) {
+	b := NewRequestBudget(5, func() {})
+	if !b.Take(3) {
+		t.Fatal("couldn't take 3 of 5 requests")
+	}
+	if b.Take(3) {
+		t.Error("took 3 requests with only 2 left")
+	}
+	if !b.Take(2) {
+		t.Error("couldn't take the 2 requests left")
+	}
+	if b.Used() != 5 {
+		t.Errorf("used %d, want 5", b.Used())
+	}
+}
+
+func TestWorkerSpend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := Worker{Ctx: ctx}
+	if err := w.spend(100); err != nil {
+		t.Errorf("worker without a budget got %v, want no limit", err)
+	}
+
+	// The scan is stopped when the budget is spent, which the worker reports as its context's error
+	w.Budget = NewRequestBudget(1, cancel)
+	if err := w.spend(1); err != nil {
+		t.Fatalf("got %v spending the only request", err)
+	}
+	if err := w.spend(1); err != context.Canceled {
+		t.Errorf("got %v spending past the budget, want the cancelled context", err)
+	}
+
+	w = Worker{Ctx: context.Background(), Budget: NewRequestBudget(0, func() {})}
+	if err := w.spend(1); err == nil {
+		t.Error("spent a request from an empty budget")
+	}
+}
+
+func TestSpentBudgetDoesntDial(t *testing.T) {
+	var conns int32
+	u := stubServer(t, func(conn net.Conn) {
+		atomic.AddInt32(&conns, 1)
+	})
+
+	w, _ := testWorker(Config{ReuseConnections: true, ReuseTestConnections: true})
+	w.Budget = NewRequestBudget(0, func() {})
+	if _, err := w.SendKeepAlive(baseReq(u, RequestOptions{}), u, time.Second); err == nil {
+		t.Error("got no error sending a keep-alive request with a spent budget")
+	}
+	if _, err, _ := w.SendTestRequest(baseReq(u, RequestOptions{}), u, time.Second); err == nil {
+		t.Error("got no error sending a test request with a spent budget")
+	}
+	if _, err, _ := w.SendRequest(baseReq(u, RequestOptions{}), u, time.Second); err == nil {
+		t.Error("got no error sending a request with a spent budget")
+	}
+
+	// Give any connection a chance to be accepted
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&conns); n != 0 {
+		t.Errorf("got %d connections with a spent budget, want none", n)
+	}
+}
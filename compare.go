@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// readFindings reads the findings from a log file in either output format, indexed by their method, URL, and
+// mutation
+func readFindings(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Logs written with --compress-output are gzipped
+	var r io.Reader = f
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	findings := make(map[string]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+
+		// Logs written with --output-format ndjson have a JSON object per line
+		if strings.HasPrefix(line, "{") {
+			var f finding
+			if err := json.Unmarshal([]byte(line), &f); err != nil {
+				continue
+			}
+			fields = []string{f.Method, f.Url, f.Status, f.Mutation}
+		}
+		// Other lines, such as those of nuclei templates, don't have a status in the third field
+		if len(fields) < 4 || !isFinding(SmuggleType(fields[2])) {
+			continue
+		}
+		findings[findingKey(fields)] = strings.Join(fields[:4], " ")
+	}
+
+	return findings, scanner.Err()
+}
+
+// isFinding returns whether s is the status of a reported finding
+func isFinding(s SmuggleType) bool {
+	switch s {
+	case CLTE, TECL, ZEROCL, RESET, PIPELINE, HOST:
+		return true
+	default:
+		return false
+	}
+}
+
+// findingKey returns the method, URL, and mutation of a finding from the fields of its log line
+func findingKey(fields []string) string {
+	return strings.Join([]string{fields[0], fields[1], fields[3]}, " ")
+}
+
+// compareFindings returns the findings which are only in the new findings, those which are only in the old
+// findings, and those which are in both, each sorted
+func compareFindings(oldFindings map[string]string, newFindings map[string]string) (added []string, fixed []string, unchanged []string) {
+	added = make([]string, 0)
+	fixed = make([]string, 0)
+	unchanged = make([]string, 0)
+
+	for k, line := range newFindings {
+		if _, ok := oldFindings[k]; ok {
+			unchanged = append(unchanged, line)
+		} else {
+			added = append(added, line)
+		}
+	}
+	for k, line := range oldFindings {
+		if _, ok := newFindings[k]; !ok {
+			fixed = append(fixed, line)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(fixed)
+	sort.Strings(unchanged)
+	return
+}
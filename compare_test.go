@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFindings(t *testing.T) {
+	dir := tempDir(t)
+
+	// Lines end with optional fields, which don't change which finding they are, and other lines are skipped
+	path := filepath.Join(dir, "smuggles.log")
+	content := strings.Join([]string{
+		"POST https://example.com/ TE.CL space1 high 0.90",
+		"POST https://example.com/ CL.TE tab high 0.45 scan-1",
+		"",
+		"short line",
+		"POST https://example.com/ 0.CL zero-cl medium 0.50",
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readFindings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"POST https://example.com/ space1":  "POST https://example.com/ TE.CL space1",
+		"POST https://example.com/ tab":     "POST https://example.com/ CL.TE tab",
+		"POST https://example.com/ zero-cl": "POST https://example.com/ 0.CL zero-cl",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Logs written with --output-format nuclei have no lines which are findings
+	conf := Config{Mutations: generateMutations(), MarkerStatus: http.StatusNotFound}
+	u, _ := url.Parse("https://example.com/path")
+	finding := SmuggleTest{Url: u, Method: "POST", Mutation: "standard", Timeout: time.Second, Status: CLTE}
+	tmpl, err := nucleiTemplate(conf, finding, "scan-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "nuclei.log")
+	content = tmpl + "\n---\n# GET https://example.com/ PIPELINE pipeline medium 0.50 (no PoC)\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readFindings(path); err != nil || len(got) != 0 {
+		t.Errorf("got findings %v and error %v reading a nuclei log, want none", got, err)
+	}
+
+	if _, err := readFindings(filepath.Join(dir, "missing.log")); err == nil {
+		t.Error("got no error reading a missing log")
+	}
+}
+
+func TestCompareFindings(t *testing.T) {
+	oldFindings := map[string]string{
+		"POST https://a.example.com/ tab":    "POST https://a.example.com/ CL.TE tab",
+		"POST https://b.example.com/ space1": "POST https://b.example.com/ TE.CL space1",
+	}
+	// A finding whose status changed is the same finding
+	newFindings := map[string]string{
+		"POST https://a.example.com/ tab": "POST https://a.example.com/ TE.CL tab",
+		"GET https://c.example.com/ tab":  "GET https://c.example.com/ CL.TE tab",
+		"POST https://c.example.com/ tab": "POST https://c.example.com/ CL.TE tab",
+	}
+
+	added, fixed, unchanged := compareFindings(oldFindings, newFindings)
+	if want := []string{"GET https://c.example.com/ CL.TE tab", "POST https://c.example.com/ CL.TE tab"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("got added %v, want %v", added, want)
+	}
+	if want := []string{"POST https://b.example.com/ TE.CL space1"}; !reflect.DeepEqual(fixed, want) {
+		t.Errorf("got fixed %v, want %v", fixed, want)
+	}
+	if want := []string{"POST https://a.example.com/ TE.CL tab"}; !reflect.DeepEqual(unchanged, want) {
+		t.Errorf("got unchanged %v, want %v", unchanged, want)
+	}
+
+	added, fixed, unchanged = compareFindings(map[string]string{}, map[string]string{})
+	if added == nil || fixed == nil || unchanged == nil {
+		t.Error("got nil slices comparing no findings, want empty ones")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	dir := tempDir(t)
+	oldLog := "POST https://a.example.com/ CL.TE tab high 0.90\nPOST https://b.example.com/ TE.CL space1 high 0.90\n"
+	newLog := "POST https://a.example.com/ CL.TE tab high 0.80\nGET https://c.example.com/ CL.TE tab high 0.90\n"
+	ioutil.WriteFile(filepath.Join(dir, "old.log"), []byte(oldLog), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "new.log"), []byte(newLog), 0644)
+
+	stdout, stderr, code := runMain(t, dir, "", "--compare", "old.log", "new.log")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	want := "+ GET https://c.example.com/ CL.TE tab\n- POST https://b.example.com/ TE.CL space1\n1 new, 1 fixed, 1 unchanged\n"
+	if stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
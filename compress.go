@@ -0,0 +1,71 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// GzipWriter compresses everything written to it into a file. The stream is flushed after each write, so the
+// file can be read while the scan is running and nothing is lost if it's killed. Output is added to the end of
+// an existing file as a new gzip member, which readers decompress as a continuation of the earlier output
+type GzipWriter struct {
+	f   *os.File
+	gz  *gzip.Writer
+	mux sync.Mutex
+}
+
+// NewGzipWriter opens the given file for appending, and returns a writer which compresses output into it
+func NewGzipWriter(filename string) (*GzipWriter, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GzipWriter{f: f, gz: gzip.NewWriter(f)}, nil
+}
+
+// Write compresses p into the file
+func (w *GzipWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	n, err := w.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.gz.Flush()
+}
+
+// Close ends the gzip stream and closes the file
+func (w *GzipWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	err := w.gz.Close()
+	if ferr := w.f.Close(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
+
+// openLog opens the given log file, compressing it if asked to and otherwise rotating it once it exceeds maxSize
+// bytes if maxSize is set. Compressed logs are given a .gz extension if they don't already have one. Compressed and
+// rotated logs are appended to, so the findings of previous runs are kept, while other logs are written over from
+// the start of the file
+func openLog(filename string, compress bool, maxSize int64) (io.WriteCloser, error) {
+	if compress {
+		if !strings.HasSuffix(filename, ".gz") {
+			filename += ".gz"
+		}
+		return NewGzipWriter(filename)
+	} else if maxSize > 0 {
+		return NewRotatingWriter(filename, maxSize)
+	}
+
+	return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+}
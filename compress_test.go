@@ -0,0 +1,73 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressOutput(t *testing.T) {
+	dir := tempDir(t)
+	a, b := zeroCLServer(t, true), zeroCLServer(t, true)
+
+	// A second scan appends its findings to the first's log
+	for _, u := range []string{a.String(), b.String()} {
+		_, stderr, code := runMain(t, dir, u+"\n", "--compress-output", "-o", "findings.log", "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+		if code != 0 {
+			t.Fatalf("exited with %d: %s", code, stderr)
+		}
+	}
+
+	filename := filepath.Join(dir, "findings.log.gz")
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("the log isn't valid gzip: %v", err)
+	}
+	out, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("the log isn't valid gzip: %v", err)
+	}
+	want := fmt.Sprintf("POST %s 0.CL %s medium 0.50\nPOST %s 0.CL %s medium 0.50\n", a, ZeroCLMutation, b, ZeroCLMutation)
+	if string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+
+	// The compressed log can be compared against
+	findings, err := readFindings(filename)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(findings) != 2 {
+		t.Errorf("got findings %v from the compressed log, want 2", findings)
+	}
+}
+
+func TestOpenLogPlain(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "findings.log")
+	if err := ioutil.WriteFile(filename, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain logs are written from the start of the file, as they were before rotation and compression
+	f, err := openLog(filename, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(f, "current run\n")
+	f.Close()
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "current run\n" {
+		t.Errorf("got log %q, want it written from the start", b)
+	}
+}
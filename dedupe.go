@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// IPDeduper tracks the servers which URLs resolve to, so that a URL can be skipped when an earlier URL reaches the
+// same path on the same server through a different hostname. It is safe for concurrent use, as URLs redirected to
+// are checked while the input is still being read
+type IPDeduper struct {
+	resolver *DoHResolver
+
+	// The address each hostname resolved to, and the first URL seen for each server and path, which are protected
+	// by mux
+	addrs map[string]string
+	seen  map[string]*url.URL
+	mux   sync.Mutex
+}
+
+// NewIPDeduper returns a deduper which resolves hostnames with the given resolver, or the system resolver if nil
+func NewIPDeduper(resolver *DoHResolver) *IPDeduper {
+	return &IPDeduper{
+		resolver: resolver,
+		addrs:    make(map[string]string, 0),
+		seen:     make(map[string]*url.URL, 0),
+	}
+}
+
+// Duplicate returns the earlier URL which u reaches the same server and path as, or nil if there isn't one. If
+// the hostname of u can't be resolved, the error is returned and u isn't treated as a duplicate
+func (d *IPDeduper) Duplicate(ctx context.Context, u *url.URL) (*url.URL, error) {
+	// The lookup isn't made with the mutex held, so a slow lookup doesn't hold up URLs from other hosts
+	addr, err := d.resolve(ctx, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	// The URL with its host replaced by the address identifies what is tested
+	key := *u
+	key.Host = net.JoinHostPort(addr, urlPort(u))
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if first, ok := d.seen[key.String()]; ok {
+		return first, nil
+	}
+	d.seen[key.String()] = u
+
+	return nil, nil
+}
+
+// resolve returns the address host resolves to. Where there are several, the lowest is used so that the result
+// doesn't depend on the order the addresses were returned in
+func (d *IPDeduper) resolve(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	d.mux.Lock()
+	addr, ok := d.addrs[host]
+	d.mux.Unlock()
+	if ok {
+		return addr, nil
+	}
+
+	var addrs []string
+	var err error
+	if d.resolver != nil {
+		addrs, err = d.resolver.Lookup(ctx, host)
+	} else {
+		addrs, err = net.DefaultResolver.LookupHost(ctx, host)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(addrs)
+	d.mux.Lock()
+	d.addrs[host] = addrs[0]
+	d.mux.Unlock()
+
+	return addrs[0], nil
+}
+
+// duplicateServer returns the earlier URL which u reaches the same server and path as according to deduper, or
+// nil if there isn't one or deduper is nil. URLs which can't be resolved are logged and kept
+func duplicateServer(ctx context.Context, deduper *IPDeduper, u *url.URL, errlog *log.Logger) *url.URL {
+	if deduper == nil {
+		return nil
+	}
+
+	first, err := deduper.Duplicate(ctx, u)
+	if err != nil {
+		errlog.Printf("Couldn't resolve %s to deduplicate it: %v\n", u.Hostname(), err)
+	}
+
+	return first
+}
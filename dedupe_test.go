@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestIPDeduper(t *testing.T) {
+	server, _ := dohServer(t, map[string]map[int]string{
+		"a.test":     {dnsTypeA: "127.0.0.1"},
+		"b.test":     {dnsTypeA: "127.0.0.1"},
+		"other.test": {dnsTypeA: "127.0.0.2"},
+	})
+	resolver, err := NewDoHResolver(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewIPDeduper(resolver)
+
+	tests := []struct {
+		url  string
+		dupe string
+	}{
+		{"http://a.test/", ""},
+		{"http://b.test/", "http://a.test/"},
+		{"http://127.0.0.1:80/", "http://a.test/"},
+		{"http://b.test/path", ""},
+		{"http://b.test:8080/", ""},
+		{"https://b.test/", ""},
+		{"https://a.test:443/", "https://b.test/"},
+		{"http://other.test/", ""},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		first, err := d.Duplicate(context.Background(), u)
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+		} else if test.dupe == "" && first != nil {
+			t.Errorf("%s: got a duplicate of %s, want none", test.url, first)
+		} else if test.dupe != "" && (first == nil || first.String() != test.dupe) {
+			t.Errorf("%s: got a duplicate of %v, want %s", test.url, first, test.dupe)
+		}
+	}
+
+	// Hostnames which can't be resolved aren't treated as duplicates
+	u, _ := url.Parse("http://missing.test/")
+	for i := 0; i < 2; i++ {
+		if first, err := d.Duplicate(context.Background(), u); err == nil || first != nil {
+			t.Errorf("got %v and error %v for an unresolvable hostname, want no duplicate and an error", first, err)
+		}
+	}
+}
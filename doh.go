@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DNS record types requested from DoH servers
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// DoHResolver resolves hostnames using the JSON API of a DNS-over-HTTPS server, as served by Cloudflare and
+// Google. Addresses are cached for the rest of the scan, so each hostname is only looked up once
+type DoHResolver struct {
+	server string
+	client *http.Client
+
+	cache    map[string][]string
+	cacheMux sync.Mutex
+}
+
+// dohResponse is the part of a DoH JSON API response needed to resolve a hostname
+type dohResponse struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Type int    `json:"type"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// NewDoHResolver returns a resolver which sends queries to the given DoH server URL, such as
+// https://cloudflare-dns.com/dns-query
+func NewDoHResolver(server string) (*DoHResolver, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("DoH server must be an http or https URL: %s", server)
+	}
+
+	return &DoHResolver{
+		server: server,
+		client: &http.Client{Timeout: 10 * time.Second},
+		cache:  make(map[string][]string, 0),
+	}, nil
+}
+
+// Lookup returns the IPv4 addresses of host, or its IPv6 addresses if it has none
+func (r *DoHResolver) Lookup(ctx context.Context, host string) ([]string, error) {
+	r.cacheMux.Lock()
+	addrs, ok := r.cache[host]
+	r.cacheMux.Unlock()
+	if ok {
+		return addrs, nil
+	}
+
+	addrs, err := r.query(ctx, host, dnsTypeA)
+	if err == nil && len(addrs) == 0 {
+		addrs, err = r.query(ctx, host, dnsTypeAAAA)
+	}
+	if err != nil {
+		return nil, err
+	} else if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s using DoH", host)
+	}
+
+	r.cacheMux.Lock()
+	r.cache[host] = addrs
+	r.cacheMux.Unlock()
+
+	return addrs, nil
+}
+
+// query asks the DoH server for the records of the given type for host, and returns the addresses in them
+func (r *DoHResolver) query(ctx context.Context, host string, recordType int) ([]string, error) {
+	u, err := url.Parse(r.server)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("name", host)
+	q.Set("type", fmt.Sprint(recordType))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH lookup of %s failed: %w", host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH lookup of %s failed: server responded with %s", host, resp.Status)
+	}
+
+	var answer dohResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("DoH lookup of %s failed: %w", host, err)
+	} else if answer.Status != 0 {
+		// A non-zero status is a DNS response code, such as NXDOMAIN
+		return nil, fmt.Errorf("DoH lookup of %s failed with DNS response code %d", host, answer.Status)
+	}
+
+	// CNAME records may be included in the answer, so only keep the addresses of the requested type
+	addrs := make([]string, 0, len(answer.Answer))
+	for _, a := range answer.Answer {
+		if a.Type == recordType && net.ParseIP(a.Data) != nil {
+			addrs = append(addrs, a.Data)
+		}
+	}
+
+	return addrs, nil
+}
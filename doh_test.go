@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// dohServer starts a stub DoH server answering with the given records, keyed by name and then record type, and
+// returns its URL along with a function returning the number of queries it has received
+func dohServer(t *testing.T, records map[string]map[int]string) (string, func() int) {
+	var queries int
+	var mux sync.Mutex
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		queries++
+		mux.Unlock()
+
+		if r.Header.Get("Accept") != "application/dns-json" {
+			http.Error(w, "unsupported Accept header", http.StatusBadRequest)
+			return
+		}
+		rs, ok := records[r.URL.Query().Get("name")]
+		if !ok {
+			fmt.Fprint(w, `{"Status": 3}`)
+			return
+		}
+		var recordType int
+		fmt.Sscan(r.URL.Query().Get("type"), &recordType)
+		if addr, ok := rs[recordType]; ok {
+			fmt.Fprintf(w, `{"Status": 0, "Answer": [{"type": 5, "data": "alias.test."}, {"type": %d, "data": %q}]}`, recordType, addr)
+		} else {
+			fmt.Fprint(w, `{"Status": 0}`)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	return s.URL + "/dns-query", func() int {
+		mux.Lock()
+		defer mux.Unlock()
+		return queries
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	server, queries := dohServer(t, map[string]map[int]string{
+		"v4.test": {dnsTypeA: "127.0.0.1", dnsTypeAAAA: "::1"},
+		"v6.test": {dnsTypeAAAA: "::1"},
+	})
+	r, err := NewDoHResolver(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]string{
+		"v4.test": {"127.0.0.1"},
+		"v6.test": {"::1"},
+	}
+	for host, want := range tests {
+		addrs, err := r.Lookup(context.Background(), host)
+		if err != nil {
+			t.Errorf("%s: %v", host, err)
+		} else if !reflect.DeepEqual(addrs, want) {
+			t.Errorf("%s: got %v, want %v", host, addrs, want)
+		}
+	}
+	if _, err := r.Lookup(context.Background(), "missing.test"); err == nil {
+		t.Error("got no error for a name which doesn't exist")
+	}
+
+	// Addresses are cached for the rest of the scan
+	n := queries()
+	r.Lookup(context.Background(), "v4.test")
+	if queries() != n {
+		t.Errorf("got %d more queries for a cached name", queries()-n)
+	}
+
+	if _, err := NewDoHResolver("ftp://example.com/"); err == nil {
+		t.Error("got no error for a non-HTTP DoH server")
+	}
+}
+
+func TestDoHDial(t *testing.T) {
+	target := stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err == nil {
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		}
+	})
+	server, queries := dohServer(t, map[string]map[int]string{"target.test": {dnsTypeA: target.Hostname()}})
+	resolver, err := NewDoHResolver(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests to the hostname go through the DoH server to the stub target
+	u, _ := url.Parse("http://target.test:" + target.Port() + "/")
+	w, _ := testWorker(Config{})
+	w.Resolver = resolver
+	if _, resp, err := w.measureBase(u, w.requestOptions(u)); err != nil {
+		t.Fatalf("couldn't measure base time through DoH: %v", err)
+	} else if resp.StatusCode != 200 {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+	if queries() == 0 {
+		t.Error("the DoH server wasn't queried")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fingerprint recognises a frontend or backend technology from a pattern in one of the headers of a base response
+type fingerprint struct {
+	// The header to check, and a lowercase substring of its value which identifies the technology. An empty
+	// pattern matches any value, for headers only sent by one technology
+	Header  string
+	Pattern string
+
+	// The name of the technology, and where it usually sits: "front" for proxies and CDNs, "back" for application
+	// servers, or "either" for servers commonly used as both
+	Name string
+	Role string
+}
+
+// fingerprints are the technologies which can be recognised, checked in order
+var fingerprints = []fingerprint{
+	// Headers added by CDNs and caching proxies
+	{Header: "X-Amz-Cf-Id", Name: "CloudFront", Role: "front"},
+	{Header: "Via", Pattern: "cloudfront", Name: "CloudFront", Role: "front"},
+	{Header: "Via", Pattern: "varnish", Name: "Varnish", Role: "front"},
+	{Header: "Via", Pattern: "squid", Name: "Squid", Role: "front"},
+	{Header: "Via", Pattern: "google", Name: "Google Cloud Load Balancer", Role: "front"},
+	{Header: "Via", Pattern: "akamai", Name: "Akamai", Role: "front"},
+	{Header: "X-Served-By", Pattern: "cache-", Name: "Fastly", Role: "front"},
+	{Header: "X-Varnish", Name: "Varnish", Role: "front"},
+	{Header: "CF-Ray", Name: "Cloudflare", Role: "front"},
+
+	// Server headers of proxies, which replace the backend's
+	{Header: "Server", Pattern: "cloudflare", Name: "Cloudflare", Role: "front"},
+	{Header: "Server", Pattern: "akamaighost", Name: "Akamai", Role: "front"},
+	{Header: "Server", Pattern: "envoy", Name: "Envoy", Role: "front"},
+	{Header: "Server", Pattern: "ats/", Name: "Apache Traffic Server", Role: "front"},
+	{Header: "Server", Pattern: "haproxy", Name: "HAProxy", Role: "front"},
+	{Header: "Server", Pattern: "awselb", Name: "AWS ELB", Role: "front"},
+
+	// Servers which are commonly either a reverse proxy or serving the application
+	{Header: "Server", Pattern: "openresty", Name: "OpenResty", Role: "either"},
+	{Header: "Server", Pattern: "nginx", Name: "Nginx", Role: "either"},
+	{Header: "Server", Pattern: "apache", Name: "Apache", Role: "either"},
+	{Header: "Server", Pattern: "caddy", Name: "Caddy", Role: "either"},
+
+	// Application servers
+	{Header: "Server", Pattern: "gunicorn", Name: "Gunicorn", Role: "back"},
+	{Header: "Server", Pattern: "uvicorn", Name: "Uvicorn", Role: "back"},
+	{Header: "Server", Pattern: "werkzeug", Name: "Werkzeug", Role: "back"},
+	{Header: "Server", Pattern: "waitress", Name: "Waitress", Role: "back"},
+	{Header: "Server", Pattern: "puma", Name: "Puma", Role: "back"},
+	{Header: "Server", Pattern: "jetty", Name: "Jetty", Role: "back"},
+	{Header: "Server", Pattern: "kestrel", Name: "Kestrel", Role: "back"},
+	{Header: "Server", Pattern: "microsoft-iis", Name: "IIS", Role: "back"},
+	{Header: "X-Powered-By", Pattern: "express", Name: "Express", Role: "back"},
+	{Header: "X-Powered-By", Pattern: "php", Name: "PHP", Role: "back"},
+	{Header: "X-Powered-By", Pattern: "asp.net", Name: "ASP.NET", Role: "back"},
+	{Header: "X-Powered-By", Pattern: "servlet", Name: "Java Servlet", Role: "back"},
+}
+
+// fingerprintHeaders returns the names of the headers checked by the fingerprints, in the order first checked
+func fingerprintHeaders() []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool, 0)
+	for _, f := range fingerprints {
+		if !seen[f.Header] {
+			names = append(names, f.Header)
+			seen[f.Header] = true
+		}
+	}
+
+	return names
+}
+
+// guessFingerprint returns a best guess at the frontend and backend technologies of a host from the captured
+// headers of its base response, or an empty string if none were recognised. For CL.TE and TE.CL desyncs, the
+// guess notes which length header each side is expected to have used
+func guessFingerprint(headers map[string]string, status SmuggleType) string {
+	if len(headers) == 0 {
+		return ""
+	}
+
+	// The captured headers are indexed by the names they were asked for with, in any case
+	values := make(map[string]string, len(headers))
+	for k, v := range headers {
+		values[strings.ToLower(k)] = strings.ToLower(v)
+	}
+
+	var front, back string
+	var either []string
+	for _, f := range fingerprints {
+		v, ok := values[strings.ToLower(f.Header)]
+		if !ok || !strings.Contains(v, f.Pattern) {
+			continue
+		}
+		switch f.Role {
+		case "front":
+			if front == "" {
+				front = f.Name
+			}
+		case "back":
+			if back == "" {
+				back = f.Name
+			}
+		default:
+			either = append(either, f.Name)
+		}
+	}
+
+	// Servers which could be either fill whichever side is still unknown, frontend first, since a proxy usually
+	// hides the backend's Server header
+	for _, name := range either {
+		if front == "" && name != back {
+			front = name
+		} else if back == "" && name != front {
+			back = name
+		}
+	}
+
+	frontUses, backUses := "", ""
+	switch status {
+	case CLTE:
+		frontUses, backUses = " (Content-Length)", " (Transfer-Encoding)"
+	case TECL:
+		frontUses, backUses = " (Transfer-Encoding)", " (Content-Length)"
+	}
+
+	parts := make([]string, 0, 2)
+	if front != "" {
+		parts = append(parts, fmt.Sprintf("%s front%s", front, frontUses))
+	}
+	if back != "" {
+		parts = append(parts, fmt.Sprintf("%s back%s", back, backUses))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return "likely " + strings.Join(parts, ", ")
+}
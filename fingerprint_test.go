@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestGuessFingerprint(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  SmuggleType
+		want    string
+	}{
+		{"either on its own", map[string]string{"Server": "nginx/1.18.0"}, CLTE, "likely Nginx front (Content-Length)"},
+		{"proxy and application server", map[string]string{"Via": "1.1 varnish (Varnish/6.0)", "Server": "gunicorn/20.0.4"}, CLTE, "likely Varnish front (Content-Length), Gunicorn back (Transfer-Encoding)"},
+		{"TE.CL", map[string]string{"Via": "1.1 varnish", "Server": "gunicorn"}, TECL, "likely Varnish front (Transfer-Encoding), Gunicorn back (Content-Length)"},
+		{"either is the frontend", map[string]string{"Server": "nginx", "x-powered-by": "Express"}, ZEROCL, "likely Nginx front, Express back"},
+		{"either is the backend", map[string]string{"cf-ray": "abc-LHR", "Server": "Apache/2.4"}, CLTE, "likely Cloudflare front (Content-Length), Apache back (Transfer-Encoding)"},
+		{"only a frontend", map[string]string{"Server": "cloudflare"}, CLTE, "likely Cloudflare front (Content-Length)"},
+		{"unknown", map[string]string{"Server": "custom"}, CLTE, ""},
+		{"no headers", nil, CLTE, ""},
+	}
+
+	for _, test := range tests {
+		if got := guessFingerprint(test.headers, test.status); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFingerprintHeaders(t *testing.T) {
+	names := fingerprintHeaders()
+	seen := make(map[string]bool, 0)
+	for _, n := range names {
+		if seen[n] {
+			t.Errorf("got %s more than once", n)
+		}
+		seen[n] = true
+	}
+	for _, f := range fingerprints {
+		if !seen[f.Header] {
+			t.Errorf("the %s header used by the %s fingerprint isn't captured", f.Header, f.Name)
+		}
+	}
+}
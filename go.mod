@@ -3,6 +3,7 @@ module github.com/danielthatcher/smuggles
 go 1.14
 
 require (
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/ryanuber/go-glob v1.0.0
 	github.com/schollz/progressbar/v3 v3.3.4
 	github.com/spf13/pflag v1.0.5
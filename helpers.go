@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 // generatePoC returns a PoC request for verifying the desync at the given URL using the supplied method, smuggle
@@ -18,38 +27,65 @@ func generatePoC(conf Config, method string, uStr string, stype string, mutation
 		return nil, err
 	}
 
-	te, ok := conf.Mutations[mutation]
+	m, ok := conf.Mutations[mutation]
 	if !ok {
 		return nil, fmt.Errorf("mutations %s not found", mutation)
 	}
 
-	if stype == CLTE {
-		return clte(method, u, te, conf.Headers), nil
+	if stype == ZEROCL {
+		return append(zerocl(method, u, conf.RequestOptions.keepAlive()), baseReq(u, conf.RequestOptions)...), nil
+	} else if mutation == ZeroCLMutation {
+		return nil, fmt.Errorf("mutation %s can only be used with %s", mutation, ZEROCL)
+	} else if stype == PIPELINE {
+		return append(pipelineReq(method, u, conf.RequestOptions.keepAlive()), notFoundReq(u, conf.RequestOptions)...), nil
+	} else if mutation == PipelineMutation {
+		return nil, fmt.Errorf("mutation %s can only be used with %s", mutation, PIPELINE)
+	} else if stype == HOST && mutation != DuplicateHostMutation && mutation != DuplicateHostReversedMutation {
+		return nil, fmt.Errorf("%s can only be used with mutation %s or %s", HOST, DuplicateHostMutation, DuplicateHostReversedMutation)
+	} else if stype == HOST {
+		return hostReq(method, u, conf.RequestOptions, duplicateHosts(mutation, u)...), nil
+	} else if mutation == DuplicateHostMutation || mutation == DuplicateHostReversedMutation {
+		return nil, fmt.Errorf("mutation %s can only be used with %s", mutation, HOST)
+	} else if stype == CLTE && m.Terminator != "" {
+		return nil, fmt.Errorf("mutation %s only alters TE.CL tests", mutation)
+	} else if stype == CLTE {
+		return clte(method, u, m, conf.RequestOptions), nil
 	} else if stype == TECL {
-		return tecl(method, u, te, conf.Headers), nil
+		return tecl(method, u, m, conf.RequestOptions), nil
 	} else {
 		return nil, fmt.Errorf("unrecognised smuggles type: %s", stype)
 	}
 }
 
-// generateScript fills in the specified script template using the given information
-func generateScript(conf Config, scriptFile string, method string, uStr string, mutation string) ([]byte, error) {
+// generateScript fills in the specified script template using the given information. The script smuggles a
+// prefix requesting confirmPath, which should give a different response to the victim requests
+func generateScript(conf Config, scriptFile string, method string, uStr string, mutation string, confirmPath string) ([]byte, error) {
 	u, err := url.Parse(uStr)
 	if err != nil {
 		return nil, err
 	}
 
-	te, ok := conf.Mutations[mutation]
+	m, ok := conf.Mutations[mutation]
 	if !ok {
 		return nil, fmt.Errorf("mutation %s not found", mutation)
+	} else if mutation == ZeroCLMutation || mutation == PipelineMutation || mutation == DuplicateHostMutation || mutation == DuplicateHostReversedMutation {
+		return nil, fmt.Errorf("mutation %s has no Transfer-Encoding header to use in a script", mutation)
+	} else if m.CL != "" {
+		return nil, fmt.Errorf("mutation %s alters the Content-Length header, which scripts set themselves", mutation)
+	} else if m.LateTE != "" {
+		return nil, fmt.Errorf("mutation %s sends headers after the Content-Length header, which scripts can't reproduce", mutation)
+	} else if m.Terminator != "" || m.ChunkExt != "" {
+		return nil, fmt.Errorf("mutation %s alters the body, which scripts set themselves", mutation)
 	}
+	te := m.TE
 
 	// scriptParams is used with the text/template package to fill in the script file
 	type scriptParams struct {
-		Host     string
-		Method   string
-		Path     string
-		Mutation string
+		Host        string
+		Method      string
+		Path        string
+		Mutation    string
+		ConfirmPath string
 	}
 	te = strings.ReplaceAll(te, "\r", "\\r")
 	te = strings.ReplaceAll(te, "\n", "\\n")
@@ -59,10 +95,11 @@ func generateScript(conf Config, scriptFile string, method string, uStr string,
 	}
 
 	params := scriptParams{
-		Host:     u.Host,
-		Method:   method,
-		Path:     path,
-		Mutation: te,
+		Host:        u.Host,
+		Method:      method,
+		Path:        path,
+		Mutation:    te,
+		ConfirmPath: confirmPath,
 	}
 
 	t, err := template.ParseFiles(scriptFile)
@@ -77,24 +114,78 @@ func generateScript(conf Config, scriptFile string, method string, uStr string,
 	return b.Bytes(), nil
 }
 
+// sharedBase returns whether the base file name is "-" for the standard input, or an http or https URL to fetch it
+// from, in which case it is shared with other scans rather than written to
+func sharedBase(name string) bool {
+	return name == "-" || strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// readSharedBase reads a shared base file from the standard input, given as stdin, or fetches it from a URL. The
+// base file on the standard input is a single JSON object, which the targets may follow, so the rest of the
+// standard input is returned to read the targets from
+func readSharedBase(name string, stdin io.Reader) ([]byte, io.Reader, error) {
+	if name == "-" {
+		var raw json.RawMessage
+		dec := json.NewDecoder(stdin)
+		if err := dec.Decode(&raw); err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+
+		// The line break after the object would otherwise be read as an empty target
+		rest := bufio.NewReader(io.MultiReader(dec.Buffered(), stdin))
+		for {
+			c, err := rest.ReadByte()
+			if err != nil {
+				break
+			} else if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				rest.UnreadByte()
+				break
+			}
+		}
+		return raw, rest, nil
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s returned status %d", name, resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, stdin, nil
+}
+
 // saveState saves the state in a concurrency-safe manner
 func saveState(state *State, stateFile *os.File) error {
 	state.BaseMux.RLock()
 	state.ErrorsMux.RLock()
 	state.ResultsMux.RLock()
-	b, err := json.Marshal(*state)
-	if err != nil {
-		return err
-	}
+	b, err := json.Marshal(state)
 	state.BaseMux.RUnlock()
 	state.ErrorsMux.RUnlock()
 	state.ResultsMux.RUnlock()
+	if err != nil {
+		return err
+	}
 
 	_, err = stateFile.Seek(0, 0)
 	if err != nil {
 		return err
 	}
 
+	// The state can shrink, such as when --refresh-base drops old base times, so the old contents are removed
+	// rather than being left after the new ones
+	if err = stateFile.Truncate(0); err != nil {
+		return err
+	}
+
 	_, err = stateFile.Write(b)
 	if err != nil {
 		return err
@@ -102,3 +193,320 @@ func saveState(state *State, stateFile *os.File) error {
 
 	return nil
 }
+
+// throughput returns the number of tests completed per second
+func throughput(completed int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(completed) / elapsed.Seconds()
+}
+
+// eta returns the estimated time remaining until total tests are completed, based on the rate at which tests
+// have been completed so far. The estimate is rounded to the nearest second
+func eta(completed int, total int, elapsed time.Duration) time.Duration {
+	if completed <= 0 || completed >= total {
+		return 0
+	}
+
+	remaining := float64(elapsed) / float64(completed) * float64(total-completed)
+	return time.Duration(remaining).Round(time.Second)
+}
+
+// waitWhilePaused blocks while the pause file exists, or until the context is cancelled
+func waitWhilePaused(ctx context.Context, pauseFile string, infolog *log.Logger) {
+	if _, err := os.Stat(pauseFile); err != nil {
+		return
+	}
+
+	infolog.Printf("Pausing while %s exists...\n", pauseFile)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := os.Stat(pauseFile); err != nil {
+				infolog.Println("Resuming...")
+				return
+			}
+		}
+	}
+}
+
+// durationUnits are the units which times in the base report can be given in
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// writeBaseReport writes the base times of the given URLs to a file as JSON, in the given unit
+func writeBaseReport(filename string, unit string, urls []*url.URL, base map[string]time.Duration) error {
+	type baseReport struct {
+		Unit  string             `json:"unit"`
+		Times map[string]float64 `json:"times"`
+	}
+
+	report := baseReport{
+		Unit:  unit,
+		Times: make(map[string]float64, len(urls)),
+	}
+	for _, u := range urls {
+		if d, ok := base[u.String()]; ok {
+			report.Times[u.String()] = float64(d) / float64(durationUnits[unit])
+		}
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// authFromEnv returns an Authorization header built from the SMUGGLES_BEARER environment variable, or if that
+// isn't set, the SMUGGLES_BASIC_AUTH environment variable in the form <user>:<password>. If neither is set, an
+// empty string is returned
+func authFromEnv() string {
+	if token := os.Getenv("SMUGGLES_BEARER"); token != "" {
+		return "Authorization: Bearer " + token
+	}
+
+	if creds := os.Getenv("SMUGGLES_BASIC_AUTH"); creds != "" {
+		return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+	}
+
+	return ""
+}
+
+// generateTests returns the tests to run against each of urls, skipping tests which have already been performed
+// according to the results in state. When not using a fixed timeout, URLs without a base time are skipped if
+// requireBase is set, and otherwise have their tests generated without a timeout. With FollowRedirects, the tests
+// of URLs whose base requests were redirected are against the URL redirected to, unless it is out of scope
+func generateTests(conf Config, urls []*url.URL, targets map[string]Target, state *State, requireBase bool) []SmuggleTest {
+	// The mutations to test against each host, if limited
+	hostMutations := make(map[string]map[string]bool, 0)
+
+	// The URLs tests have been generated against, so URLs redirected to the same place are only tested once
+	generated := make(map[string]bool, 0)
+
+	tests := make([]SmuggleTest, 0)
+	for _, input := range urls {
+		u := input
+		if conf.FollowRedirects && state.Redirects[input.String()] != "" {
+			// The URL redirected to may be outside the scope of the URLs given, if the base file is from another run
+			final, err := url.Parse(state.Redirects[input.String()])
+			if err != nil || skipReason(final, conf) != "" {
+				continue
+			}
+			u = final
+		}
+		if generated[u.String()] {
+			continue
+		}
+		generated[u.String()] = true
+
+		timeout := conf.FixedTimeout
+		if timeout == 0 {
+			base, ok := state.Base[input.String()]
+			if !ok && requireBase {
+				continue
+			} else if ok {
+				timeout = base + conf.Delay
+			}
+		}
+
+		methods := conf.Methods
+		if len(targets[input.String()].Methods) > 0 {
+			methods = targets[input.String()].Methods
+		}
+
+		if conf.MutationLimit > 0 && hostMutations[u.Hostname()] == nil {
+			hostMutations[u.Hostname()] = limitMutations(conf.Mutations, u.Hostname(), conf.MutationLimit, conf.Seed)
+		}
+
+		for m := range conf.Mutations {
+			if conf.MutationLimit > 0 && !hostMutations[u.Hostname()][m] {
+				continue
+			}
+
+		METHODLOOP:
+			for _, v := range methods {
+				t := SmuggleTest{
+					Url:      u,
+					Method:   v,
+					Mutation: m,
+					Status:   SAFE,
+					Timeout:  conf.Mutations[m].timeout(timeout),
+				}
+
+				// Check the test isn't in the state file, meaning it has already been performed
+				for _, s := range state.Results {
+					if t.Equals(s) {
+						continue METHODLOOP
+					}
+				}
+				tests = append(tests, t)
+			}
+		}
+	}
+
+	return tests
+}
+
+// loadSafeTests reads the state file of a previous scan, and returns the keys of the tests it records as safe
+func loadSafeTests(filename string) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev State
+	if err := json.Unmarshal(b, &prev); err != nil {
+		return nil, err
+	}
+
+	safe := make(map[string]bool, 0)
+	for _, t := range prev.Results {
+		if t.Status == SAFE && t.Url != nil {
+			safe[testKey(t)] = true
+		}
+	}
+
+	return safe, nil
+}
+
+// excludeTests returns the tests whose keys aren't in exclude
+func excludeTests(tests []SmuggleTest, exclude map[string]bool) []SmuggleTest {
+	if len(exclude) == 0 {
+		return tests
+	}
+
+	kept := make([]SmuggleTest, 0, len(tests))
+	for _, t := range tests {
+		if !exclude[testKey(t)] {
+			kept = append(kept, t)
+		}
+	}
+
+	return kept
+}
+
+// testKey returns a key identifying a test by its method, URL, and mutation, matching SmuggleTest.Equals
+func testKey(t SmuggleTest) string {
+	return fmt.Sprintf("%s %s %s", t.Method, t.Url, t.Mutation)
+}
+
+// finding is the JSON form of a discovered vulnerability
+type finding struct {
+	Method          string            `json:"method"`
+	Url             string            `json:"url"`
+	Status          string            `json:"status"`
+	Mutation        string            `json:"mutation"`
+	MutationHeaders string            `json:"mutation_headers,omitempty"`
+	Severity        string            `json:"severity"`
+	Confidence      float64           `json:"confidence"`
+	Confirmed       bool              `json:"confirmed"`
+	Suspect         bool              `json:"suspect"`
+	SuspectReasons  []string          `json:"suspect_reasons,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Fingerprint     string            `json:"fingerprint,omitempty"`
+	PoCCommand      string            `json:"poc_command,omitempty"`
+	Tag             string            `json:"tag,omitempty"`
+}
+
+// newFinding returns the JSON form of the discovered vulnerability t, labelled with the given tag
+func newFinding(t SmuggleTest, tag string) finding {
+	return finding{
+		Method:          t.Method,
+		Url:             t.Url.String(),
+		Status:          string(t.Status),
+		Mutation:        t.Mutation,
+		MutationHeaders: t.MutationHeaders,
+		Severity:        t.Status.Severity().String(),
+		Confidence:      t.Confidence,
+		Confirmed:       t.Confirmed,
+		Suspect:         len(t.Suspect) > 0,
+		SuspectReasons:  t.Suspect,
+		Headers:         t.Headers,
+		Fingerprint:     guessFingerprint(t.Headers, t.Status),
+		PoCCommand:      t.PoCCommand,
+		Tag:             tag,
+	}
+}
+
+// formatFinding returns the line output for a discovered vulnerability in the given format, either "text" for
+// space separated fields ending with the tag if it isn't empty, or "ndjson" for a single line JSON object
+func formatFinding(t SmuggleTest, tag string, format string) string {
+	if format == "ndjson" {
+		// Marshalling without indentation keeps the object on one line, since newlines in strings are escaped
+		b, _ := json.Marshal(newFinding(t, tag))
+		return string(b)
+	}
+
+	line := fmt.Sprintf("%s %s %s %s %s %.2f", t.Method, t.Url, t.Status, t.Mutation, t.Status.Severity(), t.Confidence)
+	if t.Confirmed {
+		line += " confirmed"
+	}
+	if len(t.Suspect) > 0 {
+		line += " suspect"
+	}
+	if tag != "" {
+		line += " " + tag
+	}
+
+	return line
+}
+
+// betterFinding returns whether the finding t is more severe than the finding s, or as severe but more likely
+// to be genuine
+func betterFinding(t SmuggleTest, s SmuggleTest) bool {
+	if t.Status.Severity() != s.Status.Severity() {
+		return t.Status.Severity() > s.Status.Severity()
+	} else if t.Confirmed != s.Confirmed {
+		return t.Confirmed
+	}
+
+	return t.Confidence > s.Confidence
+}
+
+// maxRetryAfter is the longest a Retry-After header can make a retry wait
+const maxRetryAfter = time.Minute
+
+// retryAfter returns how long the given Retry-After header asks for a request to be retried after, up to
+// maxRetryAfter. If the header is empty or invalid, fallback is returned
+func retryAfter(header string, fallback time.Duration) time.Duration {
+	d := fallback
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		d = time.Until(t)
+	}
+
+	if d < 0 {
+		return 0
+	} else if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// errorLogger logs errors from a scan, explaining the first error caused by the open file limit
+type errorLogger struct {
+	Log      *log.Logger
+	fdWarned bool
+}
+
+// Println logs err, preceded by an explanation if it is the first error caused by the open file limit
+func (l *errorLogger) Println(err error) {
+	if isFDLimit(err) && !l.fdWarned {
+		l.Log.Printf("Too many open files: reduce the number of workers with -c, raise the open file limit with ulimit -n, or retry these connections with --fd-backoff")
+		l.fdWarned = true
+	}
+	l.Log.Println(err)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestThroughput(t *testing.T) {
+	tests := []struct {
+		completed int
+		elapsed   time.Duration
+		want      float64
+	}{
+		{100, 50 * time.Second, 2},
+		{30, 2 * time.Minute, 0.25},
+		{0, time.Minute, 0},
+		{10, 0, 0},
+	}
+
+	for _, test := range tests {
+		if got := throughput(test.completed, test.elapsed); got != test.want {
+			t.Errorf("%d tests in %s: got %f tests/s, want %f", test.completed, test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestETA(t *testing.T) {
+	tests := []struct {
+		completed int
+		total     int
+		elapsed   time.Duration
+		want      time.Duration
+	}{
+		{100, 400, time.Minute, 3 * time.Minute},
+		{3, 10, 10 * time.Second, 23 * time.Second},
+		{0, 10, time.Minute, 0},
+		{10, 10, time.Minute, 0},
+	}
+
+	for _, test := range tests {
+		if got := eta(test.completed, test.total, test.elapsed); got != test.want {
+			t.Errorf("%d/%d tests in %s: got ETA %s, want %s", test.completed, test.total, test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestWriteBaseReport(t *testing.T) {
+	a, _ := url.Parse("https://a.example.com/")
+	b, _ := url.Parse("https://b.example.com/")
+	unmeasured, _ := url.Parse("https://c.example.com/")
+	base := map[string]time.Duration{
+		a.String():                  1500 * time.Millisecond,
+		b.String():                  500 * time.Microsecond,
+		"https://other.example.com": time.Second,
+	}
+
+	tests := []struct {
+		unit  string
+		times map[string]float64
+	}{
+		{"ms", map[string]float64{a.String(): 1500, b.String(): 0.5}},
+		{"ns", map[string]float64{a.String(): 1500000000, b.String(): 500000}},
+		{"s", map[string]float64{a.String(): 1.5, b.String(): 0.0005}},
+	}
+
+	// Only the measured times of the URLs being scanned are reported
+	for _, test := range tests {
+		filename := filepath.Join(tempDir(t), "base.json")
+		if err := writeBaseReport(filename, test.unit, []*url.URL{a, b, unmeasured}, base); err != nil {
+			t.Fatal(err)
+		}
+
+		var report struct {
+			Unit  string             `json:"unit"`
+			Times map[string]float64 `json:"times"`
+		}
+		if err := json.Unmarshal([]byte(readFile(t, filename)), &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Unit != test.unit || !reflect.DeepEqual(report.Times, test.times) {
+			t.Errorf("got %s times %v, want %s times %v", report.Unit, report.Times, test.unit, test.times)
+		}
+	}
+}
+
+func TestAuthFromEnv(t *testing.T) {
+	tests := []struct {
+		bearer string
+		basic  string
+		want   string
+	}{
+		{"", "", ""},
+		{"token", "", "Authorization: Bearer token"},
+		{"", "user:pass", "Authorization: Basic dXNlcjpwYXNz"},
+		{"token", "user:pass", "Authorization: Bearer token"},
+	}
+
+	defer os.Unsetenv("SMUGGLES_BEARER")
+	defer os.Unsetenv("SMUGGLES_BASIC_AUTH")
+	for _, test := range tests {
+		os.Setenv("SMUGGLES_BEARER", test.bearer)
+		os.Setenv("SMUGGLES_BASIC_AUTH", test.basic)
+		if got := authFromEnv(); got != test.want {
+			t.Errorf("bearer %q and basic %q: got %q, want %q", test.bearer, test.basic, got, test.want)
+		}
+	}
+}
+
+func TestAuthFromEnvPrecedence(t *testing.T) {
+	os.Setenv("SMUGGLES_BEARER", "token")
+	defer os.Unsetenv("SMUGGLES_BEARER")
+
+	// The PoC shows the headers which would be sent in a scan
+	poc := []string{"--poc", "POST", "https://example.com/", "CL.TE", "standard"}
+	stdout, stderr, code := runMain(t, tempDir(t), "", poc...)
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "\r\nAuthorization: Bearer token\r\n") {
+		t.Errorf("got PoC %q, want the header from the environment", stdout)
+	}
+
+	// A header given with -H takes precedence
+	stdout, stderr, code = runMain(t, tempDir(t), "", append([]string{"-H", "Authorization: Basic flag"}, poc...)...)
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if strings.Count(stdout, "Authorization:") != 1 || !strings.Contains(stdout, "\r\nAuthorization: Basic flag\r\n") {
+		t.Errorf("got PoC %q, want only the header given with -H", stdout)
+	}
+}
+
+func TestErrorLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	el := errorLogger{Log: log.New(buf, "", 0)}
+	emfile := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.EMFILE)}
+	el.Println(fmt.Errorf("http://a.example/ unreachable: %w", emfile))
+	el.Println(errors.New("http://b.example/: connection refused"))
+	el.Println(fmt.Errorf("http://c.example/ unreachable: %w", emfile))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want the 3 errors and one explanation:\n%s", len(lines), buf)
+	}
+	if !strings.HasPrefix(lines[0], "Too many open files: ") || !strings.Contains(lines[0], "--fd-backoff") {
+		t.Errorf("got first line %q, want an explanation of the open file limit", lines[0])
+	}
+	for i, host := range []string{"a", "b", "c"} {
+		if !strings.HasPrefix(lines[i+1], "http://"+host+".example/") {
+			t.Errorf("got line %q, want the error for %s.example", lines[i+1], host)
+		}
+	}
+}
+
+func TestBetterFinding(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	reset := SmuggleTest{Url: u, Status: RESET}
+	zerocl := SmuggleTest{Url: u, Status: ZEROCL, Confidence: zeroCLConfidence}
+	likely := SmuggleTest{Url: u, Status: CLTE, Confidence: 0.9}
+	unlikely := SmuggleTest{Url: u, Status: TECL, Confidence: 0.2}
+	confirmed := SmuggleTest{Url: u, Status: TECL, Confidence: 0.1, Confirmed: true}
+
+	// Each finding is better than those after it
+	ordered := []SmuggleTest{confirmed, likely, unlikely, zerocl, reset}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			if got := betterFinding(a, b); got != (i < j) {
+				t.Errorf("%s: got %v comparing with %s, want %v", formatFinding(a, "", "text"), got, formatFinding(b, "", "text"), i < j)
+			}
+		}
+	}
+}
+
+func TestFormatFinding(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	f := SmuggleTest{Url: u, Method: "POST", Mutation: "standard", Status: TECL, Confidence: 0.875}
+	if got, want := formatFinding(f, "", "text"), "POST https://example.com/ TE.CL standard high 0.88"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	f.Confirmed = true
+	if got, want := formatFinding(f, "run-1", "text"), "POST https://example.com/ TE.CL standard high 0.88 confirmed run-1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGenerateScriptConfirmPath(t *testing.T) {
+	conf := Config{Mutations: generateMutations()}
+	for _, script := range []string{"resources/clte.py", "resources/tecl.py"} {
+		b, err := generateScript(conf, script, "POST", "https://example.com/login", "standard", "/smuggles-confirm")
+		if err != nil {
+			t.Fatalf("%s: %v", script, err)
+		}
+		if !strings.Contains(string(b), `prefix_path = "/smuggles-confirm"`) {
+			t.Errorf("%s: the confirmation path wasn't filled in:\n%s", script, b)
+		}
+		if strings.Contains(string(b), "{{") {
+			t.Errorf("%s: got unfilled template fields:\n%s", script, b)
+		}
+	}
+}
+
+func TestSaveStateShrinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smuggles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.OpenFile(filepath.Join(dir, "smuggles.state"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	state := State{
+		Base: map[string]time.Duration{
+			"http://a.example.com/":             time.Second,
+			"http://long-hostname.example.com/": 2 * time.Second,
+		},
+		Results: []SmuggleTest{},
+		Errors:  map[string]uint{},
+	}
+	if err := saveState(&state, f); err != nil {
+		t.Fatal(err)
+	}
+
+	// As with --refresh-base, which drops the base times about to be measured again
+	delete(state.Base, "http://long-hostname.example.com/")
+	if err := saveState(&state, f); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next run must be able to read the base file
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read State
+	if err := json.Unmarshal(b, &read); err != nil {
+		t.Fatalf("base file can't be read after shrinking: %v\n%s", err, b)
+	}
+	if len(read.Base) != 1 || read.Base["http://a.example.com/"] != time.Second {
+		t.Errorf("got base times %v, want only http://a.example.com/", read.Base)
+	}
+}
+
+func TestSharedBase(t *testing.T) {
+	for name, want := range map[string]bool{
+		"-":                         true,
+		"https://example.com/state": true,
+		"http://example.com/state":  true,
+		"smuggles.state":            false,
+		"./http.state":              false,
+	} {
+		if got := sharedBase(name); got != want {
+			t.Errorf("%s: got %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestReadSharedBaseStdin(t *testing.T) {
+	stdin := strings.NewReader("{\"base\": {\"http://example.com/\": 1000}}\n\nhttp://a.example.com/\nhttp://b.example.com/\n")
+	b, rest, err := readSharedBase("-", stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var state State
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatalf("base file %q can't be parsed: %v", b, err)
+	}
+	if state.Base["http://example.com/"] != 1000 {
+		t.Errorf("got base times %v, want the one given", state.Base)
+	}
+
+	// The targets follow, without an empty line before them
+	targets, err := ioutil.ReadAll(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(targets) != "http://a.example.com/\nhttp://b.example.com/\n" {
+		t.Errorf("got targets %q, want the lines after the base file", targets)
+	}
+}
+
+func TestReadSharedBaseStdinInvalid(t *testing.T) {
+	if _, _, err := readSharedBase("-", strings.NewReader("http://example.com/\n")); err == nil {
+		t.Error("got no error with targets in place of the base file")
+	}
+}
+
+func TestReadSharedBaseURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/smuggles.state" {
+			http.NotFound(rw, r)
+			return
+		}
+		rw.Write([]byte(`{"base": {"http://example.com/": 1000}}`))
+	}))
+	defer srv.Close()
+
+	// Targets are still read from the standard input
+	stdin := strings.NewReader("http://a.example.com/\n")
+	b, rest, err := readSharedBase(srv.URL+"/smuggles.state", stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"base": {"http://example.com/": 1000}}` {
+		t.Errorf("got base file %q", b)
+	}
+	if rest != stdin {
+		t.Error("got a different reader for the targets, want the standard input")
+	}
+
+	if _, _, err := readSharedBase(srv.URL+"/missing", stdin); err == nil {
+		t.Error("got no error for a base file URL returning 404")
+	}
+}
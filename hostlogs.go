@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// HostLogs writes discovered vulnerabilities to a separate file for each host in a directory
+type HostLogs struct {
+	Dir string
+
+	files map[string]*os.File
+}
+
+// NewHostLogs creates the given directory if needed, and returns a HostLogs writing to it
+func NewHostLogs(dir string) (*HostLogs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &HostLogs{
+		Dir:   dir,
+		files: make(map[string]*os.File, 0),
+	}, nil
+}
+
+// Println appends line to the file for the host of u, opening the file if this is the first line for the host
+func (h *HostLogs) Println(u *url.URL, line string) error {
+	f, ok := h.files[u.Host]
+	if !ok {
+		// Colons aren't allowed in filenames on all platforms, so the port is separated with an underscore
+		filename := path.Join(h.Dir, strings.ReplaceAll(u.Host, ":", "_")+".log")
+		var err error
+		f, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		h.files[u.Host] = f
+	}
+
+	_, err := fmt.Fprintln(f, line)
+	return err
+}
+
+// Close closes all of the opened files
+func (h *HostLogs) Close() {
+	for _, f := range h.files {
+		f.Close()
+	}
+}
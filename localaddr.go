@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// LocalAddrs are the local addresses to make connections from, which are used in turn by all workers. It is safe
+// for concurrent use
+type LocalAddrs struct {
+	addrs []*net.TCPAddr
+	next  uint32
+}
+
+// NewLocalAddrs returns the given local IP addresses to make connections from
+func NewLocalAddrs(ips []string) (*LocalAddrs, error) {
+	addrs := make([]*net.TCPAddr, 0, len(ips))
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", s)
+		}
+		addrs = append(addrs, &net.TCPAddr{IP: ip})
+	}
+
+	return &LocalAddrs{addrs: addrs}, nil
+}
+
+// Next returns the local address to make the next connection from
+func (l *LocalAddrs) Next() *net.TCPAddr {
+	i := atomic.AddUint32(&l.next, 1) - 1
+	return l.addrs[int(i)%len(l.addrs)]
+}
+
+// dialer returns a dialer with the given timeout, which connects from the next of the local addresses if there
+// are any
+func (l *LocalAddrs) dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if l != nil {
+		d.LocalAddr = l.Next()
+	}
+
+	return d
+}
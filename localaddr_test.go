@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocalAddrs(t *testing.T) {
+	if _, err := NewLocalAddrs([]string{"127.0.0.1", "localhost"}); err == nil {
+		t.Error("got no error for a hostname")
+	}
+
+	// Connections are made from each address in turn
+	sources := make(chan string, 10)
+	u := stubServer(t, func(conn net.Conn) {
+		sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	})
+	addrs, err := NewLocalAddrs([]string{"127.0.0.2", "127.0.0.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := testWorker(Config{})
+	w.LocalAddrs = addrs
+
+	for _, want := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.2"} {
+		conn, err := w.dial(u, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := <-sources; got != want {
+			t.Errorf("got a connection from %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// newLogger returns a logger for operational messages at the given level, either "INFO" or "ERROR", which
+// writes to w in the given format: "text" for plain lines, or "json" for one JSON object per line
+func newLogger(w io.Writer, level string, format string) *log.Logger {
+	if format == "json" {
+		return log.New(jsonLogWriter{w, level}, "", 0)
+	} else if level == "ERROR" {
+		return log.New(w, "ERROR:", 0)
+	}
+
+	return log.New(w, "", 0)
+}
+
+// jsonLogWriter wraps each message written to it in a JSON object with the time and level of the message
+type jsonLogWriter struct {
+	w     io.Writer
+	level string
+}
+
+// Write writes p as the message of a single JSON log record
+func (j jsonLogWriter) Write(p []byte) (int, error) {
+	record := struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{
+		Time:  time.Now().Format(time.RFC3339),
+		Level: j.level,
+		Msg:   strings.TrimSuffix(string(p), "\n"),
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = j.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var b bytes.Buffer
+	newLogger(&b, "ERROR", "json").Printf("request to %s failed\n", "https://example.com/")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &record); err != nil {
+		t.Fatalf("got invalid JSON %q: %v", b.String(), err)
+	}
+	if len(record) != 3 || record["level"] != "ERROR" || record["msg"] != "request to https://example.com/ failed" {
+		t.Errorf("got record %v", record)
+	}
+	if s, _ := record["time"].(string); s == "" {
+		t.Error("got a record without a time")
+	} else if _, err := time.Parse(time.RFC3339, s); err != nil {
+		t.Errorf("got an invalid time: %v", err)
+	}
+}
+
+func TestTextLogger(t *testing.T) {
+	var b bytes.Buffer
+	newLogger(&b, "ERROR", "text").Println("failed")
+	newLogger(&b, "INFO", "text").Println("done")
+	if got, want := b.String(), "ERROR:failed\ndone\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLogFormatOutput(t *testing.T) {
+	stdout, stderr, code := runMain(t, tempDir(t), "", "--log-format", "json")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Each line of operational output is a JSON record
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	for _, line := range lines {
+		var record map[string]string
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Errorf("got a line which isn't JSON: %q", line)
+		} else if record["level"] != "INFO" || record["msg"] == "" || record["time"] == "" {
+			t.Errorf("got record %v", record)
+		}
+	}
+	if !strings.Contains(stdout, `"msg":"Testing smuggling..."`) {
+		t.Errorf("got output %q, want the scan's progress to be logged", stdout)
+	}
+}
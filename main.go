@@ -2,19 +2,27 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/ryanuber/go-glob"
 	"github.com/schollz/progressbar/v3"
@@ -28,28 +36,121 @@ type Config struct {
 	// The HTTP methods to test
 	Methods []string
 
-	// The headers to add to requests
-	Headers []string
+	// How requests are written, including the headers to add to them
+	RequestOptions
 
 	// The delay which signifies a timeout between the frontend and backend servers
 	Delay time.Duration
 
-	// The Transfer-Encoding headers to test
-	Mutations map[string]string
+	// A timeout to use for all URLs in place of measured base times. 0 means base times are measured
+	FixedTimeout time.Duration
+
+	// A unix socket to send all requests over, in place of connecting to the hosts of the URLs
+	UnixSocket string
+
+	// An address to send all requests to, in place of connecting to the hosts of the URLs
+	ConnectTo string
+
+	// The protocols to offer with ALPN in TLS handshakes, in order of preference. None are offered if empty
+	ALPN []string
+
+	// The CAs to verify the certificates of https targets with. Certificates aren't verified if nil
+	RootCAs *x509.CertPool
+
+	// Whether to reuse keep-alive connections for base timing requests
+	ReuseConnections bool
+
+	// Whether to send the requests of smuggling tests which can't desync the connection, such as verification
+	// requests, over connections left open by previous ones
+	ReuseTestConnections bool
+
+	// Headers of base responses to capture and include in findings
+	CaptureHeaders []string
+
+	// Status codes which cause base requests to be retried, since they indicate the time isn't representative
+	RetryStatuses []int
+
+	// The timeout for checking a URL is reachable before measuring its base time. 0 disables the check
+	ProbeTimeout time.Duration
+
+	// The number of body bytes below which a base response is flagged as not meaningful. 0 disables the check
+	MinResponseBytes int64
+
+	// Whether to skip testing URLs with base responses smaller than MinResponseBytes
+	SkipSmallResponses bool
+
+	// Whether base requests follow redirects, in which case the URL redirected to is timed and tested in place of
+	// the URL requested
+	FollowRedirects bool
+
+	// The mutations to test
+	Mutations map[string]Mutation
 
 	// The maximum number of desyncs to find in a target
 	StopAfter uint
 
+	// The maximum number of mutations to test against each host. 0 means there is no limit
+	MutationLimit int
+
+	// The seed for random choices, such as test order and the mutations selected by MutationLimit
+	Seed int64
+
 	// The number of errors to receive from a target URL before stopping scanning it
 	MaxErrors uint
 
+	// The number of consecutive test requests to a host which can time out before it stops being scanned
+	HostTimeoutLimit uint
+
+	// How long to wait before retrying a connection which failed due to the open file limit. 0 disables retrying
+	FDBackoff time.Duration
+
+	// Whether to report test requests which have their connection reset or closed without a response
+	DetectResets bool
+
+	// Whether to test if responses to pipelined requests are mis-associated
+	DetectPipelining bool
+
+	// Whether to hold back the body of requests sent with Expect: 100-continue until the server asks for it
+	WaitForContinue bool
+
+	// Whether to test if requests with two Host headers are answered according to the second
+	DetectHostRouting bool
+
+	// The request line of a request to smuggle to confirm TE.CL desyncs. Empty if they shouldn't be confirmed
+	SmugglePrefix string
+
+	// The status code a request for the marker path receives, which a normal request receiving shows a request
+	// for the marker path was smuggled ahead of it. Defaults to 404 if 0
+	MarkerStatus int
+
+	// The minimum severity of discovered desyncs to report
+	MinSeverity Severity
+
+	// The minimum confidence of discovered desyncs to report
+	MinConfidence float64
+
+	// A label for this scan to include in each finding
+	Tag string
+
+	// Globs of hosts which should never be scanned
+	Denylist []string
+
+	// Globs of hosts which are allowed to be scanned. If empty, all hosts not in the denylist are allowed
+	Scope []string
+
 	// Whether to show the progress bar
 	ShowProgress bool
 
+	// Whether to periodically show the test throughput and estimated time remaining
+	ShowETA bool
+
 	// Whether to user verbose or debugging output
 	Verbose bool
 	Debug   bool
 
+	// Whether only findings are written to stdout, with operational messages and debugging output going to stderr
+	StdoutOnlyFindings bool
+
 	// The filenames to save to
 	OutFilename   string
 	StateFilename string
@@ -57,6 +158,12 @@ type Config struct {
 
 	// How often to save the state file
 	SaveEvery time.Duration
+
+	// A file which, while it exists, stops new tests from being started
+	PauseFile string
+
+	// The size in bytes at which the output log is rotated. 0 disables rotation
+	MaxLogSize int64
 }
 
 type State struct {
@@ -64,6 +171,13 @@ type State struct {
 	Base    map[string]time.Duration `json:"base"`
 	BaseMux sync.RWMutex             `json:"-"`
 
+	// The headers captured from base responses, indexed by host. These are protected by BaseMux
+	Headers map[string]map[string]string `json:"headers,omitempty"`
+
+	// The URLs which base requests were redirected to with FollowRedirects, indexed by the URL requested. These
+	// are protected by BaseMux
+	Redirects map[string]string `json:"redirects,omitempty"`
+
 	// Results of smuggling tests
 	Results    []SmuggleTest `json:"results"`
 	ResultsMux sync.RWMutex  `json:"-"`
@@ -74,48 +188,365 @@ type State struct {
 	ErrorsMux sync.RWMutex    `json:"-"`
 }
 
+// Exit codes returned by run
+const (
+	exitOK         = 0
+	exitUsage      = 1 // Invalid arguments, configuration, or targets
+	exitVulnerable = 2 // Findings were reported with --fail-on-vuln
+	exitError      = 3 // A runtime or I/O error stopped smuggles
+)
+
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs smuggles with the given command line arguments, not including the program name, and returns the exit
+// code
+func run(args []string) int {
 	conf := Config{}
 	state := State{}
 
+	// Parse errors are returned rather than exiting, so that they give the usage exit code
+	flags := flag.NewFlagSet("smuggles", flag.ContinueOnError)
+
 	// Scanning options
-	flag.IntVarP(&conf.Workers, "workers", "c", 10, "the number of concurrent workers")
-	flag.StringSliceVarP(&conf.Methods, "methods", "m", []string{"GET", "POST", "PUT", "DELETE"}, "the methods to test")
-	flag.DurationVarP(&conf.Delay, "delay", "", 5*time.Second, "the extra time delay on top of the base time that indicates the service is vulnerable")
-	enabled := flag.StringSliceP("enable", "e", nil, "globs of modules to enable")
-	disabled := flag.StringSliceP("disable", "d", nil, "globs of modules to disable")
-	flag.UintVarP(&conf.StopAfter, "stop-after", "x", 0, "the number of smuggling vulnerabilities to find in a host before stopping testing on it. This won't cancel already queued tests, so slightly more than this number of vulnerabilities may be found")
-	flag.UintVarP(&conf.MaxErrors, "max-errors", "E", 0, "the number of errors that can be received from a URL before it stops being scanned")
-	customHeaders := flag.StringSliceP("headers", "H", nil, "custom headers to add to requests")
+	flags.IntVarP(&conf.Workers, "workers", "c", 10, "the number of concurrent workers")
+	flags.StringSliceVarP(&conf.Methods, "methods", "m", []string{"GET", "POST", "PUT", "DELETE"}, "the methods to test")
+	flags.DurationVarP(&conf.Delay, "delay", "", 5*time.Second, "the extra time delay on top of the base time that indicates the service is vulnerable")
+	flags.DurationVarP(&conf.ProbeTimeout, "probe-timeout", "", 3*time.Second, "the timeout for connecting to a URL to check it's reachable before measuring its base time, independent of --delay (0 to disable the check)")
+	flags.Int64VarP(&conf.MinResponseBytes, "min-response-bytes", "", 0, "flag URLs whose base response has a body smaller than this many bytes, or which can't be parsed, in the error log (0 to disable the check)")
+	flags.BoolVarP(&conf.SkipSmallResponses, "skip-small-responses", "", false, "don't test URLs flagged by --min-response-bytes")
+	flags.StringVarP(&conf.ConnectTo, "connect-to", "", "", "send all requests to this host:port, such as a single load balancer node, while still setting the Host header and SNI from the URL")
+	dedupeIP := flags.BoolP("dedupe-ip", "", false, "only scan the first of any URLs whose hostnames resolve to the same IP address, with the same port and path. Servers routing by hostname may behave differently for each, so this is off by default")
+	doh := flags.StringP("doh", "", "", "resolve hostnames with the JSON API of this DNS-over-HTTPS server, such as https://cloudflare-dns.com/dns-query, instead of the system resolver")
+	localAddrList := flags.StringSliceP("local-addr", "", nil, "the local IP address to make connections from. If given more than once, connections are made from each address in turn")
+	caCert := flags.StringP("cacert", "", "", "verify the certificates of https targets against the CA certificates in this PEM file, rather than accepting any certificate")
+	flags.StringSliceVarP(&conf.ALPN, "alpn", "", nil, "the protocols to offer with ALPN in TLS handshakes, in order of preference, such as h2,http/1.1. Requests are always sent as HTTP/1.x, so a server choosing h2 won't understand them")
+	flags.StringVarP(&conf.UnixSocket, "unix", "", "", "send all requests over the unix socket at this path, while still setting the Host header from the URL")
+	fingerprintHosts := flags.BoolP("fingerprint", "", false, "capture the headers of each host's base response which identify common proxies and servers, and include a guess at the frontend and backend in findings output with --output-format ndjson")
+	flags.StringSliceVarP(&conf.CaptureHeaders, "capture-headers", "", nil, "headers of each host's base response to record and include in findings output with --output-format ndjson, such as Server,Via,X-Cache")
+	flags.IntSliceVarP(&conf.RetryStatuses, "retry-on-status", "", nil, "status codes, such as 429,502,503,504, which cause base requests to be retried up to 3 times rather than timed, waiting for as long as the Retry-After header asks")
+	flags.BoolVarP(&conf.FollowRedirects, "follow-redirects", "", false, "follow redirects from base requests, and time and test the URL redirected to in place of the URL given. Redirects to other hosts are only followed if they're in --scope. Without this, the time of the redirect response itself is used")
+	flags.BoolVarP(&conf.ReuseConnections, "reuse-connections", "", false, "reuse keep-alive connections between base timing requests to the same host from each worker")
+	flags.BoolVarP(&conf.ReuseTestConnections, "reuse-test-connections", "", false, "send the verification requests of smuggling tests, and other test requests which can't leave bytes behind, over an idle connection to the same host if the worker has one. The first requests of CL.TE and TE.CL tests always use fresh connections")
+	flags.DurationVarP(&conf.FixedTimeout, "fixed-timeout", "", 0, "use this timeout for all URLs instead of measuring base times, skipping the base timing phase and the base file")
+	enabled := flags.StringSliceP("enable", "e", nil, "globs of modules to enable")
+	fuzzMutations := flags.IntP("fuzz-mutations", "", 0, "also test this many randomly generated obfuscations of the Transfer-Encoding and Content-Length headers, named after a hash of their headers. The same --seed generates the same mutations")
+	profileName := flags.StringP("profile", "", "", "enable a named set of mutations: \"quick\", \"thorough\", \"te-only\", or \"cl-only\". Mutations matching -e are enabled as well, and those matching -d are disabled")
+	disabled := flags.StringSliceP("disable", "d", nil, "globs of modules to disable")
+	detectZeroCL := flags.BoolP("detect-zero-cl", "", false, "also test whether each URL ignores the body of requests with a Content-Length header over a reused connection, reporting it with the 0.CL status")
+	mutationTimeouts := flags.StringToStringP("mutation-timeout", "", nil, "multiply the timeout of tests using mutations matching a glob by a factor, such as 'trailer-*=2'. If several globs match a mutation, the largest factor is used")
+	flags.UintVarP(&conf.StopAfter, "stop-after", "x", 0, "the number of smuggling vulnerabilities to find in a host before stopping testing on it. This won't cancel already queued tests, so slightly more than this number of vulnerabilities may be found")
+	drainOnStop := flags.BoolP("drain-on-stop", "", true, "let the tests already running against a host finish once it reaches --stop-after, rather than cancelling them and dropping any more findings so the count is exact")
+	flags.IntVarP(&conf.MutationLimit, "mutation-limit", "", 0, "the maximum number of randomly selected mutations to test against each host (0 for no limit)")
+	flags.Int64VarP(&conf.Seed, "seed", "", 0, "the seed for randomly ordering tests, selecting and generating mutations, and ordering headers, for reproducible scans. The seed used is logged at startup (default based on the current time)")
+	flags.DurationVarP(&conf.FDBackoff, "fd-backoff", "", 0, "when a connection fails because too many files are open, wait this long for other connections to close before retrying it, up to 5 times (0 to disable)")
+	flags.UintVarP(&conf.MaxErrors, "max-errors", "E", 0, "the number of errors that can be received from a URL before it stops being scanned")
+	requestBudget := flags.UintP("request-budget", "", 0, "the most requests to send in total, including base requests, after which the scan is stopped and the results so far are saved (0 for no limit)")
+	maxTotalErrors := flags.UintP("max-total-errors", "", 0, "the number of errors across all URLs after which the whole scan is stopped, with exit status 3 (0 for no limit)")
+	flags.BoolVarP(&conf.CacheBust, "cache-bust", "", false, "add a query parameter with a random value to each base and test request, so that responses aren't served from a cache")
+	expectContinue := flags.StringP("expect-continue", "", "none", "whether to send an Expect: 100-continue header with test requests which have a body: \"none\", \"send\" to send the body straight after the headers, or \"wait\" to hold the body back until the server answers with 100 Continue, or for up to a second")
+	flags.StringVarP(&conf.MarkerPath, "marker-path", "", "/smuggles404", "the path which 0.CL, pipelining, and the built-in \"404\" --smuggle-prefix requests ask for to tell a smuggled request's response apart, which shouldn't exist on targets")
+	flags.IntVarP(&conf.MarkerStatus, "marker-status", "", http.StatusNotFound, "the status code targets return for --marker-path, which a normal request receiving shows a 0.CL desync")
+	flags.StringVarP(&conf.SmugglePrefix, "smuggle-prefix", "", "", "confirm TE.CL desyncs by smuggling a request, and checking a following request receives its response. Either the request line to smuggle, or one of the built-in \"404\" or \"method\" prefixes")
+	paceFactor := flags.Float64P("pace", "", 0, "leave this many times a host's base time between the test requests sent to it by all workers, so slower hosts are given longer between requests (0 to disable)")
+	resampleBase := flags.DurationP("resample-base", "", 0, "measure the base time of each URL again once this long has passed since it was last measured, and use it for the timeouts of the URL's remaining tests, so they follow changes in how quickly the host responds during the scan (0 to disable)")
+	flags.UintVarP(&conf.HostTimeoutLimit, "host-timeout-limit", "", 0, "the number of consecutive test requests to a host which can time out before it is assumed to be rate limiting or down, and stops being scanned (0 for no limit)")
+	flags.BoolVarP(&conf.DetectPipelining, "detect-pipelining", "", false, "also test whether each URL mixes up the responses to two requests pipelined on one connection, reporting it with the PIPELINE status")
+	flags.BoolVarP(&conf.DetectHostRouting, "detect-host-routing", "", false, "also test whether each URL answers requests with two conflicting Host headers according to the second, reporting it with the HOST status")
+	flags.BoolVarP(&conf.DetectResets, "detect-resets", "", false, "report test requests which have their connection reset or closed without a response, which can be a sign of a desync, with the RESET status")
+	customHeaders := flags.StringSliceP("headers", "H", nil, "custom headers to add to requests")
+	connectionHeader := flags.StringP("connection", "", "close", "the Connection header to send with base and test requests: \"close\", \"keep-alive\", or \"none\" to leave it out. Requests which need the connection kept open always ask for it")
+	denylistFile := flags.StringP("denylist", "", "", "a file of host globs, one per line, which should never be scanned")
+	pipeline := flags.BoolP("pipeline", "", false, "start smuggling tests against each URL as soon as its base time is known, instead of waiting for every base time to be measured. Base requests and tests are sent by separate workers, so up to twice as many connections can be open at once")
+	hideSuspect := flags.BoolP("hide-suspect", "", false, "don't report findings which are likely false positives, such as those on hosts where every test found a desync, those with low confidence, or TE.CL desyncs which couldn't be confirmed. They are marked as suspect in the output otherwise")
+	limitPerMutation := flags.UintP("limit-per-mutation", "", 0, "the number of findings to report for each mutation across all hosts, after which its findings are only counted as completed tests, so a single mutation can't dominate the results (0 for no limit)")
+	failOnVuln := flags.BoolP("fail-on-vuln", "", false, "exit with status 2 if any vulnerabilities are reported")
+	strict := flags.BoolP("strict", "", false, "exit with a non-zero status on malformed targets, unknown fields in jsonl targets, and URLs whose base time can't be measured, instead of logging them and carrying on")
+	targetsFormat := flags.StringP("targets-format", "", "text", "the format of targets read from stdin: \"text\" for one URL per line, or \"jsonl\" for one JSON object per line with a \"url\" field, and optional \"headers\" and \"methods\" overrides")
+	skipSafeFile := flags.StringP("skip-safe-log", "", "", "the base file of a previous scan, whose tests which found nothing should be skipped in this scan")
+	normalizeSlash := flags.BoolP("normalize-trailing-slash", "", false, "treat URLs which differ only by a trailing slash on their path as the same URL, by removing the slash and skipping URLs which are then already targets")
+	scopeFile := flags.StringP("scope", "", "", "a file of host globs, one per line, at least one of which a URL's host must match to be scanned. The denylist takes precedence")
+	flags.StringVarP(&conf.HTTPVersion, "http-version", "", "1.1", "the HTTP version to send in the request line of all requests, either \"1.0\" or \"1.1\"")
+	flags.IntVarP(&conf.ChunkSize, "chunk-size", "", 0, "the number of bytes in each data chunk of chunked test bodies (default 1)")
+	flags.IntVarP(&conf.ChunkCount, "chunk-count", "", 0, "the number of data chunks in chunked test bodies. By default, CL.TE tests use one chunk and TE.CL tests use none")
+	flags.BoolVarP(&conf.RandomizeHeaderOrder, "randomize-header-order", "", false, "shuffle the Host header and added headers in requests, leaving the request line and the headers which frame the body in place. The order depends on --seed, and the method and URL of each request")
+	flags.StringVarP(&conf.HeaderCase, "header-case", "", "", "case the names of all headers other than the mutation, either \"lower\" or \"upper\". By default, header names are sent exactly as written")
 
 	// Output display options
-	flag.BoolVarP(&conf.ShowProgress, "progress", "p", false, "show a progress bar instead of output discovered vulnerabilities to stdout")
-	flag.BoolVarP(&conf.Verbose, "verbose", "v", false, "print scanned hosts to stdout")
-	flag.BoolVarP(&conf.Debug, "debug", "", false, "time each request and output the times to stdout")
-	flag.DurationVarP(&conf.SaveEvery, "save-every", "", time.Minute, "time between saves of the state file")
+	flags.BoolVarP(&conf.ShowProgress, "progress", "p", false, "show a progress bar instead of output discovered vulnerabilities to stdout")
+	minSeverity := flags.StringP("min-severity", "", "low", "the minimum severity of discovered vulnerabilities to report: \"low\", \"medium\", or \"high\"")
+	flags.Float64VarP(&conf.MinConfidence, "min-confidence", "", 0, "the minimum confidence, between 0 and 1, of discovered vulnerabilities to report")
+	flags.StringVarP(&conf.Tag, "tag", "", "", "a label for the scan which is added to the end of each discovered vulnerability in the output. It can't contain whitespace, or be \"confirmed\" or \"suspect\"")
+	flags.BoolVarP(&conf.ShowETA, "eta", "", false, "periodically print the number of tests completed, tests per second, and the estimated time remaining")
+	flags.BoolVarP(&conf.Verbose, "verbose", "v", false, "print scanned hosts to stdout")
+	flags.BoolVarP(&conf.Debug, "debug", "", false, "output each request to stdout, along with how long it took, and the status code and size of its response and whether the response was truncated")
+	flags.DurationVarP(&conf.SaveEvery, "save-every", "", time.Minute, "time between saves of the state file")
+	flags.StringVarP(&conf.PauseFile, "pause-file", "", "", "a file which pauses the scan while it exists, allowing a running scan to be paused by creating it and resumed by removing it")
 
 	// Output file options
-	flag.StringVarP(&conf.OutFilename, "output", "o", "", "the log file to write to")
-	flag.StringVarP(&conf.StateFilename, "base", "b", "", "the base file with request times to use (default \"smuggles.state\")")
-	flag.StringVarP(&conf.ErrFilename, "error-log", "", "", "the file to log errors to")
-	outDir := flag.StringP("dir", "O", "", "the directory to output the log, error log, and base file to")
+	flags.StringVarP(&conf.OutFilename, "output", "o", "", "the log file to write to")
+	flags.StringVarP(&conf.StateFilename, "base", "b", "", "the base file with request times to use (default \"smuggles.state\")")
+	noBaseFile := flags.BoolP("no-base-file", "", false, "keep base times and completed tests in memory for this run only, without reading or writing a base file")
+	refreshBase := flags.BoolP("refresh-base", "", false, "measure the base times of all input URLs again, replacing any already in the base file")
+	outputFormat := flags.StringP("output-format", "", "text", "the format of discovered vulnerabilities in the output: \"text\" for space separated fields, or \"ndjson\" for one JSON object per line")
+	flags.StringVarP(&conf.ErrFilename, "error-log", "", "", "the file to log errors to")
+	serveAddr := flags.StringP("serve", "", "", "serve the findings and progress of the running scan as JSON over HTTP on this address, such as :8080, at /findings and /progress")
+	splitOutput := flags.StringP("split-output", "", "", "also write discovered vulnerabilities to a separate file for each host in this directory")
+	teeDests := flags.StringSliceP("tee", "", nil, "also write discovered vulnerabilities to each of these destinations: \"stdout\", \"stderr\", \"syslog\", an http or https webhook URL to POST each one to, or a file to append to")
+	heartbeat := flags.DurationP("heartbeat", "", 0, "print the number of tests completed and the current rate to stderr at this interval, to show a scan without findings is still running (0 to disable)")
+	profileWorkers := flags.BoolP("profile-workers", "", false, "record how long each worker's requests take, and print a histogram of the times for each worker when the scan finishes, to find slow or overloaded workers when tuning -c")
+	flags.BoolVarP(&conf.StdoutOnlyFindings, "output-stdout-only-findings", "", false, "only write discovered vulnerabilities to stdout, sending operational messages and errors to stderr instead, so findings can be piped to another program")
+	quiet := flags.BoolP("quiet", "q", false, "don't print operational messages such as heartbeats, ETAs, and skipped URLs. Findings and errors are still output")
+	logFormat := flags.StringP("log-format", "", "text", "the format of errors and other operational messages logged during a scan: \"text\", or \"json\" for one JSON object per line. Discovered vulnerabilities are unaffected")
+	compressOutput := flags.BoolP("compress-output", "", false, "gzip the output log and error log as they're written, adding a .gz extension to their filenames")
+	flags.Int64VarP(&conf.MaxLogSize, "max-log-size", "", 0, "the size in bytes at which to rotate the output log to <output>.1, <output>.2, etc. (0 to disable)")
+	outDir := flags.StringP("dir", "O", "", "the directory to output the log, error log, and base file to")
+	interactive := flags.BoolP("interactive", "", false, "pause on each finding to accept or reject it, or show a PoC for it, on the terminal. Rejected findings aren't output")
+	bestPerHost := flags.BoolP("best-per-host", "", false, "only output the most severe finding for each host to stdout, once the scan finishes. The log file still contains all findings")
+	sqliteFile := flags.StringP("sqlite", "", "", "also record the measured base times and discovered vulnerabilities in this SQLite database, so results can be queried across scans")
+	summaryJSON := flags.StringP("summary-json", "", "", "write a summary of the scan's coverage and findings per host and per mutation to this file as JSON when the scan finishes")
+	baseReport := flags.StringP("base-report", "", "", "write the base times of the scanned URLs to this file as JSON once they have been measured")
+	baseReportUnit := flags.StringP("base-report-unit", "", "ms", "the unit of times in the base report: \"ns\", \"us\", \"ms\", or \"s\"")
+	timestamped := flags.BoolP("timestamped", "", false, "write the log and error log to a new timestamped subdirectory of the --dir directory for each run. The base file is kept in the --dir directory so it can be reused between runs")
 
 	// Early exit flags
-	generatePoc := flag.BoolP("poc", "", false, "generate a PoC from a provided line of the log file of format <method> <url> <desync type> <mutation name> and exit")
-	scriptFile := flag.StringP("script", "", "", "generate a Turbo Intruder script using the specified file as a base, to verify the smuggling issue with a 404 request from a provided line of the log file of format <method> <url> <desync type> <mutation name>")
-	gadget := flag.StringP("mutation", "", "", "print the specified Transfer-Encoding header mutation and exit")
-	list := flag.BoolP("list", "l", false, "list the enabled mutation names and exit")
+	replayFile := flags.StringP("replay-raw", "", "", "send the raw HTTP request in this file exactly as written to the URL given as a positional argument, print how long the response took and the response, and exit. The request waits for --fixed-timeout, or 30 seconds if not set")
+	generatePoc := flags.BoolP("poc", "", false, "generate a PoC from a provided line of the log file of format <method> <url> <desync type> <mutation name> and exit")
+	pocFormat := flags.StringP("poc-format", "", "raw", "the format of PoCs generated with --poc: \"raw\", \"httpie\", or \"caido\" for a Caido replay session input")
+	autoPoC := flags.StringP("auto-poc", "", "", "write the PoC of each discovered vulnerability to a file in this directory as it's found, in the format given by --poc-format")
+	scriptFile := flags.StringP("script", "", "", "generate a Turbo Intruder script using the specified file as a base, to verify the smuggling issue with a 404 request from a provided line of the log file of format <method> <url> <desync type> <mutation name>")
+	confirmPath := flags.StringP("confirm-path", "", "/404", "the path requested by the prefix smuggled in scripts generated with --script, which should give a different response to the victim requests")
+	gadget := flags.StringP("mutation", "", "", "print the headers of the specified mutation and exit")
+	list := flags.BoolP("list", "l", false, "list the enabled mutation names and exit")
+	mutationDiff := flags.StringP("mutation-diff", "", "", "print how the mutations in this JSON file, an object of mutations indexed by name, differ from the enabled built-in mutations, and exit")
+	validate := flags.BoolP("validate-mutations", "", false, "send the test requests of each enabled mutation to a local server, report any whose headers don't arrive exactly as generated or gain framing headers from -H, and exit")
+	compare := flags.BoolP("compare", "", false, "compare two text or ndjson log files given as positional arguments, <old log> <new log>, printing the findings which are new (+) and fixed (-), and exit")
+	runSelfTest := flags.BoolP("self-test", "", false, "scan a built-in server vulnerable to CL.TE desyncs to check detection works with the given options, and exit")
+	countOnly := flags.BoolP("count-only", "", false, "read targets from stdin, print the number of base requests and smuggling tests a scan would perform, taking the base file into account, and exit")
+
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+
+	// 0 is a valid seed, so only a seed which wasn't given is generated
+	if !flags.Changed("seed") {
+		conf.Seed = time.Now().UnixNano()
+	}
+	conf.HeaderOrderSeed = conf.Seed
+
+	var err error
+	conf.MinSeverity, err = parseSeverity(*minSeverity)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+
+	if _, ok := durationUnits[*baseReportUnit]; !ok {
+		fmt.Println("--base-report-unit should be one of \"ns\", \"us\", \"ms\", or \"s\"")
+		return exitUsage
+	}
+
+	if *logFormat != "text" && *logFormat != "json" {
+		fmt.Println("--log-format should be one of \"text\" or \"json\"")
+		return exitUsage
+	}
+
+	if *targetsFormat != "text" && *targetsFormat != "jsonl" {
+		fmt.Println("--targets-format should be one of \"text\" or \"jsonl\"")
+		return exitUsage
+	}
+
+	if *outputFormat != "text" && *outputFormat != "ndjson" && *outputFormat != "nuclei" {
+		fmt.Println("--output-format should be one of \"text\", \"ndjson\", or \"nuclei\"")
+		return exitUsage
+	}
+
+	// The tag ends text findings, so it can't be split into more fields or be mistaken for a marker before it
+	if strings.IndexFunc(conf.Tag, unicode.IsSpace) >= 0 {
+		fmt.Println("--tag can't contain whitespace")
+		return exitUsage
+	}
+	if conf.Tag == "confirmed" || conf.Tag == "suspect" {
+		fmt.Printf("--tag can't be %q, since it marks findings in the output\n", conf.Tag)
+		return exitUsage
+	}
+
+	if conf.HeaderCase != "" && conf.HeaderCase != "lower" && conf.HeaderCase != "upper" {
+		fmt.Println("--header-case should be one of \"lower\" or \"upper\"")
+		return exitUsage
+	}
+
+	if !strings.HasPrefix(conf.MarkerPath, "/") || strings.ContainsAny(conf.MarkerPath, " \t\r\n") {
+		fmt.Println("--marker-path should be a path starting with / and without whitespace")
+		return exitUsage
+	}
+
+	if conf.MarkerStatus < 100 || conf.MarkerStatus > 599 {
+		fmt.Println("--marker-status should be an HTTP status code between 100 and 599")
+		return exitUsage
+	}
+
+	if prefix, ok := smugglePrefixes[conf.SmugglePrefix]; ok {
+		conf.SmugglePrefix = strings.ReplaceAll(prefix, "%s", conf.MarkerPath)
+	}
+
+	if conf.ConnectTo != "" {
+		if _, _, err := net.SplitHostPort(conf.ConnectTo); err != nil {
+			fmt.Printf("--connect-to should be of the form host:port: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	if *caCert != "" {
+		pem, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			fmt.Printf("Failed to read CA file: %v\n", err)
+			return exitError
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			fmt.Printf("No PEM certificates found in %s\n", *caCert)
+			return exitUsage
+		}
+	}
+
+	for _, p := range conf.ALPN {
+		if p == "" {
+			fmt.Println("--alpn protocols can't be empty")
+			return exitUsage
+		}
+	}
+
+	var localAddrs *LocalAddrs
+	if len(*localAddrList) > 0 {
+		if conf.UnixSocket != "" {
+			fmt.Println("--local-addr can't be used with --unix")
+			return exitUsage
+		}
+		localAddrs, err = NewLocalAddrs(*localAddrList)
+		if err != nil {
+			fmt.Printf("Invalid --local-addr: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	var resolver *DoHResolver
+	if *doh != "" {
+		resolver, err = NewDoHResolver(*doh)
+		if err != nil {
+			fmt.Printf("Invalid --doh server: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	if *paceFactor < 0 {
+		fmt.Println("--pace can't be negative")
+		return exitUsage
+	}
+	var pacer *Pacer
+	if *paceFactor > 0 {
+		pacer = NewPacer(*paceFactor)
+	}
+
+	if *resampleBase < 0 {
+		fmt.Println("--resample-base can't be negative")
+		return exitUsage
+	} else if *resampleBase > 0 && conf.FixedTimeout != 0 {
+		fmt.Println("--resample-base can't be used with --fixed-timeout, which doesn't use base times")
+		return exitUsage
+	}
+	var sampler *BaseSampler
+	if *resampleBase > 0 {
+		sampler = NewBaseSampler(*resampleBase)
+	}
+
+	var deduper *IPDeduper
+	if *dedupeIP {
+		deduper = NewIPDeduper(resolver)
+	}
+
+	if conf.ChunkSize < 0 || conf.ChunkCount < 0 {
+		fmt.Println("--chunk-size and --chunk-count can't be negative")
+		return exitUsage
+	}
+
+	if *noBaseFile && conf.StateFilename != "" {
+		fmt.Println("--no-base-file can't be used with --base")
+		return exitUsage
+	}
+
+	if !*drainOnStop && conf.StopAfter == 0 {
+		fmt.Println("--drain-on-stop only applies with --stop-after")
+		return exitUsage
+	}
+
+	if *refreshBase && (*noBaseFile || conf.FixedTimeout != 0) {
+		fmt.Println("--refresh-base can't be used with --no-base-file or --fixed-timeout")
+		return exitUsage
+	}
+
+	if *compressOutput && conf.MaxLogSize > 0 {
+		fmt.Println("--compress-output can't be used with --max-log-size")
+		return exitUsage
+	}
 
-	flag.Parse()
+	// Fingerprinting needs the headers which identify the frontend and backend, alongside any asked for
+	if *fingerprintHosts {
+		for _, h := range fingerprintHeaders() {
+			captured := false
+			for _, c := range conf.CaptureHeaders {
+				captured = captured || strings.EqualFold(c, h)
+			}
+			if !captured {
+				conf.CaptureHeaders = append(conf.CaptureHeaders, h)
+			}
+		}
+	}
+
+	if conf.MinResponseBytes < 0 {
+		fmt.Println("--min-response-bytes can't be negative")
+		return exitUsage
+	} else if conf.SkipSmallResponses && conf.MinResponseBytes == 0 {
+		fmt.Println("--skip-small-responses requires --min-response-bytes")
+		return exitUsage
+	}
+
+	if conf.HTTPVersion != "1.0" && conf.HTTPVersion != "1.1" {
+		fmt.Println("--http-version should be one of \"1.0\" or \"1.1\"")
+		return exitUsage
+	}
+
+	var skipSafe map[string]bool
+	if *skipSafeFile != "" {
+		var err error
+		skipSafe, err = loadSafeTests(*skipSafeFile)
+		if err != nil {
+			fmt.Printf("Failed to read safe tests from %s: %v\n", *skipSafeFile, err)
+			return exitUsage
+		}
+	}
+
+	var profile func(string, Mutation) bool
+	if *profileName != "" {
+		var ok bool
+		profile, ok = mutationProfiles[*profileName]
+		if !ok {
+			fmt.Printf("Unknown mutation profile: %s\n", *profileName)
+			return exitUsage
+		}
+	}
 
 	// Generate the enabled mutations
 	all := generateMutations()
-	conf.Mutations = make(map[string]string, 0)
+	conf.Mutations = make(map[string]Mutation, 0)
 	for m := range all {
 		include := true
 
-		if enabled != nil && len(*enabled) > 0 {
-			include = false
+		if profile != nil || (enabled != nil && len(*enabled) > 0) {
+			include = profile != nil && profile(m, all[m])
 			for _, e := range *enabled {
 				if glob.Glob(e, m) {
 					include = true
@@ -138,15 +569,72 @@ func main() {
 		}
 	}
 
+	// 0.CL tests don't use a Transfer-Encoding header, so aren't affected by -e or -d
+	if *detectZeroCL {
+		conf.Mutations[ZeroCLMutation] = Mutation{}
+	}
+
+	// Add the randomly generated mutations, which aren't affected by -e, -d, or --profile
+	if *fuzzMutations < 0 {
+		fmt.Println("--fuzz-mutations can't be negative")
+		return exitUsage
+	}
+	for k, v := range generateFuzzMutations(*fuzzMutations, conf.Seed) {
+		conf.Mutations[k] = v
+	}
+	if conf.DetectPipelining {
+		conf.Mutations[PipelineMutation] = Mutation{}
+	}
+	if conf.DetectHostRouting {
+		conf.Mutations[DuplicateHostMutation] = Mutation{}
+		conf.Mutations[DuplicateHostReversedMutation] = Mutation{}
+	}
+
+	// Set the timeout multipliers of the mutations
+	for g, v := range *mutationTimeouts {
+		factor, err := strconv.ParseFloat(v, 64)
+		if err != nil || factor <= 0 {
+			fmt.Printf("Invalid --mutation-timeout factor for %s: %s\n", g, v)
+			return exitUsage
+		}
+		for name, m := range conf.Mutations {
+			if glob.Glob(g, name) && factor > m.TimeoutMultiplier {
+				m.TimeoutMultiplier = factor
+				conf.Mutations[name] = m
+			}
+		}
+	}
+
+	// Load the hosts to never scan
+	if *denylistFile != "" {
+		conf.Denylist, err = loadGlobs(*denylistFile)
+		if err != nil {
+			fmt.Printf("Failed to read denylist: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	// Load the hosts which are in scope
+	if *scopeFile != "" {
+		conf.Scope, err = loadGlobs(*scopeFile)
+		if err != nil {
+			fmt.Printf("Failed to read scope file: %v\n", err)
+			return exitUsage
+		}
+	}
+
 	// Set the headers in the config
 	connOverride := false
 	uaOverride := false
+	authOverride := false
 	if customHeaders != nil {
 		for _, h := range *customHeaders {
 			if strings.HasPrefix(h, "User-Agent:") {
 				uaOverride = true
 			} else if strings.HasPrefix(h, "Connection:") {
 				connOverride = true
+			} else if strings.HasPrefix(h, "Authorization:") {
+				authOverride = true
 			}
 		}
 		conf.Headers = *customHeaders
@@ -159,9 +647,34 @@ func main() {
 		conf.Headers = append(conf.Headers, ua)
 	}
 
-	if !connOverride {
-		conn := "Connection: close"
-		conf.Headers = append(conf.Headers, conn)
+	// A Connection header given with -H takes precedence over --connection
+	switch *connectionHeader {
+	case "close", "keep-alive":
+		if !connOverride {
+			conf.Headers = append(conf.Headers, "Connection: "+*connectionHeader)
+		}
+	case "none":
+	default:
+		fmt.Printf("Unknown --connection value: %s\n", *connectionHeader)
+		return exitUsage
+	}
+
+	switch *expectContinue {
+	case "wait":
+		conf.WaitForContinue = true
+		conf.ExpectContinue = true
+	case "send":
+		conf.ExpectContinue = true
+	case "none":
+	default:
+		fmt.Printf("Unknown --expect-continue value: %s\n", *expectContinue)
+		return exitUsage
+	}
+
+	// Credentials can be given in the environment to keep them out of shell history and process listings,
+	// but an Authorization header given with -H takes precedence
+	if auth := authFromEnv(); auth != "" && !authOverride {
+		conf.Headers = append(conf.Headers, auth)
 	}
 
 	// Check for options that lead to early exit
@@ -176,51 +689,175 @@ func main() {
 		for _, k := range keys {
 			fmt.Println(k)
 		}
-		os.Exit(0)
+		return exitOK
 	}
 
 	if *gadget != "" {
 		header, ok := conf.Mutations[*gadget]
 		if ok {
 			fmt.Println(header)
-			os.Exit(0)
+			return exitOK
 		} else {
 			fmt.Println("Mutation not found")
-			os.Exit(1)
+			return exitUsage
 		}
 	}
 
+	if *mutationDiff != "" {
+		mutations, err := readMutations(*mutationDiff)
+		if err != nil {
+			fmt.Printf("Failed to read mutations from %s: %v\n", *mutationDiff, err)
+			return exitError
+		}
+
+		// The headers are quoted, as they contain line breaks and may contain other unprintable characters
+		diff := diffMutations(conf.Mutations, mutations)
+		for _, name := range diff.Added {
+			fmt.Printf("+ %s: %q\n", name, mutations[name].String())
+		}
+		for _, name := range diff.Removed {
+			fmt.Printf("- %s: %q\n", name, conf.Mutations[name].String())
+		}
+		for _, name := range diff.Changed {
+			fmt.Printf("~ %s: %q -> %q\n", name, conf.Mutations[name].String(), mutations[name].String())
+		}
+		fmt.Printf("%d added, %d removed, %d changed\n", len(diff.Added), len(diff.Removed), len(diff.Changed))
+		return exitOK
+	}
+
+	if *validate {
+		failed, checked, err := validateMutations(conf)
+		if err != nil {
+			fmt.Printf("Failed to validate mutations: %v\n", err)
+			return exitError
+		}
+
+		names := make([]string, 0, len(failed))
+		for name := range failed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s: %s\n", name, failed[name])
+		}
+		fmt.Printf("%d of %d mutations arrived intact\n", checked-len(failed), checked)
+		if len(failed) > 0 {
+			return exitError
+		}
+		return exitOK
+	}
+
 	if *generatePoc {
-		if flag.NArg() != 4 {
+		if flags.NArg() < 4 {
 			fmt.Println("Positional arguments should be: <method> <url> <desync type> <mutation name>")
 			fmt.Println("e.g.: smuggles --poc GET https://example.com CL.TE lineprefix-space")
-			os.Exit(1)
+			return exitUsage
 		}
 
-		poc, err := generatePoC(conf, flag.Arg(0), flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		poc, err := generatePoC(conf, flags.Arg(0), flags.Arg(1), flags.Arg(2), flags.Arg(3))
 		if err != nil {
 			fmt.Printf("Couldn't generate PoC: %v\n", err)
-			os.Exit(1)
+			return exitUsage
+		}
+
+		u, _ := url.Parse(flags.Arg(1))
+		poc, warning, err := formatPoC(*pocFormat, u, poc)
+		if err != nil {
+			fmt.Printf("Couldn't generate PoC: %v\n", err)
+			return exitUsage
+		} else if warning != "" {
+			fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
 		}
 		fmt.Printf("%s", string(poc))
-		os.Exit(0)
+		return exitOK
 	}
 
 	if *scriptFile != "" {
-		if flag.NArg() != 4 {
+		if flags.NArg() < 4 {
 			fmt.Println("Positional arguments should be: <method> <url> <desync type> <mutation name>")
 			fmt.Println("e.g.: smuggles --script resources/clte.py GET https://example.com CL.TE lineprefix-space")
-			os.Exit(1)
+			return exitUsage
 		}
 
-		script, err := generateScript(conf, *scriptFile, flag.Arg(0), flag.Arg(1), flag.Arg(3))
+		script, err := generateScript(conf, *scriptFile, flags.Arg(0), flags.Arg(1), flags.Arg(3), *confirmPath)
 		if err != nil {
 			fmt.Printf("Error generating script: %v\n", err)
-			os.Exit(1)
+			return exitUsage
 		}
 
 		fmt.Printf("%s", string(script))
-		os.Exit(0)
+		return exitOK
+	}
+
+	if *compare {
+		if flags.NArg() != 2 {
+			fmt.Println("Positional arguments should be: <old log> <new log>")
+			fmt.Println("e.g.: smuggles --compare old/smuggles.log new/smuggles.log")
+			return exitUsage
+		}
+
+		oldFindings, err := readFindings(flags.Arg(0))
+		if err != nil {
+			fmt.Printf("Failed to read old log: %v\n", err)
+			return exitError
+		}
+		newFindings, err := readFindings(flags.Arg(1))
+		if err != nil {
+			fmt.Printf("Failed to read new log: %v\n", err)
+			return exitError
+		}
+
+		added, fixed, unchanged := compareFindings(oldFindings, newFindings)
+		for _, l := range added {
+			fmt.Printf("+ %s\n", l)
+		}
+		for _, l := range fixed {
+			fmt.Printf("- %s\n", l)
+		}
+		fmt.Printf("%d new, %d fixed, %d unchanged\n", len(added), len(fixed), len(unchanged))
+		return exitOK
+	}
+
+	if *replayFile != "" {
+		if flags.NArg() != 1 {
+			fmt.Println("Positional arguments should be: <url>")
+			fmt.Println("e.g.: smuggles --replay-raw request.txt https://example.com")
+			return exitUsage
+		}
+
+		u, err := url.Parse(flags.Arg(0))
+		if err != nil {
+			fmt.Printf("Invalid URL: %v\n", err)
+			return exitUsage
+		}
+		timeout := conf.FixedTimeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+
+		d, resp, isTimeout, err := replayRaw(conf, resolver, localAddrs, *replayFile, u, timeout)
+		if err != nil {
+			fmt.Printf("Failed to replay request: %v\n", err)
+			return exitError
+		}
+		status, truncated := inspectResponse(resp)
+		fmt.Printf("Response from %s took %dms (timeout: %t, status: %d, size: %d, truncated: %t)\n", u, d.Milliseconds(), isTimeout, status, len(resp), truncated)
+		fmt.Printf("%s", resp)
+		return exitOK
+	}
+
+	if *runSelfTest {
+		fmt.Println("Running self-test against a server vulnerable to CL.TE desyncs...")
+		detected, err := selfTest(conf)
+		if err != nil {
+			fmt.Printf("Self-test failed: %v\n", err)
+			return exitError
+		} else if !detected {
+			fmt.Println("Self-test failed: the CL.TE desync was not detected")
+			return exitError
+		}
+		fmt.Println("Self-test passed: the CL.TE desync was detected")
+		return exitOK
 	}
 
 	urls := make([]*url.URL, 0)
@@ -228,80 +865,243 @@ func main() {
 	// Logging
 	var reslog *log.Logger
 	var errlog *log.Logger
+	resStdout := false
+
+	// Where operational messages are written, which is kept separate from findings if asked
+	var infoOut io.Writer = os.Stdout
+	if conf.StdoutOnlyFindings {
+		infoOut = os.Stderr
+	}
+	if *timestamped && *outDir == "" {
+		fmt.Fprintln(infoOut, "--timestamped requires an output directory to be set with --dir")
+		return exitUsage
+	}
+
 	if *outDir != "" {
+		runDir := *outDir
+		if *timestamped {
+			runDir = path.Join(*outDir, time.Now().Format("2006-01-02T15-04-05"))
+			if err := os.MkdirAll(runDir, 0755); err != nil {
+				fmt.Fprintf(infoOut, "Failed to create output directory: %v\n", err)
+				return exitError
+			}
+		}
+
 		if conf.OutFilename == "" {
-			conf.OutFilename = path.Join(*outDir, "smuggles.log")
+			conf.OutFilename = path.Join(runDir, "smuggles.log")
 		}
-		if conf.StateFilename == "" {
+		if conf.StateFilename == "" && !*noBaseFile {
 			conf.StateFilename = path.Join(*outDir, "smuggles.state")
 		}
 		if conf.ErrFilename == "" {
-			conf.ErrFilename = path.Join(*outDir, "smuggles.errors")
+			conf.ErrFilename = path.Join(runDir, "smuggles.errors")
 		}
 	}
 
 	if conf.OutFilename != "" {
-		f, err := os.OpenFile(conf.OutFilename, os.O_WRONLY|os.O_CREATE, 0644)
+		f, err := openLog(conf.OutFilename, *compressOutput, conf.MaxLogSize)
 		if err != nil {
-			fmt.Printf("Failed to open log file: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(infoOut, "Failed to open log file: %v\n", err)
+			return exitError
 		}
 		defer f.Close()
 		outputs := []io.Writer{f}
-		if !conf.ShowProgress {
+		if !conf.ShowProgress && !*bestPerHost {
 			outputs = append(outputs, os.Stdout)
+			resStdout = true
 		}
 		mw := io.MultiWriter(outputs...)
 		reslog = log.New(mw, "", 0)
+	} else if *bestPerHost {
+		// The best findings are output once the scan finishes
+		reslog = log.New(ioutil.Discard, "", 0)
 	} else if conf.ShowProgress {
-		fmt.Println("WARNING: progress bar being shown and no output file specified - discovered vulnerabilities will not be outputted anywhere!")
+		if len(*teeDests) == 0 {
+			fmt.Fprintln(infoOut, "WARNING: progress bar being shown and no output file specified - discovered vulnerabilities will not be outputted anywhere!")
+		}
 		reslog = log.New(ioutil.Discard, "", 0)
 	} else {
 		reslog = log.New(os.Stdout, "", 0)
+		resStdout = true
+	}
+
+	if *autoPoC != "" {
+		if _, ok := pocExtensions[*pocFormat]; !ok {
+			fmt.Fprintf(infoOut, "Unrecognised PoC format: %s\n", *pocFormat)
+			return exitUsage
+		}
+		if err := os.MkdirAll(*autoPoC, 0755); err != nil {
+			fmt.Fprintf(infoOut, "Failed to create PoC directory: %v\n", err)
+			return exitError
+		}
+	}
+
+	var hostLogs *HostLogs
+	if *splitOutput != "" {
+		var err error
+		hostLogs, err = NewHostLogs(*splitOutput)
+		if err != nil {
+			fmt.Fprintf(infoOut, "Failed to create split output directory: %v\n", err)
+			return exitError
+		}
+		defer hostLogs.Close()
 	}
 
 	if conf.ErrFilename != "" {
-		f, err := os.OpenFile(conf.ErrFilename, os.O_WRONLY|os.O_CREATE, 0644)
+		f, err := openLog(conf.ErrFilename, *compressOutput, 0)
 		if err != nil {
-			fmt.Printf("Failed to open error log file: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(infoOut, "Failed to open error log file: %v\n", err)
+			return exitError
 		}
 		defer f.Close()
 		outputs := []io.Writer{f}
 		if !conf.ShowProgress {
-			outputs = append(outputs, os.Stdout)
+			outputs = append(outputs, infoOut)
 		}
 
 		mw := io.MultiWriter(outputs...)
-		errlog = log.New(mw, "ERROR:", 0)
+		errlog = newLogger(mw, "ERROR", *logFormat)
 	} else {
-		errlog = log.New(os.Stderr, "ERROR:", 0)
+		errlog = newLogger(os.Stderr, "ERROR", *logFormat)
+	}
+	// Mirror findings to the --tee destinations too, other than the standard output if they already go there
+	if len(*teeDests) > 0 {
+		contentType := "text/plain"
+		if *outputFormat == "ndjson" {
+			contentType = "application/x-ndjson"
+		} else if *outputFormat == "nuclei" {
+			contentType = "application/yaml"
+		}
+		outputs := []io.Writer{reslog.Writer()}
+		for _, dest := range *teeDests {
+			if dest == "stdout" && resStdout {
+				continue
+			}
+			w, err := openTee(dest, contentType, func(err error) { errlog.Println(err) })
+			if err != nil {
+				fmt.Fprintf(infoOut, "Failed to open --tee destination %s: %v\n", dest, err)
+				return exitError
+			}
+			defer w.Close()
+			outputs = append(outputs, w)
+		}
+		reslog.SetOutput(io.MultiWriter(outputs...))
 	}
 
-	// The base times for standard requests
-	if conf.StateFilename == "" {
-		conf.StateFilename = "smuggles.state"
+	infolog := newLogger(infoOut, "INFO", *logFormat)
+	if *quiet {
+		infolog = newLogger(ioutil.Discard, "INFO", *logFormat)
 	}
-	stateFile, err := os.OpenFile(conf.StateFilename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		fmt.Printf("Failed to open base file: %v\n", err)
-		os.Exit(1)
+
+	// The test order, selected and generated mutations, and header order all depend on the seed, so it's logged
+	// for the scan to be reproduced with --seed
+	infolog.Printf("Using seed %d\n", conf.Seed)
+
+	// The base times for standard requests. These aren't needed when using a fixed timeout, and are only kept in
+	// memory with --no-base-file, or with a shared base file read from the standard input or a URL
+	var stateFile *os.File
+	stdin := io.Reader(os.Stdin)
+	if conf.FixedTimeout == 0 && !*noBaseFile {
+		if conf.StateFilename == "" {
+			conf.StateFilename = "smuggles.state"
+		}
+		// Counting tests shouldn't create a base file as a side effect
+		mode := os.O_RDWR | os.O_CREATE
+		if *countOnly {
+			mode = os.O_RDONLY
+		}
+		var jsonBytes []byte
+		if sharedBase(conf.StateFilename) {
+			jsonBytes, stdin, err = readSharedBase(conf.StateFilename, os.Stdin)
+			if err != nil {
+				fmt.Fprintf(infoOut, "Failed to read base file: %v\n", err)
+				return exitError
+			}
+		} else if stateFile, err = os.OpenFile(conf.StateFilename, mode, 0644); err == nil {
+			defer stateFile.Close()
+			jsonBytes, err = ioutil.ReadAll(stateFile)
+			if err != nil {
+				fmt.Fprintf(infoOut, "Failed to read base file: %v\n", err)
+				return exitError
+			}
+		} else if !*countOnly || !os.IsNotExist(err) {
+			fmt.Fprintf(infoOut, "Failed to open base file: %v\n", err)
+			return exitError
+		}
+
+		if len(jsonBytes) > 0 {
+			err = json.Unmarshal(jsonBytes, &state)
+			if err != nil {
+				fmt.Fprintf(infoOut, "Failed to parse base file as JSON: %v\n", err)
+				return exitError
+			}
+		}
 	}
-	defer stateFile.Close()
-	jsonBytes, err := ioutil.ReadAll(stateFile)
-	if err != nil {
-		fmt.Printf("Failed to read base file: %v\n", err)
-		os.Exit(1)
+	if state.Base == nil {
+		state.Base = make(map[string]time.Duration, 0)
+	}
+
+	if *countOnly {
+		targets := make(map[string]Target, 0)
+		baseCount := 0
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			target, targetUrls, err := parseTarget(scanner.Text(), *targetsFormat, *strict)
+			if err != nil {
+				errlog.Println(err)
+				if *strict {
+					return exitUsage
+				}
+				continue
+			}
+			for _, u := range targetUrls {
+				if *normalizeSlash {
+					normalizeTrailingSlash(u)
+					if _, seen := targets[u.String()]; seen {
+						infolog.Printf("Skipping %s: already a target once its trailing slash is removed\n", u)
+						continue
+					}
+				}
+				if reason := skipReason(u, conf); reason != "" {
+					infolog.Printf("Skipping %s URL: %s\n", reason, u)
+					continue
+				}
+				if first := duplicateServer(context.Background(), deduper, u, errlog); first != nil {
+					infolog.Printf("Skipping %s: same server as %s\n", u, first)
+					continue
+				}
+				targets[u.String()] = target
+				if _, exists := state.Base[u.String()]; (!exists || *refreshBase) && conf.FixedTimeout == 0 {
+					baseCount++
+				}
+				urls = append(urls, u)
+			}
+		}
+
+		tests := excludeTests(generateTests(conf, urls, targets, &state, false), skipSafe)
+		fmt.Printf("Base requests: %d\n", baseCount)
+		fmt.Printf("Smuggling tests: %d\n", len(tests))
+		return exitOK
 	}
 
-	if len(jsonBytes) > 0 {
-		err = json.Unmarshal(jsonBytes, &state)
+	var resultsDB *ResultsDB
+	if *sqliteFile != "" {
+		var err error
+		resultsDB, err = OpenResultsDB(*sqliteFile, conf.Tag)
 		if err != nil {
-			fmt.Printf("Failed to parse base file as JSON: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(infoOut, "Failed to open SQLite database: %v\n", err)
+			return exitError
+		}
+		defer resultsDB.Close()
+	}
+
+	var status *ScanStatus
+	if *serveAddr != "" {
+		status = NewScanStatus()
+		if err := status.Serve(*serveAddr); err != nil {
+			fmt.Fprintf(infoOut, "Failed to serve scan status: %v\n", err)
+			return exitError
 		}
-	} else {
-		state.Base = make(map[string]time.Duration, 0)
 	}
 
 	// Genrate the workers
@@ -309,31 +1109,176 @@ func main() {
 		state.Errors = make(map[string]uint, 0)
 	}
 	state.ErrorsMux = sync.RWMutex{}
+	targets := make(map[string]Target, 0)
+	targetsMux := sync.RWMutex{}
+
+	// Stop scanning on an interrupt, keeping what has been measured and tested so far
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		infolog.Println("Interrupted, stopping...")
+		cancel()
+	}()
+
+	// Problems which mean the scan can't usefully continue stop it early, and set the exit code
+	stopCode := exitOK
+	stopMux := sync.Mutex{}
+	stopScan := func(code int, msg string) {
+		errlog.Println(msg)
+		stopMux.Lock()
+		stopCode = code
+		stopMux.Unlock()
+		cancel()
+	}
+
+	// With --strict, problems which would otherwise only be logged stop the scan
+	failStrict := func(code int, err error) {
+		stopScan(code, fmt.Sprintf("Stopping because of --strict: %v", err))
+	}
+
+	// Stop sending requests once the budget is spent, keeping the results of the tests already completed
+	var budget *RequestBudget
+	if *requestBudget > 0 {
+		budget = NewRequestBudget(int64(*requestBudget), func() {
+			stopScan(exitOK, fmt.Sprintf("Stopping after sending %d requests, the --request-budget", budget.Used()))
+		})
+	}
+
+	// Without --drain-on-stop, the tests of a URL are cancelled as soon as it reaches --stop-after
+	var urlContexts *URLContexts
+	if !*drainOnStop {
+		urlContexts = NewURLContexts(ctx)
+	}
+
 	workers := make([]Worker, conf.Workers)
 	errs := make(chan error)
+	hostTimeouts := make(map[string]uint, 0)
+	hostTimeoutsMux := sync.RWMutex{}
 	for i := range workers {
 		workers[i] = Worker{
-			Conf:         conf,
-			Errs:         errs,
-			ErrCounts:    &state.Errors,
-			ErrCountsMux: &state.ErrorsMux,
+			Ctx:             ctx,
+			Conf:            conf,
+			Errs:            errs,
+			ErrCounts:       &state.Errors,
+			ErrCountsMux:    &state.ErrorsMux,
+			Targets:         &targets,
+			TargetsMux:      &targetsMux,
+			HostTimeouts:    &hostTimeouts,
+			HostTimeoutsMux: &hostTimeoutsMux,
+			Resolver:        resolver,
+			Pacer:           pacer,
+			LocalAddrs:      localAddrs,
+			Budget:          budget,
+			URLContexts:     urlContexts,
+			Sampler:         sampler,
+		}
+	}
+
+	// When pipelining, the base requests and tests are sent at the same time, so need their own workers
+	testWorkers := workers
+	if *pipeline {
+		testWorkers = make([]Worker, len(workers))
+		copy(testWorkers, workers)
+	}
+
+	// Name the workers to profile them, telling the base and test workers apart when they are separate
+	var workerProfile *WorkerProfile
+	if *profileWorkers {
+		names := make([]string, 0, len(workers)+len(testWorkers))
+		for i := range workers {
+			workers[i].Name = fmt.Sprint(i)
+			if *pipeline {
+				workers[i].Name = fmt.Sprintf("base-%d", i)
+				testWorkers[i].Name = fmt.Sprintf("test-%d", i)
+			}
+			names = append(names, workers[i].Name)
+		}
+		if *pipeline {
+			for i := range testWorkers {
+				names = append(names, testWorkers[i].Name)
+			}
+		}
+		workerProfile = NewWorkerProfile(names)
+		for i := range workers {
+			workers[i].Profile = workerProfile
+			testWorkers[i].Profile = workerProfile
 		}
 	}
 
 	// Periodically save the state file
-	go func() {
-		ticker := time.NewTicker(conf.SaveEvery)
-		for {
-			<-ticker.C
-			err := saveState(&state, stateFile)
-			if err != nil {
-				errlog.Println(err)
+	if stateFile != nil {
+		go func() {
+			ticker := time.NewTicker(conf.SaveEvery)
+			for {
+				<-ticker.C
+				err := saveState(&state, stateFile)
+				if err != nil {
+					errlog.Println(err)
+				}
 			}
+		}()
+	}
+
+	// The tests waiting to be sent, which are chosen from at random, and the results of those completed
+	queue := NewTestQueue()
+	results := NewResultAggregator(conf.MinSeverity, conf.MinConfidence, int(*limitPerMutation), *hideSuspect)
+	total, completed := 0, 0
+	completedMux := sync.RWMutex{}
+
+	// queueTests adds the tests against the given URLs which have a base time to the queue
+	queueTests := func(urls []*url.URL) {
+		targetsMux.RLock()
+		state.BaseMux.RLock()
+		state.ResultsMux.RLock()
+		tests := excludeTests(generateTests(conf, urls, targets, &state, true), skipSafe)
+		state.ResultsMux.RUnlock()
+		state.BaseMux.RUnlock()
+		targetsMux.RUnlock()
+
+		queue.Push(tests)
+		results.AddTests(len(tests))
+		if status != nil {
+			status.AddTests(len(tests))
 		}
-	}()
+		completedMux.Lock()
+		total += len(tests)
+		completedMux.Unlock()
+	}
+
+	// shareTarget gives the URL a target was redirected to the same overrides as the target, without its
+	// credentials if the redirect was to another host, unless it was given as a target itself. Being a target also
+	// means it's skipped as a duplicate if it's given later
+	shareTarget := func(from *url.URL, to *url.URL, target Target) {
+		targetsMux.Lock()
+		if _, ok := targets[to.String()]; !ok {
+			targets[to.String()] = redirectTarget(from, to, target)
+		}
+		targetsMux.Unlock()
+	}
+
+	// skipRedirect returns whether a URL which was redirected to another shouldn't be tested, logging why. The
+	// scope, denylist, and --dedupe-ip are checked when the input is read, so the URL redirected to is checked
+	// against them again, and against the URL's own host if there is no scope
+	skipRedirect := func(from *url.URL, to *url.URL) bool {
+		if reason := redirectSkipReason(from, to, conf); reason != "" {
+			infolog.Printf("Skipping %s: redirected to %s URL %s\n", from, reason, to)
+			return true
+		}
+		if first := duplicateServer(ctx, deduper, to, errlog); first != nil && first.String() != from.String() {
+			infolog.Printf("Skipping %s: redirected to %s, the same server as %s\n", from, to, first)
+			return true
+		}
+
+		return false
+	}
 
 	// Fill in any missing entries in the base file
-	fmt.Println("Getting missing base times...")
+	if conf.FixedTimeout == 0 {
+		infolog.Println("Getting missing base times...")
+	}
 	baseUrls := make(chan *url.URL)
 	baseResults := make(chan BaseResult)
 	baseWg := sync.WaitGroup{}
@@ -343,29 +1288,89 @@ func main() {
 		go workers[i].BaseTimes(baseUrls, baseResults, baseWg.Done)
 	}
 
+	// The number of URLs with a base time already in the base file, and the number sent to be measured
+	reused, queued := 0, 0
+
 	// Read from stdin
 	go func() {
 		var bar *progressbar.ProgressBar
 		if conf.ShowProgress {
 			bar = progressbar.Default(-1)
 		}
-		scanner := bufio.NewScanner(os.Stdin)
+		scanner := bufio.NewScanner(stdin)
 		for scanner.Scan() {
-			urlStr := scanner.Text()
-			u, err := url.Parse(urlStr)
+			target, targetUrls, err := parseTarget(scanner.Text(), *targetsFormat, *strict)
 			if err != nil {
+				if *strict {
+					failStrict(exitUsage, err)
+					break
+				}
 				errlog.Println(err)
+				continue
 			}
-			state.BaseMux.RLock()
-			_, exists := state.Base[u.String()]
-			state.BaseMux.RUnlock()
-			if !exists {
-				baseUrls <- u
-				if conf.ShowProgress {
-					bar.Add(1)
+			for _, u := range targetUrls {
+				if *normalizeSlash {
+					// URLs collapsed into one which is already a target would repeat its base request and tests
+					normalizeTrailingSlash(u)
+					targetsMux.RLock()
+					_, seen := targets[u.String()]
+					targetsMux.RUnlock()
+					if seen {
+						infolog.Printf("Skipping %s: already a target once its trailing slash is removed\n", u)
+						continue
+					}
+				}
+				if reason := skipReason(u, conf); reason != "" {
+					infolog.Printf("Skipping %s URL: %s\n", reason, u)
+					continue
+				}
+				if first := duplicateServer(ctx, deduper, u, errlog); first != nil {
+					infolog.Printf("Skipping %s: same server as %s\n", u, first)
+					continue
+				}
+				targetsMux.Lock()
+				targets[u.String()] = target
+				targetsMux.Unlock()
+
+				// Stale base times are removed rather than left to be used if the URL can't be measured again
+				state.BaseMux.Lock()
+				_, exists := state.Base[u.String()]
+				if exists && *refreshBase {
+					delete(state.Base, u.String())
+					delete(state.Redirects, u.String())
+					exists = false
+				}
+				redirect := state.Redirects[u.String()]
+				state.BaseMux.Unlock()
+				if exists && redirect != "" && conf.FollowRedirects {
+					final, err := url.Parse(redirect)
+					if err != nil || skipRedirect(u, final) {
+						continue
+					}
+					shareTarget(u, final, target)
+				}
+				if exists {
+					reused++
+				} else if conf.FixedTimeout == 0 {
+					select {
+					case baseUrls <- u:
+					case <-ctx.Done():
+						close(baseUrls)
+						return
+					}
+					queued++
+					if conf.ShowProgress {
+						bar.Add(1)
+					}
+				}
+				urls = append(urls, u)
+				results.AddURL(u)
+
+				// URLs which don't need a base time measuring can be tested straight away
+				if *pipeline && (exists || conf.FixedTimeout != 0) {
+					queueTests([]*url.URL{u})
 				}
 			}
-			urls = append(urls, u)
 		}
 		close(baseUrls)
 	}()
@@ -378,96 +1383,215 @@ func main() {
 
 	// Handle errors
 	go func() {
+		el := errorLogger{Log: errlog}
+		count := uint(0)
 		for err := range errs {
-			errlog.Println(err)
+			if err == context.Canceled {
+				continue
+			}
+			el.Println(err)
+
+			// So many errors across the scan suggest the network or configuration is at fault, not the targets
+			count++
+			if *maxTotalErrors > 0 && count == *maxTotalErrors {
+				stopScan(exitError, fmt.Sprintf("Stopping after %d errors, which suggests a problem with the network, proxy, or options rather than the targets", count))
+			}
 		}
 	}()
 
-	for r := range baseResults {
-		state.BaseMux.Lock()
-		state.Base[r.Url.String()] = r.Time
-		state.BaseMux.Unlock()
-		if conf.Verbose {
-			fmt.Printf("%s %d\n", r.Url, r.Time)
+	// Record the base times as they are measured, queueing the tests against each URL straight away if pipelining
+	receiveBase := func() {
+		measured := 0
+		for r := range baseResults {
+			measured++
+
+			// Tests are sent to the URL redirected to, so its host's headers are the ones which matter
+			host := r.Url.Host
+			if r.Final != nil {
+				// Without a base time, the URL isn't tested
+				if skipRedirect(r.Url, r.Final) {
+					continue
+				}
+				host = r.Final.Host
+				infolog.Printf("Following redirect from %s to %s\n", r.Url, r.Final)
+				targetsMux.RLock()
+				target := targets[r.Url.String()]
+				targetsMux.RUnlock()
+				shareTarget(r.Url, r.Final, target)
+			}
+
+			state.BaseMux.Lock()
+			state.Base[r.Url.String()] = r.Time
+			if r.Final != nil {
+				if state.Redirects == nil {
+					state.Redirects = make(map[string]string, 0)
+				}
+				state.Redirects[r.Url.String()] = r.Final.String()
+			}
+			if len(r.Headers) > 0 {
+				if state.Headers == nil {
+					state.Headers = make(map[string]map[string]string, 0)
+				}
+				state.Headers[host] = r.Headers
+			}
+			state.BaseMux.Unlock()
+			if resultsDB != nil {
+				if err := resultsDB.AddBase(r.Url, r.Time); err != nil {
+					errlog.Println(err)
+				}
+			}
+			if conf.Verbose {
+				fmt.Fprintf(infoOut, "%s %d\n", r.Url, r.Time)
+			}
+			if *pipeline {
+				queueTests([]*url.URL{r.Url})
+			}
+		}
+
+		// The counts are final once the base results are closed, as the URLs have all been read by then
+		if conf.FixedTimeout == 0 {
+			if *noBaseFile {
+				infolog.Printf("Base times: %d measured, %d failed\n", measured, queued-measured)
+			} else {
+				infolog.Printf("Base times: %d reused from %s, %d measured, %d failed\n", reused, conf.StateFilename, measured, queued-measured)
+			}
+			if *strict && queued > measured && ctx.Err() == nil {
+				failStrict(exitError, fmt.Errorf("%d base times couldn't be measured", queued-measured))
+			}
+		}
+
+		// Report the base times of the URLs being scanned
+		if *baseReport != "" {
+			state.BaseMux.RLock()
+			err := writeBaseReport(*baseReport, *baseReportUnit, urls, state.Base)
+			state.BaseMux.RUnlock()
+			if err != nil {
+				errlog.Printf("Failed to write base report: %v\n", err)
+			}
 		}
 	}
 
-	// Now smuggle test
-	fmt.Println("Testing smuggling...")
-
-	// Counts the number of issues found on each host for use with the -x flag
-	vulns := make(map[string]uint, 0)
-	vulnsMux := sync.RWMutex{}
-
-	// Generate a slice of all the tests to choose from at random
-	tests := make([]SmuggleTest, 0)
-	state.ResultsMux.RLock()
-	for _, u := range urls {
-		// We only want to run the tests if we have a base time for this URL
-		if _, ok := state.Base[u.String()]; !ok {
-			continue
-		}
-
-		for m := range conf.Mutations {
-		METHODLOOP:
-			for _, v := range conf.Methods {
-				timeout := state.Base[u.String()] + conf.Delay
-				t := SmuggleTest{
-					Url:      u,
-					Method:   v,
-					Mutation: m,
-					Status:   SAFE,
-					Timeout:  timeout,
-				}
+	if *pipeline {
+		go func() {
+			receiveBase()
+			queue.Close()
+		}()
+	} else {
+		receiveBase()
 
-				// Check the test isn't in the state file, meaning it has already been performed
-				for _, s := range state.Results {
-					if t.Equals(s) {
-						continue METHODLOOP
-					}
+		// If interrupted, save the base times that were measured and stop
+		if ctx.Err() != nil {
+			if stateFile != nil {
+				if err := saveState(&state, stateFile); err != nil {
+					errlog.Println(err)
+					return exitError
 				}
-				tests = append(tests, t)
 			}
+			stopMux.Lock()
+			defer stopMux.Unlock()
+			return stopCode
+		}
+
+		queueTests(urls)
+		queue.Close()
+	}
+
+	// Now smuggle test
+	infolog.Println("Testing smuggling...")
+
+	// Counts the number of issues found on each URL for use with --stop-after
+	findingCounts := NewFindingCounts(conf.StopAfter, urlContexts)
+
+	if status != nil {
+		status.Start()
+	}
+
+	var triage *Triage
+	if *interactive {
+		triage, err = NewTriage(conf)
+		if err != nil {
+			errlog.Printf("--interactive needs a terminal, so findings won't be triaged: %v\n", err)
+		} else {
+			defer triage.Close()
 		}
 	}
-	state.ResultsMux.RUnlock()
+
+	// Periodically show the throughput and estimated time remaining
+	if conf.ShowETA {
+		start := time.Now()
+		go func() {
+			ticker := time.NewTicker(10 * time.Second)
+			for {
+				<-ticker.C
+				completedMux.RLock()
+				done, all := completed, total
+				completedMux.RUnlock()
+				elapsed := time.Since(start)
+				infolog.Printf("Completed %d/%d tests (%.2f tests/s), ETA: %s\n", done, all, throughput(done, elapsed), eta(done, all, elapsed))
+			}
+		}()
+	}
+
+	// The heartbeat goes to stderr so that it shows even when stdout is redirected, and reports the rate over
+	// the last interval, which shows a stalled scan sooner than the overall rate
+	if *heartbeat > 0 && !*quiet {
+		hblog := newLogger(os.Stderr, "INFO", *logFormat)
+		go func() {
+			ticker := time.NewTicker(*heartbeat)
+			last := 0
+			for {
+				<-ticker.C
+				completedMux.RLock()
+				done, all := completed, total
+				completedMux.RUnlock()
+				hblog.Printf("Still scanning: %d/%d tests completed (%.2f tests/s)\n", done, all, throughput(done-last, *heartbeat))
+				last = done
+			}
+		}()
+	}
 
 	// Start the workers
 	testsChan := make(chan SmuggleTest)
 	testResults := make(chan SmuggleTest)
 	testsWg := sync.WaitGroup{}
 	testsWg.Add(conf.Workers)
-	for i := range workers {
-		go workers[i].SmuggleTest(testsChan, testResults, testsWg.Done)
+	for i := range testWorkers {
+		go testWorkers[i].SmuggleTest(testsChan, testResults, testsWg.Done)
 	}
 
 	// Send tests
 	go func() {
+		// The number of tests isn't known up front when pipelining
 		var bar *progressbar.ProgressBar
-		if conf.ShowProgress {
-			bar = progressbar.Default(int64(len(tests)))
+		if conf.ShowProgress && *pipeline {
+			bar = progressbar.Default(-1)
+		} else if conf.ShowProgress {
+			bar = progressbar.Default(int64(total))
 		}
 
-		rand.Seed(time.Now().Unix())
-		for len(tests) > 0 {
-			i := rand.Intn(len(tests))
-			t := tests[i]
-			tests = append(tests[:i], tests[i+1:]...)
-			send := true
-			if conf.StopAfter > 0 {
-				vulnsMux.RLock()
-				send = vulns[t.Url.String()] < conf.StopAfter
-				vulnsMux.RUnlock()
+		rand.Seed(conf.Seed)
+		for {
+			if conf.PauseFile != "" {
+				waitWhilePaused(ctx, conf.PauseFile, infolog)
+			}
 
+			t, ok := queue.Next()
+			if !ok {
+				break
 			}
-			if send {
-				testsChan <- t
+			if findingCounts.Open(t.Url.String()) {
+				select {
+				case testsChan <- t:
+				case <-ctx.Done():
+					close(testsChan)
+					return
+				}
 			}
 			if conf.ShowProgress {
 				bar.Add(1)
 			}
 			if conf.Verbose {
-				fmt.Printf("Testing: %s %s %s\n", t.Method, t.Url, t.Mutation)
+				fmt.Fprintf(infoOut, "Testing: %s %s %s\n", t.Method, t.Url, t.Mutation)
 			}
 		}
 		close(testsChan)
@@ -479,28 +1603,159 @@ func main() {
 		close(testResults)
 	}()
 
-	// Receive results
+	// Receive results, with the flags needed to generate PoCs for them
+	pocFlagArgs := pocArgs(flags, conf.Seed)
+	formatOutput := func(t SmuggleTest) string {
+		if *outputFormat != "nuclei" {
+			return formatFinding(t, conf.Tag, *outputFormat)
+		}
+		// Findings without a template are kept as a comment, so the output is still valid YAML
+		tmpl, err := nucleiTemplate(conf, t, conf.Tag)
+		if err != nil {
+			return fmt.Sprintf("---\n# %s (%v)", formatFinding(t, conf.Tag, "text"), err)
+		}
+		return tmpl
+	}
+	state.ResultsMux.Lock()
 	if state.Results == nil {
 		state.Results = make([]SmuggleTest, 0)
 	}
-	for t := range testResults {
+	state.ResultsMux.Unlock()
+	// handleResult records a completed test, and outputs it if it's a reported finding
+	handleResult := func(t SmuggleTest) {
+		state.BaseMux.RLock()
+		t.Headers = state.Headers[t.Url.Host]
+		if m := conf.Mutations[t.Mutation]; m.Fuzzed {
+			t.MutationHeaders = m.String()
+		}
+		// RESET findings can't be reproduced with a PoC, as they don't say which of the tests caused them
+		if t.Status != SAFE && t.Status != RESET {
+			t.PoCCommand = pocCommand(pocFlagArgs, t)
+		}
+		state.BaseMux.RUnlock()
+		t.Suspect = results.Suspect(t, conf.SmugglePrefix != "")
+		if triage != nil && results.Reported(t) {
+			t.Triage = triage.Decide(t, formatFinding(t, conf.Tag, "text"))
+		}
+		reported := results.Add(t)
 		if t.Status != SAFE {
-			reslog.Printf("%s %s %s %s\n", t.Method, t.Url, t.Status, t.Mutation)
-			if conf.StopAfter > 1 {
-				vulnsMux.Lock()
-				vulns[t.Url.String()] += 1
-				vulnsMux.Unlock()
+			if reported {
+				line := formatOutput(t)
+				reslog.Println(line)
+				if hostLogs != nil {
+					if err := hostLogs.Println(t.Url, line); err != nil {
+						errlog.Println(err)
+					}
+				}
+				if resultsDB != nil {
+					if err := resultsDB.AddFinding(t); err != nil {
+						errlog.Println(err)
+					}
+				}
+				if *autoPoC != "" && t.PoCCommand != "" {
+					if err := writePoC(conf, *autoPoC, *pocFormat, t); err != nil {
+						errlog.Printf("Failed to write PoC for %s %s %s %s: %v\n", t.Method, t.Url, t.Status, t.Mutation, err)
+					}
+				}
 			}
 		}
 
 		state.ResultsMux.Lock()
 		state.Results = append(state.Results, t)
 		state.ResultsMux.Unlock()
+
+		completedMux.Lock()
+		completed++
+		completedMux.Unlock()
+		if status != nil {
+			status.Complete(t, reported, conf.Tag)
+		}
+	}
+
+	// With --hide-suspect, findings against a host are held back until it's known whether every test against the
+	// host found a desync. Otherwise they're output straight away, and those already output are marked as suspect
+	// in the saved results once it's known
+	for t := range testResults {
+		// Tests which were already running when their URL reached --stop-after can still find more, which are
+		// dropped without --drain-on-stop like a cancelled test, so the count is exact. Findings are counted as
+		// they arrive, including those held back, so no more tests are sent to a URL which has had enough
+		if t.Status != SAFE {
+			if findingCounts.Surplus(t.Url.String()) {
+				continue
+			}
+			findingCounts.Add(t.Url.String())
+		}
+
+		ready, everyTest := results.Settle(t)
+		if everyTest {
+			infolog.Printf("Every test against %s has found a desync, so its findings are suspect\n", t.Url.Host)
+			state.ResultsMux.Lock()
+			for i, r := range state.Results {
+				if r.Url.Host == t.Url.Host && r.Status != SAFE {
+					state.Results[i].Suspect = addReason(r.Suspect, "every-test")
+				}
+			}
+			state.ResultsMux.Unlock()
+		}
+		for _, r := range ready {
+			handleResult(r)
+		}
+	}
+	for _, r := range results.Flush() {
+		handleResult(r)
+	}
+
+	if *bestPerHost {
+		for _, t := range results.Best() {
+			fmt.Println(formatOutput(t))
+		}
+	}
+
+	// Break the findings down by desync type, so the most common class of bug can be looked at first
+	if classes := results.Classes(); len(classes) > 0 {
+		infolog.Println("Findings by desync type:")
+		for _, c := range classes {
+			hosts := c.Hosts
+			more := ""
+			if len(hosts) > 10 {
+				more = fmt.Sprintf(" and %d more", len(hosts)-10)
+				hosts = hosts[:10]
+			}
+			infolog.Printf("  %s: %d findings on %d hosts (%s%s)\n", c.Status, c.Findings, len(c.Hosts), strings.Join(hosts, ", "), more)
+		}
+	}
+
+	if workerProfile != nil {
+		fmt.Fprintln(infoOut, "Request times by worker:")
+		if err := workerProfile.Write(infoOut); err != nil {
+			errlog.Println(err)
+		}
+	}
+
+	code := exitOK
+	if *summaryJSON != "" {
+		if err := results.Summary().Write(*summaryJSON); err != nil {
+			errlog.Printf("Failed to write summary: %v\n", err)
+			code = exitError
+		}
 	}
 
 	// Save the state one last time
-	err = saveState(&state, stateFile)
-	if err != nil {
-		errlog.Println(err)
+	if stateFile != nil {
+		err = saveState(&state, stateFile)
+		if err != nil {
+			errlog.Println(err)
+			code = exitError
+		}
 	}
+
+	stopMux.Lock()
+	defer stopMux.Unlock()
+	if stopCode != exitOK {
+		return stopCode
+	} else if code == exitOK && *failOnVuln && results.Summary().Findings > 0 {
+		return exitVulnerable
+	}
+
+	return code
 }
@@ -0,0 +1,1264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMainProcess runs smuggles with the arguments in SMUGGLES_TEST_ARGS when the test binary is started by
+// runMain, so that scans can be tested from end to end in their own process
+func TestMainProcess(t *testing.T) {
+	args := os.Getenv("SMUGGLES_TEST_ARGS")
+	if args == "" {
+		return
+	}
+
+	var argv []string
+	if err := json.Unmarshal([]byte(args), &argv); err != nil {
+		os.Exit(100)
+	}
+	os.Exit(run(argv))
+}
+
+// startMain starts smuggles in dir with the given arguments, writing stdin to its standard input. Its standard
+// output and error are written to the returned buffers
+func startMain(t *testing.T, dir string, stdin string, args ...string) (*exec.Cmd, *bytes.Buffer, *bytes.Buffer) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(args)
+
+	cmd := exec.Command(exe, "-test.run=^TestMainProcess$")
+	cmd.Env = append(os.Environ(), "SMUGGLES_TEST_ARGS="+string(b))
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, &stdout, &stderr
+}
+
+// runMain runs smuggles in dir with the given arguments, writing stdin to its standard input, and returns its
+// standard output and error along with its exit code
+func runMain(t *testing.T, dir string, stdin string, args ...string) (string, string, int) {
+	cmd, stdout, stderr := startMain(t, dir, stdin, args...)
+	err := cmd.Wait()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), stderr.String(), exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// tempDir creates a temporary directory which is removed when the test finishes
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "smuggles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// stubServer starts a TCP server on the loopback interface which passes each connection to handle, and returns
+// its URL. The server is closed when the test finishes
+func stubServer(t *testing.T, handle func(conn net.Conn)) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	u, _ := url.Parse("http://" + l.Addr().String() + "/")
+	return u
+}
+
+// readHead reads the request line and headers of a request from r, up to and including the empty line ending
+// them, without parsing them, as test requests aren't always valid HTTP
+func readHead(r *bufio.Reader) (string, error) {
+	var head strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		head.WriteString(line)
+		if err != nil {
+			return head.String(), err
+		} else if line == "\r\n" {
+			return head.String(), nil
+		}
+	}
+}
+
+// stubRequest is a request received by a stub server, and how long its connection was held open for after it
+type stubRequest struct {
+	Head string
+	Held time.Duration
+}
+
+// hangingServer starts a stub server which never answers requests, and records each request's head along with how
+// long the client waited before closing the connection. The requests are returned once n have been received, or
+// after a second if fewer are
+func hangingServer(t *testing.T) (*url.URL, func(n int) []stubRequest) {
+	var mux sync.Mutex
+	requests := make([]stubRequest, 0)
+
+	u := stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		head, err := readHead(r)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		ioutil.ReadAll(r)
+
+		mux.Lock()
+		requests = append(requests, stubRequest{head, time.Since(start)})
+		mux.Unlock()
+	})
+
+	return u, func(n int) []stubRequest {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			mux.Lock()
+			received := len(requests)
+			mux.Unlock()
+			if received >= n {
+				break
+			}
+		}
+
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]stubRequest{}, requests...)
+	}
+}
+
+// respondingServer starts a stub server which answers the first request on each connection with a 200, sending the
+// value of its Host header to hosts
+func respondingServer(t *testing.T, hosts chan<- string) *url.URL {
+	return stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		head, err := readHead(r)
+		if err != nil {
+			return
+		}
+		hosts <- headerValue(head, "Host")
+		respond(conn, 200)
+	})
+}
+
+func TestFixedTimeout(t *testing.T) {
+	dir := tempDir(t)
+	u, requests := hangingServer(t)
+
+	// Base requests are sent with GET, so only testing POST shows whether any were made
+	_, stderr, code := runMain(t, dir, u.String()+"\n", "--fixed-timeout", "300ms", "-m", "POST", "-e", "standard", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// The probe and verification requests of the CL.TE and TE.CL tests all time out
+	rs := requests(4)
+	if len(rs) != 4 {
+		t.Fatalf("got %d requests, want the 4 test requests: %v", len(rs), rs)
+	}
+	for _, r := range rs {
+		if !strings.HasPrefix(r.Head, "POST ") {
+			t.Errorf("got a request other than a test: %q", r.Head)
+		}
+		if r.Held < 250*time.Millisecond || r.Held > 2*time.Second {
+			t.Errorf("request waited %s, want the fixed timeout of 300ms", r.Held)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "smuggles.state")); !os.IsNotExist(err) {
+		t.Errorf("got a base file, want none: %v", err)
+	}
+}
+
+func TestMinSeverity(t *testing.T) {
+	u := zeroCLServer(t, true)
+
+	// 0.CL desyncs are reported with a medium severity
+	tests := []struct {
+		minSeverity string
+		reported    bool
+	}{
+		{"low", true},
+		{"medium", true},
+		{"high", false},
+	}
+
+	for _, test := range tests {
+		stdout, stderr, code := runMain(t, tempDir(t), u.String()+"\n", "--min-severity", test.minSeverity, "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+		if code != 0 {
+			t.Fatalf("exited with %d: %s", code, stderr)
+		}
+
+		finding := fmt.Sprintf("POST %s 0.CL %s medium 0.50", u, ZeroCLMutation)
+		if reported := strings.Contains(stdout, finding); reported != test.reported {
+			t.Errorf("--min-severity %s: got reported %t, want %t: %s", test.minSeverity, reported, test.reported, stdout)
+		}
+	}
+
+	if _, _, code := runMain(t, tempDir(t), "", "--min-severity", "critical"); code == 0 {
+		t.Error("an unrecognised severity was accepted")
+	}
+}
+
+func TestInterruptBaseTiming(t *testing.T) {
+	dir := tempDir(t)
+	hosts := make(chan string, 10)
+	responding := respondingServer(t, hosts)
+	hanging, requests := hangingServer(t)
+
+	// The responding URL is timed first, then the scan is interrupted while waiting for the hanging one
+	cmd, stdout, stderr := startMain(t, dir, responding.String()+"\n"+hanging.String()+"\n", "-c", "1")
+	select {
+	case <-hosts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the responding URL wasn't timed")
+	}
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("got %v, want a clean exit: %s", err, stderr)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to exit after being interrupted", elapsed)
+	}
+	if strings.Contains(stdout.String(), "Testing smuggling") {
+		t.Error("testing started after being interrupted")
+	}
+	if rs := requests(1); len(rs) != 1 {
+		t.Errorf("got %d base requests to the hanging server, want 1", len(rs))
+	}
+
+	// The base time which was measured is saved
+	var state State
+	b, err := ioutil.ReadFile(filepath.Join(dir, "smuggles.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Base[responding.String()]; !ok || len(state.Base) != 1 {
+		t.Errorf("got base times %v, want just the responding URL's", state.Base)
+	}
+}
+
+func TestTimestamped(t *testing.T) {
+	dir := tempDir(t)
+	if _, stderr, code := runMain(t, dir, "", "-O", dir, "--timestamped"); code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	runDirs, _ := filepath.Glob(filepath.Join(dir, "????-??-??T??-??-??"))
+	if len(runDirs) != 1 {
+		t.Fatalf("got run directories %v, want one", runDirs)
+	}
+	if _, err := time.Parse("2006-01-02T15-04-05", filepath.Base(runDirs[0])); err != nil {
+		t.Errorf("got an invalid timestamp: %v", err)
+	}
+
+	// The logs are written to the run's directory, and the base file to the output directory so it can be reused
+	for _, path := range []string{filepath.Join(runDirs[0], "smuggles.log"), filepath.Join(runDirs[0], "smuggles.errors"), filepath.Join(dir, "smuggles.state")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, _, code := runMain(t, dir, "", "--timestamped"); code == 0 {
+		t.Error("--timestamped was accepted without --dir")
+	}
+}
+
+func TestTag(t *testing.T) {
+	u := zeroCLServer(t, true)
+	stdout, stderr, code := runMain(t, tempDir(t), u.String()+"\n", "--tag", "program-1", "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	finding := fmt.Sprintf("POST %s 0.CL %s medium 0.50 program-1\n", u, ZeroCLMutation)
+	if !strings.Contains(stdout, finding) {
+		t.Errorf("got output %q, want the finding tagged: %q", stdout, finding)
+	}
+}
+
+func TestMinConfidence(t *testing.T) {
+	u := zeroCLServer(t, true)
+
+	// 0.CL desyncs are reported with a fixed confidence of 0.5
+	tests := []struct {
+		minConfidence string
+		reported      bool
+	}{
+		{"0", true},
+		{"0.5", true},
+		{"0.6", false},
+	}
+
+	for _, test := range tests {
+		stdout, stderr, code := runMain(t, tempDir(t), u.String()+"\n", "--min-confidence", test.minConfidence, "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+		if code != 0 {
+			t.Fatalf("exited with %d: %s", code, stderr)
+		}
+
+		finding := fmt.Sprintf("POST %s 0.CL %s medium 0.50", u, ZeroCLMutation)
+		if reported := strings.Contains(stdout, finding); reported != test.reported {
+			t.Errorf("--min-confidence %s: got reported %t, want %t: %s", test.minConfidence, reported, test.reported, stdout)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir := tempDir(t)
+	socket := filepath.Join(dir, "smuggles.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	hosts := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if head, err := readHead(bufio.NewReader(conn)); err == nil {
+					hosts <- headerValue(head, "Host")
+					respond(conn, 200)
+				}
+			}()
+		}
+	}()
+
+	// The host doesn't resolve, so the scan can only reach the stub through the socket
+	_, stderr, code := runMain(t, dir, "http://smuggles.invalid/\n", "--unix", socket, "--fixed-timeout", "1s", "-m", "POST", "-e", "standard", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	close(hosts)
+	tested := 0
+	for host := range hosts {
+		if host != "smuggles.invalid" {
+			t.Errorf("got Host header %q, want the URL's host", host)
+		}
+		tested++
+	}
+	if tested != 2 {
+		t.Errorf("got %d requests over the socket, want 2: %s", tested, stderr)
+	}
+}
+
+func TestPauseFile(t *testing.T) {
+	dir := tempDir(t)
+	pauseFile := filepath.Join(dir, "pause")
+	if err := ioutil.WriteFile(pauseFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := make(chan string, 10)
+	u := respondingServer(t, hosts)
+	cmd, stdout, stderr := startMain(t, dir, u.String()+"\n", "--pause-file", pauseFile, "--fixed-timeout", "1s", "-m", "POST", "-e", "standard", "-c", "1")
+
+	// No tests are started while the pause file exists
+	time.Sleep(1500 * time.Millisecond)
+	if len(hosts) != 0 {
+		t.Errorf("got %d requests while paused", len(hosts))
+	}
+
+	// The tests resume once it's removed
+	if err := os.Remove(pauseFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("got %v: %s", err, stderr)
+	}
+	if len(hosts) != 2 {
+		t.Errorf("got %d requests after resuming, want 2", len(hosts))
+	}
+	if !strings.Contains(stdout.String(), "Pausing") || !strings.Contains(stdout.String(), "Resuming") {
+		t.Errorf("got output %q, want the scan to be paused and resumed", stdout)
+	}
+}
+
+func TestMutationLimit(t *testing.T) {
+	hosts := make(chan string, 100)
+	u := respondingServer(t, hosts)
+	_, stderr, code := runMain(t, tempDir(t), u.String()+"\n", "--mutation-limit", "3", "--seed", "1", "--fixed-timeout", "1s", "-m", "POST", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Each mutation is tested with a CL.TE and a TE.CL request
+	if len(hosts) != 6 {
+		t.Errorf("got %d requests, want 2 for each of the 3 mutations", len(hosts))
+	}
+}
+
+func TestCountOnly(t *testing.T) {
+	dir := tempDir(t)
+	ioutil.WriteFile(filepath.Join(dir, "denylist"), []byte("denied.example.com\n"), 0644)
+	stdin := "https://a.example.com/\nhttps://b.example.com/\nhttps://denied.example.com/\n"
+	args := []string{"--count-only", "--denylist", "denylist", "-m", "GET", "-m", "POST", "-e", "standard", "-e", "cl-plus"}
+
+	// 2 URLs, each tested with 2 methods and 2 mutations
+	stdout, stderr, code := runMain(t, dir, stdin, args...)
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Base requests: 2\nSmuggling tests: 8\n") {
+		t.Errorf("got output %q, want 2 base requests and 8 tests", stdout)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "smuggles.state")); !os.IsNotExist(err) {
+		t.Errorf("got a base file, want none: %v", err)
+	}
+
+	// URLs with a base time in the base file don't need measuring again
+	state := `{"base": {"https://a.example.com/": 1000000}, "results": [], "errors": {}}`
+	ioutil.WriteFile(filepath.Join(dir, "smuggles.state"), []byte(state), 0644)
+	stdout, _, _ = runMain(t, dir, stdin, args...)
+	if !strings.Contains(stdout, "Base requests: 1\nSmuggling tests: 8\n") {
+		t.Errorf("got output %q with a base file, want 1 base request and 8 tests", stdout)
+	}
+
+	// No base requests are needed with a fixed timeout
+	stdout, _, _ = runMain(t, dir, stdin, append(args, "--fixed-timeout", "1s")...)
+	if !strings.Contains(stdout, "Base requests: 0\nSmuggling tests: 8\n") {
+		t.Errorf("got output %q with a fixed timeout, want no base requests and 8 tests", stdout)
+	}
+}
+
+func TestSkipSafeLog(t *testing.T) {
+	dir := tempDir(t)
+	a, _ := url.Parse("https://a.example.com/")
+	b, _ := url.Parse("https://b.example.com/")
+	prev := State{Results: []SmuggleTest{
+		{Url: a, Method: "GET", Mutation: "standard", Status: SAFE},
+		{Url: a, Method: "POST", Mutation: "standard", Status: SAFE},
+		{Url: b, Method: "GET", Mutation: "cl-plus", Status: SAFE},
+		{Url: b, Method: "POST", Mutation: "cl-plus", Status: CLTE},
+	}}
+	j, _ := json.Marshal(&prev)
+	ioutil.WriteFile(filepath.Join(dir, "prev.state"), j, 0644)
+
+	// The 3 safe tests are skipped, while the finding is tested again
+	stdin := a.String() + "\n" + b.String() + "\n"
+	stdout, stderr, code := runMain(t, dir, stdin, "--count-only", "--skip-safe-log", "prev.state", "--fixed-timeout", "1s", "-m", "GET", "-m", "POST", "-e", "standard", "-e", "cl-plus")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Smuggling tests: 5\n") {
+		t.Errorf("got output %q, want 5 tests", stdout)
+	}
+
+	if _, _, code := runMain(t, dir, stdin, "--count-only", "--skip-safe-log", "missing.state"); code == 0 {
+		t.Error("a missing safe log was accepted")
+	}
+}
+
+func TestSplitOutput(t *testing.T) {
+	dir := tempDir(t)
+	hosts := []*url.URL{zeroCLServer(t, true), zeroCLServer(t, true)}
+	stdin := hosts[0].String() + "\n" + hosts[1].String() + "\n"
+	_, stderr, code := runMain(t, dir, stdin, "--split-output", "hosts", "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Each host's file has only that host's finding
+	files, _ := filepath.Glob(filepath.Join(dir, "hosts", "*"))
+	if len(files) != 2 {
+		t.Errorf("got files %v, want one for each host", files)
+	}
+	for _, u := range hosts {
+		filename := filepath.Join(dir, "hosts", "127.0.0.1_"+u.Port()+".log")
+		want := fmt.Sprintf("POST %s 0.CL %s medium 0.50\n", u, ZeroCLMutation)
+		if got := readFile(t, filename); got != want {
+			t.Errorf("got %q in %s, want %q", got, filename, want)
+		}
+	}
+}
+
+func TestBestPerHost(t *testing.T) {
+	dir := tempDir(t)
+	a, b := zeroCLServer(t, true), zeroCLServer(t, true)
+	stdin := a.String() + "x\n" + a.String() + "y\n" + b.String() + "\n"
+	stdout, stderr, code := runMain(t, dir, stdin, "--best-per-host", "-o", "findings.log", "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Only one finding is output for each host, while the log gets all of them
+	for _, u := range []*url.URL{a, b} {
+		if n := strings.Count(stdout, "POST http://"+u.Host+"/"); n != 1 {
+			t.Errorf("got %d findings for %s, want 1: %s", n, u.Host, stdout)
+		}
+	}
+	if n := strings.Count(readFile(t, filepath.Join(dir, "findings.log")), " 0.CL "); n != 3 {
+		t.Errorf("got %d findings in the log, want 3", n)
+	}
+}
+
+func TestOutputFormatNDJSON(t *testing.T) {
+	dir := tempDir(t)
+	u := zeroCLServer(t, true)
+	stdin := u.String() + "a\n" + u.String() + "b\n"
+	stdout, stderr, code := runMain(t, dir, stdin, "--output-format", "ndjson", "-o", "findings.log", "--tag", "run-1", "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Each line of the log is a complete JSON object on its own
+	lines := strings.Split(strings.TrimSuffix(readFile(t, filepath.Join(dir, "findings.log")), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), lines)
+	}
+	urls := make(map[string]bool)
+	for _, line := range lines {
+		var f map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatalf("line %q isn't a JSON object: %v", line, err)
+		}
+		if f["method"] != "POST" || f["status"] != string(ZEROCL) || f["mutation"] != ZeroCLMutation || f["severity"] != "medium" || f["confidence"] != zeroCLConfidence || f["confirmed"] != false || f["tag"] != "run-1" {
+			t.Errorf("got finding %v", f)
+		}
+		urls[f["url"].(string)] = true
+		if !strings.Contains(stdout, line+"\n") {
+			t.Errorf("got output %q, want it to contain the line %q", stdout, line)
+		}
+	}
+	if !urls[u.String()+"a"] || !urls[u.String()+"b"] {
+		t.Errorf("got findings for %v, want both URLs", urls)
+	}
+
+	if _, _, code := runMain(t, dir, "", "--output-format", "json"); code == 0 {
+		t.Error("an unrecognised output format was accepted")
+	}
+}
+
+func TestCaptureHeaders(t *testing.T) {
+	// A server vulnerable to 0.CL desyncs, which identifies its stack in its response headers
+	u := stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			status := 200
+			if strings.HasPrefix(head, "GET /smuggles404 ") {
+				status = 404
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 %d Status\r\nServer: stub/1.0\r\nVia: 1.1 edge\r\nX-Other: 1\r\nContent-Length: 0\r\n\r\n", status)
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+
+	dir := tempDir(t)
+	_, stderr, code := runMain(t, dir, u.String()+"\n", "--capture-headers", "Server,via,X-Cache", "--output-format", "ndjson", "-o", "findings.log", "--detect-zero-cl", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Only the chosen headers which were present are captured, under the names they were given
+	want := map[string]string{"Server": "stub/1.0", "via": "1.1 edge"}
+	var f finding
+	log := readFile(t, filepath.Join(dir, "findings.log"))
+	if err := json.Unmarshal([]byte(log), &f); err != nil {
+		t.Fatalf("got log %q: %v", log, err)
+	}
+	if !reflect.DeepEqual(f.Headers, want) {
+		t.Errorf("got headers %v in the finding, want %v", f.Headers, want)
+	}
+
+	// They're also kept in the base file
+	var state State
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "smuggles.state"))), &state); err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Headers[u.Host]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got headers %v in the base file, want %v", got, want)
+	}
+}
+
+func TestBaseReused(t *testing.T) {
+	dir := tempDir(t)
+	reusedHosts, missingHosts := make(chan string, 10), make(chan string, 10)
+	reused, missing := respondingServer(t, reusedHosts), respondingServer(t, missingHosts)
+	state := fmt.Sprintf(`{"base": {%q: 1000000}, "results": []}`, reused.String())
+	if err := ioutil.WriteFile(filepath.Join(dir, "smuggles.state"), []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens on port 1, so its base time can't be measured
+	stdin := reused.String() + "\n" + missing.String() + "\nhttp://127.0.0.1:1/\n"
+	stdout, stderr, code := runMain(t, dir, stdin, "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Only the URL missing from the base file is sent a base request
+	if n := len(reusedHosts); n != 0 {
+		t.Errorf("got %d base requests to the URL in the base file, want none", n)
+	}
+	if n := len(missingHosts); n != 1 {
+		t.Errorf("got %d base requests to the URL missing from the base file, want 1", n)
+	}
+	if !strings.Contains(stdout, "Base times: 1 reused from smuggles.state, 1 measured, 1 failed") {
+		t.Errorf("got output %q, want the base time counts", stdout)
+	}
+}
+
+func TestRefreshBase(t *testing.T) {
+	dir := tempDir(t)
+	aHosts, bHosts := make(chan string, 10), make(chan string, 10)
+	a, b := respondingServer(t, aHosts), respondingServer(t, bHosts)
+	stale := time.Hour
+	state := fmt.Sprintf(`{"base": {%q: %d, %q: %d, "http://127.0.0.1:1/": %d, "http://other.example.com/": %d}, "results": []}`, a, stale, b, stale, stale, stale)
+	if err := ioutil.WriteFile(filepath.Join(dir, "smuggles.state"), []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin := a.String() + "\n" + b.String() + "\nhttp://127.0.0.1:1/\n"
+	_, stderr, code := runMain(t, dir, stdin, "--refresh-base", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Every input URL is measured again, and the one which can't be loses its stale time
+	if len(aHosts) != 1 || len(bHosts) != 1 {
+		t.Errorf("got %d and %d base requests, want 1 to each URL", len(aHosts), len(bHosts))
+	}
+	var saved State
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "smuggles.state"))), &saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*url.URL{a, b} {
+		if d, ok := saved.Base[u.String()]; !ok || d == stale {
+			t.Errorf("%s: got base time %v, want it measured again", u, d)
+		}
+	}
+	if _, ok := saved.Base["http://127.0.0.1:1/"]; ok {
+		t.Error("the stale base time of a URL which couldn't be measured was kept")
+	}
+	if saved.Base["http://other.example.com/"] != stale {
+		t.Error("the base time of a URL which wasn't in the input was changed")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	hosts := make(chan string, 10)
+	u := respondingServer(t, hosts)
+	tests := []struct {
+		name  string
+		stdin string
+		args  []string
+	}{
+		{"malformed target", "example.com/\n" + u.String() + "\n", nil},
+		{"malformed target with a fixed timeout", "example.com/\n" + u.String() + "\n", []string{"--fixed-timeout", "1s"}},
+		{"failed base request", "http://127.0.0.1:1/\n" + u.String() + "\n", nil},
+	}
+
+	for _, test := range tests {
+		args := append([]string{"-m", "POST", "-e", "none", "-c", "1"}, test.args...)
+
+		// Without --strict, the problem is only logged
+		if _, stderr, code := runMain(t, tempDir(t), test.stdin, args...); code != 0 {
+			t.Errorf("%s: exited with %d without --strict: %s", test.name, code, stderr)
+		}
+		if _, _, code := runMain(t, tempDir(t), test.stdin, append(args, "--strict")...); code == 0 {
+			t.Errorf("%s: exited with 0 with --strict", test.name)
+		}
+	}
+}
+
+func TestDebugOutput(t *testing.T) {
+	u := stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err == nil {
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nConnection: close\r\n\r\nshort")
+		}
+	})
+	stdout, stderr, code := runMain(t, tempDir(t), u.String()+"\n", "--debug", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// The response is 5 bytes short of its Content-Length
+	size := len("HTTP/1.1 200 OK\r\nContent-Length: 10\r\nConnection: close\r\n\r\nshort")
+	want := fmt.Sprintf("status: 200, size: %d, truncated: true)", size)
+	if !strings.Contains(stdout, "Request to "+u.String()+" took ") || !strings.Contains(stdout, want) {
+		t.Errorf("got output %q, want a debug line ending %q", stdout, want)
+	}
+}
+
+func TestReplayRaw(t *testing.T) {
+	dir := tempDir(t)
+	received := make(chan string, 1)
+	u := stubServer(t, func(conn net.Conn) {
+		head, err := readHead(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		received <- head
+		fmt.Fprint(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 4\r\nConnection: close\r\n\r\nnope")
+	})
+
+	// The request is sent exactly as written, with its odd header intact and nothing added
+	req := "GET /replayed HTTP/1.1\r\nHost: example.com\r\n Transfer-Encoding: chunked\r\n\r\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "request.txt"), []byte(req), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runMain(t, dir, "", "--replay-raw", "request.txt", "--fixed-timeout", "5s", u.String())
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	select {
+	case head := <-received:
+		if head != req {
+			t.Errorf("got request %q, want %q", head, req)
+		}
+	default:
+		t.Fatal("the request wasn't received")
+	}
+	if !strings.Contains(stdout, "(timeout: false, status: 404, size: 68, truncated: false)") {
+		t.Errorf("got output %q, want the response's timing, status and size", stdout)
+	}
+	if !strings.HasSuffix(stdout, "\r\n\r\nnope") {
+		t.Errorf("got output %q, want it to end with the response", stdout)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	scan := []string{"--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1"}
+	tests := []struct {
+		name  string
+		stdin string
+		args  []string
+		want  int
+	}{
+		{"clean scan", zeroCLServer(t, false).String() + "\n", scan, exitOK},
+		{"findings", zeroCLServer(t, true).String() + "\n", scan, exitOK},
+		{"findings with --fail-on-vuln", zeroCLServer(t, true).String() + "\n", append([]string{"--fail-on-vuln"}, scan...), exitVulnerable},
+		{"no findings with --fail-on-vuln", zeroCLServer(t, false).String() + "\n", append([]string{"--fail-on-vuln"}, scan...), exitOK},
+		{"unknown flag", "", []string{"--no-such-flag"}, exitUsage},
+		{"invalid flag value", "", []string{"-c", "many"}, exitUsage},
+		{"invalid option", "", []string{"--output-format", "xml"}, exitUsage},
+		{"tag with whitespace", "", []string{"--tag", "scan 1"}, exitUsage},
+		{"tag which marks findings", "", []string{"--tag", "suspect"}, exitUsage},
+		{"help", "", []string{"-h"}, exitOK},
+		{"unwritable log", zeroCLServer(t, true).String() + "\n", append([]string{"-o", filepath.Join("missing", "findings.log")}, scan...), exitError},
+	}
+
+	for _, test := range tests {
+		_, stderr, code := runMain(t, tempDir(t), test.stdin, test.args...)
+		if code != test.want {
+			t.Errorf("%s: exited with %d, want %d: %s", test.name, code, test.want, stderr)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	dir := tempDir(t)
+	fast := zeroCLServer(t, true)
+
+	// The slow server takes a while to answer its base request, and is safe
+	answered := make(chan bool, 10)
+	slow := stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err == nil {
+			time.Sleep(1500 * time.Millisecond)
+			respond(conn, 200)
+			answered <- true
+		}
+	})
+
+	stdin := slow.String() + "\n" + fast.String() + "\n"
+	cmd, _, stderr := startMain(t, dir, stdin, "--pipeline", "-o", "findings.log", "--detect-zero-cl", "--delay", "1s", "-m", "POST", "-e", "none", "-c", "2")
+	defer cmd.Process.Kill()
+
+	// The fast server's test is performed while the slow server's base time is still being measured
+	want := fmt.Sprintf("POST %s 0.CL %s medium", fast, ZeroCLMutation)
+	found := false
+	for start := time.Now(); time.Since(start) < time.Second && !found; time.Sleep(10 * time.Millisecond) {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "findings.log"))
+		found = strings.Contains(string(b), want)
+	}
+	if !found {
+		t.Fatalf("the finding wasn't logged within a second: %s", stderr)
+	}
+	if len(answered) != 0 {
+		t.Error("the slow server's base request had been answered before the finding")
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v: %s", err, stderr)
+	}
+}
+
+func TestNoBaseFile(t *testing.T) {
+	dir := tempDir(t)
+	u := zeroCLServer(t, true)
+
+	// The base time is still measured and used, but only kept in memory
+	stdout, stderr, code := runMain(t, dir, u.String()+"\n", "--no-base-file", "--detect-zero-cl", "--delay", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if want := fmt.Sprintf("POST %s 0.CL %s medium", u, ZeroCLMutation); !strings.Contains(stdout, want) {
+		t.Errorf("got output %q, want %q", stdout, want)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("got files %v, want none", files)
+	}
+
+	if _, _, code := runMain(t, dir, u.String()+"\n", "--no-base-file", "-b", "base.state"); code != exitUsage {
+		t.Errorf("exited with %d with a base file given, want %d", code, exitUsage)
+	}
+}
+
+func TestConnectionHeader(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"close", "close"},
+		{"keep-alive", "keep-alive"},
+		{"none", ""},
+	}
+
+	for _, test := range tests {
+		// The server only closes the connection when asked to, so other responses must be read without waiting for
+		// it to be closed
+		headers := make(chan string, 10)
+		u := stubServer(t, func(conn net.Conn) {
+			r := bufio.NewReader(conn)
+			for {
+				head, err := readHead(r)
+				if err != nil {
+					return
+				}
+				headers <- headerValue(head, "Connection")
+				respond(conn, 200)
+				if headerValue(head, "Connection") == "close" {
+					return
+				}
+			}
+		})
+
+		_, stderr, code := runMain(t, tempDir(t), u.String()+"\n", "--connection", test.value, "-m", "POST", "-e", "none", "-c", "1")
+		if code != 0 {
+			t.Fatalf("--connection %s: exited with %d: %s", test.value, code, stderr)
+		}
+		if len(headers) == 0 {
+			t.Errorf("--connection %s: got no requests", test.value)
+		}
+		for len(headers) > 0 {
+			if h := <-headers; h != test.want {
+				t.Errorf("--connection %s: got Connection header %q, want %q", test.value, h, test.want)
+			}
+		}
+	}
+
+	if _, _, code := runMain(t, tempDir(t), "", "--connection", "sometimes"); code != exitUsage {
+		t.Errorf("--connection sometimes: exited with %d, want %d", code, exitUsage)
+	}
+}
+
+// shellSplit splits a command line whose arguments are separated by spaces, and may be single quoted or contain
+// characters escaped with a backslash
+func shellSplit(s string) []string {
+	args := make([]string, 0)
+	var arg strings.Builder
+	quoted, escaped, started := false, false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\'':
+			quoted = !quoted
+			started = true
+		case c == '\\' && !quoted:
+			escaped = true
+			started = true
+		case c == ' ' && !quoted:
+			if started {
+				args = append(args, arg.String())
+				arg.Reset()
+				started = false
+			}
+		default:
+			arg.WriteRune(c)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, arg.String())
+	}
+
+	return args
+}
+
+func TestPoCCommand(t *testing.T) {
+	dir := tempDir(t)
+	u := zeroCLServer(t, true)
+	_, stderr, code := runMain(t, dir, u.String()+"\n", "-H", "X-Test: it's", "--output-format", "ndjson", "-o", "findings.log", "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	var f finding
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "findings.log"))), &f); err != nil {
+		t.Fatalf("couldn't read the finding: %v", err)
+	}
+	args := shellSplit(f.PoCCommand)
+	if len(args) < 2 || args[0] != "smuggles" || args[1] != "--poc" {
+		t.Fatalf("got PoC command %q", f.PoCCommand)
+	}
+
+	// The command generates the same PoC as --poc given the finding's flags
+	stdout, stderr, code := runMain(t, dir, "", args[1:]...)
+	if code != 0 {
+		t.Fatalf("%q exited with %d: %s%s", f.PoCCommand, code, stdout, stderr)
+	}
+	stdout2, _, _ := runMain(t, dir, "", "--poc", "-H", "X-Test: it's", "--detect-zero-cl", "POST", u.String(), string(ZEROCL), ZeroCLMutation)
+	if stdout != stdout2 || !strings.Contains(stdout, "X-Test: it's\r\n") {
+		t.Errorf("%q generated %q, want %q", f.PoCCommand, stdout, stdout2)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	u, _ := hangingServer(t)
+	args := []string{"--heartbeat", "100ms", "--fixed-timeout", "300ms", "-m", "POST", "-e", "standard", "-c", "1"}
+
+	// Each request of the single test times out, so the scan runs for over a second without finding anything
+	start := time.Now()
+	_, stderr, code := runMain(t, tempDir(t), u.String()+"\n", args...)
+	elapsed := time.Since(start)
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	n := strings.Count(stderr, "Still scanning: ")
+	if n < 5 || n > int(elapsed/(100*time.Millisecond)) {
+		t.Errorf("got %d heartbeats in %v, want one every 100ms: %s", n, elapsed, stderr)
+	}
+	if !strings.Contains(stderr, "/1 tests completed") {
+		t.Errorf("got no heartbeat with the number of tests: %s", stderr)
+	}
+
+	// --quiet silences them
+	_, stderr, _ = runMain(t, tempDir(t), u.String()+"\n", append(args, "--quiet")...)
+	if strings.Contains(stderr, "Still scanning: ") {
+		t.Errorf("got heartbeats with --quiet: %s", stderr)
+	}
+}
+
+func TestMaxTotalErrors(t *testing.T) {
+	// Every connection is reset without a response, so each base request fails
+	var mux sync.Mutex
+	conns := 0
+	u := stubServer(t, func(conn net.Conn) {
+		mux.Lock()
+		conns++
+		mux.Unlock()
+		readHead(bufio.NewReader(conn))
+		conn.(*net.TCPConn).SetLinger(0)
+	})
+	stdin := ""
+	for i := 0; i < 20; i++ {
+		stdin += fmt.Sprintf("%s%d\n", u, i)
+	}
+
+	_, stderr, code := runMain(t, tempDir(t), stdin, "--max-total-errors", "3", "-m", "POST", "-e", "none", "-c", "1")
+	if code != exitError {
+		t.Errorf("exited with %d, want %d: %s", code, exitError, stderr)
+	}
+	if !strings.Contains(stderr, "Stopping after 3 errors") {
+		t.Errorf("got no message about stopping: %s", stderr)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if conns >= 20 {
+		t.Errorf("got %d connections, want the scan to stop before trying every URL", conns)
+	}
+}
+
+func TestStopAfterHideSuspect(t *testing.T) {
+	// A server vulnerable to 0.CL desyncs, which ignores the Content-Length header of requests
+	var conns int32
+	u := stubServer(t, func(conn net.Conn) {
+		atomic.AddInt32(&conns, 1)
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(head, "GET /smuggles404 ") {
+				respond(conn, 404)
+			} else {
+				respond(conn, 200)
+			}
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+
+	// Each test finds a desync, so is held back by --hide-suspect, but still counts toward --stop-after
+	methods := []string{"POST", "PUT", "PATCH", "DELETE", "OPTIONS", "GET"}
+	args := []string{"--hide-suspect", "--stop-after", "1", "--drain-on-stop=false", "--detect-zero-cl", "--fixed-timeout", "1s", "-e", "none", "-c", "1"}
+	for _, m := range methods {
+		args = append(args, "-m", m)
+	}
+	stdout, stderr, code := runMain(t, tempDir(t), u.String()+"\n", args...)
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if n := strings.Count(stdout, " zero-cl "); n != 1 {
+		t.Errorf("got %d findings, want 1: %s", n, stdout)
+	}
+
+	// Each test makes 2 connections, and at most the test already running when the first finding arrives
+	// follows it
+	if n := atomic.LoadInt32(&conns); n > 4 {
+		t.Errorf("got %d connections, want testing to stop after the first finding", n)
+	}
+}
+
+func TestSeedLogged(t *testing.T) {
+	args := []string{"--count-only", "-m", "GET", "-e", "standard"}
+
+	// A seed of 0 is used as given, rather than replaced with one based on the current time
+	stdout, stderr, code := runMain(t, tempDir(t), "", append(args, "--seed", "0")...)
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Using seed 0\n") {
+		t.Errorf("got output %q, want seed 0 logged", stdout)
+	}
+
+	// A generated seed is logged so the scan can be reproduced
+	stdout, _, _ = runMain(t, tempDir(t), "", args...)
+	if !strings.Contains(stdout, "Using seed ") || strings.Contains(stdout, "Using seed 0\n") {
+		t.Errorf("got output %q, want a generated seed logged", stdout)
+	}
+}
+
+func TestAutoPoC(t *testing.T) {
+	dir := tempDir(t)
+	u := zeroCLServer(t, true)
+	pocDir := filepath.Join(dir, "pocs")
+	_, stderr, code := runMain(t, dir, u.String()+"\n", "--auto-poc", pocDir, "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// The file holds the same PoC as --poc generates
+	name := pocFileName(SmuggleTest{Url: u, Method: "POST", Status: ZEROCL, Mutation: ZeroCLMutation}, "raw")
+	poc := readFile(t, filepath.Join(pocDir, name))
+	want, _, _ := runMain(t, dir, "", "--poc", "--detect-zero-cl", "POST", u.String(), string(ZEROCL), ZeroCLMutation)
+	if poc != want {
+		t.Errorf("got PoC %q, want %q", poc, want)
+	}
+	if files, _ := ioutil.ReadDir(pocDir); len(files) != 1 {
+		t.Errorf("got %d files, want only the finding's PoC", len(files))
+	}
+}
+
+func TestTee(t *testing.T) {
+	dir := tempDir(t)
+	u := zeroCLServer(t, true)
+
+	var mux sync.Mutex
+	posted := make([]string, 0)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mux.Lock()
+		posted = append(posted, string(b))
+		mux.Unlock()
+	}))
+	defer webhook.Close()
+
+	teeFile := filepath.Join(dir, "tee.log")
+	stdout, stderr, code := runMain(t, dir, u.String()+"\n", "-o", "findings.log", "--tee", "stdout,stderr,"+teeFile+","+webhook.URL, "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// The finding reaches every destination once, including the standard output it goes to anyway
+	want := fmt.Sprintf("POST %s 0.CL %s medium", u, ZeroCLMutation)
+	mux.Lock()
+	defer mux.Unlock()
+	outputs := map[string]string{
+		"log file": readFile(t, filepath.Join(dir, "findings.log")),
+		"stdout":   stdout,
+		"stderr":   stderr,
+		"tee file": readFile(t, teeFile),
+		"webhook":  strings.Join(posted, "\n"),
+	}
+	for name, out := range outputs {
+		if n := strings.Count(out, want); n != 1 {
+			t.Errorf("%s: got the finding %d times, want once: %q", name, n, out)
+		}
+	}
+}
+
+func TestStdoutOnlyFindings(t *testing.T) {
+	u := zeroCLServer(t, true)
+	stdin := u.String() + "\nhttp://127.0.0.1:1/\n"
+	args := []string{"--detect-zero-cl", "-m", "POST", "-e", "none", "-c", "1", "-v"}
+	want := fmt.Sprintf("POST %s 0.CL %s medium", u, ZeroCLMutation)
+
+	// By default, operational messages are mixed in with the findings
+	stdout, _, _ := runMain(t, tempDir(t), stdin, args...)
+	if !strings.Contains(stdout, "Getting missing base times...") {
+		t.Errorf("got stdout %q, want it to include operational messages", stdout)
+	}
+
+	stdout, stderr, code := runMain(t, tempDir(t), stdin, append(args, "--output-stdout-only-findings")...)
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], want) {
+		t.Errorf("got stdout %q, want only the finding", stdout)
+	}
+	for _, s := range []string{"Getting missing base times...", "Testing: POST " + u.String()} {
+		if !strings.Contains(stderr, s) {
+			t.Errorf("got stderr %q, want it to include %q", stderr, s)
+		}
+	}
+
+	// Startup failures aren't findings either
+	dir := tempDir(t)
+	stdout, stderr, code = runMain(t, dir, stdin, "--output-stdout-only-findings", "--base", dir)
+	if code != exitError || stdout != "" || !strings.Contains(stderr, "Failed to") {
+		t.Errorf("got exit code %d, stdout %q, and stderr %q for a base file which can't be opened, want the error on stderr only", code, stdout, stderr)
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	var mux sync.Mutex
+	requests := 0
+	u := stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err == nil {
+			mux.Lock()
+			requests++
+			mux.Unlock()
+			respond(conn, 200)
+		}
+	})
+	stdin := ""
+	for i := 0; i < 20; i++ {
+		stdin += fmt.Sprintf("%s%d\n", u, i)
+	}
+
+	_, stderr, code := runMain(t, tempDir(t), stdin, "--request-budget", "5", "-m", "POST", "-e", "standard", "-c", "4")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stderr, "Stopping after sending 5 requests") {
+		t.Errorf("got no message about the budget: %s", stderr)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if requests == 0 || requests > 5 {
+		t.Errorf("got %d requests, want no more than the budget of 5", requests)
+	}
+}
+
+func TestBaseStdin(t *testing.T) {
+	var mux sync.Mutex
+	baseRequests := 0
+	u := stubServer(t, func(conn net.Conn) {
+		head, err := readHead(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		// Only the base request is sent without a Transfer-Encoding header
+		if headerValue(head, "Transfer-Encoding") == "" {
+			mux.Lock()
+			baseRequests++
+			mux.Unlock()
+		}
+		respond(conn, 200)
+	})
+
+	tests := []struct {
+		name  string
+		stdin string
+		want  int
+	}{
+		{"base time given", fmt.Sprintf("{\"base\": {%q: 100000000}}\n%s\n", u, u), 0},
+		{"base time of another URL given", fmt.Sprintf("{\"base\": {\"http://example.com/\": 100000000}}\n%s\n", u), 1},
+	}
+	for _, test := range tests {
+		mux.Lock()
+		baseRequests = 0
+		mux.Unlock()
+
+		dir := tempDir(t)
+		_, stderr, code := runMain(t, dir, test.stdin, "--base", "-", "-m", "POST", "-e", "standard", "-c", "1")
+		if code != 0 {
+			t.Fatalf("%s: exited with %d: %s", test.name, code, stderr)
+		}
+		mux.Lock()
+		if baseRequests != test.want {
+			t.Errorf("%s: got %d base requests, want %d", test.name, baseRequests, test.want)
+		}
+		mux.Unlock()
+
+		// The shared base file isn't written to
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Errorf("%s: got files %v written, want none", test.name, files)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+)
+
+// readMutations reads a set of mutations from a JSON file, which holds an object of mutations indexed by name.
+// Each mutation is an object with any of the TE, CL, LateTE, Terminator, ChunkExt, and TimeoutMultiplier fields
+// of a Mutation
+func readMutations(path string) (map[string]Mutation, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Misspelt fields would otherwise be silently ignored, making the mutation look unchanged
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var mutations map[string]Mutation
+	if err := dec.Decode(&mutations); err != nil {
+		return nil, err
+	}
+
+	return mutations, nil
+}
+
+// MutationDiff is how a set of mutations differs from another, by the names of the mutations which were added,
+// removed, or have changed headers, each sorted
+type MutationDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// diffMutations returns how the mutations in other differ from those in base. A mutation has changed if the
+// headers it sends differ, so the timeout multiplier isn't compared
+func diffMutations(base map[string]Mutation, other map[string]Mutation) MutationDiff {
+	diff := MutationDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for name, m := range other {
+		if b, ok := base[name]; !ok {
+			diff.Added = append(diff.Added, name)
+		} else if b.String() != m.String() {
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range base {
+		if _, ok := other[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
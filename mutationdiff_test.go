@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffMutations(t *testing.T) {
+	base := generateMutations()
+	other := make(map[string]Mutation, len(base))
+	for name, m := range base {
+		other[name] = m
+	}
+
+	other["custom"] = Mutation{TE: "Transfer-Encoding: chunked, identity"}
+	delete(other, "standard")
+	delete(other, "lineprefix-tab")
+	m := other["nospace"]
+	m.TE = "Transfer-Encoding:  chunked"
+	other["nospace"] = m
+	// Only the headers sent are compared
+	m = other["colon-post-tab"]
+	m.TimeoutMultiplier = 3
+	other["colon-post-tab"] = m
+
+	want := MutationDiff{
+		Added:   []string{"custom"},
+		Removed: []string{"lineprefix-tab", "standard"},
+		Changed: []string{"nospace"},
+	}
+	if got := diffMutations(base, other); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if got := diffMutations(base, base); len(got.Added)+len(got.Removed)+len(got.Changed) != 0 {
+		t.Errorf("got %+v comparing the mutations with themselves", got)
+	}
+}
+
+func TestReadMutations(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "mutations.json")
+	if err := ioutil.WriteFile(path, []byte(`{"custom": {"TE": "Transfer-Encoding: chunked", "CL": "Content-Length: %d"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mutations, err := readMutations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Mutation{"custom": {TE: "Transfer-Encoding: chunked", CL: "Content-Length: %d"}}
+	if !reflect.DeepEqual(mutations, want) {
+		t.Errorf("got %+v, want %+v", mutations, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"custom": {"Te": "Transfer-Encoding: chunked", "Cl": "Content-Length: %d"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMutations(path); err != nil {
+		t.Errorf("field names differing in case gave an error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"custom": {"TransferEncoding": "Transfer-Encoding: chunked"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMutations(path); err == nil {
+		t.Error("no error for an unknown field")
+	}
+}
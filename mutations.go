@@ -1,9 +1,453 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
 
-// generateMutations returns a map of TE header mutations, indexed by name
-func generateMutations() map[string]string {
+// ZeroCLMutation is the name of the pseudo-mutation used with --detect-zero-cl to test for 0.CL desyncs, which
+// don't make use of a Transfer-Encoding header
+const ZeroCLMutation = "zero-cl"
+
+// PipelineMutation is the name of the pseudo-mutation used with --detect-pipelining to test whether pipelined
+// responses are mis-associated, which doesn't make use of a Transfer-Encoding header either
+const PipelineMutation = "pipeline"
+
+// DuplicateHostMutation and DuplicateHostReversedMutation are the names of the pseudo-mutations used with
+// --detect-host-routing to test whether a request with two Host headers is routed by the second. The first sends
+// the target's own host followed by another, and the second sends them the other way round
+const (
+	DuplicateHostMutation         = "duplicate-host"
+	DuplicateHostReversedMutation = "duplicate-host-reversed"
+)
+
+// duplicateHosts returns the hosts to send Host headers for, in order, to test u with one of the duplicate Host
+// header pseudo-mutations
+func duplicateHosts(mutation string, u *url.URL) []string {
+	if mutation == DuplicateHostReversedMutation {
+		return []string{routingHost, u.Hostname()}
+	}
+
+	return []string{u.Hostname(), routingHost}
+}
+
+// Mutation describes how the framing headers of a test request are altered in an attempt to cause a desync
+type Mutation struct {
+	// The Transfer-Encoding header, or headers, to send
+	TE string
+
+	// A format string taking the length of the body, used in place of the standard Content-Length header
+	CL string
+
+	// A further Transfer-Encoding header, or headers, sent after all other headers rather than alongside TE
+	LateTE string
+
+	// The bytes used to terminate the chunked body of TE.CL tests in place of the standard terminating chunk
+	Terminator string
+
+	// An extension added to the size line of each chunk of the body, including the standard terminating chunk
+	ChunkExt string
+
+	// The factor to multiply the timeout of tests using the mutation by. 0 is treated as 1
+	TimeoutMultiplier float64
+
+	// Whether the mutation was randomly generated with --fuzz-mutations, so its headers should be recorded with
+	// findings to reproduce them
+	Fuzzed bool
+}
+
+// timeoutMultiplier returns the factor to multiply the timeout of tests using the mutation by
+func (m Mutation) timeoutMultiplier() float64 {
+	if m.TimeoutMultiplier <= 0 {
+		return 1
+	}
+
+	return m.TimeoutMultiplier
+}
+
+// timeout returns the timeout of a test using the mutation, given the timeout for its URL
+func (m Mutation) timeout(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * m.timeoutMultiplier())
+}
+
+// terminator returns the bytes which terminate the chunked body of TE.CL tests
+func (m Mutation) terminator() string {
+	if m.Terminator == "" {
+		return "0" + m.ChunkExt + "\r\n\r\n"
+	}
+
+	return m.Terminator
+}
+
+// contentLength returns the Content-Length header line for a body of n bytes
+func (m Mutation) contentLength(n int, opts RequestOptions) string {
+	if m.CL == "" {
+		return opts.header("Content-Length", fmt.Sprint(n))
+	}
+
+	return fmt.Sprintf(m.CL, n) + "\r\n"
+}
+
+// lateHeaders returns the header lines to send after all other headers
+func (m Mutation) lateHeaders() string {
+	if m.LateTE == "" {
+		return ""
+	}
+
+	return m.LateTE + "\r\n"
+}
+
+// String returns the mutated headers, with the Content-Length header left as its format string, followed by
+// the chunked body terminator if it is mutated
+func (m Mutation) String() string {
+	s := m.TE
+	if m.CL != "" {
+		s += "\r\n" + m.CL
+	}
+	if m.LateTE != "" {
+		s += "\r\n" + m.LateTE
+	}
+	if m.Terminator != "" || m.ChunkExt != "" {
+		s += "\r\n\r\n" + m.terminator()
+	}
+
+	return s
+}
+
+// quickMutations are the mutations in the quick profile, which are those most commonly found to cause desyncs
+var quickMutations = map[string]bool{
+	"standard":            true,
+	"nospace":             true,
+	"lineprefix-space":    true,
+	"lineprefix-tab":      true,
+	"line-appendix-space": true,
+	"line-appendix-tab":   true,
+	"colon-post-tab":      true,
+	"colon-wrapped-space": true,
+	"uppercase":           true,
+	"multiple-ch_id":      true,
+	"multiple-id_ch":      true,
+	"comma-ch_id":         true,
+	"comma-id_ch":         true,
+	"single-qoute":        true,
+	"double-qoute":        true,
+	"cutoff":              true,
+}
+
+// mutationProfiles are the named sets of mutations which can be enabled with --profile, each given as a function
+// returning whether a mutation is in the set
+var mutationProfiles = map[string]func(name string, m Mutation) bool{
+	"quick": func(name string, m Mutation) bool {
+		return quickMutations[name]
+	},
+	"thorough": func(name string, m Mutation) bool {
+		return true
+	},
+	// Mutations of the Transfer-Encoding header alone, sent with a standard Content-Length and body
+	"te-only": func(name string, m Mutation) bool {
+		return m.CL == "" && m.Terminator == "" && m.ChunkExt == ""
+	},
+	// Mutations of the Content-Length header alone
+	"cl-only": func(name string, m Mutation) bool {
+		return m.CL != "" && m.TE == "Transfer-Encoding: chunked"
+	},
+	"obs-fold": func(name string, m Mutation) bool {
+		return strings.HasPrefix(name, "obs-fold-")
+	},
+}
+
+// limitMutations returns a random selection of up to limit of the given mutations' names to test against a
+// host. The selection depends only on the seed and the host, so is the same for all URLs on a host
+func limitMutations(mutations map[string]Mutation, host string, limit int, seed int64) map[string]bool {
+	names := make([]string, 0, len(mutations))
+	for k := range mutations {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	r := rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+	r.Shuffle(len(names), func(i, j int) {
+		names[i], names[j] = names[j], names[i]
+	})
+
+	if limit > len(names) {
+		limit = len(names)
+	}
+	selected := make(map[string]bool, limit)
+	for _, k := range names[:limit] {
+		selected[k] = true
+	}
+
+	return selected
+}
+
+// generateMutations returns a map of all mutations, indexed by name
+func generateMutations() map[string]Mutation {
+	m := make(map[string]Mutation, 0)
+	for k, te := range generateTEMutations() {
+		m[k] = Mutation{TE: te}
+	}
+
+	// Content-Length mutations are sent alongside a standard Transfer-Encoding header
+	for k, cl := range generateCLMutations() {
+		m[k] = Mutation{TE: "Transfer-Encoding: chunked", CL: cl}
+	}
+
+	for k, v := range generateSplitMutations() {
+		m[k] = v
+	}
+
+	// Terminator mutations are also sent alongside a standard Transfer-Encoding header
+	for k, term := range generateTerminatorMutations() {
+		m[k] = Mutation{TE: "Transfer-Encoding: chunked", Terminator: term}
+	}
+	for k, term := range generateTrailerMutations() {
+		m[k] = Mutation{TE: "Transfer-Encoding: chunked", Terminator: term}
+	}
+
+	for k, v := range generateExoticMutations() {
+		m[k] = v
+	}
+
+	for k, v := range generateObsFoldMutations() {
+		m[k] = v
+	}
+
+	return m
+}
+
+// generateSplitMutations returns a map of mutations which send two conflicting Transfer-Encoding headers
+// separated by the rest of the headers, to probe differences in how multiple headers are merged
+func generateSplitMutations() map[string]Mutation {
+	m := make(map[string]Mutation, 0)
+
+	values := [][]string{
+		{"identity", "id"},
+		{"gzip", "gz"},
+		{"", "empty"},
+	}
+	for _, v := range values {
+		k := fmt.Sprintf("split-ch_%s", v[1])
+		m[k] = Mutation{TE: "Transfer-Encoding: chunked", LateTE: "Transfer-Encoding: " + v[0]}
+		k = fmt.Sprintf("split-%s_ch", v[1])
+		m[k] = Mutation{TE: "Transfer-Encoding: " + v[0], LateTE: "Transfer-Encoding: chunked"}
+	}
+
+	// The value split over the two headers, which only gives chunked if they are concatenated
+	m["split-value"] = Mutation{TE: "Transfer-Encoding: chun", LateTE: "Transfer-Encoding: ked"}
+
+	return m
+}
+
+// generateTerminatorMutations returns a map of obfuscated terminating chunks for chunked bodies, indexed by
+// name. These only affect TE.CL tests, where the frontend has to accept the terminator for a desync to occur
+func generateTerminatorMutations() map[string]string {
+	m := make(map[string]string, 0)
+
+	m["terminator-double-zero"] = "00\r\n\r\n"
+	m["terminator-extension"] = "0;x\r\n\r\n"
+	m["terminator-space"] = "0 \r\n\r\n"
+	m["terminator-lf"] = "0\n\n"
+	m["terminator-no-final-crlf"] = "0\r\n"
+
+	return m
+}
+
+// generateTrailerMutations returns a map of terminating chunks followed by trailer headers, indexed by name. Trailers
+// are parsed by a separate path to other headers, so may be handled inconsistently
+func generateTrailerMutations() map[string]string {
+	m := make(map[string]string, 0)
+
+	m["trailer-header"] = "0\r\nX: y\r\n\r\n"
+	m["trailer-te"] = "0\r\nTransfer-Encoding: chunked\r\n\r\n"
+	m["trailer-cl"] = "0\r\nContent-Length: 0\r\n\r\n"
+	m["trailer-no-colon"] = "0\r\nX\r\n\r\n"
+	m["trailer-folded"] = "0\r\nX: y\r\n z\r\n\r\n"
+
+	return m
+}
+
+// generateExoticMutations returns a map of mutations which give a conflicting length in unusual places, where
+// only some parsers will look for one. These probe rarely tested parser branches, so are grouped under exotic-
+func generateExoticMutations() map[string]Mutation {
+	m := make(map[string]Mutation, 0)
+
+	// A Content-Length of zero given as a chunk extension on every chunk
+	m["exotic-ext-cl"] = Mutation{TE: "Transfer-Encoding: chunked", ChunkExt: ";content-length=0"}
+	m["exotic-ext-cl-quoted"] = Mutation{TE: "Transfer-Encoding: chunked", ChunkExt: ";content-length=\"0\""}
+	m["exotic-ext-cl-space"] = Mutation{TE: "Transfer-Encoding: chunked", ChunkExt: " ; Content-Length = 0"}
+
+	// The Content-Length value folded onto a continuation line, which is lost by parsers that drop folded lines
+	m["exotic-cl-folded"] = Mutation{TE: "Transfer-Encoding: chunked", CL: "Content-Length:\r\n %d"}
+
+	// A second, conflicting Content-Length header after the real one
+	m["exotic-cl-conflict"] = Mutation{TE: "Transfer-Encoding: chunked", CL: "Content-Length: %d\r\nContent-Length: 0"}
+
+	return m
+}
+
+// generateObsFoldMutations returns a map of mutations which fold the Transfer-Encoding or Content-Length header
+// over several lines with obsolete line folding, where a line starting with whitespace continues the previous
+// header's value. Parsers variously join, reject, or ignore folded lines, so they are grouped under obs-fold-
+func generateObsFoldMutations() map[string]Mutation {
+	m := make(map[string]Mutation, 0)
+
+	// The value on a continuation line of its own
+	m["obs-fold-te-value"] = Mutation{TE: "Transfer-Encoding:\r\n chunked"}
+	m["obs-fold-te-value-tab"] = Mutation{TE: "Transfer-Encoding:\r\n\tchunked"}
+
+	// The value split over two lines, which is only chunked if the lines aren't joined
+	m["obs-fold-te-split"] = Mutation{TE: "Transfer-Encoding: chun\r\n ked"}
+
+	// A continuation line after the value, which is only chunked if it's ignored
+	m["obs-fold-te-after"] = Mutation{TE: "Transfer-Encoding: chunked\r\n x"}
+
+	// A second encoding on a continuation line
+	m["obs-fold-te-comma"] = Mutation{TE: "Transfer-Encoding: identity,\r\n chunked"}
+
+	// The whole header folded into the value of the header before it
+	m["obs-fold-te-hidden"] = Mutation{TE: "X: y\r\n Transfer-Encoding: chunked"}
+
+	// The same for the Content-Length header, sent alongside a standard Transfer-Encoding header
+	m["obs-fold-cl-value-tab"] = Mutation{TE: "Transfer-Encoding: chunked", CL: "Content-Length:\r\n\t%d"}
+	m["obs-fold-cl-after"] = Mutation{TE: "Transfer-Encoding: chunked", CL: "Content-Length: %d\r\n 0"}
+	m["obs-fold-cl-hidden"] = Mutation{TE: "Transfer-Encoding: chunked", CL: "X: y\r\n Content-Length: %d"}
+
+	return m
+}
+
+// fuzzWhitespace and fuzzBytes are the characters inserted into headers by generated mutations
+var fuzzWhitespace = []string{" ", "\t", "\x0b", "\x0c"}
+var fuzzBytes = []string{"\x00", "\r", "\n", "\x7f", "\xff", ",", ";", "\"", "'", "-", "_"}
+
+// fuzzHeader is a header line split into the parts which are obfuscated by generated mutations
+type fuzzHeader struct {
+	prefix, name, sep, value, suffix string
+}
+
+// String returns the header line
+func (h fuzzHeader) String() string {
+	return h.prefix + h.name + h.sep + h.value + h.suffix
+}
+
+// generateFuzzMutations returns n randomly obfuscated Transfer-Encoding or Content-Length headers, indexed by a
+// name derived from the headers. The same seed always generates the same mutations
+func generateFuzzMutations(n int, seed int64) map[string]Mutation {
+	r := rand.New(rand.NewSource(seed))
+	m := make(map[string]Mutation, n)
+
+	// Give up eventually, in case there aren't enough distinct obfuscations
+	for attempts := 0; len(m) < n && attempts < n*100; attempts++ {
+		var mutation Mutation
+		if r.Intn(3) == 0 {
+			h := fuzzHeader{name: "Content-Length", sep: ": ", value: "%d"}
+			mutation = Mutation{TE: "Transfer-Encoding: chunked", CL: obfuscateHeader(r, h)}
+			if mutation.CL == h.String() {
+				continue
+			}
+		} else {
+			h := fuzzHeader{name: "Transfer-Encoding", sep: ": ", value: "chunked"}
+			mutation = Mutation{TE: obfuscateHeader(r, h)}
+			if mutation.TE == h.String() {
+				continue
+			}
+		}
+		mutation.Fuzzed = true
+
+		f := fnv.New32a()
+		f.Write([]byte(mutation.String()))
+		m[fmt.Sprintf("fuzz-%08x", f.Sum32())] = mutation
+	}
+
+	return m
+}
+
+// obfuscateHeader returns the header line after between one and three random changes to its casing, whitespace,
+// and bytes. Values containing a format verb are kept intact
+func obfuscateHeader(r *rand.Rand, h fuzzHeader) string {
+	fixedValue := strings.Contains(h.value, "%")
+	for i := r.Intn(3); i >= 0; i-- {
+		switch r.Intn(3) {
+		case 0:
+			if fixedValue || r.Intn(2) == 0 {
+				h.name = randomCase(r, h.name)
+			} else {
+				h.value = randomCase(r, h.value)
+			}
+		case 1:
+			ws := fuzzWhitespace[r.Intn(len(fuzzWhitespace))]
+			switch r.Intn(3) {
+			case 0:
+				h.prefix += ws
+			case 1:
+				h.sep = insertAt(h.sep, r.Intn(len(h.sep)+1), ws)
+			case 2:
+				h.suffix += ws
+			}
+		case 2:
+			b := fuzzBytes[r.Intn(len(fuzzBytes))]
+			if fixedValue || r.Intn(2) == 0 {
+				h.name = insertAt(h.name, r.Intn(len(h.name)+1), b)
+			} else {
+				h.value = insertAt(h.value, r.Intn(len(h.value)+1), b)
+			}
+		}
+	}
+
+	return h.String()
+}
+
+// randomCase returns s with the case of each letter chosen at random
+func randomCase(r *rand.Rand, s string) string {
+	b := []byte(s)
+	for i := range b {
+		if r.Intn(2) == 0 {
+			b[i] = strings.ToUpper(string(b[i]))[0]
+		} else {
+			b[i] = strings.ToLower(string(b[i]))[0]
+		}
+	}
+
+	return string(b)
+}
+
+// insertAt returns s with t inserted at byte offset i
+func insertAt(s string, i int, t string) string {
+	return s[:i] + t + s[i:]
+}
+
+// generateCLMutations returns a map of Content-Length header format strings, indexed by name. Each format
+// string takes the length of the body as its only argument
+func generateCLMutations() map[string]string {
+	m := make(map[string]string, 0)
+
+	// Signs and number formats
+	m["cl-plus"] = "Content-Length: +%d"
+	m["cl-leading-zero"] = "Content-Length: 0%d"
+	m["cl-hex"] = "Content-Length: 0x%x"
+	m["cl-decimal"] = "Content-Length: %d.0"
+
+	// Whitespace around the value
+	m["cl-leading-space"] = "Content-Length:  %d"
+	m["cl-trailing-space"] = "Content-Length: %d "
+	m["cl-leading-tab"] = "Content-Length:\t%d"
+	m["cl-trailing-tab"] = "Content-Length: %d\t"
+
+	// Repeated values
+	m["cl-comma-repeat"] = "Content-Length: %[1]d, %[1]d"
+
+	return m
+}
+
+// generateTEMutations returns a map of TE header mutations, indexed by name
+func generateTEMutations() map[string]string {
 	m := make(map[string]string, 0)
 
 	m["standard"] = "Transfer-Encoding: chunked"
@@ -44,6 +488,10 @@ func generateMutations() map[string]string {
 	m["lowercase"] = "transfer-encoding: chunked"
 	m["mixedcase"] = "tRANsfEr-ENCodInG: chunked"
 	m["chunked-uppercase"] = "Transfer-Encoding: CHUNKED"
+	m["chunked-mixedcase"] = "Transfer-Encoding: cHuNkEd"
+	m["all-uppercase"] = "TRANSFER-ENCODING: CHUNKED"
+	m["lowercase-nospace"] = "transfer-encoding:chunked"
+	m["lowercase-chunked-uppercase"] = "transfer-encoding: CHUNKED"
 
 	// Searching for similar names
 	m["cutoff"] = "Transfer-Encoding: chunk"
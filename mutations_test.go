@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requestLines returns the lines of the head of req, and its body
+func requestLines(req []byte) ([]string, string) {
+	parts := strings.SplitN(string(req), "\r\n\r\n", 2)
+	return strings.Split(parts[0], "\r\n"), parts[1]
+}
+
+func TestCLMutations(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	mutations := generateMutations()
+
+	// The CL.TE request has a 4 byte body
+	tests := map[string]string{
+		"cl-plus":           "Content-Length: +4",
+		"cl-leading-zero":   "Content-Length: 04",
+		"cl-hex":            "Content-Length: 0x4",
+		"cl-decimal":        "Content-Length: 4.0",
+		"cl-leading-space":  "Content-Length:  4",
+		"cl-trailing-space": "Content-Length: 4 ",
+		"cl-leading-tab":    "Content-Length:\t4",
+		"cl-trailing-tab":   "Content-Length: 4\t",
+		"cl-comma-repeat":   "Content-Length: 4, 4",
+	}
+	if len(tests) != len(generateCLMutations()) {
+		t.Errorf("got %d Content-Length mutations, want %d", len(generateCLMutations()), len(tests))
+	}
+
+	for name, want := range tests {
+		lines, body := requestLines(clte("POST", u, mutations[name], RequestOptions{}))
+		if lines[1] != "Transfer-Encoding: chunked" {
+			t.Errorf("%s: got Transfer-Encoding header %q", name, lines[1])
+		}
+
+		var cls []string
+		for _, line := range lines {
+			if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+				cls = append(cls, line)
+			}
+		}
+		if len(cls) != 1 || cls[0] != want {
+			t.Errorf("%s: got Content-Length headers %q, want %q", name, cls, want)
+		}
+		if body != "1\r\nZ\r\nQ" {
+			t.Errorf("%s: got body %q", name, body)
+		}
+	}
+
+	// Each request uses the length of its own body
+	for _, req := range []struct {
+		name string
+		req  []byte
+		want string
+	}{
+		{"TE.CL", tecl("POST", u, mutations["cl-hex"], RequestOptions{}), "Content-Length: 0x6"},
+		{"CL.TE verification", clteVerify("POST", u, mutations["cl-hex"], RequestOptions{}), "Content-Length: 0x7"},
+		{"TE.CL verification", teclVerify("POST", u, mutations["cl-hex"], RequestOptions{}), "Content-Length: 0x5"},
+	} {
+		lines, _ := requestLines(req.req)
+		if got := lines[len(lines)-1]; got != req.want {
+			t.Errorf("%s: got %q, want %q", req.name, got, req.want)
+		}
+	}
+}
+
+func TestCLMutationHeaderCase(t *testing.T) {
+	// The Content-Length mutation is sent exactly as written, like the Transfer-Encoding header
+	u, _ := url.Parse("https://example.com/")
+	lines, _ := requestLines(clte("POST", u, generateMutations()["cl-plus"], RequestOptions{HeaderCase: "lower"}))
+	if got := lines[len(lines)-1]; got != "Content-Length: +4" {
+		t.Errorf("got %q, want the mutation unchanged", got)
+	}
+}
+
+func TestLimitMutations(t *testing.T) {
+	mutations := generateMutations()
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		selected := limitMutations(mutations, host, 5, 1)
+		if len(selected) != 5 {
+			t.Errorf("%s: got %d mutations, want 5", host, len(selected))
+		}
+		for k := range selected {
+			if _, ok := mutations[k]; !ok {
+				t.Errorf("%s: got unknown mutation %s", host, k)
+			}
+		}
+
+		// The same seed always selects the same mutations for a host
+		if again := limitMutations(mutations, host, 5, 1); !reflect.DeepEqual(again, selected) {
+			t.Errorf("%s: got %v then %v with the same seed", host, selected, again)
+		}
+	}
+
+	if got := limitMutations(mutations, "a.example.com", len(mutations)+1, 1); len(got) != len(mutations) {
+		t.Errorf("got %d mutations with a limit over the number of mutations, want all %d", len(got), len(mutations))
+	}
+}
+
+func TestTerminatorMutations(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	mutations := generateMutations()
+
+	tests := map[string]string{
+		"standard":                 "0\r\n\r\n",
+		"terminator-double-zero":   "00\r\n\r\n",
+		"terminator-extension":     "0;x\r\n\r\n",
+		"terminator-space":         "0 \r\n\r\n",
+		"terminator-lf":            "0\n\n",
+		"terminator-no-final-crlf": "0\r\n",
+	}
+
+	// The TE.CL request smuggles a byte after the terminator, and its verification request sends only the
+	// terminator, with each Content-Length covering the whole body
+	for name, term := range tests {
+		for _, req := range []struct {
+			req  []byte
+			body string
+		}{
+			{tecl("POST", u, mutations[name], RequestOptions{}), term + "X"},
+			{teclVerify("POST", u, mutations[name], RequestOptions{}), term},
+		} {
+			lines, body := requestLines(req.req)
+			if body != req.body {
+				t.Errorf("%s: got body %q, want %q", name, body, req.body)
+			}
+			if cl := lines[len(lines)-1]; cl != fmt.Sprintf("Content-Length: %d", len(req.body)) {
+				t.Errorf("%s: got %q for a body of %d bytes", name, cl, len(req.body))
+			}
+		}
+
+		// CL.TE requests are unaffected
+		if _, body := requestLines(clte("POST", u, mutations[name], RequestOptions{})); body != "1\r\nZ\r\nQ" {
+			t.Errorf("%s: got CL.TE body %q", name, body)
+		}
+	}
+}
+
+func TestTrailerMutations(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	mutations := generateMutations()
+
+	tests := map[string]string{
+		"trailer-header":   "0\r\nX: y\r\n\r\n",
+		"trailer-te":       "0\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"trailer-cl":       "0\r\nContent-Length: 0\r\n\r\n",
+		"trailer-no-colon": "0\r\nX\r\n\r\n",
+		"trailer-folded":   "0\r\nX: y\r\n z\r\n\r\n",
+	}
+
+	for name, trailer := range tests {
+		m, ok := mutations[name]
+		if !ok {
+			t.Errorf("%s: no such mutation", name)
+			continue
+		}
+		if m.TE != "Transfer-Encoding: chunked" {
+			t.Errorf("%s: got TE header %q, want it unmutated", name, m.TE)
+		}
+
+		// The trailer follows the terminating chunk, and is covered by the Content-Length header
+		lines, body := requestLines(tecl("POST", u, m, RequestOptions{}))
+		if body != trailer+"X" {
+			t.Errorf("%s: got body %q, want %q", name, body, trailer+"X")
+		}
+		if cl := lines[len(lines)-1]; cl != fmt.Sprintf("Content-Length: %d", len(trailer)+1) {
+			t.Errorf("%s: got %q for a body of %d bytes", name, cl, len(trailer)+1)
+		}
+		if _, body := requestLines(teclVerify("POST", u, m, RequestOptions{})); body != trailer {
+			t.Errorf("%s: got verification body %q, want %q", name, body, trailer)
+		}
+	}
+}
+
+func TestMutationTimeout(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	conf := Config{
+		Methods: []string{"POST"},
+		Mutations: map[string]Mutation{
+			"standard": {},
+			"slow":     {TimeoutMultiplier: 2},
+		},
+		Delay: time.Second,
+	}
+	state := &State{Base: map[string]time.Duration{u.String(): time.Second}}
+
+	want := map[string]time.Duration{"standard": 2 * time.Second, "slow": 4 * time.Second}
+	w, _ := testWorker(conf)
+	for _, test := range generateTests(conf, []*url.URL{u}, nil, state, true) {
+		if test.Timeout != want[test.Mutation] {
+			t.Errorf("%s: got timeout %v, want %v", test.Mutation, test.Timeout, want[test.Mutation])
+		}
+
+		// The confidence score still compares the timeout against the URL's own base time
+		if base := w.baseTime(test); base != time.Second {
+			t.Errorf("%s: got base time %v, want 1s", test.Mutation, base)
+		}
+	}
+}
+
+func TestExoticMutations(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	mutations := generateMutations()
+
+	// Each chunk size line, including the terminator's, carries the extension
+	for name, ext := range map[string]string{
+		"exotic-ext-cl":        ";content-length=0",
+		"exotic-ext-cl-quoted": ";content-length=\"0\"",
+		"exotic-ext-cl-space":  " ; Content-Length = 0",
+	} {
+		for _, req := range []struct {
+			req  []byte
+			body string
+			cl   int
+		}{
+			// The CL.TE request's Content-Length leaves the final byte and the CRLF before it unread
+			{clte("POST", u, mutations[name], RequestOptions{}), "1" + ext + "\r\nZ\r\nQ", len(ext) + 4},
+			{tecl("POST", u, mutations[name], RequestOptions{ChunkCount: 1}), "1" + ext + "\r\nZ\r\n0" + ext + "\r\n\r\nX", 2*len(ext) + 12},
+			{teclVerify("POST", u, mutations[name], RequestOptions{}), "0" + ext + "\r\n\r\n", len(ext) + 5},
+		} {
+			lines, body := requestLines(req.req)
+			if body != req.body {
+				t.Errorf("%s: got body %q, want %q", name, body, req.body)
+			}
+			if cl := lines[len(lines)-1]; cl != fmt.Sprintf("Content-Length: %d", req.cl) {
+				t.Errorf("%s: got %q, want a Content-Length of %d", name, cl, req.cl)
+			}
+		}
+	}
+
+	// The Content-Length headers give the length in unusual forms
+	for name, want := range map[string][]string{
+		"exotic-cl-folded":   {"Content-Length:", " 4"},
+		"exotic-cl-conflict": {"Content-Length: 4", "Content-Length: 0"},
+	} {
+		lines, body := requestLines(clte("POST", u, mutations[name], RequestOptions{}))
+		if body != "1\r\nZ\r\nQ" {
+			t.Errorf("%s: got body %q", name, body)
+		}
+		if got := lines[len(lines)-2:]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got header lines %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMutationProfiles(t *testing.T) {
+	all := generateMutations()
+	enabled := func(profile string) map[string]bool {
+		selected := make(map[string]bool, 0)
+		for name, m := range all {
+			if mutationProfiles[profile](name, m) {
+				selected[name] = true
+			}
+		}
+		return selected
+	}
+
+	if quick := enabled("quick"); !reflect.DeepEqual(quick, quickMutations) {
+		t.Errorf("got quick profile %v, want %v", quick, quickMutations)
+	}
+	if thorough := enabled("thorough"); len(thorough) != len(all) {
+		t.Errorf("got %d mutations in the thorough profile, want all %d", len(thorough), len(all))
+	}
+
+	// The te-only and cl-only profiles don't overlap, and leave out mutations of the body
+	teOnly, clOnly := enabled("te-only"), enabled("cl-only")
+	for name := range teOnly {
+		if clOnly[name] {
+			t.Errorf("%s is in both the te-only and cl-only profiles", name)
+		}
+		if strings.HasPrefix(name, "terminator-") || strings.HasPrefix(name, "trailer-") || strings.HasPrefix(name, "exotic-ext-") {
+			t.Errorf("got %s in the te-only profile", name)
+		}
+	}
+	if !teOnly["standard"] || !teOnly["lineprefix-space"] {
+		t.Errorf("got te-only profile %v, want it to include the Transfer-Encoding mutations", teOnly)
+	}
+	want := map[string]bool{"exotic-cl-folded": true, "exotic-cl-conflict": true}
+	for name, m := range generateObsFoldMutations() {
+		if m.CL != "" {
+			want[name] = true
+		}
+	}
+	for name := range generateCLMutations() {
+		want[name] = true
+	}
+	if !reflect.DeepEqual(clOnly, want) {
+		t.Errorf("got cl-only profile %v, want %v", clOnly, want)
+	}
+}
+
+func TestFuzzMutations(t *testing.T) {
+	mutations := generateFuzzMutations(50, 1)
+	if len(mutations) != 50 {
+		t.Fatalf("got %d mutations, want 50", len(mutations))
+	}
+
+	// The same seed always generates the same mutations, and another seed generates others
+	if again := generateFuzzMutations(50, 1); !reflect.DeepEqual(again, mutations) {
+		t.Error("got different mutations from the same seed")
+	}
+	if other := generateFuzzMutations(50, 2); reflect.DeepEqual(other, mutations) {
+		t.Error("got the same mutations from different seeds")
+	}
+
+	for name, m := range mutations {
+		if !strings.HasPrefix(name, "fuzz-") || !m.Fuzzed {
+			t.Errorf("%s: got a mutation which isn't marked as fuzzed", name)
+		}
+
+		// Exactly one of the headers is obfuscated, and Content-Length headers keep their length
+		switch {
+		case m.CL != "":
+			if m.TE != "Transfer-Encoding: chunked" || !strings.Contains(m.CL, "%d") || m.CL == "Content-Length: %d" {
+				t.Errorf("%s: got TE %q and CL %q, want only the CL obfuscated", name, m.TE, m.CL)
+			}
+		case m.TE == "Transfer-Encoding: chunked":
+			t.Errorf("%s: got an unobfuscated Transfer-Encoding header", name)
+		}
+	}
+
+	if n := len(generateFuzzMutations(0, 1)); n != 0 {
+		t.Errorf("got %d mutations when asking for none", n)
+	}
+}
+
+func TestObsFoldMutations(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	mutations := generateMutations()
+
+	// The folded lines are sent exactly as written, with the Content-Length filled in
+	for name, want := range map[string][]string{
+		"obs-fold-te-value":     {"Transfer-Encoding:", " chunked"},
+		"obs-fold-te-value-tab": {"Transfer-Encoding:", "\tchunked"},
+		"obs-fold-te-split":     {"Transfer-Encoding: chun", " ked"},
+		"obs-fold-te-hidden":    {"X: y", " Transfer-Encoding: chunked"},
+		"obs-fold-cl-value-tab": {"Content-Length:", "\t4"},
+		"obs-fold-cl-after":     {"Content-Length: 4", " 0"},
+	} {
+		lines, _ := requestLines(clte("POST", u, mutations[name], RequestOptions{}))
+		found := false
+		for i := range lines[:len(lines)-1] {
+			found = found || reflect.DeepEqual(lines[i:i+2], want)
+		}
+		if !found {
+			t.Errorf("%s: got header lines %q, want them to contain %q", name, lines, want)
+		}
+	}
+
+	selected := make([]string, 0)
+	for name, m := range mutations {
+		if mutationProfiles["obs-fold"](name, m) {
+			selected = append(selected, name)
+		}
+	}
+	if len(selected) != len(generateObsFoldMutations()) {
+		t.Errorf("got obs-fold profile %v, want all %d obs-fold mutations", selected, len(generateObsFoldMutations()))
+	}
+}
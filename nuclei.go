@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// nucleiIDInvalid matches the runs of characters which aren't allowed in a nuclei template ID
+var nucleiIDInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+// nucleiTemplate returns a nuclei template which re-checks the finding t, labelled with the given tag. The
+// template sends the finding's PoC as an unsafe raw request, so nuclei doesn't normalise it, and matches the
+// signal smuggles detected: a CL.TE or TE.CL response taking at least the test's timeout, a 0.CL follow-up
+// request receiving the marker status, the first of two pipelined requests receiving the marker status, or a
+// request with two Host headers being answered like one for the second. Each
+// template starts with a "---" line, so a stream of them can be split into separate files
+func nucleiTemplate(conf Config, t SmuggleTest, tag string) (string, error) {
+	var reqs [][]byte
+	var matcher, check string
+	switch t.Status {
+	case CLTE, TECL:
+		req, err := generatePoC(conf, t.Method, t.Url.String(), string(t.Status), t.Mutation)
+		if err != nil {
+			return "", err
+		}
+		// nuclei's duration is in seconds, and rounding up keeps responses within the timeout from matching
+		secs := int(math.Ceil(t.Timeout.Seconds()))
+		reqs = [][]byte{req}
+		matcher = fmt.Sprintf("duration>=%d", secs)
+		check = fmt.Sprintf("The request times out when the frontend and backend disagree on its length. nuclei should be run with -timeout greater than %d.", secs)
+	case ZEROCL:
+		reqs = [][]byte{zerocl(t.Method, t.Url, conf.RequestOptions.keepAlive()), baseReq(t.Url, conf.RequestOptions)}
+		matcher = fmt.Sprintf("status_code_2 == %d", conf.MarkerStatus)
+		check = "The second request receives the response to the request for the marker path smuggled in the body of the first."
+	case PIPELINE:
+		reqs = [][]byte{append(pipelineReq(t.Method, t.Url, conf.RequestOptions.keepAlive()), notFoundReq(t.Url, conf.RequestOptions)...)}
+		matcher = fmt.Sprintf("status_code == %d", conf.MarkerStatus)
+		check = "The first of the two pipelined requests receives the response meant for the request for the marker path."
+	case HOST:
+		// The status of a request for the host sent second is needed to tell whether the duplicate header was honoured
+		hosts := duplicateHosts(t.Mutation, t.Url)
+		reqs = [][]byte{
+			hostReq(t.Method, t.Url, conf.RequestOptions, t.Url.Hostname()),
+			hostReq(t.Method, t.Url, conf.RequestOptions, routingHost),
+			hostReq(t.Method, t.Url, conf.RequestOptions, hosts...),
+		}
+		second := "status_code_2"
+		if hosts[1] != routingHost {
+			second = "status_code_1"
+		}
+		matcher = fmt.Sprintf("status_code_1 != status_code_2 && status_code_3 == %s", second)
+		check = fmt.Sprintf("The request with Host headers for %s then %s is answered like a request for %s alone.", hosts[0], hosts[1], hosts[1])
+	default:
+		return "", fmt.Errorf("%s findings can't be re-checked with a nuclei template", t.Status)
+	}
+
+	id := nucleiIDInvalid.ReplaceAllString(strings.ToLower(fmt.Sprintf("smuggles %s %s %s %s", t.Url.Host, t.Method, t.Status, t.Mutation)), "-")
+	id = strings.Trim(id, "-")
+	name := fmt.Sprintf("%s request smuggling with mutation %s", t.Status, t.Mutation)
+	tags := "smuggling,desync,smuggles"
+	if tag != "" {
+		tags += "," + nucleiIDInvalid.ReplaceAllString(strings.ToLower(tag), "-")
+	}
+
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %s\n\n", id)
+	b.WriteString("info:\n")
+	fmt.Fprintf(&b, "  name: %s\n", yamlString(name))
+	b.WriteString("  author: smuggles\n")
+	fmt.Fprintf(&b, "  severity: %s\n", t.Status.Severity())
+	fmt.Fprintf(&b, "  description: %s\n", yamlString(fmt.Sprintf("smuggles found a %s desync on %s %s. %s", t.Status, t.Method, t.Url, check)))
+	fmt.Fprintf(&b, "  tags: %s\n", tags)
+	b.WriteString("  metadata:\n")
+	fmt.Fprintf(&b, "    method: %s\n", yamlString(t.Method))
+	fmt.Fprintf(&b, "    mutation: %s\n", yamlString(t.Mutation))
+	fmt.Fprintf(&b, "    confidence: %.2f\n", t.Confidence)
+	fmt.Fprintf(&b, "    confirmed: %t\n", t.Confirmed)
+	if len(t.Suspect) > 0 {
+		fmt.Fprintf(&b, "    suspect: %s\n", yamlString(strings.Join(t.Suspect, ",")))
+	}
+	if t.PoCCommand != "" {
+		fmt.Fprintf(&b, "    poc-command: %s\n", yamlString(t.PoCCommand))
+	}
+	b.WriteString("\nhttp:\n")
+	b.WriteString("  - raw:\n")
+	for _, req := range reqs {
+		raw, err := nucleiRaw(req)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(raw)
+	}
+	b.WriteString("    unsafe: true\n")
+	if len(reqs) > 1 {
+		b.WriteString("    req-condition: true\n")
+	}
+	b.WriteString("    matchers:\n")
+	b.WriteString("      - type: dsl\n")
+	b.WriteString("        dsl:\n")
+	fmt.Fprintf(&b, "          - %s\n", yamlString(matcher))
+
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// nucleiRaw returns req as an item of a nuclei raw request list, using a literal block scalar. nuclei sends the
+// lines of unsafe requests ending with CRLF, so line endings which aren't CRLF can't be reproduced, and are
+// pointed out in a comment. Control characters can't be written in YAML at all, so give an error
+func nucleiRaw(req []byte) (string, error) {
+	if !utf8.Valid(req) {
+		return "", errors.New("the request isn't valid UTF-8, so can't be written in a nuclei template")
+	}
+	for _, c := range string(req) {
+		if c != '\t' && c != '\r' && c != '\n' && !unicode.IsGraphic(c) {
+			return "", fmt.Errorf("the request contains the control character %q, so can't be written in a nuclei template", c)
+		}
+	}
+
+	s := strings.ReplaceAll(string(req), "\r\n", "\n")
+
+	var b strings.Builder
+	if strings.ContainsAny(s, "\r") || strings.Count(string(req), "\n") != strings.Count(string(req), "\r\n") {
+		b.WriteString("      # This request has line endings other than CRLF, which nuclei doesn't send exactly\n")
+	}
+
+	// Trailing line breaks are part of the request, so are kept, otherwise the final line break added by YAML
+	// is stripped
+	chomp := "-"
+	if strings.HasSuffix(s, "\n") {
+		chomp = "+"
+		s = strings.TrimSuffix(s, "\n")
+	}
+	fmt.Fprintf(&b, "      - |%s\n", chomp)
+	for _, line := range strings.Split(s, "\n") {
+		if line == "" {
+			b.WriteString("\n")
+		} else {
+			b.WriteString("        " + line + "\n")
+		}
+	}
+
+	return b.String(), nil
+}
+
+// yamlString returns s as a double quoted YAML string. JSON strings are valid YAML, and escape everything needed
+func yamlString(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	// Escaping <, > and & isn't needed, and would make matchers harder to read
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNucleiTemplate(t *testing.T) {
+	conf := Config{Mutations: generateMutations(), MarkerStatus: http.StatusNotFound}
+	conf.Headers = []string{"User-Agent: smuggles"}
+	conf.MarkerPath = "/smuggles404"
+	u, _ := url.Parse("https://example.com/path")
+
+	// The fields nuclei requires of every template, and that the requests are sent unmodified
+	required := []*regexp.Regexp{
+		regexp.MustCompile(`(?m)\A---\nid: [a-z0-9][a-z0-9-]*[a-z0-9]\n`),
+		regexp.MustCompile(`(?m)^info:\n  name: "[^"]+"\n  author: smuggles\n  severity: (info|low|medium|high|critical)\n`),
+		regexp.MustCompile(`(?m)^http:\n  - raw:\n      - \|[+-]\n`),
+		regexp.MustCompile(`(?m)^    unsafe: true$`),
+		regexp.MustCompile(`(?m)^    matchers:\n      - type: dsl\n        dsl:\n          - "[^"]+"\z`),
+	}
+
+	tests := []struct {
+		status   SmuggleType
+		severity string
+		matcher  string
+		requests int
+	}{
+		{CLTE, "high", `"duration>=5"`, 1},
+		{TECL, "high", `"duration>=5"`, 1},
+		{ZEROCL, "medium", `"status_code_2 == 404"`, 2},
+		{PIPELINE, "medium", `"status_code == 404"`, 1},
+	}
+	for _, test := range tests {
+		finding := SmuggleTest{Url: u, Method: "POST", Mutation: "standard", Timeout: 4500 * time.Millisecond, Status: test.status}
+		tmpl, err := nucleiTemplate(conf, finding, "Team A")
+		if err != nil {
+			t.Errorf("%s: %v", test.status, err)
+			continue
+		}
+		for _, re := range required {
+			if !re.MatchString(tmpl) {
+				t.Errorf("%s: template doesn't match %s:\n%s", test.status, re, tmpl)
+			}
+		}
+		if !strings.Contains(tmpl, "  severity: "+test.severity+"\n") {
+			t.Errorf("%s: template doesn't have severity %s:\n%s", test.status, test.severity, tmpl)
+		}
+		if !strings.HasSuffix(tmpl, "          - "+test.matcher) {
+			t.Errorf("%s: template doesn't match with %s:\n%s", test.status, test.matcher, tmpl)
+		}
+		if !strings.Contains(tmpl, "  tags: smuggling,desync,smuggles,team-a\n") {
+			t.Errorf("%s: template doesn't have the tag:\n%s", test.status, tmpl)
+		}
+		if n := strings.Count(tmpl, "\n      - |"); n != test.requests {
+			t.Errorf("%s: got %d raw requests, want %d", test.status, n, test.requests)
+		}
+		if (test.requests > 1) != strings.Contains(tmpl, "    req-condition: true\n") {
+			t.Errorf("%s: req-condition should only be set with more than one request:\n%s", test.status, tmpl)
+		}
+	}
+
+	finding := SmuggleTest{Url: u, Method: "POST", Mutation: "standard", Status: RESET}
+	if _, err := nucleiTemplate(conf, finding, ""); err == nil {
+		t.Error("got a template for a RESET finding")
+	}
+}
+
+func TestNucleiRaw(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", "      - |+\n        GET / HTTP/1.1\n        Host: a\n\n"},
+		{"POST / HTTP/1.1\r\n\r\nQ", "      - |-\n        POST / HTTP/1.1\n\n        Q\n"},
+		{"GET / HTTP/1.1\nHost: a\r\n\r\n", "      # This request has line endings other than CRLF, which nuclei doesn't send exactly\n      - |+\n        GET / HTTP/1.1\n        Host: a\n\n"},
+	}
+	for _, test := range tests {
+		got, err := nucleiRaw([]byte(test.req))
+		if err != nil {
+			t.Errorf("%q: %v", test.req, err)
+		} else if got != test.want {
+			t.Errorf("%q: got\n%q\nwant\n%q", test.req, got, test.want)
+		}
+	}
+
+	for _, req := range []string{"GET / HTTP/1.1\r\nX: \x00\r\n\r\n", "GET / HTTP/1.1\r\nX: \xff\r\n\r\n"} {
+		if _, err := nucleiRaw([]byte(req)); err == nil {
+			t.Errorf("%q: no error for a request which can't be written in YAML", req)
+		}
+	}
+}
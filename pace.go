@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Pacer spaces out the requests sent to each host by all workers, giving slower hosts longer between requests
+type Pacer struct {
+	// The multiple of a host's base time to leave between requests to it
+	Factor float64
+
+	// The earliest time the next request to each host can be sent, indexed by host
+	next map[string]time.Time
+	mux  sync.Mutex
+}
+
+// NewPacer returns a pacer leaving factor times a host's base time between requests to it
+func NewPacer(factor float64) *Pacer {
+	return &Pacer{
+		Factor: factor,
+		next:   make(map[string]time.Time, 0),
+	}
+}
+
+// Wait waits until a request can be sent to host, which has the given base time, and reserves the slot after it
+// for the next request. It returns early with the context's error if the context is cancelled
+func (p *Pacer) Wait(ctx context.Context, host string, base time.Duration) error {
+	spacing := time.Duration(float64(base) * p.Factor)
+	if spacing <= 0 {
+		return nil
+	}
+
+	p.mux.Lock()
+	now := time.Now()
+	at := p.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	p.next[host] = at.Add(spacing)
+	p.mux.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// pacedSpan returns how long it takes to make n requests to host, with the given base time, through p
+func pacedSpan(t *testing.T, p *Pacer, host string, base time.Duration, n int) time.Duration {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := p.Wait(context.Background(), host, base); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return time.Since(start)
+}
+
+func TestPacerSpacesSlowerHostsWider(t *testing.T) {
+	p := NewPacer(2)
+
+	// Four requests leave three gaps of twice the base time
+	fast := pacedSpan(t, p, "fast.example.com", 5*time.Millisecond, 4)
+	slow := pacedSpan(t, p, "slow.example.com", 25*time.Millisecond, 4)
+	if fast < 30*time.Millisecond {
+		t.Errorf("fast host's requests took %s, want at least 30ms", fast)
+	}
+	if slow < 150*time.Millisecond {
+		t.Errorf("slow host's requests took %s, want at least 150ms", slow)
+	}
+	if slow <= fast {
+		t.Errorf("slow host's requests took %s, no longer than the fast host's %s", slow, fast)
+	}
+}
+
+func TestPacerHostsIndependent(t *testing.T) {
+	p := NewPacer(1)
+	p.Wait(context.Background(), "slow.example.com", time.Hour)
+
+	// Another host isn't held up by the slow host's spacing
+	if d := pacedSpan(t, p, "other.example.com", time.Millisecond, 2); d > time.Second {
+		t.Errorf("other host's requests took %s, want them paced on their own", d)
+	}
+}
+
+func TestPacerWithoutBaseTime(t *testing.T) {
+	p := NewPacer(10)
+	if d := pacedSpan(t, p, "example.com", 0, 100); d > 100*time.Millisecond {
+		t.Errorf("requests without a base time took %s, want them unpaced", d)
+	}
+}
+
+func TestPacerCancelled(t *testing.T) {
+	p := NewPacer(1)
+	p.Wait(context.Background(), "example.com", time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Wait(ctx, "example.com", time.Hour); err != context.Canceled {
+		t.Errorf("got %v waiting with a cancelled context, want it to return early", err)
+	}
+}
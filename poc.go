@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// pocExtensions are the file extensions of PoCs written in each format
+var pocExtensions = map[string]string{
+	"raw":    "txt",
+	"httpie": "sh",
+	"caido":  "json",
+}
+
+// writePoC generates the PoC for the finding t in the given format, and writes it to a file in dir named after
+// the finding
+func writePoC(conf Config, dir string, format string, t SmuggleTest) error {
+	poc, err := generatePoC(conf, t.Method, t.Url.String(), string(t.Status), t.Mutation)
+	if err != nil {
+		return err
+	}
+	poc, _, err = formatPoC(format, t.Url, poc)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, pocFileName(t, format)), poc, 0644)
+}
+
+// pocFileName returns the name of the file the PoC of the finding t is written to in the given format. It is made
+// of the host, the path, the method, the desync type, and the mutation, with the port separated by an underscore
+// and anything which isn't allowed in filenames on all platforms replaced. The path is followed by a hash of the
+// path and query, so findings on paths which read the same once replaced don't overwrite each other
+func pocFileName(t SmuggleTest, format string) string {
+	p := safeFileName(strings.Trim(t.Url.EscapedPath(), "/"))
+	if p == "" {
+		p = "root"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(t.Url.RequestURI()))
+	p += fmt.Sprintf("-%08x", h.Sum32())
+
+	host := safeFileName(strings.ReplaceAll(t.Url.Host, ":", "_"))
+	return fmt.Sprintf("%s_%s_%s_%s_%s.%s", host, p, safeFileName(t.Method), t.Status, safeFileName(t.Mutation), pocExtensions[format])
+}
+
+// safeFileName returns s with every character other than letters, digits, dots, underscores and hyphens replaced
+// with a hyphen, so it can be used as part of a filename on any platform
+func safeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// formatPoC converts a raw PoC request to u into the given format: "raw", "httpie", or "caido". If the format
+// can't reproduce the exact bytes of the request, a warning saying so is also returned
+func formatPoC(format string, u *url.URL, req []byte) ([]byte, string, error) {
+	switch format {
+	case "raw":
+		return req, "", nil
+	case "httpie":
+		return httpiePoC(u, req), "HTTPie normalises headers and sets its own framing, so the mutated headers and body may not be sent exactly as in the raw request", nil
+	case "caido":
+		b, err := caidoPoC(u, req)
+		return b, "", err
+	default:
+		return nil, "", fmt.Errorf("unrecognised PoC format: %s", format)
+	}
+}
+
+// httpiePoC returns an HTTPie command line which sends the headers and body of req to u
+func httpiePoC(u *url.URL, req []byte) []byte {
+	head := string(req)
+	body := ""
+	if i := strings.Index(head, "\r\n\r\n"); i >= 0 {
+		head, body = head[:i], head[i+4:]
+	}
+
+	lines := strings.Split(head, "\r\n")
+	method := strings.SplitN(lines[0], " ", 2)[0]
+
+	var b bytes.Buffer
+	if body != "" {
+		// printf interprets the escaped CRLFs, so literal percent signs and backslashes need escaping
+		escaped := strings.ReplaceAll(body, "\\", "\\\\")
+		escaped = strings.ReplaceAll(escaped, "%", "%%")
+		escaped = strings.ReplaceAll(escaped, "\r", "\\r")
+		escaped = strings.ReplaceAll(escaped, "\n", "\\n")
+		fmt.Fprintf(&b, "printf %s | ", shellQuote(escaped))
+	}
+	fmt.Fprintf(&b, "http --verify=no %s %s", method, shellQuote(u.String()))
+
+	for _, h := range lines[1:] {
+		i := strings.Index(h, ":")
+		if i < 0 || strings.EqualFold(strings.TrimSpace(h[:i]), "Host") {
+			continue
+		}
+		fmt.Fprintf(&b, " %s", shellQuote(strings.TrimSpace(h[:i])+":"+strings.TrimSpace(h[i+1:])))
+	}
+	b.WriteString("\n")
+
+	return b.Bytes()
+}
+
+// caidoPoC returns a JSON object in the form of Caido's replay session input, which contains the connection
+// information for u and the exact bytes of req
+func caidoPoC(u *url.URL, req []byte) ([]byte, error) {
+	isTLS := u.Scheme == "https"
+	port := 80
+	if isTLS {
+		port = 443
+	}
+	if u.Port() != "" {
+		var err error
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	type connectionInfo struct {
+		Host  string `json:"host"`
+		Port  int    `json:"port"`
+		IsTLS bool   `json:"isTLS"`
+	}
+	type rawSource struct {
+		Raw            string         `json:"raw"`
+		ConnectionInfo connectionInfo `json:"connectionInfo"`
+	}
+	type requestSource struct {
+		Raw rawSource `json:"raw"`
+	}
+	input := struct {
+		RequestSource requestSource `json:"requestSource"`
+	}{
+		RequestSource: requestSource{
+			Raw: rawSource{
+				Raw: base64.StdEncoding.EncodeToString(req),
+				ConnectionInfo: connectionInfo{
+					Host:  u.Hostname(),
+					Port:  port,
+					IsTLS: isTLS,
+				},
+			},
+		},
+	}
+
+	b, err := json.MarshalIndent(input, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
+}
+
+// shellQuote quotes s for use as a single argument in a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// pocFlags are the flags which change the PoC generated for a finding, so are repeated in PoC commands
+var pocFlags = map[string]bool{
+	"headers":                true,
+	"http-version":           true,
+	"header-case":            true,
+	"chunk-size":             true,
+	"chunk-count":            true,
+	"randomize-header-order": true,
+	"fuzz-mutations":         true,
+	"detect-zero-cl":         true,
+	"detect-pipelining":      true,
+	"detect-host-routing":    true,
+	"connection":             true,
+	"marker-path":            true,
+	"cache-bust":             true,
+	"expect-continue":        true,
+	"seed":                   true,
+}
+
+// pocArgs returns the arguments for the flags set in flags which change the PoC generated for a finding. The
+// seed is added when it changes the PoC, as it is otherwise chosen at random
+func pocArgs(flags *flag.FlagSet, seed int64) []string {
+	args := make([]string, 0)
+	seeded := false
+	flags.Visit(func(f *flag.Flag) {
+		if !pocFlags[f.Name] {
+			return
+		}
+		if s, ok := f.Value.(flag.SliceValue); ok {
+			for _, v := range s.GetSlice() {
+				args = append(args, "--"+f.Name, v)
+			}
+		} else if f.Value.Type() == "bool" {
+			args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+		} else {
+			args = append(args, "--"+f.Name, f.Value.String())
+		}
+		seeded = seeded || f.Name == "seed"
+	})
+
+	randomized := flags.Changed("randomize-header-order") || flags.Changed("fuzz-mutations")
+	if randomized && !seeded {
+		args = append(args, "--seed", fmt.Sprint(seed))
+	}
+
+	return args
+}
+
+// pocCommand returns a smuggles command line which generates the PoC for the finding t, passing the given flags
+func pocCommand(args []string, t SmuggleTest) string {
+	parts := []string{"smuggles", "--poc"}
+	for _, a := range args {
+		parts = append(parts, shellQuote(a))
+	}
+	for _, a := range []string{t.Method, t.Url.String(), string(t.Status), t.Mutation} {
+		parts = append(parts, shellQuote(a))
+	}
+
+	return strings.Join(parts, " ")
+}
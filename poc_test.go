@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFormatPoC(t *testing.T) {
+	conf := Config{Mutations: generateMutations(), RequestOptions: RequestOptions{Headers: []string{"User-Agent: smuggles", "Connection: close"}}}
+	target := "https://example.com:8443/path"
+	raw, err := generatePoC(conf, "POST", target, CLTE, "standard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRaw := "POST /path HTTP/1.1\r\nTransfer-Encoding: chunked\r\nHost: example.com\r\nUser-Agent: smuggles\r\nConnection: close\r\nContent-Length: 4\r\n\r\n1\r\nZ\r\nQ"
+
+	tests := []struct {
+		format  string
+		want    string
+		warning bool
+	}{
+		{"raw", wantRaw, false},
+		{
+			"httpie",
+			`printf '1\r\nZ\r\nQ' | http --verify=no POST 'https://example.com:8443/path' 'Transfer-Encoding:chunked' 'User-Agent:smuggles' 'Connection:close' 'Content-Length:4'` + "\n",
+			true,
+		},
+		{
+			"caido",
+			`{
+  "requestSource": {
+    "raw": {
+      "raw": "` + base64.StdEncoding.EncodeToString([]byte(wantRaw)) + `",
+      "connectionInfo": {
+        "host": "example.com",
+        "port": 8443,
+        "isTLS": true
+      }
+    }
+  }
+}
+`,
+			false,
+		},
+	}
+
+	u, _ := url.Parse(target)
+	for _, test := range tests {
+		got, warning, err := formatPoC(test.format, u, raw)
+		if err != nil {
+			t.Errorf("%s: %v", test.format, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.format, got, test.want)
+		}
+		if (warning != "") != test.warning {
+			t.Errorf("%s: got warning %q", test.format, warning)
+		}
+	}
+
+	if _, _, err := formatPoC("curl", u, raw); err == nil {
+		t.Error("got no error for an unrecognised format")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote("it's"), `'it'\''s'`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPoCFileName(t *testing.T) {
+	parse := func(s string) *url.URL {
+		u, _ := url.Parse(s)
+		return u
+	}
+	name := func(u string, mutation string) string {
+		return pocFileName(SmuggleTest{Url: parse(u), Method: "POST", Status: CLTE, Mutation: mutation}, "raw")
+	}
+
+	got := name("https://example.com:8443/api/login", "standard")
+	if !strings.HasPrefix(got, "example.com_8443_api-login-") || !strings.HasSuffix(got, "_POST_CL.TE_standard.txt") {
+		t.Errorf("got %q, want the host, path, method, type, and mutation", got)
+	}
+	if got := name("https://example.com/", "standard"); !strings.HasPrefix(got, "example.com_root-") {
+		t.Errorf("got %q for the root path, want it named root", got)
+	}
+	if got := name("https://example.com/", "../../etc/passwd"); strings.ContainsAny(got, "/\\") {
+		t.Errorf("got %q, want the mutation's separators replaced", got)
+	}
+
+	// Paths which read the same once sanitized still get their own files
+	names := make(map[string]bool, 0)
+	for _, u := range []string{"https://example.com/a", "https://example.com/b", "https://example.com/a/b", "https://example.com/a-b", "https://example.com/a?x=1"} {
+		names[name(u, "standard")] = true
+	}
+	if len(names) != 5 {
+		t.Errorf("got %d distinct names for 5 paths: %v", len(names), names)
+	}
+}
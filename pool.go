@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pooledConn is a connection which may be kept open between requests, along with the reader responses to
+// those requests are read through
+type pooledConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// The bytes read from conn which haven't been returned as part of a response yet
+	raw *bytes.Buffer
+
+	// How long the last round trip waited for a 100 Continue response before sending its body
+	wait time.Duration
+}
+
+// newPooledConn returns a pooledConn for conn, which records the raw bytes of the responses read from it
+func newPooledConn(conn net.Conn) *pooledConn {
+	raw := new(bytes.Buffer)
+	return &pooledConn{conn: conn, r: bufio.NewReader(io.TeeReader(conn, raw)), raw: raw}
+}
+
+// readResponse reads a single final response to a request with the given method from conn, and returns its raw
+// bytes without any interim responses before it. This is for connections which the server may keep open after
+// responding, so can't be read until closed. If the connection is closed before a whole response is read, or the
+// response can't be parsed, the bytes read so far are returned as they would be when reading until the connection
+// closes, which may be none. An error is only returned if reading from conn fails
+func readResponse(conn io.Reader, method string) ([]byte, error) {
+	var raw bytes.Buffer
+	src := &errReader{r: conn}
+	r := bufio.NewReader(io.TeeReader(src, &raw))
+	resp, err := readFinalResponse(r, &http.Request{Method: method})
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if src.err != nil {
+		return nil, src.err
+	} else if err != nil {
+		return stripInterim(raw.Bytes()), nil
+	}
+
+	// Anything read beyond the end of the response is left out
+	return stripInterim(raw.Bytes()[:raw.Len()-r.Buffered()]), nil
+}
+
+// errReader records the first error other than io.EOF returned by reads from r, so it can be told apart from
+// errors parsing what was read
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+
+	return n, err
+}
+
+// readFinalResponse reads a response from r, skipping any interim 1xx responses before it, such as 100 Continue.
+// 101 Switching Protocols is treated as final, as no other HTTP response follows it
+func readFinalResponse(r *bufio.Reader, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil || resp.StatusCode >= http.StatusOK || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, err
+		}
+		// Interim responses have no body
+		resp.Body.Close()
+	}
+}
+
+// stripInterim returns the raw response without any interim 1xx responses at its start
+func stripInterim(raw []byte) []byte {
+	for {
+		r := bufio.NewReader(bytes.NewReader(raw))
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil || resp.StatusCode >= http.StatusOK || resp.StatusCode == http.StatusSwitchingProtocols {
+			return raw
+		}
+		raw = raw[len(raw)-r.Buffered():]
+	}
+}
+
+// expectContinueWait is how long to wait for a 100 Continue response before sending the body of a request anyway,
+// as servers which don't support Expect: 100-continue never send one
+const expectContinueWait = time.Second
+
+// awaitContinue waits up to expectContinueWait for a response to the headers of a request sent with
+// Expect: 100-continue, reading from r and setting the read deadline of conn. It returns whether the body should
+// be sent, which it should if a 100 Continue response arrived or no response arrived in time. Otherwise, any bytes
+// of the final response which the server sent without waiting for the body are returned, to be read before the
+// rest of the response
+func awaitContinue(conn net.Conn, r io.Reader) ([]byte, bool) {
+	conn.SetReadDeadline(time.Now().Add(expectContinueWait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// The response is read a byte at a time, so nothing after its headers is consumed
+	var head []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		n, err := r.Read(b)
+		head = append(head, b[:n]...)
+		if isTimeoutErr(err) && len(head) == 0 {
+			return nil, true
+		} else if err != nil {
+			return head, false
+		}
+	}
+
+	if status := strings.Fields(string(head)); len(status) > 1 && status[1] == "100" {
+		return nil, true
+	}
+	return head, false
+}
+
+// roundTrip sends req and reads a single final response, whose body is read and discarded. The response is
+// returned along with its raw bytes, without any interim responses before it. The response's Close field is set
+// if the connection can't be used for further requests, and its ContentLength is set to the number of bytes in
+// the body. With waitForContinue set, the body of req is only sent once awaitContinue allows it, and the timeout
+// starts again once it has been. If ctx is cancelled, the connection is closed and ctx's error is returned
+func (pc *pooledConn) roundTrip(ctx context.Context, req []byte, timeout time.Duration, waitForContinue bool) (resp *http.Response, raw []byte, err error) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.conn.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	head, body := req, []byte(nil)
+	if waitForContinue {
+		head, body = splitBody(req)
+	}
+
+	pc.wait = 0
+	pc.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := pc.conn.Write(head); err != nil {
+		return nil, nil, err
+	}
+
+	r := pc.r
+	if len(body) > 0 {
+		waitStart := time.Now()
+		early, send := awaitContinue(pc.conn, pc.r)
+		pc.wait = time.Since(waitStart)
+		if send {
+			pc.conn.SetDeadline(time.Now().Add(timeout))
+			if _, err := pc.conn.Write(body); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			r = bufio.NewReader(io.MultiReader(bytes.NewReader(early), pc.r))
+		}
+	}
+
+	resp, err = readFinalResponse(r, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.ContentLength = n
+
+	// Anything read beyond the end of the response is kept for the next one
+	raw = append([]byte(nil), pc.raw.Next(pc.raw.Len()-pc.r.Buffered())...)
+
+	// The body wasn't sent, so the server may still read it as the next request
+	if r != pc.r {
+		resp.Close = true
+	}
+
+	return resp, stripInterim(raw), nil
+}
+
+// SendKeepAlive sends req over an idle connection to the URL's host if the worker has one, or over a new
+// connection otherwise, and returns the response. If the server allows it, the connection
+// is then kept for the worker's next request to the same host
+func (w *Worker) SendKeepAlive(req []byte, u *url.URL, timeout time.Duration) (*http.Response, error) {
+	w.untimed = 0
+	for {
+		// The budget is spent before dialling, so a spent budget doesn't open connections it can't use
+		if err := w.spend(1); err != nil {
+			return nil, err
+		}
+
+		key := u.Scheme + "://" + u.Host
+		pc, reused := w.idle[key]
+		delete(w.idle, key)
+
+		if !reused {
+			conn, err := w.dial(u, timeout)
+			if err != nil {
+				return nil, err
+			}
+			pc = newPooledConn(conn)
+		}
+
+		start := time.Now()
+		resp, _, err := pc.roundTrip(w.Ctx, req, timeout, w.Conf.WaitForContinue)
+		w.recordRequest(start)
+		if err != nil {
+			pc.conn.Close()
+
+			// The server may have closed the idle connection in the meantime, so retry on a new one. The failed
+			// attempt isn't part of the time taken to answer the request
+			if reused && w.Ctx.Err() == nil {
+				w.untimed += time.Since(start)
+				continue
+			}
+			return nil, err
+		}
+
+		if resp.Close {
+			pc.conn.Close()
+		} else {
+			if w.idle == nil {
+				w.idle = make(map[string]*pooledConn, 0)
+			}
+			w.idle[key] = pc
+		}
+
+		return resp, nil
+	}
+}
+
+// SendTestRequest sends a request of a smuggling test which isn't meant to desync the connection, such as a
+// verification request, returning the same values as SendRequest. With ReuseTestConnections set, a request whose
+// body is the same length however it is framed, so can't leave anything unread on the connection, is sent over an
+// idle connection to the same host if there is one, and the connection is kept if the response is clean. Any other
+// result over a reused connection, including a timeout, may have been caused by the connection's earlier use, so
+// the request is then sent again over a new connection. Other requests always use new connections
+func (w *Worker) SendTestRequest(req []byte, u *url.URL, timeout time.Duration) (resp []byte, err error, isTimeout bool) {
+	if !w.Conf.ReuseTestConnections || !framingAgrees(req) {
+		return w.SendRequest(req, u, timeout)
+	}
+
+	key := u.Scheme + "://" + u.Host
+	w.untimed = 0
+	if pc, ok := w.idle[key]; ok {
+		delete(w.idle, key)
+		if err := w.spend(1); err != nil {
+			pc.conn.Close()
+			return nil, err, false
+		}
+		start := time.Now()
+		r, raw, err := pc.roundTrip(w.Ctx, req, timeout, w.Conf.WaitForContinue)
+		w.recordRequest(start)
+		if err == nil && cleanResponse(r) {
+			w.idle[key] = pc
+			w.untimed = pc.wait
+			return raw, nil, false
+		}
+		pc.conn.Close()
+		if err := w.Ctx.Err(); err != nil {
+			return nil, err, false
+		}
+
+		// The failed attempt isn't part of the time taken to answer the request
+		w.untimed = time.Since(start)
+	}
+
+	if err := w.spend(1); err != nil {
+		return nil, err, false
+	}
+	conn, err := w.dial(u, timeout)
+	if err != nil {
+		return nil, err, false
+	}
+	pc := newPooledConn(conn)
+	start := time.Now()
+	r, raw, err := pc.roundTrip(w.Ctx, req, timeout, w.Conf.WaitForContinue)
+	w.recordRequest(start)
+	w.untimed += pc.wait
+	if err != nil {
+		conn.Close()
+		if isTimeoutErr(err) {
+			return nil, nil, true
+		} else if err == io.EOF {
+			// Closed without a response, as SendRequest reports it
+			return nil, nil, false
+		}
+		return nil, err, false
+	}
+
+	if cleanResponse(r) {
+		if w.idle == nil {
+			w.idle = make(map[string]*pooledConn, 0)
+		}
+		w.idle[key] = pc
+	} else {
+		conn.Close()
+	}
+
+	return raw, nil, false
+}
+
+// cleanResponse returns whether resp shows that its request was accepted and the connection can be used for
+// another. Error responses are treated as unclean, as they may have been caused by bytes left over from an
+// earlier request
+func cleanResponse(resp *http.Response) bool {
+	return !resp.Close && resp.StatusCode < http.StatusBadRequest
+}
+
+// splitBody splits a raw request into its headers, including the blank line which ends them, and its body
+func splitBody(req []byte) ([]byte, []byte) {
+	i := bytes.Index(req, []byte("\r\n\r\n"))
+	if i < 0 {
+		return req, nil
+	}
+
+	return req[:i+4], req[i+4:]
+}
+
+// framingAgrees returns whether the body of req is the same length according to its Content-Length header as
+// when read as a chunked body, so a server using either leaves nothing of it unread on the connection. The first
+// requests of CL.TE and TE.CL tests deliberately disagree. Requests which can't be parsed are assumed to disagree
+func framingAgrees(req []byte) bool {
+	head, body := splitBody(req)
+	lower := strings.ToLower(string(head))
+
+	// Mutations obfuscate the Transfer-Encoding header, so any mention of chunking may be honoured
+	chunked := strings.Contains(lower, "transfer-encoding") || strings.Contains(lower, "chunked")
+
+	length := -1
+	for _, line := range strings.Split(lower, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 || !strings.Contains(line[:i], "content-length") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+		if err != nil || (length >= 0 && n != length) {
+			return false
+		}
+		length = n
+	}
+
+	if length < 0 && !chunked {
+		return len(body) == 0
+	} else if length >= 0 && length != len(body) {
+		return false
+	} else if !chunked {
+		return true
+	}
+
+	n, ok := chunkedLength(string(body))
+	return ok && n == len(body)
+}
+
+// chunkedLength returns the number of bytes of body making up a chunked body without trailers, and whether it
+// is a complete and valid one
+func chunkedLength(body string) (int, bool) {
+	n := 0
+	for {
+		i := strings.Index(body[n:], "\r\n")
+		if i < 0 {
+			return 0, false
+		}
+
+		// Chunk extensions don't change the size
+		line := body[n : n+i]
+		if j := strings.Index(line, ";"); j >= 0 {
+			line = line[:j]
+		}
+		size, err := strconv.ParseUint(strings.TrimSpace(line), 16, 31)
+		if err != nil {
+			return 0, false
+		}
+		n += i + 2
+
+		if size == 0 {
+			if !strings.HasPrefix(body[n:], "\r\n") {
+				return 0, false
+			}
+			return n + 2, true
+		}
+		if uint64(len(body)-n) < size+2 || body[n+int(size):n+int(size)+2] != "\r\n" {
+			return 0, false
+		}
+		n += int(size) + 2
+	}
+}
+
+// isTimeoutErr returns whether err is a network timeout
+func isTimeoutErr(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// closeIdle closes all of the worker's idle connections
+func (w *Worker) closeIdle() {
+	for _, pc := range w.idle {
+		pc.conn.Close()
+	}
+	w.idle = nil
+}
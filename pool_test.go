@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// keepAliveServer starts a stub server which answers each request with a 200, keeping connections open unless
+// asked to close them. It returns its URL, and a function returning the number of connections and requests it
+// has received
+func keepAliveServer(t *testing.T) (*url.URL, func() (int, int)) {
+	var mux sync.Mutex
+	conns, requests := 0, 0
+
+	u := stubServer(t, func(conn net.Conn) {
+		mux.Lock()
+		conns++
+		mux.Unlock()
+
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			mux.Lock()
+			requests++
+			mux.Unlock()
+
+			respond(conn, 200)
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+
+	return u, func() (int, int) {
+		mux.Lock()
+		defer mux.Unlock()
+		return conns, requests
+	}
+}
+
+func TestReuseConnections(t *testing.T) {
+	tests := []struct {
+		reuse bool
+		conns int
+	}{
+		{true, 1},
+		{false, 3},
+	}
+
+	for _, test := range tests {
+		u, counts := keepAliveServer(t)
+		w, errs := testWorker(Config{ReuseConnections: test.reuse, RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}})
+
+		// Each of the paths is on the same host, so can share a connection
+		urls := make(chan *url.URL, 3)
+		results := make(chan BaseResult, 3)
+		for _, path := range []string{"/a", "/b", "/c"} {
+			pu := *u
+			pu.Path = path
+			urls <- &pu
+		}
+		close(urls)
+		w.BaseTimes(urls, results, func() {})
+		noErrors(t, errs)
+
+		if len(results) != 3 {
+			t.Errorf("reuse %t: got %d base times, want 3", test.reuse, len(results))
+		}
+		if conns, requests := counts(); conns != test.conns || requests != 3 {
+			t.Errorf("reuse %t: got %d requests over %d connections, want 3 over %d", test.reuse, requests, conns, test.conns)
+		}
+	}
+}
+
+func TestSendKeepAliveRetry(t *testing.T) {
+	// A server which closes each connection after answering, without saying it will
+	u := stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err == nil {
+			respond(conn, 200)
+		}
+	})
+
+	// The idle connection is found to be closed when it's reused, so the request is retried on a new one
+	w, _ := testWorker(Config{})
+	for i := 0; i < 2; i++ {
+		resp, err := w.SendKeepAlive(baseReq(u, RequestOptions{}.keepAlive()), u, time.Second)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("request %d: got %v and %v", i, resp, err)
+		}
+	}
+	w.closeIdle()
+}
+
+func TestSendKeepAliveStaleUntimed(t *testing.T) {
+	u, closeServer := probeServer(t)
+	defer closeServer()
+
+	// The first connection is left idle as if by an earlier request, but never answers
+	w, _ := testWorker(Config{})
+	defer w.closeIdle()
+	conn, err := w.dial(u, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.idle = map[string]*pooledConn{u.Scheme + "://" + u.Host: newPooledConn(conn)}
+
+	resp, err := w.SendKeepAlive(baseReq(u, RequestOptions{}.keepAlive()), u, 200*time.Millisecond)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("got %v and %v, want the request retried on a new connection", resp, err)
+	}
+	if w.untimed < 200*time.Millisecond {
+		t.Errorf("got %s of the request untimed, want at least the 200ms of the failed attempt", w.untimed)
+	}
+}
+
+func TestSendKeepAliveCancelled(t *testing.T) {
+	// A server which never answers
+	u := stubServer(t, func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, _ := testWorker(Config{})
+	w.Ctx = ctx
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := w.SendKeepAlive(baseReq(u, RequestOptions{}.keepAlive()), u, 10*time.Second); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("took %s to return once cancelled, want it to stop waiting for the response", d)
+	}
+}
+
+func TestFramingAgrees(t *testing.T) {
+	u, _ := url.Parse("http://example.com/")
+	m := Mutation{TE: "Transfer-Encoding: chunked"}
+	opts := RequestOptions{}
+
+	tests := []struct {
+		name string
+		req  []byte
+		want bool
+	}{
+		{"base", baseReq(u, opts), true},
+		{"CL.TE probe", clte("POST", u, m, opts), false},
+		{"TE.CL probe", tecl("POST", u, m, opts), false},
+		{"CL.TE verification", clteVerify("POST", u, m, opts), false},
+		{"TE.CL verification", teclVerify("POST", u, m, opts), true},
+		{"content length only", []byte("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\nabc"), true},
+		{"short content length", []byte("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nabc"), false},
+		{"body without length", []byte("POST / HTTP/1.1\r\nHost: example.com\r\n\r\nabc"), false},
+		{"conflicting lengths", []byte("POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\n0\r\n\r\n"), false},
+		{"chunked with extension", []byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 15\r\n\r\n1;a=b\r\nQ\r\n0\r\n\r\n"), true},
+		{"obfuscated chunked", []byte("POST / HTTP/1.1\r\nTransfer-Encoding : chunked\r\nContent-Length: 6\r\n\r\n0\r\n\r\nX"), false},
+	}
+	for _, test := range tests {
+		if got := framingAgrees(test.req); got != test.want {
+			t.Errorf("%s: got %t, want %t for %q", test.name, got, test.want, test.req)
+		}
+	}
+}
+
+// probeServer starts a server which answers every request with a keep-alive 200 response, except on the first
+// connection, which never answers. It returns the server's URL
+func probeServer(t *testing.T) (*url.URL, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for first := true; ; first = false {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, silent bool) {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					if !silent {
+						conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+					}
+				}
+			}(conn, first)
+		}
+	}()
+
+	u, _ := url.Parse("http://" + l.Addr().String() + "/")
+	return u, func() { l.Close() }
+}
+
+func TestSendTestRequestRetriesReusedTimeout(t *testing.T) {
+	u, closeServer := probeServer(t)
+	defer closeServer()
+
+	w := Worker{Ctx: context.Background(), Conf: Config{ReuseTestConnections: true}}
+	defer w.closeIdle()
+
+	// The first connection is left idle as if by an earlier request, but never answers
+	conn, err := w.dial(u, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.idle = map[string]*pooledConn{u.Scheme + "://" + u.Host: newPooledConn(conn)}
+
+	resp, err, isTimeout := w.SendTestRequest(baseReq(u, RequestOptions{}.keepAlive()), u, 200*time.Millisecond)
+	if err != nil || isTimeout {
+		t.Fatalf("got error %v and timeout %t, want the request retried on a new connection", err, isTimeout)
+	}
+	if want := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"; string(resp) != want {
+		t.Errorf("got %q, want %q", resp, want)
+	}
+	if len(w.idle) != 1 {
+		t.Errorf("got %d idle connections after a clean base request, want 1", len(w.idle))
+	}
+	if w.untimed < 200*time.Millisecond {
+		t.Errorf("got %s of the request untimed, want at least the 200ms of the failed attempt", w.untimed)
+	}
+}
+
+func TestSendTestRequestDoesntKeepProbeConnections(t *testing.T) {
+	u, closeServer := probeServer(t)
+	defer closeServer()
+
+	// Use up the silent first connection
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	w := Worker{Ctx: context.Background(), Conf: Config{ReuseTestConnections: true}}
+	defer w.closeIdle()
+	m := Mutation{TE: "Transfer-Encoding: chunked"}
+	opts := RequestOptions{}.keepAlive()
+	for _, req := range [][]byte{clte("POST", u, m, opts), tecl("POST", u, m, opts), clteVerify("POST", u, m, opts)} {
+		resp, err, isTimeout := w.SendTestRequest(req, u, time.Second)
+		if err != nil || isTimeout || !strings.HasPrefix(string(resp), "HTTP/1.1 200 OK") {
+			t.Fatalf("got %q, error %v, and timeout %t, want 200 OK", resp, err, isTimeout)
+		}
+		if len(w.idle) != 0 {
+			t.Errorf("connection was kept for reuse, leaving part of the body unread for %q", req)
+		}
+	}
+}
+
+func TestSendTestRequestReusesConnections(t *testing.T) {
+	u, counts := keepAliveServer(t)
+	w, _ := testWorker(Config{ReuseTestConnections: true})
+	defer w.closeIdle()
+
+	// Requests which leave nothing unread on the connection can share it
+	m := Mutation{TE: "Transfer-Encoding: chunked"}
+	opts := RequestOptions{}.keepAlive()
+	for i, req := range [][]byte{baseReq(u, opts), teclVerify("POST", u, m, opts), notFoundReq(u, opts)} {
+		resp, err, isTimeout := w.SendTestRequest(req, u, time.Second)
+		if err != nil || isTimeout || !strings.HasPrefix(string(resp), "HTTP/1.1 200") {
+			t.Fatalf("request %d: got %q, error %v, and timeout %t", i, resp, err, isTimeout)
+		}
+	}
+	if conns, requests := counts(); conns != 1 || requests != 3 {
+		t.Errorf("got %d requests over %d connections, want 3 over 1", requests, conns)
+	}
+}
+
+// teclTimeoutServer starts a stub server which reads request bodies using their Content-Length header, and never
+// answers a request whose body ends with the byte a TE.CL test leaves for the backend, as if a frontend using
+// chunked encoding had held it back. Other requests get a 200 over a kept-alive connection. It returns its URL,
+// and a function returning the number of connections it has received
+func teclTimeoutServer(t *testing.T) (*url.URL, func() int) {
+	var conns int32
+	u := stubServer(t, func(conn net.Conn) {
+		atomic.AddInt32(&conns, 1)
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(headerValue(head, "Content-Length"))
+			body := make([]byte, n)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			if strings.HasSuffix(string(body), "X") {
+				io.Copy(ioutil.Discard, conn)
+				return
+			}
+			respond(conn, 200)
+		}
+	})
+
+	return u, func() int { return int(atomic.LoadInt32(&conns)) }
+}
+
+func TestReuseTestConnectionsScan(t *testing.T) {
+	mutations := generateMutations()
+	names := []string{"standard", "obs-fold-te-value", "split-value"}
+	for _, name := range names {
+		if _, ok := mutations[name]; !ok {
+			t.Fatalf("no %s mutation", name)
+		}
+	}
+
+	// Each test sends a CL.TE and a TE.CL probe over new connections, and a TE.CL verification request after the
+	// TE.CL probe times out, which can share a connection with those of the other tests
+	tests := []struct {
+		reuse bool
+		conns int
+	}{
+		{false, 3 * len(names)},
+		{true, 2*len(names) + 1},
+	}
+
+	for _, test := range tests {
+		u, conns := teclTimeoutServer(t)
+		w, errs := testWorker(Config{ReuseTestConnections: test.reuse, Mutations: mutations})
+		queue := make(chan SmuggleTest, len(names))
+		results := make(chan SmuggleTest, len(names))
+		for _, name := range names {
+			queue <- SmuggleTest{Url: u, Method: "POST", Mutation: name, Timeout: 200 * time.Millisecond}
+		}
+		close(queue)
+		w.SmuggleTest(queue, results, func() {})
+		close(results)
+		noErrors(t, errs)
+
+		for r := range results {
+			if r.Status != TECL {
+				t.Errorf("reuse %t: got status %q for %s, want %q", test.reuse, r.Status, r.Mutation, TECL)
+			}
+		}
+		if n := conns(); n != test.conns {
+			t.Errorf("reuse %t: got %d connections, want %d", test.reuse, n, test.conns)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// profileBuckets are the upper bounds of the histogram buckets which request times are counted in. Requests
+// taking longer than the last are counted in a final, unbounded bucket
+var profileBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// WorkerProfile records a histogram of how long the requests sent by each worker took, to find workers which are
+// slower or busier than the rest. It is safe for concurrent use
+type WorkerProfile struct {
+	names   []string
+	timings map[string]*requestTimings
+	mux     sync.Mutex
+}
+
+// requestTimings is the distribution of the times of a set of requests
+type requestTimings struct {
+	Buckets  []int
+	Requests int
+	Total    time.Duration
+	Max      time.Duration
+}
+
+// add counts a request which took d
+func (t *requestTimings) add(d time.Duration) {
+	i := 0
+	for i < len(profileBuckets) && d > profileBuckets[i] {
+		i++
+	}
+	t.Buckets[i]++
+	t.Requests++
+	t.Total += d
+	if d > t.Max {
+		t.Max = d
+	}
+}
+
+// mean returns the mean time of the requests, or 0 if there weren't any
+func (t *requestTimings) mean() time.Duration {
+	if t.Requests == 0 {
+		return 0
+	}
+
+	return t.Total / time.Duration(t.Requests)
+}
+
+// NewWorkerProfile returns an empty profile of the workers with the given names, which are reported in that order
+func NewWorkerProfile(names []string) *WorkerProfile {
+	p := &WorkerProfile{
+		names:   names,
+		timings: make(map[string]*requestTimings, len(names)),
+	}
+	for _, name := range names {
+		p.timings[name] = &requestTimings{Buckets: make([]int, len(profileBuckets)+1)}
+	}
+
+	return p
+}
+
+// Record counts a request sent by the named worker which started at start and has just finished
+func (p *WorkerProfile) Record(worker string, start time.Time) {
+	d := time.Since(start)
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if t, ok := p.timings[worker]; ok {
+		t.add(d)
+	}
+}
+
+// Write writes a table of each worker's number of requests, mean and maximum request times, and the number of
+// requests in each bucket of the histogram, followed by the same for all workers together
+func (p *WorkerProfile) Write(w io.Writer) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := []string{"worker", "requests", "mean", "max"}
+	for _, b := range profileBuckets {
+		header = append(header, "<="+b.String())
+	}
+	header = append(header, ">"+profileBuckets[len(profileBuckets)-1].String())
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+
+	all := &requestTimings{Buckets: make([]int, len(profileBuckets)+1)}
+	row := func(name string, t *requestTimings) {
+		fields := []string{name, fmt.Sprint(t.Requests), t.mean().Round(time.Millisecond).String(), t.Max.Round(time.Millisecond).String()}
+		for _, n := range t.Buckets {
+			fields = append(fields, fmt.Sprint(n))
+		}
+		fmt.Fprintln(tw, strings.Join(fields, "\t")+"\t")
+	}
+	for _, name := range p.names {
+		t := p.timings[name]
+		row(name, t)
+		for i, n := range t.Buckets {
+			all.Buckets[i] += n
+		}
+		all.Requests += t.Requests
+		all.Total += t.Total
+		if t.Max > all.Max {
+			all.Max = t.Max
+		}
+	}
+	row("all", all)
+
+	return tw.Flush()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkerProfile(t *testing.T) {
+	p := NewWorkerProfile([]string{"0", "1"})
+
+	// Requests are recorded as they finish, so their times are injected through when they started
+	for _, d := range []time.Duration{5 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond} {
+		p.Record("0", time.Now().Add(-d))
+	}
+	p.Record("1", time.Now().Add(-time.Minute))
+	p.Record("unknown", time.Now())
+
+	want := map[string][]int{
+		"0": {1, 0, 0, 1, 1, 0, 0, 0, 0, 0, 0},
+		"1": {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	}
+	for name, buckets := range want {
+		if got := p.timings[name].Buckets; !reflect.DeepEqual(got, buckets) {
+			t.Errorf("worker %s: got buckets %v, want %v", name, got, buckets)
+		}
+	}
+	if r := p.timings["0"]; r.Requests != 3 || r.Max < 300*time.Millisecond || r.Max > 400*time.Millisecond {
+		t.Errorf("worker 0: got %d requests with a maximum of %v, want 3 with a maximum of about 300ms", r.Requests, r.Max)
+	}
+
+	var b bytes.Buffer
+	if err := p.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want a header, a line for each worker, and a total: %q", len(lines), b.String())
+	}
+	for i, prefix := range []string{"worker", "0", "1", "all"} {
+		if fields := strings.Fields(lines[i]); fields[0] != prefix {
+			t.Errorf("got line %q, want it to start with %s", lines[i], prefix)
+		}
+	}
+	if fields := strings.Fields(lines[3]); fields[1] != "4" || fields[len(fields)-1] != "1" {
+		t.Errorf("got total %q, want 4 requests with 1 over 30s", lines[3])
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// TestQueue holds the smuggling tests waiting to be sent, which are taken from it in a random order. Tests can be
+// added while others are being taken, so that testing can begin before all of the tests are known. It is safe for
+// concurrent use
+type TestQueue struct {
+	tests  []SmuggleTest
+	closed bool
+	mux    sync.Mutex
+	cond   *sync.Cond
+}
+
+// NewTestQueue returns an empty queue
+func NewTestQueue() *TestQueue {
+	q := &TestQueue{tests: make([]SmuggleTest, 0)}
+	q.cond = sync.NewCond(&q.mux)
+	return q
+}
+
+// Push adds tests to the queue
+func (q *TestQueue) Push(tests []SmuggleTest) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.tests = append(q.tests, tests...)
+	q.cond.Broadcast()
+}
+
+// Close marks that no more tests will be added to the queue
+func (q *TestQueue) Close() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Next removes a test chosen at random from the queue and returns it, waiting for a test to be added if the queue
+// is empty. It returns false once the queue is empty and closed
+func (q *TestQueue) Next() (SmuggleTest, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for len(q.tests) == 0 {
+		if q.closed {
+			return SmuggleTest{}, false
+		}
+		q.cond.Wait()
+	}
+
+	i := rand.Intn(len(q.tests))
+	t := q.tests[i]
+	q.tests = append(q.tests[:i], q.tests[i+1:]...)
+
+	return t, true
+}
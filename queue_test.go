@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// numberedTests returns n tests with distinct mutations, starting from the given number
+func numberedTests(from int, n int) []SmuggleTest {
+	tests := make([]SmuggleTest, n)
+	for i := range tests {
+		tests[i] = SmuggleTest{Method: "POST", Mutation: fmt.Sprintf("m%d", from+i)}
+	}
+	return tests
+}
+
+func TestTestQueueEachTestOnce(t *testing.T) {
+	q := NewTestQueue()
+	q.Push(numberedTests(0, 50))
+
+	// Tests are pushed while others are being taken by several workers
+	taken := make(map[string]int, 0)
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				test, ok := q.Next()
+				if !ok {
+					return
+				}
+				mux.Lock()
+				taken[test.Mutation]++
+				mux.Unlock()
+			}
+		}()
+	}
+	q.Push(numberedTests(50, 50))
+	q.Push(numberedTests(100, 50))
+	q.Close()
+	wg.Wait()
+
+	if len(taken) != 150 {
+		t.Errorf("took %d distinct tests, want 150", len(taken))
+	}
+	for m, n := range taken {
+		if n != 1 {
+			t.Errorf("%s taken %d times, want once", m, n)
+		}
+	}
+}
+
+func TestTestQueueWaitsForPush(t *testing.T) {
+	q := NewTestQueue()
+	next := make(chan SmuggleTest)
+	go func() {
+		test, _ := q.Next()
+		next <- test
+	}()
+
+	select {
+	case test := <-next:
+		t.Fatalf("got %s from an empty queue", test.Mutation)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Push(numberedTests(0, 1))
+	select {
+	case test := <-next:
+		if test.Mutation != "m0" {
+			t.Errorf("got %s, want the test pushed", test.Mutation)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next didn't return after a test was pushed")
+	}
+}
+
+func TestTestQueueClosed(t *testing.T) {
+	q := NewTestQueue()
+	done := make(chan bool)
+	go func() {
+		_, ok := q.Next()
+		done <- ok
+	}()
+
+	q.Close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("got a test from an empty closed queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next didn't return after the queue was closed")
+	}
+}
+
+func TestTestQueueRandomOrder(t *testing.T) {
+	q := NewTestQueue()
+	q.Push(numberedTests(0, 100))
+	q.Close()
+
+	// The chance of 100 tests coming out in the order pushed is negligible
+	inOrder := true
+	for i := 0; ; i++ {
+		test, ok := q.Next()
+		if !ok {
+			break
+		}
+		if test.Mutation != fmt.Sprintf("m%d", i) {
+			inOrder = false
+		}
+	}
+	if inOrder {
+		t.Error("tests were taken in the order pushed, want a random order")
+	}
+}
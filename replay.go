@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"time"
+)
+
+// replayRaw sends the raw request in the given file to the host of u exactly as written, without adding any
+// headers or mutations. It returns how long the response took, the response, and whether it timed out
+func replayRaw(conf Config, resolver *DoHResolver, localAddrs *LocalAddrs, filename string, u *url.URL, timeout time.Duration) (time.Duration, []byte, bool, error) {
+	req, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	w := Worker{
+		Ctx:        context.Background(),
+		Conf:       conf,
+		Resolver:   resolver,
+		LocalAddrs: localAddrs,
+	}
+	start := time.Now()
+	resp, err, isTimeout := w.SendRequest(req, u, timeout)
+
+	return time.Since(start), resp, isTimeout, err
+}
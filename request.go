@@ -1,112 +1,392 @@
 package main
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"net/url"
+	"strings"
 )
 
+// RequestOptions controls how the requests sent to targets are written, other than the mutation being tested
+type RequestOptions struct {
+	// The headers to add to requests
+	Headers []string
+
+	// How to case the names of headers other than the mutation: "lower", "upper", or "" to leave them as written
+	HeaderCase string
+
+	// The HTTP version to send in request lines, either "1.0" or "1.1". Defaults to "1.1" if empty
+	HTTPVersion string
+
+	// The size and number of the data chunks in chunked test bodies. 0 uses the default for each test
+	ChunkSize  int
+	ChunkCount int
+
+	// Whether to shuffle the Host header and added headers, and the seed to shuffle them with
+	RandomizeHeaderOrder bool
+	HeaderOrderSeed      int64
+
+	// Whether to add a query parameter with a random value to each request, so that caches are bypassed
+	CacheBust bool
+
+	// Whether to send an Expect: 100-continue header with requests which have a body
+	ExpectContinue bool
+
+	// The path requested to tell the response to a smuggled or pipelined request apart from a normal response,
+	// which shouldn't exist on targets. Defaults to /smuggles404 if empty
+	MarkerPath string
+}
+
+// markerPath returns the path to request to tell responses to smuggled or pipelined requests apart
+func (o RequestOptions) markerPath() string {
+	if o.MarkerPath == "" {
+		return "/smuggles404"
+	}
+
+	return o.MarkerPath
+}
+
+// expectContinue returns the Expect: 100-continue header line if ExpectContinue is set, for requests with a body
+func (o RequestOptions) expectContinue() string {
+	if !o.ExpectContinue {
+		return ""
+	}
+
+	return o.header("Expect", "100-continue")
+}
+
+// chunkedData returns the data chunks of a chunked test body, which are ChunkCount chunks of ChunkSize bytes each,
+// with ext added to each chunk's size line. If either isn't set, defaultCount chunks or chunks of a single byte are
+// used instead
+func (o RequestOptions) chunkedData(defaultCount int, ext string) string {
+	size, count := o.ChunkSize, o.ChunkCount
+	if size <= 0 {
+		size = 1
+	}
+	if count <= 0 {
+		count = defaultCount
+	}
+
+	chunk := fmt.Sprintf("%x%s\r\n%s\r\n", size, ext, strings.Repeat("Z", size))
+	return strings.Repeat(chunk, count)
+}
+
+// headerLines returns the Host header for u followed by the added headers, shuffled if RandomizeHeaderOrder is
+// set. The order only depends on the seed, method, and URL, so is the same each time a request is generated
+func (o RequestOptions) headerLines(method string, u *url.URL) string {
+	lines := make([]string, 0, len(o.Headers)+1)
+	lines = append(lines, o.header("Host", u.Hostname()))
+	for _, h := range o.Headers {
+		lines = append(lines, o.caseHeader(h)+"\r\n")
+	}
+
+	if o.RandomizeHeaderOrder {
+		h := fnv.New64a()
+		h.Write([]byte(method + " " + u.String()))
+		r := rand.New(rand.NewSource(o.HeaderOrderSeed ^ int64(h.Sum64())))
+		r.Shuffle(len(lines), func(i, j int) {
+			lines[i], lines[j] = lines[j], lines[i]
+		})
+	}
+
+	return strings.Join(lines, "")
+}
+
+// requestLine returns the request line for a request with the given method and path, with a cache busting query
+// parameter added if CacheBust is set
+func (o RequestOptions) requestLine(method string, path string) string {
+	version := o.HTTPVersion
+	if version == "" {
+		version = "1.1"
+	}
+
+	if o.CacheBust {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "cb=" + cacheBuster()
+	}
+
+	return fmt.Sprintf("%s %s HTTP/%s\r\n", method, path, version)
+}
+
+// cacheBuster returns a random value for a cache busting query parameter. The math/rand source is seeded with
+// the scan's seed, so could repeat values between scans and be served from the cache
+func cacheBuster() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// header returns a header line with the given name and value, cased according to HeaderCase
+func (o RequestOptions) header(name string, value string) string {
+	return o.caseHeader(fmt.Sprintf("%s: %s", name, value)) + "\r\n"
+}
+
+// caseHeader returns the header line h with its name cased according to HeaderCase
+func (o RequestOptions) caseHeader(h string) string {
+	i := strings.Index(h, ":")
+	if i < 0 {
+		return h
+	}
+
+	switch o.HeaderCase {
+	case "lower":
+		return strings.ToLower(h[:i]) + h[i:]
+	case "upper":
+		return strings.ToUpper(h[:i]) + h[i:]
+	default:
+		return h
+	}
+}
+
+// keepAlive returns a copy of the options with any Connection header replaced by one asking for the
+// connection to be kept open
+func (o RequestOptions) keepAlive() RequestOptions {
+	headers := make([]string, 0, len(o.Headers)+1)
+	for _, h := range o.Headers {
+		if headerName(h) != "connection" {
+			headers = append(headers, h)
+		}
+	}
+	o.Headers = append(headers, "Connection: keep-alive")
+
+	return o
+}
+
 // baseReq returns a base request used to test the service
-func baseReq(u *url.URL, headers []string) []byte {
+func baseReq(u *url.URL, opts RequestOptions) []byte {
 	path := "/"
 	if u.Path != "" {
 		path = u.Path
 	}
 
-	f := fmt.Sprintf("GET %s HTTP/1.1\r\n", path)
-	f += fmt.Sprintf("Host: %s\r\n", u.Hostname())
-	for _, h := range headers {
-		f += h + "\r\n"
-	}
+	f := opts.requestLine("GET", path)
+	f += opts.headerLines("GET", u)
 	f += "\r\n"
 
 	return []byte(f)
 }
 
-// clte returns a CL.TE test request for the given URL using the given method and Transfer-Encoding header.
-// If a CL.TE issue is exploitable with the giiven TE header, then this request should timeout.
-func clte(method string, u *url.URL, te string, headers []string) []byte {
+// clte returns a CL.TE test request for the given URL using the given method and mutation.
+// If a CL.TE issue is exploitable with the given mutation, then this request should timeout.
+func clte(method string, u *url.URL, m Mutation, opts RequestOptions) []byte {
 	path := "/"
 	if u.Path != "" {
 		path = u.Path
 
 	}
 
-	f := fmt.Sprintf("%s %s HTTP/1.1\r\n", method, path)
-	f += te + "\r\n"
-	f += fmt.Sprintf("Host: %s\r\n", u.Hostname())
-	for _, h := range headers {
-		f += h + "\r\n"
-	}
-	f += "Content-Length: 4\r\n"
+	f := opts.requestLine(method, path)
+	f += m.TE + "\r\n"
+	f += opts.headerLines(method, u)
+	f += opts.expectContinue()
+	// The Content-Length header stops short of the CRLF ending the last chunk, so the backend waits for it
+	body := opts.chunkedData(1, m.ChunkExt) + "Q"
+	f += m.contentLength(len(body)-3, opts)
+	f += m.lateHeaders()
 	f += "\r\n"
-	f += "1\r\nZ\r\nQ"
+	f += body
 
 	return []byte(f)
 }
 
-// tecl returns a TE.Cl test request for the given URL using the given method and Transfer-Encoding header.
-// If a TE.CL issue is exploitable with the giiven TE header, then this request should timeout.
-func tecl(method string, u *url.URL, te string, headers []string) []byte {
+// tecl returns a TE.Cl test request for the given URL using the given method and mutation.
+// If a TE.CL issue is exploitable with the given mutation, then this request should timeout.
+func tecl(method string, u *url.URL, m Mutation, opts RequestOptions) []byte {
 	path := "/"
 	if u.Path != "" {
 		path = u.Path
 
 	}
 
-	f := fmt.Sprintf("%s %s HTTP/1.1\r\n", method, path)
-	f += te + "\r\n"
-	f += fmt.Sprintf("Host: %s\r\n", u.Hostname())
-	for _, h := range headers {
-		f += h + "\r\n"
-	}
-	f += "Content-Length: 6\r\n"
+	f := opts.requestLine(method, path)
+	f += m.TE + "\r\n"
+	f += opts.headerLines(method, u)
+	f += opts.expectContinue()
+	body := opts.chunkedData(0, m.ChunkExt) + m.terminator() + "X"
+	f += m.contentLength(len(body), opts)
+	f += m.lateHeaders()
 	f += "\r\n"
-	f += "0\r\n\r\nX"
+	f += body
 
 	return []byte(f)
 }
 
-// clteVerif returns a CL.TE verification request for the given URL using the given method and Transfer-Encoding header.
-// If a CL.TE issue is exploitable with the given TE header, then this request should not timeout, but will likely
+// clteVerif returns a CL.TE verification request for the given URL using the given method and mutation.
+// If a CL.TE issue is exploitable with the given mutation, then this request should not timeout, but will likely
 // return an error status code due to an invalid content length.
-func clteVerify(method string, u *url.URL, te string, headers []string) []byte {
+func clteVerify(method string, u *url.URL, m Mutation, opts RequestOptions) []byte {
 	path := "/"
 	if u.Path != "" {
 		path = u.Path
 
 	}
 
-	f := fmt.Sprintf("%s %s HTTP/1.1\r\n", method, path)
-	f += te + "\r\n"
-	f += fmt.Sprintf("Host: %s\r\n", u.Hostname())
-	for _, h := range headers {
-		f += h + "\r\n"
+	f := opts.requestLine(method, path)
+	f += m.TE + "\r\n"
+	f += opts.headerLines(method, u)
+	f += opts.expectContinue()
+	body := opts.chunkedData(1, m.ChunkExt) + "Q"
+	f += m.contentLength(len(body), opts)
+	f += m.lateHeaders()
+	f += "\r\n"
+	f += body
+
+	return []byte(f)
+}
+
+// teclVerify returns a TE.Cl verification request for the given URL using the given method and mutation
+// If a TE.CL issue is exploitable with the given mutation, then this request should not timeout.
+func teclVerify(method string, u *url.URL, m Mutation, opts RequestOptions) []byte {
+	path := "/"
+	if u.Path != "" {
+		path = u.Path
+
 	}
-	f += "Content-Length: 7\r\n"
+
+	f := opts.requestLine(method, path)
+	f += m.TE + "\r\n"
+	f += opts.headerLines(method, u)
+	f += opts.expectContinue()
+	body := opts.chunkedData(0, m.ChunkExt) + m.terminator()
+	f += m.contentLength(len(body), opts)
+	f += m.lateHeaders()
 	f += "\r\n"
-	f += "1\r\nZ\r\nQ"
+	f += body
 
 	return []byte(f)
 }
 
-// teclVerify returns a TE.Cl verification request for the given URL using the given method and Transfer-Encoding header
-// If a TE.CL issue is exploitable with the given TE header, then this request should not timeout.
-func teclVerify(method string, u *url.URL, te string, headers []string) []byte {
+// smugglePrefixes are the built-in request lines which can be smuggled to confirm TE.CL desyncs, indexed by name.
+// Any %s is replaced with the marker path
+var smugglePrefixes = map[string]string{
+	"404":    "GET %s HTTP/1.1",
+	"method": "GPOST / HTTP/1.1",
+}
+
+// teclPrefix returns a TE.CL request for the given URL using the given method and mutation, whose chunked body
+// contains a smuggled request with the given request line. A backend which uses the Content-Length header will
+// stop reading the body after the chunk size, and treat the smuggled request as the next request on the connection.
+// The options should keep the connection alive.
+func teclPrefix(method string, u *url.URL, m Mutation, requestLine string, opts RequestOptions) []byte {
 	path := "/"
 	if u.Path != "" {
 		path = u.Path
+	}
 
+	// The body of the smuggled request is the end of the chunked body, so it is complete on its own
+	tail := "\r\n" + m.terminator()
+	smuggled := requestLine + "\r\n"
+	smuggled += opts.header("Host", u.Hostname())
+	smuggled += opts.header("Content-Length", fmt.Sprint(len(tail)))
+	smuggled += "\r\n"
+	size := fmt.Sprintf("%x%s\r\n", len(smuggled), m.ChunkExt)
+
+	f := opts.requestLine(method, path)
+	f += m.TE + "\r\n"
+	f += opts.headerLines(method, u)
+	f += opts.expectContinue()
+	f += m.contentLength(len(size), opts)
+	f += m.lateHeaders()
+	f += "\r\n"
+	f += size + smuggled + tail
+
+	return []byte(f)
+}
+
+// zerocl returns a 0.CL test request for the given URL using the given method. The body is the start of a
+// request for the marker path, which a backend that ignores the Content-Length header will prepend
+// to the next request sent over the connection. The options should keep the connection alive.
+func zerocl(method string, u *url.URL, opts RequestOptions) []byte {
+	path := "/"
+	if u.Path != "" {
+		path = u.Path
 	}
 
-	f := fmt.Sprintf("%s %s HTTP/1.1\r\n", method, path)
-	f += te + "\r\n"
-	f += fmt.Sprintf("Host: %s\r\n", u.Hostname())
-	for _, h := range headers {
-		f += h + "\r\n"
+	body := "GET " + opts.markerPath() + " HTTP/1.1\r\nX: "
+
+	f := opts.requestLine(method, path)
+	f += opts.headerLines(method, u)
+	f += opts.expectContinue()
+	f += opts.header("Content-Length", fmt.Sprint(len(body)))
+	f += "\r\n"
+	f += body
+
+	return []byte(f)
+}
+
+// notFoundReq returns a GET request for the marker path on the host of the given URL
+func notFoundReq(u *url.URL, opts RequestOptions) []byte {
+	f := opts.requestLine("GET", opts.markerPath())
+	f += opts.headerLines("GET", u)
+	f += "\r\n"
+
+	return []byte(f)
+}
+
+// routingHost is the host sent alongside a target's own in the duplicate Host header tests, which shouldn't be
+// served by any target
+const routingHost = "smuggles.invalid"
+
+// hostReq returns a request to the given URL using the given method, with a Host header for each of the given hosts
+// in order. The Host headers are kept first and in order even if RandomizeHeaderOrder is set
+func hostReq(method string, u *url.URL, opts RequestOptions, hosts ...string) []byte {
+	path := "/"
+	if u.Path != "" {
+		path = u.Path
+	}
+
+	f := opts.requestLine(method, path)
+	for _, h := range hosts {
+		f += opts.header("Host", h)
+	}
+	for _, h := range opts.Headers {
+		f += opts.caseHeader(h) + "\r\n"
+	}
+	f += "\r\n"
+
+	return []byte(f)
+}
+
+// pipelineReq returns a request to the given URL using the given method, with a short body framed by a standard
+// Content-Length header, to be pipelined ahead of another request. The options should keep the connection alive.
+func pipelineReq(method string, u *url.URL, opts RequestOptions) []byte {
+	path := "/"
+	if u.Path != "" {
+		path = u.Path
 	}
-	f += "Content-Length: 5\r\n"
+
+	body := "x=1"
+
+	f := opts.requestLine(method, path)
+	f += opts.headerLines(method, u)
+	f += opts.expectContinue()
+	f += opts.header("Content-Length", fmt.Sprint(len(body)))
 	f += "\r\n"
-	f += "0\r\n\r\n"
+	f += body
 
 	return []byte(f)
 }
+
+// closesConnection returns whether req has a Connection header asking for the connection to be closed after the
+// response, in which case the whole response can be read by reading until the server closes the connection
+func closesConnection(req []byte) bool {
+	head := string(req)
+	if i := strings.Index(head, "\r\n\r\n"); i >= 0 {
+		head = head[:i]
+	}
+
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		i := strings.Index(line, ":")
+		if i >= 0 && headerName(line) == "connection" && strings.Contains(strings.ToLower(line[i+1:]), "close") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPVersion(t *testing.T) {
+	u, _ := url.Parse("https://example.com/path")
+	m := generateMutations()["standard"]
+	builders := map[string]func(opts RequestOptions) []byte{
+		"base":        func(opts RequestOptions) []byte { return baseReq(u, opts) },
+		"CL.TE":       func(opts RequestOptions) []byte { return clte("POST", u, m, opts) },
+		"TE.CL":       func(opts RequestOptions) []byte { return tecl("POST", u, m, opts) },
+		"CL.TE check": func(opts RequestOptions) []byte { return clteVerify("POST", u, m, opts) },
+		"TE.CL check": func(opts RequestOptions) []byte { return teclVerify("POST", u, m, opts) },
+		"0.CL":        func(opts RequestOptions) []byte { return zerocl("POST", u, opts) },
+	}
+	versions := map[string]string{
+		"":    "HTTP/1.1",
+		"1.1": "HTTP/1.1",
+		"1.0": "HTTP/1.0",
+	}
+
+	for name, build := range builders {
+		for version, want := range versions {
+			req := string(build(RequestOptions{HTTPVersion: version}))
+			line := strings.SplitN(req, "\r\n", 2)[0]
+			if !strings.HasSuffix(line, " /path "+want) {
+				t.Errorf("%s with version %q: got request line %q, want %s", name, version, line, want)
+			}
+		}
+	}
+
+	// The prefix smuggled by 0.CL tests is only parsed by the backend, so keeps its version
+	if req := string(zerocl("POST", u, RequestOptions{HTTPVersion: "1.0"})); !strings.Contains(req, "GET /smuggles404 HTTP/1.1\r\n") {
+		t.Errorf("got 0.CL request %q, want the smuggled prefix to use HTTP/1.1", req)
+	}
+}
+
+func TestTECLPrefix(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	m := generateMutations()["standard"]
+	req := string(teclPrefix("POST", u, m, strings.ReplaceAll(smugglePrefixes["404"], "%s", "/smuggles404"), RequestOptions{}))
+
+	head := strings.SplitN(req, "\r\n\r\n", 2)
+	if len(head) != 2 {
+		t.Fatalf("got request %q with no body", req)
+	}
+	size := strings.SplitN(head[1], "\r\n", 2)[0]
+	if cl := headerValue(head[0], "Content-Length"); cl != fmt.Sprint(len(size)+2) {
+		t.Errorf("got Content-Length %s, want it to cover just the chunk size %q", cl, size)
+	}
+	if !strings.HasPrefix(head[1], size+"\r\nGET /smuggles404 HTTP/1.1\r\n") {
+		t.Errorf("got body %q, want the smuggled request after the chunk size", head[1])
+	}
+	if !strings.HasSuffix(req, "\r\n0\r\n\r\n") {
+		t.Errorf("got body %q, want it to end with the terminating chunk", head[1])
+	}
+}
+
+func TestRandomizeHeaderOrder(t *testing.T) {
+	m := generateMutations()["standard"]
+	headers := []string{"A: 1", "B: 2", "C: 3", "D: 4", "E: 5"}
+	orders := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		u, _ := url.Parse(fmt.Sprintf("https://example.com/%d", i))
+		opts := RequestOptions{Headers: headers, RandomizeHeaderOrder: true, HeaderOrderSeed: 1}
+		req := string(clte("POST", u, m, opts))
+		lines := strings.Split(strings.SplitN(req, "\r\n\r\n", 2)[0], "\r\n")
+
+		// The framing headers stay either side of the shuffled ones
+		if lines[1] != m.TE {
+			t.Errorf("%s: got second line %q, want the Transfer-Encoding header", u, lines[1])
+		}
+		if last := lines[len(lines)-1]; last != "Content-Length: 4" {
+			t.Errorf("%s: got last header %q, want the Content-Length header", u, last)
+		}
+		shuffled := lines[2 : len(lines)-1]
+		if len(shuffled) != len(headers)+1 {
+			t.Fatalf("%s: got headers %q, want the Host header and each added header", u, shuffled)
+		}
+		orders[strings.Join(shuffled, "|")] = true
+
+		// The same request gets the same order each time it is generated
+		if again := string(clte("POST", u, m, opts)); again != req {
+			t.Errorf("%s: got %q then %q", u, req, again)
+		}
+	}
+
+	if len(orders) < 2 {
+		t.Errorf("got the same header order for every request: %v", orders)
+	}
+
+	// Without the option, headers are in the order given
+	u, _ := url.Parse("https://example.com/")
+	req := string(baseReq(u, RequestOptions{Headers: headers}))
+	if !strings.Contains(req, "Host: example.com\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\nE: 5\r\n\r\n") {
+		t.Errorf("got request %q, want the headers in order", req)
+	}
+}
+
+func TestChunkedBody(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	m := generateMutations()["standard"]
+	big := strings.Repeat("Z", 26)
+	tests := []struct {
+		name        string
+		build       func(method string, u *url.URL, m Mutation, opts RequestOptions) []byte
+		size, count int
+		body        string
+		cl          int
+	}{
+		{"CL.TE default", clte, 0, 0, "1\r\nZ\r\nQ", 4},
+		{"CL.TE", clte, 3, 2, "3\r\nZZZ\r\n3\r\nZZZ\r\nQ", 14},
+		{"CL.TE hex size", clte, 26, 1, "1a\r\n" + big + "\r\nQ", 30},
+		{"CL.TE check default", clteVerify, 0, 0, "1\r\nZ\r\nQ", 7},
+		{"CL.TE check", clteVerify, 3, 2, "3\r\nZZZ\r\n3\r\nZZZ\r\nQ", 17},
+		{"TE.CL default", tecl, 0, 0, "0\r\n\r\nX", 6},
+		{"TE.CL", tecl, 3, 2, "3\r\nZZZ\r\n3\r\nZZZ\r\n0\r\n\r\nX", 22},
+		{"TE.CL count only", tecl, 0, 2, "1\r\nZ\r\n1\r\nZ\r\n0\r\n\r\nX", 18},
+		{"TE.CL check", teclVerify, 3, 1, "3\r\nZZZ\r\n0\r\n\r\n", 13},
+	}
+
+	for _, test := range tests {
+		req := string(test.build("POST", u, m, RequestOptions{ChunkSize: test.size, ChunkCount: test.count}))
+		parts := strings.SplitN(req, "\r\n\r\n", 2)
+		if parts[1] != test.body {
+			t.Errorf("%s: got body %q, want %q", test.name, parts[1], test.body)
+		}
+		if cl := headerValue(parts[0], "Content-Length"); cl != fmt.Sprint(test.cl) {
+			t.Errorf("%s: got Content-Length %s, want %d", test.name, cl, test.cl)
+		}
+	}
+}
+
+func TestCacheBust(t *testing.T) {
+	u, _ := url.Parse("https://example.com/path")
+	m := generateMutations()["standard"]
+	opts := RequestOptions{CacheBust: true}
+	reqs := [][]byte{baseReq(u, opts), baseReq(u, opts), clte("POST", u, m, opts), tecl("POST", u, m, opts)}
+
+	// Each request asks for the path with a different value of the parameter
+	seen := make(map[string]bool, 0)
+	for _, req := range reqs {
+		line := strings.SplitN(string(req), "\r\n", 2)[0]
+		var path string
+		fmt.Sscanf(line, "%s %s", new(string), &path)
+		if !strings.HasPrefix(path, "/path?cb=") || len(path) == len("/path?cb=") {
+			t.Errorf("got request line %q, want a cache busting parameter", line)
+		}
+		if seen[path] {
+			t.Errorf("got the path %s more than once", path)
+		}
+		seen[path] = true
+	}
+
+	// Without the option, the path is left alone
+	if line := strings.SplitN(string(baseReq(u, RequestOptions{})), "\r\n", 2)[0]; strings.Contains(line, "cb=") {
+		t.Errorf("got request line %q without cache busting", line)
+	}
+}
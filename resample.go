@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// BaseSampler keeps the base time of each URL up to date during a scan, so the timeouts of its tests follow
+// changes in how quickly the host responds. It is safe for concurrent use
+type BaseSampler struct {
+	// How long a URL's base time is used for before it is measured again
+	Interval time.Duration
+
+	// The latest base time of each URL and when it was measured, indexed by URL
+	base    map[string]time.Duration
+	sampled map[string]time.Time
+	mux     sync.Mutex
+}
+
+// NewBaseSampler returns a sampler which measures the base time of a URL again once interval has passed since it
+// was last measured
+func NewBaseSampler(interval time.Duration) *BaseSampler {
+	return &BaseSampler{
+		Interval: interval,
+		base:     make(map[string]time.Duration, 0),
+		sampled:  make(map[string]time.Time, 0),
+	}
+}
+
+// Due returns whether the base time of u should be measured again, given the base time its tests were generated
+// with. A URL is first seen as measured now with that base time. When true is returned the URL is counted as
+// measured, so only one worker measures it at a time
+func (s *BaseSampler) Due(u string, base time.Duration) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	last, ok := s.sampled[u]
+	if !ok {
+		s.base[u] = base
+		s.sampled[u] = now
+		return false
+	} else if now.Sub(last) < s.Interval {
+		return false
+	}
+
+	s.sampled[u] = now
+	return true
+}
+
+// Record records a new base time measured for u
+func (s *BaseSampler) Record(u string, base time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.base[u] = base
+}
+
+// Base returns the latest base time of u, and whether it has one
+func (s *BaseSampler) Base(u string) (time.Duration, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	base, ok := s.base[u]
+	return base, ok
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBaseSamplerDue(t *testing.T) {
+	s := NewBaseSampler(50 * time.Millisecond)
+	if s.Due("http://example.com/", time.Second) {
+		t.Error("URL seen for the first time was due, want its base time used")
+	}
+	if base, ok := s.Base("http://example.com/"); !ok || base != time.Second {
+		t.Errorf("got base time %s, want the one first seen", base)
+	}
+	if s.Due("http://example.com/", time.Second) {
+		t.Error("URL was due again before the interval passed")
+	}
+
+	// Only one of the workers testing the URL measures it again
+	time.Sleep(60 * time.Millisecond)
+	var due int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.Due("http://example.com/", time.Second) {
+				atomic.AddInt32(&due, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if due != 1 {
+		t.Errorf("URL was due for %d workers, want 1", due)
+	}
+
+	s.Record("http://example.com/", 2*time.Second)
+	if base, _ := s.Base("http://example.com/"); base != 2*time.Second {
+		t.Errorf("got base time %s, want the one recorded", base)
+	}
+}
+
+func TestResampleBaseTracksDrift(t *testing.T) {
+	// The server's response time drifts as its load changes
+	var latency int64
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(atomic.LoadInt64(&latency)))
+		rw.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/")
+
+	errs := make(chan error, 10)
+	conf := Config{
+		Delay:     100 * time.Millisecond,
+		Mutations: map[string]Mutation{"m": {TE: "Transfer-Encoding: chunked", TimeoutMultiplier: 2}},
+	}
+	w := Worker{Ctx: context.Background(), Conf: conf, Errs: errs, Sampler: NewBaseSampler(time.Millisecond)}
+
+	// The test was generated with a base time of 10ms
+	test := SmuggleTest{Url: u, Method: "POST", Mutation: "m", Timeout: conf.Mutations["m"].timeout(110 * time.Millisecond)}
+	if got := w.resampleBase(test).Timeout; got != 220*time.Millisecond {
+		t.Fatalf("got timeout %s before drift, want 220ms", got)
+	}
+
+	atomic.StoreInt64(&latency, int64(300*time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	slow := w.resampleBase(test).Timeout
+	if slow < 800*time.Millisecond || slow > 2*time.Second {
+		t.Errorf("got timeout %s after the host slowed to 300ms, want about twice 400ms", slow)
+	}
+
+	atomic.StoreInt64(&latency, 0)
+	time.Sleep(2 * time.Millisecond)
+	fast := w.resampleBase(test).Timeout
+	if fast >= 400*time.Millisecond {
+		t.Errorf("got timeout %s after the host sped up again, want it to fall back towards 200ms", fast)
+	}
+
+	select {
+	case err := <-errs:
+		t.Errorf("got error %v", err)
+	default:
+	}
+}
+
+func TestResampleBaseFixedTimeout(t *testing.T) {
+	w := Worker{Ctx: context.Background(), Conf: Config{FixedTimeout: 5 * time.Second}, Sampler: NewBaseSampler(time.Millisecond)}
+	u, _ := url.Parse("http://example.com/")
+	test := SmuggleTest{Url: u, Timeout: 5 * time.Second}
+	if got := w.resampleBase(test).Timeout; got != 5*time.Second {
+		t.Errorf("got timeout %s, want the fixed timeout left alone", got)
+	}
+}
@@ -19,7 +19,7 @@ smuggle_headers = [
 
 # The prefix for a victim
 prefix_method = "GET"
-prefix_path = "/404"
+prefix_path = "{{ .ConfirmPath }}"
 prefix_host = None # This as default since Host header sent by victim
 prefix_headers = []
 prefix_tail_header = "X-Ignore: X" # Set to none if using a body
@@ -19,7 +19,7 @@ smuggle_headers = [
 
 # The prefix for a victim
 prefix_method = "POST"
-prefix_path = "/404"
+prefix_path = "{{ .ConfirmPath }}"
 prefix_host = host
 prefix_headers = []
 prefix_tail_header = None # Set to None if using a body
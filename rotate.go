@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingWriter writes to a file, rotating it once it grows past a maximum size. Rotated files are kept
+// alongside the original with a numbered suffix, with .1 always being the most recent
+type RotatingWriter struct {
+	Filename string
+	MaxSize  int64
+
+	f    *os.File
+	size int64
+	mux  sync.Mutex
+}
+
+// NewRotatingWriter opens the given file for appending, and returns a writer which will rotate it once it
+// exceeds maxSize bytes
+func NewRotatingWriter(filename string, maxSize int64) (*RotatingWriter, error) {
+	w := &RotatingWriter{
+		Filename: filename,
+		MaxSize:  maxSize,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Write writes p to the file, rotating the file first if the write would take it past the maximum size
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.size > 0 && w.size+int64(len(p)) > w.MaxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the underlying file
+func (w *RotatingWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return w.f.Close()
+}
+
+// open opens the file for appending and records its current size
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+// rotate shifts each existing rotated file up by one, moves the current file to .1 and opens a fresh file
+func (w *RotatingWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	// Find the first unused suffix, then shift everything below it up by one
+	n := 1
+	for {
+		if _, err := os.Stat(fmt.Sprintf("%s.%d", w.Filename, n)); os.IsNotExist(err) {
+			break
+		}
+		n++
+	}
+
+	for i := n; i > 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", w.Filename, i-1), fmt.Sprintf("%s.%d", w.Filename, i))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(w.Filename, w.Filename+".1"); err != nil {
+		return err
+	}
+
+	return w.open()
+}
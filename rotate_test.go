@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFile returns the contents of the file at path, or fails the test if it can't be read
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smuggles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The existing log is appended to, and counts towards its size
+	filename := filepath.Join(dir, "smuggles.log")
+	if err := ioutil.WriteFile(filename, []byte("previous\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewRotatingWriter(filename, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n", "fifth\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		filename:        "fifth\n",
+		filename + ".1": "second\nthird\nfourth\n",
+		filename + ".2": "previous\nfirst\n",
+	}
+	for path, content := range want {
+		if got := readFile(t, path); got != content {
+			t.Errorf("%s: got %q, want %q", filepath.Base(path), got, content)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("got a third rotated file, want two")
+	}
+}
+
+func TestRotatingWriterLargeWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smuggles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A write larger than the maximum size goes to a fresh file rather than being split
+	filename := filepath.Join(dir, "smuggles.log")
+	w, err := NewRotatingWriter(filename, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Write([]byte("a longer line\n"))
+	w.Write([]byte("another\n"))
+
+	if got := readFile(t, filename+".1"); got != "a longer line\n" {
+		t.Errorf("got rotated log %q, want the whole first line", got)
+	}
+	if got := readFile(t, filename); got != "another\n" {
+		t.Errorf("got log %q, want the second line", got)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ryanuber/go-glob"
+)
+
+// loadGlobs reads a file containing one glob of hostnames per line, skipping blank lines and comments starting
+// with #. The globs are normalized like the hostnames they're matched against
+func loadGlobs(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	globs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		globs = append(globs, normalizeHost(line))
+	}
+
+	return globs, scanner.Err()
+}
+
+// normalizeHost returns a hostname in lowercase and without a trailing dot, so that all the ways of writing the
+// same hostname match the same globs
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// matchesHost returns whether the hostname of u matches any of the given globs
+func matchesHost(u *url.URL, globs []string) bool {
+	host := normalizeHost(u.Hostname())
+	for _, g := range globs {
+		if glob.Glob(g, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipReason returns why u shouldn't be scanned given the denylist and scope in conf, or an empty string if it
+// should be scanned. The denylist takes precedence
+func skipReason(u *url.URL, conf Config) string {
+	if matchesHost(u, conf.Denylist) {
+		return "denylisted"
+	}
+	if conf.Scope != nil && !matchesHost(u, conf.Scope) {
+		return "out of scope"
+	}
+
+	return ""
+}
+
+// redirectSkipReason returns why a redirect from a URL given to another URL shouldn't be followed given conf, or
+// an empty string if it should. Without a scope, only redirects to the same host are followed, so a target
+// redirecting to a third party, such as a login provider or a CDN, doesn't have it tested
+func redirectSkipReason(from *url.URL, to *url.URL, conf Config) string {
+	if reason := skipReason(to, conf); reason != "" {
+		return reason
+	}
+	if conf.Scope == nil && normalizeHost(to.Hostname()) != normalizeHost(from.Hostname()) {
+		return "another host's"
+	}
+
+	return ""
+}
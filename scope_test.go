@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadGlobs(t *testing.T) {
+	path := filepath.Join(tempDir(t), "globs")
+	content := "# Production\n*.Example.com\n\n  admin.example.org.  \n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	globs, err := loadGlobs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"*.example.com", "admin.example.org"}; !reflect.DeepEqual(globs, want) {
+		t.Errorf("got globs %q, want %q", globs, want)
+	}
+}
+
+func TestMatchesHost(t *testing.T) {
+	globs := []string{"*.example.com", "admin.example.org"}
+	tests := []struct {
+		rawurl string
+		want   bool
+	}{
+		{"https://a.example.com/", true},
+		{"https://a.b.example.com:8443/path", true},
+		{"http://A.EXAMPLE.com/", true},
+		{"http://a.example.com./", true},
+		{"http://ADMIN.example.org./", true},
+		{"https://example.com/", false},
+		{"https://a.example.com.evil.net/", false},
+		{"https://www.example.org/", false},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse(test.rawurl)
+		if got := matchesHost(u, globs); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.rawurl, got, test.want)
+		}
+	}
+}
+
+func TestDenylist(t *testing.T) {
+	dir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "denylist"), []byte("localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := make(chan string, 10)
+	u := respondingServer(t, hosts)
+	port := u.Port()
+	targets := []string{
+		"http://127.0.0.1:" + port + "/",
+		"http://localhost:" + port + "/",
+		"http://LocalHost:" + port + "/",
+		"http://localhost.:" + port + "/",
+	}
+
+	stdout, stderr, code := runMain(t, dir, strings.Join(targets, "\n")+"\n", "--denylist", "denylist", "--fixed-timeout", "1s", "-m", "POST", "-e", "standard", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	// Only the URL which isn't denylisted is tested, with a CL.TE and a TE.CL request
+	close(hosts)
+	tested := 0
+	for host := range hosts {
+		if host != "127.0.0.1" {
+			t.Errorf("got a request for denylisted host %s", host)
+		}
+		tested++
+	}
+	if tested != 2 {
+		t.Errorf("got %d requests, want 2 for the URL which isn't denylisted", tested)
+	}
+	for _, target := range targets[1:] {
+		if !strings.Contains(stdout, "Skipping denylisted URL: "+target) {
+			t.Errorf("%s wasn't skipped: %s", target, stdout)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	dir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "scope"), []byte("127.0.0.1\nLocalHost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "denylist"), []byte("localhost.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := make(chan string, 10)
+	u := respondingServer(t, hosts)
+	port := u.Port()
+	inScope := "http://127.0.0.1:" + port + "/"
+	outOfScope := []string{"http://127.0.0.2:" + port + "/", "http://example.invalid:" + port + "/"}
+	denied := "http://localhost:" + port + "/"
+	targets := append([]string{inScope, denied}, outOfScope...)
+
+	stdout, stderr, code := runMain(t, dir, strings.Join(targets, "\n")+"\n", "--scope", "scope", "--denylist", "denylist", "--fixed-timeout", "1s", "-m", "POST", "-e", "standard", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	close(hosts)
+	tested := 0
+	for host := range hosts {
+		if host != "127.0.0.1" {
+			t.Errorf("got a request for host %s, want only the in scope URL to be tested", host)
+		}
+		tested++
+	}
+	if tested != 2 {
+		t.Errorf("got %d requests, want 2 for the in scope URL", tested)
+	}
+
+	// The denylist wins over the scope
+	if !strings.Contains(stdout, "Skipping denylisted URL: "+denied) {
+		t.Errorf("%s wasn't skipped as denylisted: %s", denied, stdout)
+	}
+	for _, target := range outOfScope {
+		if !strings.Contains(stdout, "Skipping out of scope URL: "+target) {
+			t.Errorf("%s wasn't skipped as out of scope: %s", target, stdout)
+		}
+	}
+}
+
+func TestRedirectSkipReason(t *testing.T) {
+	from, _ := url.Parse("http://example.com/")
+	tests := []struct {
+		to    string
+		scope []string
+		want  string
+	}{
+		{"https://example.com/login", nil, ""},
+		{"http://EXAMPLE.com:8080/", nil, ""},
+		{"https://sso.example.net/", nil, "another host's"},
+		{"https://sso.example.net/", []string{"*.example.net", "example.com"}, ""},
+		{"https://cdn.example.org/", []string{"*.example.net", "example.com"}, "out of scope"},
+	}
+
+	for _, test := range tests {
+		to, _ := url.Parse(test.to)
+		if got := redirectSkipReason(from, to, Config{Scope: test.scope}); got != test.want {
+			t.Errorf("%s with scope %v: got %q, want %q", test.to, test.scope, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// selfTest runs the scanner against an in-process server which is vulnerable to CL.TE desyncs, using the
+// standard mutation, and returns whether the desync was detected
+func selfTest(conf Config) (bool, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return false, err
+	}
+	defer l.Close()
+	go serveVulnerable(l)
+
+	u, err := url.Parse(fmt.Sprintf("http://%s/", l.Addr()))
+	if err != nil {
+		return false, err
+	}
+
+	conf.Mutations = map[string]Mutation{"standard": generateMutations()["standard"]}
+	errCounts := make(map[string]uint, 0)
+	errs := make(chan error, 4)
+	w := Worker{
+		Ctx:          context.Background(),
+		Conf:         conf,
+		Errs:         errs,
+		ErrCounts:    &errCounts,
+		ErrCountsMux: &sync.RWMutex{},
+	}
+
+	// Measure the base time, as in a normal scan
+	urls := make(chan *url.URL, 1)
+	baseResults := make(chan BaseResult, 1)
+	urls <- u
+	close(urls)
+	w.BaseTimes(urls, baseResults, func() { close(baseResults) })
+	r, ok := <-baseResults
+	if !ok {
+		return false, fmt.Errorf("failed to get base time: %v", <-errs)
+	}
+
+	// Then run the smuggling test
+	tests := make(chan SmuggleTest, 1)
+	results := make(chan SmuggleTest, 1)
+	tests <- SmuggleTest{
+		Url:      u,
+		Method:   "POST",
+		Mutation: "standard",
+		Status:   SAFE,
+		Timeout:  conf.Mutations["standard"].timeout(r.Time + conf.Delay),
+	}
+	close(tests)
+	w.SmuggleTest(tests, results, func() { close(results) })
+
+	select {
+	case err := <-errs:
+		return false, err
+	default:
+	}
+
+	t := <-results
+	return t.Status == CLTE, nil
+}
+
+// serveVulnerable accepts connections on l, and handles them in the manner of a frontend which uses the
+// Content-Length header in front of a backend which uses the Transfer-Encoding header
+func serveVulnerable(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handleVulnerable(conn)
+	}
+}
+
+// handleVulnerable reads a single request from conn and responds to it
+func handleVulnerable(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Read the headers, noting the ones which affect the framing of the body
+	length := 0
+	chunked := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		name := strings.ToLower(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if name == "content-length" {
+			length, _ = strconv.Atoi(value)
+		} else if name == "transfer-encoding" && value == "chunked" {
+			chunked = true
+		}
+	}
+
+	// The frontend forwards as many bytes as the Content-Length header specifies
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return
+	}
+
+	status := "200 OK"
+	if chunked {
+		complete, valid := parseChunked(string(body))
+		if !valid {
+			status = "400 Bad Request"
+		} else if !complete {
+			// The backend waits for the rest of the body, which will never arrive
+			io.Copy(ioutil.Discard, conn)
+			return
+		}
+	}
+
+	fmt.Fprintf(conn, "HTTP/1.1 %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status)
+}
+
+// parseChunked parses body as a chunked body, returning whether it is a complete chunked body and whether
+// it is valid so far
+func parseChunked(body string) (complete bool, valid bool) {
+	for {
+		i := strings.Index(body, "\r\n")
+		if i < 0 {
+			// An incomplete size line is only valid if it's hex so far
+			_, err := strconv.ParseUint(body, 16, 64)
+			return false, body == "" || err == nil
+		}
+
+		size, err := strconv.ParseUint(body[:i], 16, 64)
+		if err != nil {
+			return false, false
+		}
+		body = body[i+2:]
+
+		if size == 0 {
+			return strings.HasPrefix(body, "\r\n"), true
+		}
+
+		if uint64(len(body)) < size+2 {
+			return false, true
+		}
+		body = body[size+2:]
+	}
+}
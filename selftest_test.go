@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseChunked(t *testing.T) {
+	tests := []struct {
+		body     string
+		complete bool
+		valid    bool
+	}{
+		{"", false, true},
+		{"0\r\n\r\n", true, true},
+		{"0\r\n", false, true},
+		{"1\r\nQ\r\n0\r\n\r\n", true, true},
+		{"a\r\n0123456789\r\n0\r\n\r\n", true, true},
+		{"1\r\nQ", false, true},
+		{"1\r\nQ\r\n", false, true},
+		{"1", false, true},
+		{"zz\r\nQ\r\n0\r\n\r\n", false, false},
+		{"Q", false, false},
+	}
+
+	for _, test := range tests {
+		complete, valid := parseChunked(test.body)
+		if complete != test.complete || valid != test.valid {
+			t.Errorf("%q: got complete %t and valid %t, want %t and %t", test.body, complete, valid, test.complete, test.valid)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the self-test waits for a timeout")
+	}
+
+	conf := Config{Delay: 500 * time.Millisecond}
+	detected, err := selfTest(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detected {
+		t.Error("the built-in vulnerable server's CL.TE desync wasn't detected")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ScanStatus is the live state of a running scan, which can be served as JSON over HTTP
+type ScanStatus struct {
+	findings  []finding
+	completed int
+	total     int
+	start     time.Time
+	mux       sync.RWMutex
+}
+
+// progress is the JSON form of the progress of the scan's smuggling tests
+type progress struct {
+	Completed int     `json:"completed"`
+	Total     int     `json:"total"`
+	Elapsed   float64 `json:"elapsed"`
+	Rate      float64 `json:"rate"`
+	ETA       float64 `json:"eta"`
+}
+
+// NewScanStatus returns the status of a scan which hasn't yet started its smuggling tests
+func NewScanStatus() *ScanStatus {
+	return &ScanStatus{
+		findings: make([]finding, 0),
+		start:    time.Now(),
+	}
+}
+
+// Start records that the smuggling tests have started
+func (s *ScanStatus) Start() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.start = time.Now()
+}
+
+// AddTests adds n to the number of smuggling tests to perform
+func (s *ScanStatus) AddTests(n int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.total += n
+}
+
+// Complete records a completed smuggling test, and reports it with the given tag if it should be
+func (s *ScanStatus) Complete(t SmuggleTest, report bool, tag string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.completed++
+	if report {
+		s.findings = append(s.findings, newFinding(t, tag))
+	}
+}
+
+// Serve listens on addr, and serves the findings at /findings and the progress at /progress in the
+// background
+func (s *ScanStatus) Serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/findings", func(w http.ResponseWriter, r *http.Request) {
+		s.mux.RLock()
+		defer s.mux.RUnlock()
+		writeJSON(w, s.findings)
+	})
+	mux.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		s.mux.RLock()
+		defer s.mux.RUnlock()
+		elapsed := time.Since(s.start)
+		writeJSON(w, progress{
+			Completed: s.completed,
+			Total:     s.total,
+			Elapsed:   elapsed.Seconds(),
+			Rate:      throughput(s.completed, elapsed),
+			ETA:       eta(s.completed, s.total, elapsed).Seconds(),
+		})
+	})
+	go http.Serve(l, mux)
+
+	return nil
+}
+
+// writeJSON writes v to w as JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serveStatus serves s on a free local port, and returns a function to fetch and decode the JSON at a path
+func serveStatus(t *testing.T, s *ScanStatus) func(path string, v interface{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if err := s.Serve(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	return func(path string, v interface{}) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got Content-Type %q, want application/json", path, ct)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+}
+
+func TestServeMidScan(t *testing.T) {
+	s := NewScanStatus()
+	get := serveStatus(t, s)
+	u, _ := url.Parse("https://example.com/")
+
+	s.Start()
+	s.AddTests(3)
+	s.Complete(SmuggleTest{Url: u, Method: "POST", Mutation: "standard", Status: CLTE, Confidence: 0.75}, true, "run-1")
+	s.Complete(SmuggleTest{Url: u, Method: "GET", Mutation: "standard", Status: SAFE}, false, "run-1")
+
+	var findings []finding
+	get("/findings", &findings)
+	want := finding{
+		Method:     "POST",
+		Url:        "https://example.com/",
+		Status:     string(CLTE),
+		Mutation:   "standard",
+		Severity:   "high",
+		Confidence: 0.75,
+		Tag:        "run-1",
+	}
+	if len(findings) != 1 || !reflect.DeepEqual(findings[0], want) {
+		t.Fatalf("got findings %+v, want [%+v]", findings, want)
+	}
+
+	var p progress
+	get("/progress", &p)
+	if p.Completed != 2 || p.Total != 3 {
+		t.Errorf("got %d/%d tests completed, want 2/3", p.Completed, p.Total)
+	}
+	if p.Elapsed <= 0 || p.Elapsed > float64(time.Minute/time.Second) {
+		t.Errorf("got elapsed time %v", p.Elapsed)
+	}
+
+	// The endpoints should reflect the scan as it carries on
+	s.Complete(SmuggleTest{Url: u, Method: "PUT", Mutation: "standard", Status: TECL, Confidence: 0.5}, false, "run-1")
+	get("/findings", &findings)
+	if len(findings) != 1 {
+		t.Errorf("got %d findings after an unreported test, want 1", len(findings))
+	}
+	get("/progress", &p)
+	if p.Completed != 3 || p.ETA != 0 {
+		t.Errorf("got %d tests completed with an ETA of %v, want 3 with an ETA of 0", p.Completed, p.ETA)
+	}
+}
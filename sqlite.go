@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"net/url"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ResultsDB stores the base times and findings of scans in a SQLite database, so results can be queried across
+// scans
+type ResultsDB struct {
+	db   *sql.DB
+	scan int64
+}
+
+// resultsSchema creates the tables of a results database if they don't already exist
+const resultsSchema = `
+CREATE TABLE IF NOT EXISTS scans (
+	id INTEGER PRIMARY KEY,
+	started TEXT NOT NULL,
+	tag TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS base_times (
+	scan_id INTEGER NOT NULL REFERENCES scans(id),
+	url TEXT NOT NULL,
+	host TEXT NOT NULL,
+	nanoseconds INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS findings (
+	scan_id INTEGER NOT NULL REFERENCES scans(id),
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	host TEXT NOT NULL,
+	status TEXT NOT NULL,
+	mutation TEXT NOT NULL,
+	severity TEXT NOT NULL,
+	confidence REAL NOT NULL,
+	confirmed INTEGER NOT NULL,
+	found TEXT NOT NULL
+);
+`
+
+// OpenResultsDB opens the SQLite database in the given file, creating it and its tables if needed, and records
+// the start of a new scan with the given tag
+func OpenResultsDB(filename string, tag string) (*ResultsDB, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(resultsSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	res, err := db.Exec("INSERT INTO scans (started, tag) VALUES (?, ?)", time.Now().Format(time.RFC3339), tag)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	scan, err := res.LastInsertId()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &ResultsDB{db, scan}, nil
+}
+
+// AddBase records the base time measured for u in this scan
+func (d *ResultsDB) AddBase(u *url.URL, base time.Duration) error {
+	_, err := d.db.Exec("INSERT INTO base_times (scan_id, url, host, nanoseconds) VALUES (?, ?, ?, ?)",
+		d.scan, u.String(), u.Host, int64(base))
+	return err
+}
+
+// AddFinding records a vulnerability discovered in this scan
+func (d *ResultsDB) AddFinding(t SmuggleTest) error {
+	_, err := d.db.Exec("INSERT INTO findings (scan_id, method, url, host, status, mutation, severity, confidence, confirmed, found) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		d.scan, t.Method, t.Url.String(), t.Url.Host, string(t.Status), t.Mutation, t.Status.Severity().String(), t.Confidence, t.Confirmed, time.Now().Format(time.RFC3339))
+	return err
+}
+
+// Close closes the database
+func (d *ResultsDB) Close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultsDB(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "results.db")
+	u, _ := url.Parse("https://example.com:8443/login")
+
+	// Results from two scans are kept apart by their scan IDs
+	for i, tag := range []string{"run-1", "run-2"} {
+		db, err := OpenResultsDB(filename, tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.scan != int64(i+1) {
+			t.Errorf("%s: got scan ID %d, want %d", tag, db.scan, i+1)
+		}
+		if err := db.AddBase(u, 250*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddFinding(SmuggleTest{Url: u, Method: "POST", Mutation: "standard", Status: TECL, Confidence: 0.75, Confirmed: true}); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	db, err := OpenResultsDB(filename, "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var scanTag, baseURL, baseHost string
+	var nanoseconds int64
+	err = db.db.QueryRow("SELECT s.tag, b.url, b.host, b.nanoseconds FROM base_times b JOIN scans s ON s.id = b.scan_id WHERE s.id = 2").Scan(&scanTag, &baseURL, &baseHost, &nanoseconds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanTag != "run-2" || baseURL != u.String() || baseHost != "example.com:8443" || time.Duration(nanoseconds) != 250*time.Millisecond {
+		t.Errorf("got base time %s %s %s %d", scanTag, baseURL, baseHost, nanoseconds)
+	}
+
+	var method, host, status, mutation, severity, found string
+	var confidence float64
+	var confirmed bool
+	err = db.db.QueryRow("SELECT method, host, status, mutation, severity, confidence, confirmed, found FROM findings WHERE scan_id = 1").Scan(&method, &host, &status, &mutation, &severity, &confidence, &confirmed, &found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != "POST" || host != "example.com:8443" || status != string(TECL) || mutation != "standard" || severity != "high" || confidence != 0.75 || !confirmed {
+		t.Errorf("got finding %s %s %s %s %s %v %v", method, host, status, mutation, severity, confidence, confirmed)
+	}
+	if _, err := time.Parse(time.RFC3339, found); err != nil {
+		t.Errorf("got an invalid time the finding was found: %v", err)
+	}
+
+	var count int
+	db.db.QueryRow("SELECT COUNT(*) FROM findings").Scan(&count)
+	if count != 2 {
+		t.Errorf("got %d findings across scans, want 2", count)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+)
+
+// Summary aggregates the results of the smuggling tests performed in a scan
+type Summary struct {
+	// The number of URLs scanned, and the number of tests to perform against them
+	URLs  int `json:"urls"`
+	Tests int `json:"tests"`
+
+	// The number of tests completed, and the number of findings which were reported
+	Completed int `json:"completed"`
+	Findings  int `json:"findings"`
+
+	// The number of reported findings of each desync type
+	Statuses map[string]int `json:"statuses"`
+
+	// The coverage of and findings for each host
+	Hosts map[string]*HostSummary `json:"hosts"`
+
+	// The number of reported findings using each mutation
+	Mutations map[string]int `json:"mutations"`
+}
+
+// HostSummary aggregates the results of the smuggling tests performed against a single host
+type HostSummary struct {
+	URLs      int `json:"urls"`
+	Completed int `json:"completed"`
+	Findings  int `json:"findings"`
+}
+
+// NewSummary returns an empty summary of a scan of the given URLs, in which total tests will be performed
+func NewSummary(urls []*url.URL, total int) *Summary {
+	s := &Summary{
+		URLs:      len(urls),
+		Tests:     total,
+		Statuses:  make(map[string]int, 0),
+		Hosts:     make(map[string]*HostSummary, 0),
+		Mutations: make(map[string]int, 0),
+	}
+	for _, u := range urls {
+		s.host(u).URLs++
+	}
+
+	return s
+}
+
+// Add adds a completed test to the summary, counting it as a finding if it was reported
+func (s *Summary) Add(t SmuggleTest, reported bool) {
+	s.Completed++
+	h := s.host(t.Url)
+	h.Completed++
+	if reported {
+		s.Findings++
+		s.Statuses[string(t.Status)]++
+		s.Mutations[t.Mutation]++
+		h.Findings++
+	}
+}
+
+// Write writes the summary to the given file as JSON
+func (s *Summary) Write(filename string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// host returns the summary of the host of u, adding it if needed
+func (s *Summary) host(u *url.URL) *HostSummary {
+	h, ok := s.Hosts[u.Host]
+	if !ok {
+		h = &HostSummary{}
+		s.Hosts[u.Host] = h
+	}
+
+	return h
+}
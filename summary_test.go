@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSummaryJSON(t *testing.T) {
+	dir := tempDir(t)
+	vulnerable := zeroCLServer(t, true)
+	safe := zeroCLServer(t, false)
+	stdin := vulnerable.String() + "a\n" + vulnerable.String() + "b\n" + safe.String() + "\n"
+	_, stderr, code := runMain(t, dir, stdin, "--summary-json", "summary.json", "--detect-zero-cl", "--fixed-timeout", "1s", "-m", "POST", "-e", "none", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	var got Summary
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "summary.json"))), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := Summary{
+		URLs:      3,
+		Tests:     3,
+		Completed: 3,
+		Findings:  2,
+		Statuses:  map[string]int{string(ZEROCL): 2},
+		Hosts: map[string]*HostSummary{
+			vulnerable.Host: {URLs: 2, Completed: 2, Findings: 2},
+			safe.Host:       {URLs: 1, Completed: 1, Findings: 0},
+		},
+		Mutations: map[string]int{ZeroCLMutation: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("got summary %s, want %s", gotJSON, wantJSON)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// portRange matches a URL with a range of ports in place of a single port, such as http://host:8000-8010/
+var portRange = regexp.MustCompile(`^([^/?#]*//[^/?#]*:)([0-9]+)-([0-9]+)([/?#].*)?$`)
+
+// Target is a URL to scan read from the input, along with any overrides of the scan configuration for it
+type Target struct {
+	// The URL to scan
+	Url string `json:"url"`
+
+	// Headers to add to requests to this target, replacing any global headers of the same name
+	Headers []string `json:"headers,omitempty"`
+
+	// The methods to test this target with in place of the global methods
+	Methods []string `json:"methods,omitempty"`
+
+	// Whether this is a URL redirected to from a target on another host, so requests to it are sent without
+	// credential headers
+	redirected bool
+}
+
+// parseTarget parses a line of input in the given format, either "text" for a bare URL, or "jsonl" for a
+// JSON encoded Target. If strict is set, JSON encoded targets with unknown fields and URLs which aren't absolute
+// http or https URLs are rejected. If the target's URL has a range of ports, one URL is returned for each port
+// in the range
+func parseTarget(line string, format string, strict bool) (Target, []*url.URL, error) {
+	var t Target
+	switch format {
+	case "text":
+		t.Url = line
+	case "jsonl":
+		d := json.NewDecoder(strings.NewReader(line))
+		if strict {
+			d.DisallowUnknownFields()
+		}
+		if err := d.Decode(&t); err != nil {
+			return t, nil, fmt.Errorf("invalid target %s: %w", line, err)
+		}
+		if t.Url == "" {
+			return t, nil, fmt.Errorf("target has no url: %s", line)
+		}
+	default:
+		return t, nil, fmt.Errorf("unrecognised targets format: %s", format)
+	}
+
+	rawurls, err := expandPorts(t.Url)
+	if err != nil {
+		return t, nil, err
+	}
+
+	urls := make([]*url.URL, 0, len(rawurls))
+	for _, rawurl := range rawurls {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return t, nil, err
+		} else if strict && ((u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			return t, nil, fmt.Errorf("invalid target %s: not an absolute http or https URL", rawurl)
+		}
+		urls = append(urls, u)
+	}
+
+	return t, urls, nil
+}
+
+// expandPorts returns rawurl with its port range, if it has one, expanded into one URL per port
+func expandPorts(rawurl string) ([]string, error) {
+	m := portRange.FindStringSubmatch(rawurl)
+	if m == nil {
+		return []string{rawurl}, nil
+	}
+
+	start, err := strconv.Atoi(m[2])
+	if err != nil {
+		return nil, err
+	}
+	end, err := strconv.Atoi(m[3])
+	if err != nil {
+		return nil, err
+	}
+	if start < 1 || end > 65535 || start > end {
+		return nil, fmt.Errorf("invalid port range in %s", rawurl)
+	}
+
+	rawurls := make([]string, 0, end-start+1)
+	for port := start; port <= end; port++ {
+		rawurls = append(rawurls, m[1]+strconv.Itoa(port)+m[4])
+	}
+
+	return rawurls, nil
+}
+
+// urlPort returns the port of u, or the default port for its scheme if it doesn't give one
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	} else if u.Scheme == "https" {
+		return "443"
+	}
+
+	return "80"
+}
+
+// normalizeTrailingSlash removes a trailing slash from the path of u, so URLs with and without one are treated
+// as the same URL. An empty path is instead given a slash, so the root path is always "/"
+func normalizeTrailingSlash(u *url.URL) {
+	if u.Path == "" {
+		u.Path = "/"
+	} else if u.Path != "/" {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+	}
+	u.RawPath = ""
+}
+
+// mergeHeaders returns the headers in base with those in overrides added, with any header in base with the
+// same name as one in overrides being dropped
+func mergeHeaders(base []string, overrides []string) []string {
+	if len(overrides) == 0 {
+		return base
+	}
+
+	names := make(map[string]bool, len(overrides))
+	for _, h := range overrides {
+		names[headerName(h)] = true
+	}
+
+	merged := make([]string, 0, len(base)+len(overrides))
+	for _, h := range base {
+		if !names[headerName(h)] {
+			merged = append(merged, h)
+		}
+	}
+
+	return append(merged, overrides...)
+}
+
+// credentialHeaders are the lowercased names of headers which carry credentials for a host
+var credentialHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+}
+
+// withoutCredentials returns the given header lines without any credential headers
+func withoutCredentials(headers []string) []string {
+	kept := make([]string, 0, len(headers))
+	for _, h := range headers {
+		if !credentialHeaders[headerName(h)] {
+			kept = append(kept, h)
+		}
+	}
+
+	return kept
+}
+
+// redirectTarget returns the target of a URL redirected to from the URL from, which has the given target. A
+// redirect to another host doesn't keep credential headers, as with browsers, so credentials for the URL given
+// aren't sent to a host they weren't given for
+func redirectTarget(from *url.URL, to *url.URL, target Target) Target {
+	if from.Hostname() == to.Hostname() {
+		return target
+	}
+
+	target.Headers = withoutCredentials(target.Headers)
+	target.redirected = true
+	return target
+}
+
+// headerName returns the lowercased name of the given header line
+func headerName(h string) string {
+	if i := strings.Index(h, ":"); i >= 0 {
+		h = h[:i]
+	}
+
+	return strings.ToLower(strings.TrimSpace(h))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		format  string
+		strict  bool
+		want    Target
+		url     string
+		wantErr bool
+	}{
+		{name: "text", line: "https://example.com/path", format: "text", want: Target{Url: "https://example.com/path"}, url: "https://example.com/path"},
+		{
+			name:   "jsonl",
+			line:   `{"url": "https://example.com/", "headers": ["Cookie: a=1"], "methods": ["POST"]}`,
+			format: "jsonl",
+			want:   Target{Url: "https://example.com/", Headers: []string{"Cookie: a=1"}, Methods: []string{"POST"}},
+			url:    "https://example.com/",
+		},
+		{name: "jsonl unknown field", line: `{"url": "https://example.com/", "header": ["Cookie: a=1"]}`, format: "jsonl", want: Target{Url: "https://example.com/"}, url: "https://example.com/"},
+		{name: "jsonl without url", line: `{"methods": ["GET"]}`, format: "jsonl", wantErr: true},
+		{name: "invalid json", line: `{"url": `, format: "jsonl", wantErr: true},
+		{name: "relative url", line: "example.com/", format: "text", want: Target{Url: "example.com/"}, url: "example.com/"},
+		{name: "unknown format", line: "https://example.com/", format: "csv", wantErr: true},
+		{name: "strict", line: "https://example.com/", format: "text", strict: true, want: Target{Url: "https://example.com/"}, url: "https://example.com/"},
+		{name: "strict jsonl unknown field", line: `{"url": "https://example.com/", "header": ["Cookie: a=1"]}`, format: "jsonl", strict: true, wantErr: true},
+		{name: "strict relative url", line: "example.com/", format: "text", strict: true, wantErr: true},
+		{name: "strict ftp url", line: "ftp://example.com/", format: "text", strict: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		target, urls, err := parseTarget(test.line, test.format, test.strict)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: got no error, want one", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(target, test.want) {
+			t.Errorf("%s: got target %+v, want %+v", test.name, target, test.want)
+		}
+		if len(urls) != 1 || urls[0].String() != test.url {
+			t.Errorf("%s: got URLs %v, want %s", test.name, urls, test.url)
+		}
+	}
+}
+
+func TestMergeHeaders(t *testing.T) {
+	base := []string{"User-Agent: smuggles", "Cookie: global=1", "X-Scan: 1"}
+
+	// Headers are replaced by name regardless of case, and added headers come last
+	got := mergeHeaders(base, []string{"cookie: target=1", "X-Extra: 1"})
+	want := []string{"User-Agent: smuggles", "X-Scan: 1", "cookie: target=1", "X-Extra: 1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := mergeHeaders(base, nil); !reflect.DeepEqual(got, base) {
+		t.Errorf("got %v without overrides, want the base headers", got)
+	}
+	if len(base) != 3 || base[1] != "Cookie: global=1" {
+		t.Errorf("base headers changed to %v", base)
+	}
+}
+
+func TestTargetOverrides(t *testing.T) {
+	u, requests := hangingServer(t)
+	b, _ := json.Marshal(Target{Url: u.String(), Headers: []string{"Cookie: target=1"}, Methods: []string{"PUT"}})
+
+	// The target's method replaces the global one, and its header replaces the global header with the same name
+	_, stderr, code := runMain(t, tempDir(t), string(b)+"\n", "--targets-format", "jsonl", "-H", "Cookie: global=1", "-H", "X-Scan: 1", "--fixed-timeout", "300ms", "-m", "POST", "-e", "standard", "-c", "1")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+
+	rs := requests(4)
+	if len(rs) != 4 {
+		t.Fatalf("got %d requests, want the 4 test requests: %v", len(rs), rs)
+	}
+	for _, r := range rs {
+		if !strings.HasPrefix(r.Head, "PUT ") {
+			t.Errorf("got a request which didn't use the target's method: %q", r.Head)
+		}
+		if headerValue(r.Head, "Cookie") != "target=1" || headerValue(r.Head, "X-Scan") != "1" {
+			t.Errorf("got a request without the merged headers: %q", r.Head)
+		}
+	}
+}
+
+func TestExpandPorts(t *testing.T) {
+	tests := []struct {
+		rawurl  string
+		want    []string
+		wantErr bool
+	}{
+		{rawurl: "http://example.com:8000/", want: []string{"http://example.com:8000/"}},
+		{rawurl: "http://example.com:8000-8002/path?q=1", want: []string{"http://example.com:8000/path?q=1", "http://example.com:8001/path?q=1", "http://example.com:8002/path?q=1"}},
+		{rawurl: "https://example.com:443-444", want: []string{"https://example.com:443", "https://example.com:444"}},
+		{rawurl: "http://example.com:80-80/", want: []string{"http://example.com:80/"}},
+		{rawurl: "http://example.com/a:1-2", want: []string{"http://example.com/a:1-2"}},
+		{rawurl: "http://example.com:8010-8000/", wantErr: true},
+		{rawurl: "http://example.com:0-10/", wantErr: true},
+		{rawurl: "http://example.com:65535-65536/", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := expandPorts(test.rawurl)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", test.rawurl, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.rawurl, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.rawurl, got, test.want)
+		}
+	}
+}
+
+func TestParseTargetPortRange(t *testing.T) {
+	// Each URL of a JSONL target with a port range shares its overrides
+	target, urls, err := parseTarget(`{"url": "http://example.com:8000-8001/", "methods": ["GET"]}`, "jsonl", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 || urls[0].Port() != "8000" || urls[1].Port() != "8001" {
+		t.Errorf("got URLs %v, want ports 8000 and 8001", urls)
+	}
+	if len(target.Methods) != 1 || target.Methods[0] != "GET" {
+		t.Errorf("got methods %v, want GET", target.Methods)
+	}
+
+	if _, _, err := parseTarget("http://example.com:9-1/", "text", false); err == nil {
+		t.Error("got no error for a reversed port range")
+	}
+}
+
+func TestPortRangeCount(t *testing.T) {
+	// Each port in the range is a separate URL to measure and test
+	stdout, stderr, code := runMain(t, tempDir(t), "http://example.com:8000-8002/\n", "--count-only", "-m", "GET", "-e", "standard")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "Base requests: 3\nSmuggling tests: 3\n") {
+		t.Errorf("got output %q, want 3 base requests and tests", stdout)
+	}
+}
+
+func TestNormalizeTrailingSlash(t *testing.T) {
+	tests := map[string]string{
+		"https://example.com/a":      "https://example.com/a",
+		"https://example.com/a/":     "https://example.com/a",
+		"https://example.com/a/?q=1": "https://example.com/a?q=1",
+		"https://example.com/":       "https://example.com/",
+		"https://example.com":        "https://example.com/",
+	}
+
+	for rawurl, want := range tests {
+		u, _ := url.Parse(rawurl)
+		normalizeTrailingSlash(u)
+		if u.String() != want {
+			t.Errorf("%s: got %s, want %s", rawurl, u, want)
+		}
+	}
+}
+
+func TestNormalizeTrailingSlashCount(t *testing.T) {
+	tests := []struct {
+		stdin string
+		args  []string
+		want  string
+	}{
+		{"https://example.com/a\nhttps://example.com/a/\n", nil, "Base requests: 2\nSmuggling tests: 2\n"},
+		{"https://example.com/a\nhttps://example.com/a/\n", []string{"--normalize-trailing-slash"}, "Base requests: 1\nSmuggling tests: 1\n"},
+
+		// Repeated URLs are only skipped when normalizing, as before the option existed, though their tests are
+		// still only counted once
+		{"https://example.com/a\nhttps://example.com/a\n", nil, "Base requests: 2\nSmuggling tests: 1\n"},
+	}
+
+	// Both forms of the URL collapse to one when normalized
+	for _, test := range tests {
+		stdout, stderr, code := runMain(t, tempDir(t), test.stdin, append([]string{"--count-only", "-m", "GET", "-e", "standard"}, test.args...)...)
+		if code != 0 {
+			t.Fatalf("exited with %d: %s", code, stderr)
+		}
+		if !strings.Contains(stdout, test.want) {
+			t.Errorf("%v: got output %q, want %q", test.args, stdout, test.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openTee opens a destination which findings are mirrored to: "stdout", "stderr", "syslog", an http or https URL
+// of a webhook which each finding is POSTed to, or otherwise a file to append to. Webhook requests are sent in the
+// background, with failures passed to onError, and the contentType of findings is sent with each
+func openTee(dest string, contentType string, onError func(error)) (io.WriteCloser, error) {
+	switch {
+	case dest == "stdout":
+		return nopCloser{os.Stdout}, nil
+	case dest == "stderr":
+		return nopCloser{os.Stderr}, nil
+	case dest == "syslog":
+		return openSyslog()
+	case strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://"):
+		return NewWebhookWriter(dest, contentType, onError), nil
+	default:
+		return os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	}
+}
+
+// nopCloser is a writer which isn't closed when its destination is, such as the standard output
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// webhookBacklog is the number of findings which can be waiting to be sent to a webhook before writes block
+const webhookBacklog = 100
+
+// WebhookWriter POSTs each write to a webhook URL as a separate request, in the order written. Requests are sent
+// in the background so a slow webhook doesn't hold up the scan
+type WebhookWriter struct {
+	URL         string
+	ContentType string
+
+	client  *http.Client
+	lines   chan []byte
+	onError func(error)
+	wg      sync.WaitGroup
+}
+
+// NewWebhookWriter returns a writer which POSTs to the given URL, passing any failures to onError
+func NewWebhookWriter(url string, contentType string, onError func(error)) *WebhookWriter {
+	w := &WebhookWriter{
+		URL:         url,
+		ContentType: contentType,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		lines:       make(chan []byte, webhookBacklog),
+		onError:     onError,
+	}
+
+	w.wg.Add(1)
+	go w.send()
+
+	return w
+}
+
+// Write queues p to be sent to the webhook. It never returns an error, as sending happens later
+func (w *WebhookWriter) Write(p []byte) (int, error) {
+	// The logger reuses its buffer, so the line needs copying before it's sent later
+	w.lines <- append([]byte(nil), bytes.TrimRight(p, "\n")...)
+	return len(p), nil
+}
+
+// Close waits for the queued writes to be sent
+func (w *WebhookWriter) Close() error {
+	close(w.lines)
+	w.wg.Wait()
+	return nil
+}
+
+// send POSTs the queued writes to the webhook until the writer is closed
+func (w *WebhookWriter) send() {
+	defer w.wg.Done()
+	for line := range w.lines {
+		resp, err := w.client.Post(w.URL, w.ContentType, bytes.NewReader(line))
+		if err != nil {
+			w.onError(fmt.Errorf("failed to send finding to webhook: %w", err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			w.onError(fmt.Errorf("webhook %s returned status %d for finding", w.URL, resp.StatusCode))
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog returns an error, as syslog isn't available on this platform
+func openSyslog() (io.WriteCloser, error) {
+	return nil, errors.New("syslog isn't supported on this platform")
+}
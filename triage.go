@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Triage decisions recorded against findings
+const (
+	TriageAccepted = "accepted"
+	TriageRejected = "rejected"
+)
+
+// Triage prompts on the terminal for a decision on each finding of a scan. The terminal is used directly rather
+// than stdin, as stdin is where the targets are read from
+type Triage struct {
+	conf Config
+	tty  *os.File
+	r    *bufio.Reader
+}
+
+// NewTriage returns a Triage prompting on the controlling terminal, or an error if there isn't one
+func NewTriage(conf Config) (*Triage, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Triage{conf, tty, bufio.NewReader(tty)}, nil
+}
+
+// Decide shows the given finding and prompts until it is accepted or rejected, generating PoCs for it when
+// asked. If the terminal is closed, the finding is accepted
+func (tr *Triage) Decide(t SmuggleTest, line string) string {
+	fmt.Fprintf(tr.tty, "\nFound: %s\n", line)
+	for {
+		fmt.Fprint(tr.tty, "[a]ccept, [r]eject, or show a [p]oC? ")
+		input, err := tr.r.ReadString('\n')
+		if err != nil {
+			return TriageAccepted
+		}
+
+		switch strings.ToLower(strings.TrimSpace(input)) {
+		case "a", "accept":
+			return TriageAccepted
+		case "r", "reject":
+			return TriageRejected
+		case "p", "poc":
+			poc, err := generatePoC(tr.conf, t.Method, t.Url.String(), string(t.Status), t.Mutation)
+			if err != nil {
+				fmt.Fprintf(tr.tty, "Couldn't generate PoC: %v\n", err)
+			} else {
+				fmt.Fprintf(tr.tty, "%s\n", poc)
+			}
+		}
+	}
+}
+
+// Close closes the terminal
+func (tr *Triage) Close() error {
+	return tr.tty.Close()
+}
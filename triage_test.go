@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTriageDecide(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	test := SmuggleTest{Url: u, Method: "POST", Mutation: "standard", Status: CLTE}
+	conf := Config{Mutations: generateMutations()}
+
+	tests := []struct {
+		input string
+		want  string
+		poc   bool
+	}{
+		{"a\n", TriageAccepted, false},
+		{"Reject\n", TriageRejected, false},
+		{"x\np\nr\n", TriageRejected, true},
+		{"p\n", TriageAccepted, true},
+	}
+
+	for _, tc := range tests {
+		tty, err := os.Create(filepath.Join(tempDir(t), "tty"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := &Triage{conf, tty, bufio.NewReader(strings.NewReader(tc.input))}
+		if got := tr.Decide(test, "POST https://example.com/ CL.TE standard high 0.00"); got != tc.want {
+			t.Errorf("input %q: got %q, want %q", tc.input, got, tc.want)
+		}
+		tr.Close()
+
+		// The finding is shown, along with its PoC if asked for. Without further input, it is accepted
+		out, err := ioutil.ReadFile(tty.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), "Found: POST https://example.com/ CL.TE standard") {
+			t.Errorf("input %q: got output %q, want the finding", tc.input, out)
+		}
+		if poc := strings.Contains(string(out), "POST / HTTP/1.1"); poc != tc.poc {
+			t.Errorf("input %q: got PoC shown %v, want %v", tc.input, poc, tc.poc)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// URLContexts are contexts derived from a parent context for each URL, which can be cancelled to abort the tests of
+// a single URL. They are created when first needed. It is safe for concurrent use
+type URLContexts struct {
+	parent  context.Context
+	ctxs    map[string]context.Context
+	cancels map[string]context.CancelFunc
+	mux     sync.Mutex
+}
+
+// NewURLContexts returns contexts for each URL, which are also cancelled when parent is
+func NewURLContexts(parent context.Context) *URLContexts {
+	return &URLContexts{
+		parent:  parent,
+		ctxs:    make(map[string]context.Context),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// Get returns the context of the given URL
+func (c *URLContexts) Get(u string) context.Context {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.get(u)
+}
+
+// Cancel cancels the context of the given URL, aborting its tests
+func (c *URLContexts) Cancel(u string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.get(u)
+	c.cancels[u]()
+}
+
+// get returns the context of the given URL, creating it if needed. The mutex must be held
+func (c *URLContexts) get(u string) context.Context {
+	if ctx, ok := c.ctxs[u]; ok {
+		return ctx
+	}
+
+	ctx, cancel := context.WithCancel(c.parent)
+	c.ctxs[u] = ctx
+	c.cancels[u] = cancel
+	return ctx
+}
+
+// FindingCounts counts the findings made against each URL, to stop testing a URL once it has had a limit of
+// findings. If there are URLContexts, a URL's tests are cancelled when it reaches the limit. It is safe for
+// concurrent use
+type FindingCounts struct {
+	limit    uint
+	contexts *URLContexts
+	counts   map[string]uint
+	mux      sync.RWMutex
+}
+
+// NewFindingCounts returns counts which stop testing a URL after limit findings, or never if limit is 0, cancelling
+// the URL's context in contexts if it isn't nil
+func NewFindingCounts(limit uint, contexts *URLContexts) *FindingCounts {
+	return &FindingCounts{
+		limit:    limit,
+		contexts: contexts,
+		counts:   make(map[string]uint),
+	}
+}
+
+// Open returns whether more tests should be sent to the given URL, as it hasn't reached the limit
+func (c *FindingCounts) Open(u string) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.limit == 0 || c.counts[u] < c.limit
+}
+
+// Surplus returns whether a finding against the given URL should be dropped, as its tests were cancelled when it
+// reached the limit, so that exactly the limit of findings is kept. Without URLContexts, tests which were already
+// running are left to finish, and their findings are kept
+func (c *FindingCounts) Surplus(u string) bool {
+	return c.contexts != nil && !c.Open(u)
+}
+
+// Add counts a finding against the given URL, cancelling its tests if it has reached the limit
+func (c *FindingCounts) Add(u string) {
+	if c.limit == 0 {
+		return
+	}
+
+	c.mux.Lock()
+	c.counts[u]++
+	reached := c.counts[u] == c.limit
+	c.mux.Unlock()
+	if reached && c.contexts != nil {
+		c.contexts.Cancel(u)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestURLContexts(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewURLContexts(parent)
+
+	a := c.Get("http://a.example.com/")
+	if c.Get("http://a.example.com/") != a {
+		t.Error("got a different context for the same URL")
+	}
+
+	// Cancelling one URL leaves the others running, including URLs not seen yet
+	c.Cancel("http://a.example.com/")
+	if a.Err() == nil {
+		t.Error("cancelled URL's context wasn't cancelled")
+	}
+	b := c.Get("http://b.example.com/")
+	if b.Err() != nil {
+		t.Error("another URL's context was cancelled")
+	}
+
+	// A URL can be cancelled before its tests have started
+	c.Cancel("http://c.example.com/")
+	if c.Get("http://c.example.com/").Err() == nil {
+		t.Error("URL cancelled before it was seen has a running context")
+	}
+
+	// Stopping the scan cancels every URL
+	cancel()
+	if b.Err() == nil {
+		t.Error("URL's context wasn't cancelled with its parent")
+	}
+}
+
+func TestFindingCountsLimit(t *testing.T) {
+	c := NewFindingCounts(2, nil)
+	u := "http://example.com/"
+	c.Add(u)
+	if !c.Open(u) {
+		t.Error("URL closed after 1 of 2 findings")
+	}
+	c.Add(u)
+	if c.Open(u) {
+		t.Error("URL still open after 2 of 2 findings")
+	}
+	if !c.Open("http://other.example.com/") {
+		t.Error("another URL was closed")
+	}
+
+	// Without URLContexts, findings of tests which were already running are kept
+	if c.Surplus(u) {
+		t.Error("finding after the limit was surplus while draining")
+	}
+
+	unlimited := NewFindingCounts(0, nil)
+	for i := 0; i < 10; i++ {
+		unlimited.Add(u)
+	}
+	if !unlimited.Open(u) {
+		t.Error("URL closed without a limit")
+	}
+}
+
+func TestFindingCountsStopAfterExact(t *testing.T) {
+	const limit = 3
+	contexts := NewURLContexts(context.Background())
+	counts := NewFindingCounts(limit, contexts)
+	u := "http://example.com/"
+
+	// Workers which were already testing the URL keep finding desyncs after it reaches the limit, as results are
+	// received one at a time like in main
+	results := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				results <- u
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	kept := 0
+	for r := range results {
+		if counts.Surplus(r) {
+			continue
+		}
+		kept++
+		counts.Add(r)
+	}
+
+	if kept != limit {
+		t.Errorf("kept %d findings, want exactly %d", kept, limit)
+	}
+	if contexts.Get(u).Err() == nil {
+		t.Error("URL's tests weren't cancelled when it reached the limit")
+	}
+	if contexts.Get("http://other.example.com/").Err() != nil {
+		t.Error("another URL's tests were cancelled")
+	}
+}
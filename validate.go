@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// validateMutations sends the test requests of each of the mutations to a local server, which records the bytes
+// it receives, and checks the mutated headers and terminators arrived exactly as they were generated, and that
+// the added headers didn't bring framing headers of their own. Nothing sits between the requests and the server,
+// so the first check only confirms requests are written as built; the second catches options which change what a
+// mutation tests. It returns why each mutation which failed did, indexed by name, and the number of mutations
+// checked
+func validateMutations(conf Config) (map[string]string, int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer l.Close()
+
+	u, err := url.Parse("http://" + l.Addr().String() + "/")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	names := make([]string, 0, len(conf.Mutations))
+	for name := range conf.Mutations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := make(map[string]string, 0)
+	checked := 0
+	for _, name := range names {
+		// Pseudo-mutations don't alter the headers
+		if name == ZeroCLMutation || name == PipelineMutation || name == DuplicateHostMutation || name == DuplicateHostReversedMutation {
+			continue
+		}
+		checked++
+
+		// The same requests without the added headers have only the mutation's framing headers
+		bare := conf.RequestOptions
+		bare.Headers = nil
+
+		m := conf.Mutations[name]
+		reqs := map[string][]byte{TECL: tecl("POST", u, m, conf.RequestOptions)}
+		bareReqs := map[string][]byte{TECL: tecl("POST", u, m, bare)}
+		if m.Terminator == "" {
+			reqs[CLTE] = clte("POST", u, m, conf.RequestOptions)
+			bareReqs[CLTE] = clte("POST", u, m, bare)
+		}
+		for _, stype := range []string{CLTE, TECL} {
+			req, ok := reqs[stype]
+			if !ok {
+				continue
+			}
+			received, err := echoRequest(l, req)
+			if err != nil {
+				return nil, 0, err
+			}
+			if reason := mutationIntact(m, received); reason != "" {
+				failed[name] = fmt.Sprintf("%s request %s", stype, reason)
+				break
+			}
+			if extra := extraFraming(framingHeaders(bareReqs[stype]), framingHeaders(received)); len(extra) > 0 {
+				failed[name] = fmt.Sprintf("%s request had framing headers added by -H: %q", stype, extra)
+				break
+			}
+		}
+	}
+
+	return failed, checked, nil
+}
+
+// echoRequest sends req to the listener l over a new connection, and returns the bytes l received
+func echoRequest(l net.Listener, req []byte) ([]byte, error) {
+	received := make(chan []byte, 1)
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// The client closes its side once the request is written, so everything up to then is the request
+		b, err := ioutil.ReadAll(conn)
+		if err != nil {
+			errs <- err
+			return
+		}
+		received <- b
+	}()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	select {
+	case b := <-received:
+		return b, nil
+	case err := <-errs:
+		return nil, err
+	}
+}
+
+// mutationIntact returns why the mutated parts of m aren't all present in the request received, or an empty
+// string if they are
+func mutationIntact(m Mutation, received []byte) string {
+	parts := map[string]string{
+		"Transfer-Encoding header":      m.TE,
+		"late Transfer-Encoding header": m.LateTE,
+		"chunk extension":               m.ChunkExt,
+		"terminator":                    m.Terminator,
+	}
+
+	// The Content-Length format string is only checked up to the length
+	if m.CL != "" {
+		parts["Content-Length header"] = strings.SplitN(m.CL, "%", 2)[0]
+	}
+
+	for part, s := range parts {
+		if s != "" && !bytes.Contains(received, []byte(s)) {
+			return fmt.Sprintf("didn't contain the %s %q", part, s)
+		}
+	}
+
+	return ""
+}
+
+// framingHeaders returns the Transfer-Encoding and Content-Length header lines of the request req, including folded
+// and obfuscated ones
+func framingHeaders(req []byte) []string {
+	head := string(req)
+	if i := strings.Index(head, "\r\n\r\n"); i >= 0 {
+		head = head[:i]
+	}
+
+	var lines []string
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		name := headerName(line)
+		if strings.Contains(name, "transfer-encoding") || strings.Contains(name, "content-length") {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// extraFraming returns the framing header lines in got which aren't in want, counting repeated lines separately
+func extraFraming(want []string, got []string) []string {
+	counts := make(map[string]int, len(want))
+	for _, line := range want {
+		counts[line]++
+	}
+
+	var extra []string
+	for _, line := range got {
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		extra = append(extra, line)
+	}
+
+	return extra
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateMutations(t *testing.T) {
+	mutations := generateMutations()
+	mutations[ZeroCLMutation] = Mutation{}
+	failed, checked, err := validateMutations(Config{Mutations: mutations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != len(mutations)-1 {
+		t.Errorf("checked %d mutations, want all %d but the pseudo-mutation", checked, len(mutations)-1)
+	}
+	if len(failed) != 0 {
+		t.Errorf("got mutations which didn't arrive intact: %v", failed)
+	}
+}
+
+func TestValidateMutationsAddedHeaders(t *testing.T) {
+	mutations := map[string]Mutation{"plain": {TE: "Transfer-Encoding: chunked"}}
+
+	failed, _, err := validateMutations(Config{Mutations: mutations, RequestOptions: RequestOptions{Headers: []string{"X-Test: 1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("got failures for a header which doesn't affect framing: %v", failed)
+	}
+
+	failed, _, err = validateMutations(Config{Mutations: mutations, RequestOptions: RequestOptions{Headers: []string{"Content-Length: 0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(failed["plain"], "Content-Length: 0") {
+		t.Errorf("got reason %q for an added Content-Length header, want it to be named", failed["plain"])
+	}
+}
+
+func TestMutationIntact(t *testing.T) {
+	u, _ := url.Parse("http://example.com/")
+	m := generateMutations()
+
+	// The ways an HTTP client or proxy could normalize a request
+	tests := []struct {
+		mutation  string
+		normalize func(string) string
+		want      string
+	}{
+		{"lineprefix-space", func(s string) string { return strings.Replace(s, "\r\n Transfer-Encoding", "\r\nTransfer-Encoding", 1) }, "Transfer-Encoding header"},
+		{"cl-plus", func(s string) string { return strings.Replace(s, "Content-Length: +", "Content-Length: ", 1) }, "Content-Length header"},
+		{"lineprefix-tab", func(s string) string { return s }, ""},
+	}
+
+	for _, test := range tests {
+		req := clte("POST", u, m[test.mutation], RequestOptions{})
+		reason := mutationIntact(m[test.mutation], []byte(test.normalize(string(req))))
+		if !strings.Contains(reason, test.want) || (test.want == "") != (reason == "") {
+			t.Errorf("%s: got reason %q, want it to mention the %s", test.mutation, reason, test.want)
+		}
+	}
+
+	// Terminators are only in TE.CL requests
+	term := m["terminator-extension"]
+	req := tecl("POST", u, term, RequestOptions{})
+	if reason := mutationIntact(term, bytes.Replace(req, []byte(term.Terminator), []byte("0\r\n\r\n"), 1)); !strings.Contains(reason, "terminator") {
+		t.Errorf("got reason %q for a normalized terminator", reason)
+	}
+}
@@ -1,55 +1,354 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type Worker struct {
+	// Cancelling Ctx stops the worker, aborting any request in progress
+	Ctx context.Context
+
 	Conf         Config
 	Errs         chan<- error
 	ErrCounts    *map[string]uint
 	ErrCountsMux *sync.RWMutex
+
+	// Per-target overrides of the configuration, indexed by URL
+	Targets    *map[string]Target
+	TargetsMux *sync.RWMutex
+
+	// The number of consecutive test requests which have timed out, indexed by host
+	HostTimeouts    *map[string]uint
+	HostTimeoutsMux *sync.RWMutex
+
+	// The resolver to look up hostnames with in place of the system resolver, if set
+	Resolver *DoHResolver
+
+	// Spaces out test requests to each host according to its base time, if set
+	Pacer *Pacer
+
+	// The local addresses to make connections from in turn, if set
+	LocalAddrs *LocalAddrs
+
+	// The worker's name, and the profile its request times are recorded in, if set
+	Name    string
+	Profile *WorkerProfile
+
+	// The limit on the number of requests sent by all workers, if set
+	Budget *RequestBudget
+
+	// The contexts which abort the tests of each URL once it has had enough findings, if set
+	URLContexts *URLContexts
+
+	// Measures the base times of URLs again during the scan, updating the timeouts of their tests, if set
+	Sampler *BaseSampler
+
+	// Idle keep-alive connections, indexed by scheme and host
+	idle map[string]*pooledConn
+
+	// How much of the time taken by the last request sent with SendRequest, SendKeepAlive or SendTestRequest wasn't
+	// spent waiting for the response to it, such as waiting for a 100 Continue response before sending its body, or
+	// a failed attempt over a stale reused connection
+	untimed time.Duration
+}
+
+// requestOptions returns the options to write requests to the given URL with, taking into account any
+// overrides for the target
+func (w *Worker) requestOptions(u *url.URL) RequestOptions {
+	opts := w.Conf.RequestOptions
+	if w.Targets == nil {
+		return opts
+	}
+
+	w.TargetsMux.RLock()
+	t, ok := (*w.Targets)[u.String()]
+	w.TargetsMux.RUnlock()
+	if ok {
+		if t.redirected {
+			opts.Headers = withoutCredentials(opts.Headers)
+		}
+		opts.Headers = mergeHeaders(opts.Headers, t.Headers)
+	}
+
+	return opts
+}
+
+// maxBaseRetries is the number of times to retry a base request which receives one of the RetryStatuses
+const maxBaseRetries = 3
+
+// measureBase times a base request to u written with opts, and returns the time along with the response, which
+// is nil if it couldn't be parsed. Requests which receive one of the RetryStatuses are retried, after waiting for
+// as long as the response's Retry-After header asks
+func (w *Worker) measureBase(u *url.URL, opts RequestOptions) (time.Duration, *http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := w.sendBase(u, opts)
+		duration := time.Since(start) - w.untimed
+		if err != nil || resp == nil || !w.retryStatus(resp.StatusCode) {
+			return duration, resp, err
+		} else if attempt == maxBaseRetries {
+			return 0, nil, fmt.Errorf("base request to %s received a %d response after %d retries", u, resp.StatusCode, maxBaseRetries)
+		}
+
+		select {
+		case <-time.After(retryAfter(resp.Header.Get("Retry-After"), time.Duration(attempt+1)*time.Second)):
+		case <-w.Ctx.Done():
+			return 0, nil, w.Ctx.Err()
+		}
+	}
+}
+
+// sendBase sends a base request to u written with opts, and returns the response, or nil if the response couldn't
+// be parsed. The response's body has already been read, and its ContentLength is set to the number of bytes in it
+func (w *Worker) sendBase(u *url.URL, opts RequestOptions) (*http.Response, error) {
+	if w.Conf.ReuseConnections {
+		return w.SendKeepAlive(baseReq(u, opts.keepAlive()), u, 30*time.Second)
+	}
+
+	raw, err, _ := w.SendRequest(baseReq(u, opts), u, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+	if err != nil {
+		return nil, nil
+	}
+
+	// The whole response has already been read, so a truncated body is just shorter
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.ContentLength = int64(len(body))
+
+	return resp, nil
+}
+
+// smallResponse returns an error describing why resp is too small to be a meaningful base response, or nil if
+// it isn't smaller than MinResponseBytes
+func (w *Worker) smallResponse(u *url.URL, resp *http.Response) error {
+	if w.Conf.MinResponseBytes == 0 {
+		return nil
+	} else if resp == nil {
+		return fmt.Errorf("base response from %s couldn't be parsed, so may not be a meaningful baseline", u)
+	} else if resp.ContentLength < w.Conf.MinResponseBytes {
+		return fmt.Errorf("base response from %s was only %d bytes, so may be from a captive portal or error page rather than the target", u, resp.ContentLength)
+	}
+
+	return nil
+}
+
+// captureHeaders returns the values of the CaptureHeaders present in the headers of resp, indexed by their names
+func (w *Worker) captureHeaders(resp *http.Response) map[string]string {
+	if len(w.Conf.CaptureHeaders) == 0 || resp == nil {
+		return nil
+	}
+
+	captured := make(map[string]string, 0)
+	for _, name := range w.Conf.CaptureHeaders {
+		if v, ok := resp.Header[http.CanonicalHeaderKey(name)]; ok {
+			captured[name] = strings.Join(v, ", ")
+		}
+	}
+
+	return captured
+}
+
+// maxRedirects is the number of redirects a base request follows with FollowRedirects
+const maxRedirects = 5
+
+// redirectLocation returns the URL which resp to a request to u redirects to, or nil if it isn't a redirect to an
+// http or https URL
+func redirectLocation(u *url.URL, resp *http.Response) *url.URL {
+	if resp == nil {
+		return nil
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	next, err := u.Parse(location)
+	if err != nil || (next.Scheme != "http" && next.Scheme != "https") {
+		return nil
+	}
+	next.Fragment = ""
+
+	return next
+}
+
+// retryStatus returns whether base requests receiving the given status code should be retried
+func (w *Worker) retryStatus(status int) bool {
+	for _, s := range w.Conf.RetryStatuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
 }
 
 type BaseResult struct {
 	Time time.Duration
 	Url  *url.URL
+
+	// The URL the base request was redirected to and the time is for, if FollowRedirects is set, or nil if it
+	// wasn't redirected
+	Final *url.URL
+
+	// The captured headers of the base response
+	Headers map[string]string
 }
 
 // BaseTimes fetches urls on a channel and times how long it takes to fetch those URLs
 func (w *Worker) BaseTimes(urls <-chan *url.URL, results chan<- BaseResult, done func()) {
 	for u := range urls {
-		req := baseReq(u, w.Conf.Headers)
-		start := time.Now()
-		_, err, _ := w.SendRequest(req, u, 30*time.Second)
-		end := time.Now()
-		duration := end.Sub(start)
-		if err != nil {
+		if w.Ctx.Err() != nil {
+			break
+		}
+
+		// Drop unreachable URLs quickly, rather than waiting for the full base request to time out
+		if w.Conf.ProbeTimeout > 0 {
+			conn, err := w.dial(u, w.Conf.ProbeTimeout)
+			if err != nil {
+				w.Errs <- fmt.Errorf("%s unreachable: %w", u, err)
+				continue
+			}
+			conn.Close()
+		}
+
+		// Only the final request of a chain of redirects is timed, since that's where tests will be sent
+		final := u
+		duration, resp, err := w.measureBase(u, w.requestOptions(u))
+		for redirects := 0; err == nil && w.Conf.FollowRedirects; redirects++ {
+			next := redirectLocation(final, resp)
+			if next == nil {
+				break
+			} else if redirects == maxRedirects {
+				err = fmt.Errorf("base request to %s was redirected more than %d times", u, maxRedirects)
+				break
+			} else if reason := redirectSkipReason(u, next, w.Conf); reason != "" {
+				// The scope and denylist only apply to the URLs given, so are checked before following each redirect
+				err = fmt.Errorf("base request to %s was redirected to %s URL %s, so it won't be tested", u, reason, next)
+				break
+			}
+			final = next
+
+			// Credentials for the URL given aren't sent to another host it redirects to
+			opts := w.requestOptions(u)
+			if final.Hostname() != u.Hostname() {
+				opts.Headers = withoutCredentials(opts.Headers)
+			}
+			duration, resp, err = w.measureBase(final, opts)
+		}
+		if w.Ctx.Err() != nil {
+			break
+		} else if err != nil {
 			w.Errs <- err
 			continue
 		}
 
-		results <- BaseResult{duration, u}
+		// Flag base responses too small to be from the target, and leave their URLs without a base time so they
+		// aren't tested if asked to
+		if err := w.smallResponse(final, resp); err != nil {
+			w.Errs <- err
+			if w.Conf.SkipSmallResponses {
+				continue
+			}
+		}
+
+		r := BaseResult{Time: duration, Url: u, Headers: w.captureHeaders(resp)}
+		if final.String() != u.String() {
+			r.Final = final
+		}
+		results <- r
 	}
+	w.closeIdle()
 	done()
 }
 
-// SmuggleType represents the type of smuggling vulnerability - either CL.TE or TE.CL
+// SmuggleType represents the type of smuggling vulnerability - either CL.TE or TE.CL, or a signal of a desync such
+// as a reset connection
 type SmuggleType string
 
 const (
-	SAFE = ""
-	CLTE = "CL.TE"
-	TECL = "TE.CL"
+	SAFE     = ""
+	CLTE     = "CL.TE"
+	TECL     = "TE.CL"
+	ZEROCL   = "0.CL"
+	RESET    = "RESET"
+	PIPELINE = "PIPELINE"
+	HOST     = "HOST"
 )
 
+// Severity represents how likely a desync of a given type is to be exploitable
+type Severity int
+
+const (
+	NONE Severity = iota
+	LOW
+	MEDIUM
+	HIGH
+)
+
+// Severity returns the severity of a desync of this type. CL.TE and TE.CL desyncs have been confirmed with a
+// verification request, whereas the others which rely on a differing status code could have other causes
+func (s SmuggleType) Severity() Severity {
+	switch s {
+	case CLTE, TECL:
+		return HIGH
+	case ZEROCL, PIPELINE, HOST:
+		return MEDIUM
+	case SAFE:
+		return NONE
+	default:
+		return LOW
+	}
+}
+
+// String returns the lowercase name of the severity
+func (s Severity) String() string {
+	switch s {
+	case LOW:
+		return "low"
+	case MEDIUM:
+		return "medium"
+	case HIGH:
+		return "high"
+	default:
+		return "none"
+	}
+}
+
+// parseSeverity returns the severity with the given name, as returned by Severity.String
+func parseSeverity(name string) (Severity, error) {
+	for _, s := range []Severity{NONE, LOW, MEDIUM, HIGH} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+
+	return NONE, fmt.Errorf("unrecognised severity: %s", name)
+}
+
 // SmuggleTest represents the parameters for a test of CL.TE and TE.CL smuggling against
 // a single URL using a single method and a single Transfer-Encoding header mutation
 type SmuggleTest struct {
@@ -68,6 +367,62 @@ type SmuggleTest struct {
 
 	// The type of attack the service is vulnerable to
 	Status SmuggleType
+
+	// How likely a discovered desync is to be genuine, between 0 and 1
+	Confidence float64 `json:",omitempty"`
+
+	// Whether a TE.CL desync was confirmed by smuggling a request
+	Confirmed bool `json:",omitempty"`
+
+	// The reasons a desync is likely to be a false positive, as returned by ResultAggregator.Suspect
+	Suspect []string `json:",omitempty"`
+
+	// The decision made on the finding with --interactive, if any
+	Triage string `json:",omitempty"`
+
+	// The headers captured from the base response of the URL's host, which are stored in the state separately
+	Headers map[string]string `json:"-"`
+
+	// The headers of a randomly generated mutation, which its name alone isn't enough to reproduce
+	MutationHeaders string `json:"-"`
+
+	// The command line which generates a PoC for the finding
+	PoCCommand string `json:"-"`
+}
+
+// zeroCLConfidence is the confidence of 0.CL desyncs. They're detected by a differing status code rather than a
+// timeout, so there is no timing margin to score them by
+const zeroCLConfidence = 0.5
+
+// confidence returns a score between 0 and 1 of how likely a CL.TE or TE.CL desync is to be genuine, given how
+// long the verification request took to be answered, the base time of the URL, and the timeout used. A
+// verification response which arrived well within the timeout is more convincing, as is a base time which is
+// small compared to the timeout, since slow or variable hosts are more likely to time out for other reasons
+func confidence(verify time.Duration, base time.Duration, timeout time.Duration) float64 {
+	if timeout <= 0 {
+		return 0
+	}
+
+	margin := 1 - float64(verify)/float64(timeout)
+	stability := 1 - float64(base)/float64(timeout)
+	c := margin * stability
+	if c < 0 {
+		return 0
+	} else if c > 1 {
+		return 1
+	}
+
+	return c
+}
+
+// baseTime returns the base time a test's timeout was derived from, or 0 if a fixed timeout is in use
+func (w *Worker) baseTime(t SmuggleTest) time.Duration {
+	timeout := time.Duration(float64(t.Timeout) / w.Conf.Mutations[t.Mutation].timeoutMultiplier())
+	if w.Conf.FixedTimeout > 0 || timeout < w.Conf.Delay {
+		return 0
+	}
+
+	return timeout - w.Conf.Delay
 }
 
 // Equals returns whether two SmuggleTests are equal
@@ -78,51 +433,181 @@ func (t SmuggleTest) Equals(s SmuggleTest) bool {
 // smuggleWorker sends requests URLs using the given Transfer-Encoding header,
 // and checks for CL.TE then TE.CL vulnerabilities
 func (w *Worker) SmuggleTest(tests <-chan SmuggleTest, results chan<- SmuggleTest, done func()) {
+	// Each test is run with its URL's context if there are URLContexts, so the worker's own context is kept to
+	// tell whether the whole scan has been stopped
+	scanCtx := w.Ctx
+	defer func() { w.Ctx = scanCtx }()
 	for t := range tests {
+		w.Ctx = scanCtx
+		if w.Ctx.Err() != nil {
+			break
+		}
+		if w.URLContexts != nil {
+			w.Ctx = w.URLContexts.Get(t.Url.String())
+			if w.Ctx.Err() != nil {
+				continue
+			}
+		}
+
 		// Skip test if we've received too many errors for this URL
 		if w.Conf.MaxErrors > 0 {
 			w.ErrCountsMux.RLock()
-			if (*w.ErrCounts)[t.Url.String()] >= w.Conf.MaxErrors {
+			count := (*w.ErrCounts)[t.Url.String()]
+			w.ErrCountsMux.RUnlock()
+			if count >= w.Conf.MaxErrors {
 				continue
 			}
-			w.ErrCountsMux.RUnlock()
 		}
 
-		// First test for CL.TE
-		req := clte(t.Method, t.Url, w.Conf.Mutations[t.Mutation], w.Conf.Headers)
-		_, err, isTimeout := w.SendRequest(req, t.Url, t.Timeout)
-		if isTimeout {
-			// Send the verification request
-			req = clteVerify(t.Method, t.Url, w.Conf.Mutations[t.Mutation], w.Conf.Headers)
-			_, err, verifyTimeout := w.SendRequest(req, t.Url, t.Timeout)
+		// Skip test if every recent test against the host has timed out
+		if w.hostStalled(t.Url) {
+			continue
+		}
 
-			if !verifyTimeout {
-				t.Status = CLTE
+		t = w.resampleBase(t)
+
+		opts := w.requestOptions(t.Url)
+
+		// 0.CL tests don't use a Transfer-Encoding header, so are performed on their own
+		if t.Mutation == ZeroCLMutation {
+			if w.pace(t) != nil {
+				continue
+			}
+			vulnerable, err := w.ZeroCL(t.Method, t.Url, opts, t.Timeout)
+			if err != nil {
+				w.ErrCountsMux.Lock()
+				(*w.ErrCounts)[t.Url.String()]++
+				w.ErrCountsMux.Unlock()
+				w.Errs <- err
+			} else if vulnerable {
+				t.Status = ZEROCL
+				t.Confidence = zeroCLConfidence
+			}
+
+			// A cancelled test is incomplete, so shouldn't be recorded as having been performed
+			if w.Ctx.Err() == nil {
 				results <- t
+			}
+			continue
+		}
+
+		// Pipelining tests send ordinary requests, so are also performed on their own
+		if t.Mutation == PipelineMutation {
+			if w.pace(t) != nil {
 				continue
+			}
+			vulnerable, err := w.Pipeline(t.Method, t.Url, opts, t.Timeout)
+			if err != nil {
+				w.ErrCountsMux.Lock()
+				(*w.ErrCounts)[t.Url.String()]++
+				w.ErrCountsMux.Unlock()
+				w.Errs <- err
+			} else if vulnerable {
+				t.Status = PIPELINE
+				t.Confidence = 1
+			}
+
+			if w.Ctx.Err() == nil {
+				results <- t
+			}
+			continue
+		}
+
+		// Duplicate Host header tests don't alter the framing either
+		if t.Mutation == DuplicateHostMutation || t.Mutation == DuplicateHostReversedMutation {
+			if w.pace(t) != nil {
+				continue
+			}
+			vulnerable, err := w.HostRouting(t.Method, t.Url, t.Mutation, opts, t.Timeout)
+			if err != nil {
+				w.ErrCountsMux.Lock()
+				(*w.ErrCounts)[t.Url.String()]++
+				w.ErrCountsMux.Unlock()
+				w.Errs <- err
+			} else if vulnerable {
+				t.Status = HOST
+				t.Confidence = 1
+			}
+
+			if w.Ctx.Err() == nil {
+				results <- t
+			}
+			continue
+		}
+
+		// Terminator mutations only alter the body of TE.CL tests, so their CL.TE tests would repeat those of the
+		// standard mutation
+		m := w.Conf.Mutations[t.Mutation]
+		if m.Terminator == "" {
+			// First test for CL.TE
+			req := clte(t.Method, t.Url, m, opts)
+			if w.pace(t) != nil {
+				continue
+			}
+			resp, err, isTimeout := w.SendRequest(req, t.Url, t.Timeout)
+			w.recordTimeout(t.Url, err, isTimeout)
+			if w.Conf.DetectResets && !isTimeout && isReset(resp, err) {
+				// The TE.CL test is still performed, as it could find a more severe desync
+				t.Status = RESET
+			} else if isTimeout {
+				// Send the verification request
+				req = clteVerify(t.Method, t.Url, m, w.cleanOptions(opts))
+				start := time.Now()
+				_, err, verifyTimeout := w.SendTestRequest(req, t.Url, t.Timeout)
+
+				if w.Ctx.Err() != nil {
+					continue
+				}
+				if !verifyTimeout {
+					t.Status = CLTE
+					t.Confidence = confidence(time.Since(start)-w.untimed, w.baseTime(t), t.Timeout)
+					results <- t
+					continue
+				} else if err != nil {
+					w.ErrCountsMux.Lock()
+					(*w.ErrCounts)[t.Url.String()]++
+					w.ErrCountsMux.Unlock()
+					w.Errs <- err
+				}
 			} else if err != nil {
 				w.ErrCountsMux.Lock()
 				(*w.ErrCounts)[t.Url.String()]++
 				w.ErrCountsMux.Unlock()
 				w.Errs <- err
 			}
-		} else if err != nil {
-			w.ErrCountsMux.Lock()
-			(*w.ErrCounts)[t.Url.String()]++
-			w.ErrCountsMux.Unlock()
-			w.Errs <- err
 		}
 
 		// First test for TE.CL
-		req = tecl(t.Method, t.Url, w.Conf.Mutations[t.Mutation], w.Conf.Headers)
-		_, err, isTimeout = w.SendRequest(req, t.Url, t.Timeout)
-		if isTimeout {
+		req := tecl(t.Method, t.Url, m, opts)
+		if w.pace(t) != nil {
+			continue
+		}
+		resp, err, isTimeout := w.SendRequest(req, t.Url, t.Timeout)
+		w.recordTimeout(t.Url, err, isTimeout)
+		if w.Conf.DetectResets && !isTimeout && isReset(resp, err) {
+			t.Status = RESET
+		} else if isTimeout {
 			// Send the verification request
-			req = teclVerify(t.Method, t.Url, w.Conf.Mutations[t.Mutation], w.Conf.Headers)
-			_, err, verifyTimeout := w.SendRequest(req, t.Url, t.Timeout)
+			req = teclVerify(t.Method, t.Url, m, w.cleanOptions(opts))
+			start := time.Now()
+			_, err, verifyTimeout := w.SendTestRequest(req, t.Url, t.Timeout)
 
+			// A cancelled verification request is incomplete, rather than a sign of a desync
+			if w.Ctx.Err() != nil {
+				continue
+			}
 			if !verifyTimeout {
 				t.Status = TECL
+				t.Confidence = confidence(time.Since(start)-w.untimed, w.baseTime(t), t.Timeout)
+				if w.Conf.SmugglePrefix != "" {
+					t.Confirmed, err = w.ConfirmTECL(t.Method, t.Url, m, opts, t.Timeout)
+					if err != nil {
+						w.ErrCountsMux.Lock()
+						(*w.ErrCounts)[t.Url.String()]++
+						w.ErrCountsMux.Unlock()
+						w.Errs <- err
+					}
+				}
 				results <- t
 				continue
 			} else if err != nil {
@@ -138,52 +623,460 @@ func (w *Worker) SmuggleTest(tests <-chan SmuggleTest, results chan<- SmuggleTes
 			w.Errs <- err
 		}
 
+		// A cancelled test is incomplete, so shouldn't be recorded as having been performed
+		if w.Ctx.Err() != nil {
+			continue
+		}
 		results <- t
 	}
+	w.closeIdle()
 	done()
 }
 
-// sendRequest sends the specified request, but doesn't try to parse the response,
-// and instead just returns it
-func (w *Worker) SendRequest(req []byte, u *url.URL, timeout time.Duration) (resp []byte, err error, isTimeout bool) {
-	var cerr error
-	var conn io.ReadWriteCloser
+// resampleBase returns the test with its timeout derived from the latest base time of its URL, if there is a
+// Sampler, first measuring the base time again if it is due. Tests using a fixed timeout or without a base time
+// are left as they are
+func (w *Worker) resampleBase(t SmuggleTest) SmuggleTest {
+	if w.Sampler == nil || w.Conf.FixedTimeout > 0 || t.Timeout == 0 {
+		return t
+	}
 
-	port := u.Port()
-	if port == "" {
-		if u.Scheme == "https" {
-			port = "443"
-		} else {
-			port = "80"
+	u := t.Url.String()
+	if w.Sampler.Due(u, w.baseTime(t)) {
+		base, _, err := w.measureBase(t.Url, w.requestOptions(t.Url))
+		if err == nil {
+			w.Sampler.Record(u, base)
+		} else if w.Ctx.Err() == nil {
+			w.Errs <- fmt.Errorf("failed to measure the base time of %s again, so keeping the last one: %v", u, err)
+		}
+	}
+
+	if base, ok := w.Sampler.Base(u); ok {
+		t.Timeout = w.Conf.Mutations[t.Mutation].timeout(base + w.Conf.Delay)
+	}
+	return t
+}
+
+// pace waits until the Pacer allows another request to the host of the test, if there is a Pacer. Tests without
+// a base time, such as those using a fixed timeout, aren't paced. An error is returned if the scan was cancelled
+// while waiting, in which case the test shouldn't be performed
+func (w *Worker) pace(t SmuggleTest) error {
+	if w.Pacer == nil {
+		return nil
+	}
+
+	return w.Pacer.Wait(w.Ctx, t.Url.Host, w.baseTime(t))
+}
+
+// recordTimeout records whether a test request to the host of u timed out, resetting the host's count of
+// consecutive timeouts if it was answered. A warning is sent once the count reaches HostTimeoutLimit
+func (w *Worker) recordTimeout(u *url.URL, err error, isTimeout bool) {
+	if w.Conf.HostTimeoutLimit == 0 || (err != nil && !isTimeout) {
+		return
+	}
+
+	w.HostTimeoutsMux.Lock()
+	if !isTimeout {
+		(*w.HostTimeouts)[u.Host] = 0
+		w.HostTimeoutsMux.Unlock()
+		return
+	}
+	(*w.HostTimeouts)[u.Host]++
+	reached := (*w.HostTimeouts)[u.Host] == w.Conf.HostTimeoutLimit
+	w.HostTimeoutsMux.Unlock()
+
+	// The warning is sent without holding the lock, as other workers would be held up until it's received
+	if reached {
+		w.Errs <- fmt.Errorf("%s timed out on %d consecutive tests, so is likely rate limiting or down rather than vulnerable. No more tests will be sent to it", u.Host, w.Conf.HostTimeoutLimit)
+	}
+}
+
+// hostStalled returns whether the host of u has timed out on too many consecutive test requests to keep testing
+func (w *Worker) hostStalled(u *url.URL) bool {
+	if w.Conf.HostTimeoutLimit == 0 {
+		return false
+	}
+
+	w.HostTimeoutsMux.RLock()
+	defer w.HostTimeoutsMux.RUnlock()
+	return (*w.HostTimeouts)[u.Host] >= w.Conf.HostTimeoutLimit
+}
+
+// markerStatus returns the status code a request for the marker path is expected to receive
+func (w *Worker) markerStatus() int {
+	if w.Conf.MarkerStatus == 0 {
+		return http.StatusNotFound
+	}
+
+	return w.Conf.MarkerStatus
+}
+
+// ZeroCL tests for a 0.CL desync by sending a request whose body is the start of a request for the marker path,
+// followed by a normal request on the same connection. If the backend ignores the body, it will be prepended to
+// the normal request, which will then receive the marker status
+func (w *Worker) ZeroCL(method string, u *url.URL, opts RequestOptions, timeout time.Duration) (bool, error) {
+	// Find the status code normally returned, so the marker status can be attributed to the smuggled prefix
+	base, err := w.baseStatus(u, opts, timeout)
+	if err != nil || base == 0 || base == w.markerStatus() {
+		return false, err
+	}
+
+	statuses, err := w.SendReused([][]byte{zerocl(method, u, opts.keepAlive()), baseReq(u, opts)}, u, timeout)
+	if err != nil || len(statuses) < 2 {
+		// The connection not being reused isn't an error worth reporting
+		return false, nil
+	}
+
+	return statuses[1] == w.markerStatus(), nil
+}
+
+// Pipeline tests whether responses to pipelined requests are mis-associated, by sending a request with a body
+// immediately followed by a request for the marker path, in a single write on one connection. The responses
+// should arrive in order, so the first receiving the marker path's response or the second receiving the first
+// request's usual response means they have been mixed up. Servers which close the connection after the first
+// response don't support pipelining, so aren't vulnerable
+func (w *Worker) Pipeline(method string, u *url.URL, opts RequestOptions, timeout time.Duration) (bool, error) {
+	// Find the status codes each request normally receives on its own, which need to differ for the responses to
+	// be told apart
+	own, err := w.requestStatus(pipelineReq(method, u, w.cleanOptions(opts)), u, timeout)
+	if err != nil || own == 0 {
+		return false, err
+	}
+	notFound, err := w.requestStatus(notFoundReq(u, w.cleanOptions(opts)), u, timeout)
+	if err != nil || notFound == 0 || notFound == own {
+		return false, err
+	}
+
+	statuses, err := w.SendPipelined([][]byte{pipelineReq(method, u, opts.keepAlive()), notFoundReq(u, opts)}, u, timeout)
+	if err != nil || len(statuses) < 2 {
+		// The server not answering the second request isn't an error worth reporting
+		return false, nil
+	}
+
+	return statuses[0] == notFound || statuses[1] == own, nil
+}
+
+// HostRouting tests whether a request with two Host headers is routed by the second, by comparing the status codes
+// of requests to u with only its own Host header, with only one for routingHost, and with both in the order given by
+// the mutation. The first two need to differ for the responses to be told apart. The request with both being
+// answered like the one for the host sent second means that host was honoured by the frontend or the backend,
+// which can disagree with each other on the host being requested. A 400 or 421 response to the request with both
+// is a rejection, so never counts
+func (w *Worker) HostRouting(method string, u *url.URL, mutation string, opts RequestOptions, timeout time.Duration) (bool, error) {
+	clean := w.cleanOptions(opts)
+	own, err := w.requestStatus(hostReq(method, u, clean, u.Hostname()), u, timeout)
+	if err != nil || own == 0 {
+		return false, err
+	}
+	other, err := w.requestStatus(hostReq(method, u, clean, routingHost), u, timeout)
+	if err != nil || other == 0 || other == own {
+		return false, err
+	}
+
+	hosts := duplicateHosts(mutation, u)
+	status, err := w.requestStatus(hostReq(method, u, clean, hosts...), u, timeout)
+	if err != nil || status == 0 {
+		return false, err
+	}
+
+	// Frontends often reject both an unknown host and duplicate Host headers outright, which isn't a sign of
+	// either host being honoured
+	if status == http.StatusBadRequest || status == http.StatusMisdirectedRequest {
+		return false, nil
+	}
+
+	if hosts[1] == routingHost {
+		return status == other, nil
+	}
+	return status == own, nil
+}
+
+// ConfirmTECL confirms a TE.CL desync by smuggling a request with the configured request line, followed by a
+// normal request on the same connection. If the normal request receives a different status code to usual, it must
+// have received the response to the smuggled request
+func (w *Worker) ConfirmTECL(method string, u *url.URL, m Mutation, opts RequestOptions, timeout time.Duration) (bool, error) {
+	base, err := w.baseStatus(u, opts, timeout)
+	if err != nil || base == 0 {
+		return false, err
+	}
+
+	reqs := [][]byte{teclPrefix(method, u, m, w.Conf.SmugglePrefix, opts.keepAlive()), baseReq(u, opts)}
+	statuses, err := w.SendReused(reqs, u, timeout)
+	if err != nil || len(statuses) < 2 {
+		// The connection not being reused isn't an error worth reporting
+		return false, nil
+	}
+
+	return statuses[1] != base, nil
+}
+
+// baseStatus returns the status code normally returned by the given URL, or 0 if the request timed out
+func (w *Worker) baseStatus(u *url.URL, opts RequestOptions, timeout time.Duration) (int, error) {
+	return w.requestStatus(baseReq(u, w.cleanOptions(opts)), u, timeout)
+}
+
+// cleanOptions returns the options to write the requests of a test which shouldn't desync the connection with.
+// With ReuseTestConnections set, they ask for the connection to be kept open, so it can be used for the next one
+func (w *Worker) cleanOptions(opts RequestOptions) RequestOptions {
+	if w.Conf.ReuseTestConnections {
+		return opts.keepAlive()
+	}
+
+	return opts
+}
+
+// requestStatus sends req to the host of the given URL with SendTestRequest, and returns the status code of the
+// response, or 0 if the request timed out
+func (w *Worker) requestStatus(req []byte, u *url.URL, timeout time.Duration) (int, error) {
+	resp, err, isTimeout := w.SendTestRequest(req, u, timeout)
+	if err != nil || isTimeout {
+		return 0, err
+	}
+	parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return parsed.StatusCode, nil
+}
+
+// SendReused sends each of the requests in turn over a single connection, reading the response to each before
+// sending the next. The status codes of the responses read are returned, which will be fewer than the number of
+// requests if the connection was closed early
+func (w *Worker) SendReused(reqs [][]byte, u *url.URL, timeout time.Duration) ([]int, error) {
+	if err := w.spend(len(reqs)); err != nil {
+		return nil, err
+	}
+	defer w.recordRequest(time.Now())
+	conn, err := w.dial(u, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	statuses := make([]int, 0, len(reqs))
+	pc := newPooledConn(conn)
+	for _, req := range reqs {
+		resp, _, err := pc.roundTrip(w.Ctx, req, timeout, w.Conf.WaitForContinue)
+		if err != nil {
+			return statuses, err
+		}
+		statuses = append(statuses, resp.StatusCode)
+	}
+
+	return statuses, nil
+}
+
+// SendPipelined sends all of reqs to the host of the given URL in a single write on one connection, without waiting
+// for any responses, and then returns the status codes of the responses received in order. Fewer status codes are
+// returned if the connection is closed early
+func (w *Worker) SendPipelined(reqs [][]byte, u *url.URL, timeout time.Duration) ([]int, error) {
+	if err := w.spend(len(reqs)); err != nil {
+		return nil, err
+	}
+	defer w.recordRequest(time.Now())
+	conn, err := w.dial(u, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(bytes.Join(reqs, nil)); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]int, 0, len(reqs))
+	r := bufio.NewReader(conn)
+	for range reqs {
+		resp, err := readFinalResponse(r, nil)
+		if err != nil {
+			return statuses, nil
+		}
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return statuses, nil
+		}
+		statuses = append(statuses, resp.StatusCode)
+	}
+
+	return statuses, nil
+}
+
+// spend takes n requests from the worker's budget, if it has one. If there aren't enough left, the scan is being
+// stopped, so the context's error is returned
+func (w *Worker) spend(n int) error {
+	if w.Budget == nil || w.Budget.Take(n) {
+		return nil
+	} else if err := w.Ctx.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("request budget spent")
+}
+
+// recordRequest records the time of a request which started at start in the worker's profile, if it has one
+func (w *Worker) recordRequest(start time.Time) {
+	if w.Profile != nil {
+		w.Profile.Record(w.Name, start)
+	}
+}
+
+// maxFDRetries is the number of times to retry a connection which failed due to the open file limit
+const maxFDRetries = 5
+
+// dial opens a connection to the host of the given URL, using TLS for https URLs. If FDBackoff is set, connections
+// which fail due to the open file limit are retried after waiting for other connections to be closed
+func (w *Worker) dial(u *url.URL, timeout time.Duration) (net.Conn, error) {
+	conn, err := w.dialOnce(u, timeout)
+	for i := 0; i < maxFDRetries && w.Conf.FDBackoff > 0 && isFDLimit(err); i++ {
+		select {
+		case <-time.After(w.Conf.FDBackoff):
+		case <-w.Ctx.Done():
+			return nil, w.Ctx.Err()
+		}
+		conn, err = w.dialOnce(u, timeout)
+	}
+
+	return conn, err
+}
+
+// dialOnce opens a connection to the host of the given URL, or to ConnectTo if set, using TLS for https URLs.
+// The host is resolved with the Resolver if there is one
+func (w *Worker) dialOnce(u *url.URL, timeout time.Duration) (net.Conn, error) {
+	if w.Conf.UnixSocket != "" {
+		return w.dialUnix(u, timeout)
+	}
+
+	port := urlPort(u)
+	target := net.JoinHostPort(u.Hostname(), port)
+	if w.Conf.ConnectTo != "" {
+		target = w.Conf.ConnectTo
+	} else if w.Resolver != nil && net.ParseIP(u.Hostname()) == nil {
+		addrs, err := w.Resolver.Lookup(w.Ctx, u.Hostname())
+		if err != nil {
+			return nil, err
 		}
+		target = net.JoinHostPort(addrs[0], port)
 	}
-	target := fmt.Sprintf("%s:%s", u.Hostname(), port)
 	if u.Scheme == "https" {
-		conf := &tls.Config{InsecureSkipVerify: true}
-		conn, cerr = tls.DialWithDialer(&net.Dialer{
-			Timeout: timeout,
-		}, "tcp", target, conf)
+		return tls.DialWithDialer(w.LocalAddrs.dialer(timeout), "tcp", target, w.tlsConfig(u))
+	}
+
+	return w.LocalAddrs.dialer(timeout).Dial("tcp", target)
+}
+
+// tlsConfig returns the TLS configuration for connections to the given URL. Certificates are only verified if
+// RootCAs is set, and the SNI is always taken from the URL, even when connecting elsewhere
+func (w *Worker) tlsConfig(u *url.URL) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: w.Conf.RootCAs == nil,
+		RootCAs:            w.Conf.RootCAs,
+		ServerName:         u.Hostname(),
+		NextProtos:         w.Conf.ALPN,
+	}
+}
 
-	} else {
-		d := net.Dialer{Timeout: timeout}
-		conn, cerr = d.Dial("tcp", target)
+// dialUnix opens a connection to the configured unix socket in place of the host of the given URL, using TLS
+// for https URLs
+func (w *Worker) dialUnix(u *url.URL, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", w.Conf.UnixSocket, timeout)
+	if err != nil || u.Scheme != "https" {
+		return conn, err
+	}
+
+	tlsConn := tls.Client(conn, w.tlsConfig(u))
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// isFDLimit returns whether err was caused by reaching the limit on the number of open files
+func isFDLimit(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// isReset returns whether a request's response and error show that the connection was reset, or closed without
+// any response being sent
+func isReset(resp []byte, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNRESET)
 	}
 
+	return len(resp) == 0
+}
+
+// inspectResponse returns the status code of a raw response, or 0 if it can't be parsed, and whether its body is
+// shorter than its headers say it should be
+func inspectResponse(raw []byte) (int, bool) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+	if err != nil {
+		return 0, false
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode, err == io.ErrUnexpectedEOF
+}
+
+// sendRequest sends the specified request, but doesn't try to parse the response,
+// and instead just returns it
+func (w *Worker) SendRequest(req []byte, u *url.URL, timeout time.Duration) (resp []byte, err error, isTimeout bool) {
+	if err = w.spend(1); err != nil {
+		return
+	}
+	defer w.recordRequest(time.Now())
+	conn, cerr := w.dial(u, timeout)
 	if cerr != nil {
 		err = cerr
 		return
 	}
+	defer conn.Close()
 
-	_, err = conn.Write(req)
+	// With WaitForContinue, the body is held back until the server asks for it, so the timeout below only
+	// starts once the whole request has been sent
+	head, body := req, []byte(nil)
+	if w.Conf.WaitForContinue {
+		head, body = splitBody(req)
+	}
+	_, err = conn.Write(head)
 	if err != nil {
 		return
 	}
+	var reader io.Reader = conn
+	w.untimed = 0
+	if len(body) > 0 {
+		waitStart := time.Now()
+		early, send := awaitContinue(conn, conn)
+		w.untimed = time.Since(waitStart)
+		if send {
+			if _, err = conn.Write(body); err != nil {
+				return
+			}
+		}
+		reader = io.MultiReader(bytes.NewReader(early), conn)
+	}
 
-	// See if we can read before the timeout
-	c := make(chan []byte)
-	e := make(chan error)
+	// See if we can read before the timeout. The channels are buffered so the reader can always finish, even
+	// if it is abandoned. Unless the request asks for the connection to be closed, the server may keep it open,
+	// so only the first response is read
+	c := make(chan []byte, 1)
+	e := make(chan error, 1)
 	go func() {
-		r, err := ioutil.ReadAll(conn)
+		var r []byte
+		var err error
+		if closesConnection(req) {
+			r, err = ioutil.ReadAll(reader)
+			r = stripInterim(r)
+		} else {
+			r, err = readResponse(reader, strings.SplitN(string(req), " ", 2)[0])
+		}
 		if err != nil {
 			e <- err
 		} else {
@@ -202,13 +1095,21 @@ func (w *Worker) SendRequest(req []byte, u *url.URL, timeout time.Duration) (res
 	case <-time.After(timeout):
 		isTimeout = true
 		conn.Close()
+	case <-w.Ctx.Done():
+		err = w.Ctx.Err()
+		conn.Close()
 	}
 
 	if w.Conf.Debug {
 		d := time.Now().Sub(start)
-		fmt.Printf("Request to %s took %dms (timeout: %t)\n", u.String(), d.Milliseconds(), isTimeout)
-		fmt.Println(string(req))
-		fmt.Println("---")
+		status, truncated := inspectResponse(resp)
+		out := io.Writer(os.Stdout)
+		if w.Conf.StdoutOnlyFindings {
+			out = os.Stderr
+		}
+		fmt.Fprintf(out, "Request to %s took %dms (timeout: %t, status: %d, size: %d, truncated: %t)\n", u.String(), d.Milliseconds(), isTimeout, status, len(resp), truncated)
+		fmt.Fprintln(out, string(req))
+		fmt.Fprintln(out, "---")
 	}
 
 	return
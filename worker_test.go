@@ -0,0 +1,1382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testWorker returns a worker with the given configuration, and the channel its errors are sent to
+func testWorker(conf Config) (*Worker, chan error) {
+	errs := make(chan error, 100)
+	counts := make(map[string]uint, 0)
+	timeouts := make(map[string]uint, 0)
+	return &Worker{
+		Ctx:             context.Background(),
+		Conf:            conf,
+		Errs:            errs,
+		ErrCounts:       &counts,
+		ErrCountsMux:    &sync.RWMutex{},
+		HostTimeouts:    &timeouts,
+		HostTimeoutsMux: &sync.RWMutex{},
+	}, errs
+}
+
+// runTest performs a single smuggling test with w, and returns its result
+func runTest(t *testing.T, w *Worker, test SmuggleTest) SmuggleTest {
+	tests := make(chan SmuggleTest, 1)
+	results := make(chan SmuggleTest, 1)
+	tests <- test
+	close(tests)
+	w.SmuggleTest(tests, results, func() {})
+
+	select {
+	case r := <-results:
+		return r
+	default:
+		t.Fatalf("no result for %s %s %s", test.Method, test.Url, test.Mutation)
+		return test
+	}
+}
+
+// noErrors fails the test if any errors have been sent to errs
+func noErrors(t *testing.T, errs chan error) {
+	for {
+		select {
+		case err := <-errs:
+			t.Errorf("got error: %v", err)
+		default:
+			return
+		}
+	}
+}
+
+// headerValue returns the value of the first header in head with the given name, ignoring case, or "" if there
+// isn't one
+func headerValue(head string, name string) string {
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], name) {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// respond writes a response with the given status and an empty body to w
+func respond(w io.Writer, status int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d Status\r\nContent-Length: 0\r\n\r\n", status)
+}
+
+// zeroCLServer starts a stub server which answers requests for /smuggles404 with a 404 and others with a 200,
+// closing connections when asked. If ignoreBody is set, it ignores the Content-Length header of requests, as the
+// backend of a server vulnerable to 0.CL desyncs would, so their bodies are read as the start of the next request
+func zeroCLServer(t *testing.T, ignoreBody bool) *url.URL {
+	return stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			if n, _ := strconv.Atoi(headerValue(head, "Content-Length")); n > 0 && !ignoreBody {
+				io.CopyN(ioutil.Discard, r, int64(n))
+			}
+
+			if strings.HasPrefix(head, "GET /smuggles404 ") {
+				respond(conn, 404)
+			} else {
+				respond(conn, 200)
+			}
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+}
+
+func TestZeroCL(t *testing.T) {
+	tests := []struct {
+		name       string
+		ignoreBody bool
+		want       SmuggleType
+	}{
+		{"backend ignoring the body", true, ZEROCL},
+		{"backend reading the body", false, SAFE},
+	}
+
+	for _, test := range tests {
+		u := zeroCLServer(t, test.ignoreBody)
+		w, errs := testWorker(Config{RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}, Mutations: map[string]Mutation{ZeroCLMutation: {}}})
+		r := runTest(t, w, SmuggleTest{Url: u, Method: "POST", Mutation: ZeroCLMutation, Timeout: time.Second})
+		if r.Status != test.want {
+			t.Errorf("%s: got status %q, want %q", test.name, r.Status, test.want)
+		}
+		noErrors(t, errs)
+	}
+}
+
+func TestZeroCLNotFoundBase(t *testing.T) {
+	// A URL which is always not found can't show the smuggled request was answered
+	u := stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			respond(conn, 404)
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+
+	w, _ := testWorker(Config{RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}, Mutations: map[string]Mutation{ZeroCLMutation: {}}})
+	vulnerable, err := w.ZeroCL("POST", u, w.Conf.RequestOptions, time.Second)
+	if err != nil || vulnerable {
+		t.Errorf("got %t and %v, want a safe result", vulnerable, err)
+	}
+}
+
+func TestHeaderCaseOnWire(t *testing.T) {
+	heads := make(chan string, 1)
+	u := stubServer(t, func(conn net.Conn) {
+		head, _ := readHead(bufio.NewReader(conn))
+		heads <- head
+		respond(conn, 200)
+	})
+
+	// The mutation is always sent exactly as written, whatever the case of the other headers
+	mutation := "tRANsfEr-ENCodInG: chunked"
+	tests := []struct {
+		headerCase string
+		want       []string
+	}{
+		{"", []string{mutation, "Host: 127.0.0.1", "X-Mixed-Case: 1", "Content-Length: 4"}},
+		{"lower", []string{mutation, "host: 127.0.0.1", "x-mixed-case: 1", "content-length: 4"}},
+		{"upper", []string{mutation, "HOST: 127.0.0.1", "X-MIXED-CASE: 1", "CONTENT-LENGTH: 4"}},
+	}
+
+	for _, test := range tests {
+		w, _ := testWorker(Config{RequestOptions: RequestOptions{Headers: []string{"X-Mixed-Case: 1"}, HeaderCase: test.headerCase}})
+		if _, err, _ := w.SendRequest(clte("POST", u, Mutation{TE: mutation}, w.Conf.RequestOptions), u, time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(<-heads, "\r\n\r\n"), "\r\n")
+		if got := lines[1:]; strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%q: got headers %q, want %q", test.headerCase, got, test.want)
+		}
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	tests := []struct {
+		status SmuggleType
+		want   Severity
+	}{
+		{CLTE, HIGH},
+		{TECL, HIGH},
+		{ZEROCL, MEDIUM},
+		{SAFE, NONE},
+		{SmuggleType("unknown"), LOW},
+	}
+
+	for _, test := range tests {
+		if got := test.status.Severity(); got != test.want {
+			t.Errorf("%q: got severity %s, want %s", test.status, got, test.want)
+		}
+		if got, err := parseSeverity(test.want.String()); err != nil || got != test.want {
+			t.Errorf("parsing %q: got %s and %v", test.want, got, err)
+		}
+	}
+
+	if _, err := parseSeverity("critical"); err == nil {
+		t.Error("parsed an unrecognised severity")
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	// A server which accepts connections but never completes a TLS handshake
+	u := stubServer(t, func(conn net.Conn) {
+		ioutil.ReadAll(conn)
+	})
+	u.Scheme = "https"
+
+	w, errs := testWorker(Config{Delay: time.Minute, ProbeTimeout: 200 * time.Millisecond})
+	urls := make(chan *url.URL, 1)
+	results := make(chan BaseResult, 1)
+	urls <- u
+	close(urls)
+
+	// The probe gives up after its own timeout, rather than the delay or the base request's timeout
+	start := time.Now()
+	w.BaseTimes(urls, results, func() {})
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("probe took %s, want the probe timeout of 200ms", elapsed)
+	}
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "unreachable") {
+			t.Errorf("got error %v, want the URL to be unreachable", err)
+		}
+	default:
+		t.Error("got no error for the unreachable URL")
+	}
+	if len(results) != 0 {
+		t.Errorf("got a base time for the unreachable URL: %v", <-results)
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	tests := []struct {
+		verify  time.Duration
+		base    time.Duration
+		timeout time.Duration
+		want    float64
+	}{
+		{0, 0, 10 * time.Second, 1},
+		{time.Second, 0, 10 * time.Second, 0.9},
+		{5 * time.Second, 0, 10 * time.Second, 0.5},
+		{time.Second, 5 * time.Second, 10 * time.Second, 0.45},
+		{9 * time.Second, 8 * time.Second, 10 * time.Second, 0.02},
+		{10 * time.Second, 0, 10 * time.Second, 0},
+		{11 * time.Second, 0, 10 * time.Second, 0},
+		{time.Second, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		if got := confidence(test.verify, test.base, test.timeout); math.Abs(got-test.want) > 0.0001 {
+			t.Errorf("verified in %s with base %s and timeout %s: got %.4f, want %.4f", test.verify, test.base, test.timeout, got, test.want)
+		}
+	}
+}
+
+func TestZeroCLConfidence(t *testing.T) {
+	// 0.CL desyncs aren't detected by timing, so how long the test takes doesn't affect their confidence
+	u := zeroCLServer(t, true)
+	w, _ := testWorker(Config{Delay: time.Second, RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}, Mutations: map[string]Mutation{ZeroCLMutation: {}}})
+	r := runTest(t, w, SmuggleTest{Url: u, Method: "POST", Mutation: ZeroCLMutation, Timeout: 2 * time.Second})
+	if r.Status != ZEROCL || r.Confidence != zeroCLConfidence {
+		t.Errorf("got %s with confidence %.2f, want %s with %.2f", r.Status, r.Confidence, ZEROCL, zeroCLConfidence)
+	}
+}
+
+func TestSplitMutationsOnWire(t *testing.T) {
+	heads := make(chan string, 1)
+	u := stubServer(t, func(conn net.Conn) {
+		head, _ := readHead(bufio.NewReader(conn))
+		heads <- head
+		respond(conn, 200)
+	})
+
+	tests := map[string][]string{
+		"split-ch_id":    {"Transfer-Encoding: chunked", "Transfer-Encoding: identity"},
+		"split-id_ch":    {"Transfer-Encoding: identity", "Transfer-Encoding: chunked"},
+		"split-ch_gz":    {"Transfer-Encoding: chunked", "Transfer-Encoding: gzip"},
+		"split-gz_ch":    {"Transfer-Encoding: gzip", "Transfer-Encoding: chunked"},
+		"split-ch_empty": {"Transfer-Encoding: chunked", "Transfer-Encoding: "},
+		"split-empty_ch": {"Transfer-Encoding: ", "Transfer-Encoding: chunked"},
+		"split-value":    {"Transfer-Encoding: chun", "Transfer-Encoding: ked"},
+	}
+
+	// The first header is sent before all others, and the second after all others
+	mutations := generateMutations()
+	w, _ := testWorker(Config{RequestOptions: RequestOptions{Headers: []string{"X-Other: 1"}}})
+	for name, want := range tests {
+		if _, err, _ := w.SendRequest(tecl("POST", u, mutations[name], w.Conf.RequestOptions), u, time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(<-heads, "\r\n\r\n"), "\r\n")
+		if first, last := lines[1], lines[len(lines)-1]; first != want[0] || last != want[1] {
+			t.Errorf("%s: got first header %q and last %q, want %q", name, first, last, want)
+		}
+		if len(lines) != 6 {
+			t.Errorf("%s: got headers %q, want two Transfer-Encoding headers around the others", name, lines[1:])
+		}
+	}
+}
+
+// resetServer starts a stub server which resets the connection of each request with a Transfer-Encoding header,
+// and answers others with a 200
+func resetServer(t *testing.T) *url.URL {
+	return stubServer(t, func(conn net.Conn) {
+		head, err := readHead(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		if headerValue(head, "Transfer-Encoding") != "" {
+			conn.(*net.TCPConn).SetLinger(0)
+			return
+		}
+		respond(conn, 200)
+	})
+}
+
+// resetTECLServer starts a stub server which reads request bodies using their Content-Length header. It resets
+// the connection of CL.TE test requests, and never answers TE.CL test requests, as a server vulnerable to TE.CL
+// desyncs wouldn't. Other requests are answered with a 200
+func resetTECLServer(t *testing.T) *url.URL {
+	return stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		head, err := readHead(r)
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(headerValue(head, "Content-Length"))
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch {
+		case strings.HasSuffix(string(body), "Z"):
+			conn.(*net.TCPConn).SetLinger(0)
+		case strings.HasSuffix(string(body), "X"):
+			io.Copy(ioutil.Discard, conn)
+		default:
+			respond(conn, 200)
+		}
+	})
+}
+
+func TestDetectResets(t *testing.T) {
+	tests := []struct {
+		name         string
+		u            *url.URL
+		detectResets bool
+		want         SmuggleType
+	}{
+		{"reset with detection", resetServer(t), true, RESET},
+		{"reset without detection", resetServer(t), false, SAFE},
+		{"response with detection", zeroCLServer(t, false), true, SAFE},
+		{"reset before a TE.CL desync", resetTECLServer(t), true, TECL},
+	}
+
+	for _, test := range tests {
+		w, _ := testWorker(Config{DetectResets: test.detectResets, RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}, Mutations: map[string]Mutation{"standard": generateMutations()["standard"]}})
+		r := runTest(t, w, SmuggleTest{Url: test.u, Method: "POST", Mutation: "standard", Timeout: time.Second})
+		if r.Status != test.want {
+			t.Errorf("%s: got status %q, want %q", test.name, r.Status, test.want)
+		}
+	}
+}
+
+func TestIsReset(t *testing.T) {
+	tests := []struct {
+		resp []byte
+		err  error
+		want bool
+	}{
+		{nil, nil, true},
+		{[]byte("HTTP/1.1 200 OK\r\n\r\n"), nil, false},
+		{nil, fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{nil, io.ErrUnexpectedEOF, false},
+	}
+
+	for _, test := range tests {
+		if got := isReset(test.resp, test.err); got != test.want {
+			t.Errorf("%q and %v: got %t, want %t", test.resp, test.err, got, test.want)
+		}
+	}
+}
+
+// teclServer starts a stub server which answers requests for /smuggles404 with a 404 and others with a 200. If
+// useCL is set, it reads request bodies using their Content-Length header, as the backend of a server vulnerable to
+// TE.CL desyncs would, and otherwise reads chunked bodies.
+func teclServer(t *testing.T, useCL bool) *url.URL {
+	return stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			if headerValue(head, "Transfer-Encoding") == "chunked" && !useCL {
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+					io.CopyN(ioutil.Discard, r, n+2)
+					if n == 0 {
+						break
+					}
+				}
+			} else if n, _ := strconv.Atoi(headerValue(head, "Content-Length")); n > 0 {
+				io.CopyN(ioutil.Discard, r, int64(n))
+			}
+
+			if strings.HasPrefix(head, "GET /smuggles404 ") {
+				respond(conn, 404)
+			} else {
+				respond(conn, 200)
+			}
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+}
+
+func TestConfirmTECL(t *testing.T) {
+	tests := []struct {
+		name  string
+		useCL bool
+		want  bool
+	}{
+		{"backend using Content-Length", true, true},
+		{"backend using chunked encoding", false, false},
+	}
+
+	m := generateMutations()["standard"]
+	for _, test := range tests {
+		u := teclServer(t, test.useCL)
+		w, errs := testWorker(Config{SmugglePrefix: strings.ReplaceAll(smugglePrefixes["404"], "%s", "/smuggles404")})
+		opts := RequestOptions{Headers: []string{"Connection: close"}}
+		confirmed, err := w.ConfirmTECL("POST", u, m, opts, time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if confirmed != test.want {
+			t.Errorf("%s: got confirmed %v, want %v", test.name, confirmed, test.want)
+		}
+		noErrors(t, errs)
+	}
+}
+
+// exhaustFiles lowers the open file limit of the process and opens files until it is reached, returning a function
+// which closes them. The limit is restored when the test finishes.
+func exhaustFiles(t *testing.T) func() {
+	var orig syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &orig); err != nil {
+		t.Skip(err)
+	}
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip(err)
+	}
+	lim := orig
+	lim.Cur = uint64(len(fds) + 16)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { syscall.Setrlimit(syscall.RLIMIT_NOFILE, &orig) })
+
+	files := make([]*os.File, 0)
+	for {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			break
+		}
+		files = append(files, f)
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			for _, f := range files {
+				f.Close()
+			}
+		})
+	}
+	t.Cleanup(release)
+	return release
+}
+
+// TestFDBackoff runs in its own process, since the open file limit it lowers is shared by the whole test binary
+func TestFDBackoff(t *testing.T) {
+	if os.Getenv("SMUGGLES_FD_TEST") == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(exe, "-test.run=^TestFDBackoff$", "-test.v")
+		cmd.Env = append(os.Environ(), "SMUGGLES_FD_TEST=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		} else if bytes.Contains(out, []byte("--- SKIP")) {
+			t.Skipf("%s", out)
+		}
+		return
+	}
+
+	u := zeroCLServer(t, false)
+
+	// Without a backoff, the first error is returned
+	w, _ := testWorker(Config{})
+	release := exhaustFiles(t)
+	_, err := w.dial(u, time.Second)
+	if !isFDLimit(err) {
+		t.Fatalf("got error %v, want one caused by the open file limit", err)
+	}
+
+	// With one, the connection is retried once files have been closed
+	w, _ = testWorker(Config{FDBackoff: 50 * time.Millisecond})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release()
+	}()
+	conn, err := w.dial(u, time.Second)
+	if err != nil {
+		t.Fatalf("got error %v, want the connection to be retried", err)
+	}
+	conn.Close()
+}
+
+func TestIsFDLimit(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("dial: %w", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.EMFILE)}), true},
+		{os.NewSyscallError("socket", syscall.ENFILE), true},
+		{syscall.ECONNREFUSED, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := isFDLimit(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestConnectTo(t *testing.T) {
+	var mux sync.Mutex
+	var sni, host string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		host = r.Host
+		mux.Unlock()
+	}))
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			mux.Lock()
+			sni = hello.ServerName
+			mux.Unlock()
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The URL's host doesn't resolve, so the request can only succeed by connecting to the override
+	w, errs := testWorker(Config{ConnectTo: srv.Listener.Addr().String()})
+	u, _ := url.Parse("https://edge.smuggles.invalid/")
+	resp, err, isTimeout := w.SendRequest(baseReq(u, RequestOptions{Headers: []string{"Connection: close"}}), u, time.Second)
+	if err != nil || isTimeout {
+		t.Fatalf("got error %v and timeout %v", err, isTimeout)
+	}
+	if !strings.HasPrefix(string(resp), "HTTP/1.1 200 ") {
+		t.Errorf("got response %q, want a 200", resp)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if sni != "edge.smuggles.invalid" {
+		t.Errorf("got SNI %q, want the URL's host", sni)
+	}
+	if host != "edge.smuggles.invalid" {
+		t.Errorf("got Host header %q, want the URL's host", host)
+	}
+	noErrors(t, errs)
+}
+
+func TestHostTimeoutLimit(t *testing.T) {
+	// A host which never answers
+	u := stubServer(t, func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+
+	tests := []struct {
+		limit   uint
+		results int
+		warned  bool
+	}{
+		{0, 3, false},
+		{2, 1, true},
+	}
+
+	for _, test := range tests {
+		w, errs := testWorker(Config{HostTimeoutLimit: test.limit, Mutations: generateMutations()})
+		queue := make(chan SmuggleTest, 3)
+		results := make(chan SmuggleTest, 3)
+		for _, method := range []string{"GET", "POST", "PUT"} {
+			queue <- SmuggleTest{Url: u, Method: method, Mutation: "standard", Timeout: 50 * time.Millisecond}
+		}
+		close(queue)
+		w.SmuggleTest(queue, results, func() {})
+		close(results)
+
+		n := 0
+		for r := range results {
+			n++
+			if r.Status != SAFE {
+				t.Errorf("limit %d: got a %s finding for %s, want none", test.limit, r.Status, r.Method)
+			}
+		}
+		if n != test.results {
+			t.Errorf("limit %d: got %d results, want %d", test.limit, n, test.results)
+		}
+
+		warned := false
+		for len(errs) > 0 {
+			err := <-errs
+			if strings.Contains(err.Error(), "timed out on 2 consecutive tests") {
+				warned = true
+			} else {
+				t.Errorf("limit %d: got error %v", test.limit, err)
+			}
+		}
+		if warned != test.warned {
+			t.Errorf("limit %d: got warned %v, want %v", test.limit, warned, test.warned)
+		}
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	// A server which answers the first request with a 503 straight away, and later ones with a 200 after a delay
+	var mux sync.Mutex
+	requests := 0
+	u := stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		mux.Lock()
+		requests++
+		first := requests == 1
+		mux.Unlock()
+		if first {
+			fmt.Fprint(conn, "HTTP/1.1 503 Service Unavailable\r\nRetry-After: 0\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+		respond(conn, 200)
+	})
+
+	for _, reuse := range []bool{false, true} {
+		mux.Lock()
+		requests = 0
+		mux.Unlock()
+		w, _ := testWorker(Config{RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}, RetryStatuses: []int{429, 503}, ReuseConnections: reuse})
+		d, _, err := w.measureBase(u, w.requestOptions(u))
+		if err != nil {
+			t.Fatalf("reusing connections %v: %v", reuse, err)
+		}
+		if d < 200*time.Millisecond {
+			t.Errorf("reusing connections %v: got base time %s, want the time of the 200 response", reuse, d)
+		}
+		mux.Lock()
+		if requests != 2 {
+			t.Errorf("reusing connections %v: got %d requests, want 2", reuse, requests)
+		}
+		mux.Unlock()
+		w.closeIdle()
+	}
+
+	// A status which is always received is an error once the retries run out
+	u = stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err == nil {
+			fmt.Fprint(conn, "HTTP/1.1 429 Too Many Requests\r\nRetry-After: 0\r\nContent-Length: 0\r\n\r\n")
+		}
+	})
+	w, _ := testWorker(Config{RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}, RetryStatuses: []int{429}})
+	if _, _, err := w.measureBase(u, w.requestOptions(u)); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("got error %v, want one reporting the 429 response", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 2 * time.Second},
+		{"invalid", 2 * time.Second},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-1", 2 * time.Second},
+		{"3600", maxRetryAfter},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+
+	for _, test := range tests {
+		if got := retryAfter(test.header, 2*time.Second); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.header, got, test.want)
+		}
+	}
+}
+
+func TestMinResponseBytes(t *testing.T) {
+	// A server answering with a tiny body, as a captive portal might
+	tiny := stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err == nil {
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		}
+	})
+	large := stubServer(t, func(conn net.Conn) {
+		if _, err := readHead(bufio.NewReader(conn)); err == nil {
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 64\r\nConnection: close\r\n\r\n%s", strings.Repeat("x", 64))
+		}
+	})
+
+	tests := []struct {
+		skip  bool
+		timed int
+	}{
+		{false, 2},
+		{true, 1},
+	}
+
+	for _, test := range tests {
+		for _, reuse := range []bool{false, true} {
+			w, errs := testWorker(Config{MinResponseBytes: 10, SkipSmallResponses: test.skip, ReuseConnections: reuse})
+			urls := make(chan *url.URL, 2)
+			results := make(chan BaseResult, 2)
+			urls <- tiny
+			urls <- large
+			close(urls)
+			w.BaseTimes(urls, results, func() {})
+			close(results)
+
+			timed := make(map[string]bool)
+			for r := range results {
+				timed[r.Url.String()] = true
+			}
+			if len(timed) != test.timed || !timed[large.String()] {
+				t.Errorf("skip %v, reusing connections %v: got base times for %v, want %d including %s", test.skip, reuse, timed, test.timed, large)
+			}
+
+			// Only the tiny response is flagged
+			if len(errs) != 1 {
+				t.Fatalf("skip %v, reusing connections %v: got %d errors, want 1", test.skip, reuse, len(errs))
+			}
+			if err := <-errs; !strings.Contains(err.Error(), tiny.String()) || !strings.Contains(err.Error(), "only 2 bytes") {
+				t.Errorf("skip %v, reusing connections %v: got error %v, want the tiny response flagged", test.skip, reuse, err)
+			}
+		}
+	}
+}
+
+func TestInspectResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		status    int
+		truncated bool
+	}{
+		{"complete", "HTTP/1.1 404 Not Found\r\nContent-Length: 2\r\n\r\nno", 404, false},
+		{"truncated", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort", 200, true},
+		{"truncated chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nshort", 200, true},
+		{"no length", "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nbody", 200, false},
+		{"unparseable", "garbage", 0, false},
+		{"empty", "", 0, false},
+	}
+
+	for _, test := range tests {
+		status, truncated := inspectResponse([]byte(test.raw))
+		if status != test.status || truncated != test.truncated {
+			t.Errorf("%s: got status %d and truncated %v, want %d and %v", test.name, status, truncated, test.status, test.truncated)
+		}
+	}
+}
+
+func TestPaceCancelled(t *testing.T) {
+	for _, mutation := range []string{"standard", ZeroCLMutation} {
+		hosts := make(chan string, 10)
+		u := respondingServer(t, hosts)
+
+		// Another request has already reserved the host's next slot for an hour's time
+		pacer := NewPacer(1)
+		pacer.Wait(context.Background(), u.Host, time.Hour)
+
+		w, _ := testWorker(Config{Mutations: generateMutations()})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		w.Ctx = ctx
+		w.Pacer = pacer
+
+		tests := make(chan SmuggleTest, 1)
+		results := make(chan SmuggleTest, 1)
+		tests <- SmuggleTest{Url: u, Method: "POST", Mutation: mutation, Timeout: time.Second}
+		close(tests)
+		start := time.Now()
+		w.SmuggleTest(tests, results, func() {})
+
+		// The test is abandoned when the scan is cancelled, without sending anything
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s: the test took %s, want it to stop waiting when cancelled", mutation, d)
+		}
+		if len(results) != 0 {
+			t.Errorf("%s: got a result for a test cancelled while waiting to be paced", mutation)
+		}
+		if len(hosts) != 0 {
+			t.Errorf("%s: got %d requests, want none", mutation, len(hosts))
+		}
+	}
+}
+
+// pipelineServer returns the URL of a server answering unknown paths with a 404, which answers pipelined requests
+// in reverse order if misorder is set. If onlyGet is set, requests using other methods are also answered with a 404
+func pipelineServer(t *testing.T, misorder bool, onlyGet bool) *url.URL {
+	return stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		var pending []int
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			if n, _ := strconv.Atoi(headerValue(head, "Content-Length")); n > 0 {
+				io.CopyN(ioutil.Discard, r, int64(n))
+			}
+
+			status := 200
+			if strings.HasPrefix(head, "GET /smuggles404 ") || (onlyGet && !strings.HasPrefix(head, "GET ")) {
+				status = 404
+			}
+			pending = append(pending, status)
+			if misorder && r.Buffered() > 0 {
+				continue
+			}
+			for i := range pending {
+				if misorder {
+					respond(conn, pending[len(pending)-1-i])
+				} else {
+					respond(conn, pending[i])
+				}
+			}
+			pending = nil
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+}
+
+func TestPipelining(t *testing.T) {
+	tests := []struct {
+		name     string
+		misorder bool
+		onlyGet  bool
+		want     SmuggleType
+	}{
+		{"server mixing up pipelined responses", true, false, PIPELINE},
+		{"server answering pipelined requests in order", false, false, SAFE},
+		{"server answering other methods with a 404", false, true, SAFE},
+	}
+
+	for _, test := range tests {
+		u := pipelineServer(t, test.misorder, test.onlyGet)
+		w, errs := testWorker(Config{RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}, Mutations: map[string]Mutation{PipelineMutation: {}}})
+		r := runTest(t, w, SmuggleTest{Url: u, Method: "POST", Mutation: PipelineMutation, Timeout: time.Second})
+		if r.Status != test.want {
+			t.Errorf("%s: got status %q, want %q", test.name, r.Status, test.want)
+		}
+		noErrors(t, errs)
+	}
+}
+
+// hostServer starts a stub server which answers requests with a 200 if they're for the host it serves, and with a
+// 404 otherwise. Requests with more than one Host header are routed by the first, or the last if honourLast is set.
+// If ignoreHost is set, every request is answered with a 200. If reject is set, requests for other hosts and those
+// with more than one Host header are answered with a 400, as many frontends do
+func hostServer(t *testing.T, honourLast bool, ignoreHost bool, reject bool) *url.URL {
+	return stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+
+			var hosts []string
+			for _, line := range strings.Split(head, "\r\n")[1:] {
+				if parts := strings.SplitN(line, ":", 2); len(parts) == 2 && strings.EqualFold(parts[0], "Host") {
+					hosts = append(hosts, strings.TrimSpace(parts[1]))
+				}
+			}
+			host := hosts[0]
+			if honourLast {
+				host = hosts[len(hosts)-1]
+			}
+			if reject && (len(hosts) > 1 || host != "127.0.0.1") {
+				respond(conn, 400)
+			} else if ignoreHost || host == "127.0.0.1" {
+				respond(conn, 200)
+			} else {
+				respond(conn, 404)
+			}
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+}
+
+func TestHostRouting(t *testing.T) {
+	tests := []struct {
+		name       string
+		honourLast bool
+		ignoreHost bool
+		reject     bool
+		want       SmuggleType
+	}{
+		{"server routing by the last Host header", true, false, false, HOST},
+		{"server routing by the first Host header", false, false, false, SAFE},
+		{"server ignoring the Host header", true, true, false, SAFE},
+		{"server rejecting other hosts and duplicate Host headers", true, false, true, SAFE},
+	}
+
+	for _, test := range tests {
+		u := hostServer(t, test.honourLast, test.ignoreHost, test.reject)
+		for _, mutation := range []string{DuplicateHostMutation, DuplicateHostReversedMutation} {
+			w, errs := testWorker(Config{RequestOptions: RequestOptions{Headers: []string{"Connection: close"}}, Mutations: map[string]Mutation{mutation: {}}})
+			r := runTest(t, w, SmuggleTest{Url: u, Method: "GET", Mutation: mutation, Timeout: time.Second})
+			if r.Status != test.want {
+				t.Errorf("%s, %s: got status %q, want %q", test.name, mutation, r.Status, test.want)
+			}
+			noErrors(t, errs)
+		}
+	}
+}
+
+func TestALPN(t *testing.T) {
+	protos := make(chan []string, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			protos <- hello.SupportedProtos
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/")
+
+	tests := []struct {
+		alpn []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"h2", "http/1.1"}, "h2,http/1.1"},
+		{[]string{"http/1.1"}, "http/1.1"},
+	}
+
+	for _, test := range tests {
+		w, errs := testWorker(Config{ALPN: test.alpn})
+		conn, err := w.dial(u, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := strings.Join(<-protos, ","); got != test.want {
+			t.Errorf("--alpn %q: got protocols %q offered, want %q", test.alpn, got, test.want)
+		}
+		noErrors(t, errs)
+	}
+}
+
+// redirectServers starts a server which redirects to a second server on another hostname, and returns their URLs
+// along with the Authorization headers each one received
+func redirectServers() (*url.URL, *url.URL, func() (string, string, int), func()) {
+	var mux sync.Mutex
+	var fromAuth, toAuth string
+	toRequests := 0
+
+	to := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		toAuth = r.Header.Get("Authorization")
+		toRequests++
+		mux.Unlock()
+		rw.Write([]byte("redirected"))
+	}))
+	toURL, _ := url.Parse(to.URL + "/")
+	toURL.Host = "localhost:" + toURL.Port()
+
+	from := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		fromAuth = r.Header.Get("Authorization")
+		mux.Unlock()
+		http.Redirect(rw, r, toURL.String(), http.StatusFound)
+	}))
+	fromURL, _ := url.Parse(from.URL + "/")
+
+	received := func() (string, string, int) {
+		mux.Lock()
+		defer mux.Unlock()
+		return fromAuth, toAuth, toRequests
+	}
+	closeAll := func() {
+		from.Close()
+		to.Close()
+	}
+	return fromURL, toURL, received, closeAll
+}
+
+// baseTimes measures the base time of u with a single worker, and returns its results and errors
+func baseTimes(conf Config, u *url.URL) ([]BaseResult, []error) {
+	errs := make(chan error, 10)
+	results := make(chan BaseResult, 10)
+	w := Worker{Ctx: context.Background(), Conf: conf, Errs: errs}
+
+	urls := make(chan *url.URL, 1)
+	urls <- u
+	close(urls)
+	w.BaseTimes(urls, results, func() {})
+	close(errs)
+	close(results)
+
+	var rs []BaseResult
+	for r := range results {
+		rs = append(rs, r)
+	}
+	var es []error
+	for err := range errs {
+		es = append(es, err)
+	}
+	return rs, es
+}
+
+func TestBaseTimesRedirect(t *testing.T) {
+	from, to, received, closeAll := redirectServers()
+	defer closeAll()
+
+	// Without FollowRedirects, the redirect response itself is timed
+	results, errs := baseTimes(Config{}, from)
+	if len(errs) > 0 || len(results) != 1 || results[0].Final != nil {
+		t.Fatalf("got results %v and errors %v, want one result which wasn't redirected", results, errs)
+	}
+	if _, _, n := received(); n != 0 {
+		t.Errorf("URL redirected to received %d requests without following redirects, want none", n)
+	}
+
+	// The URL redirected to is on another host, so is only followed when it's in scope
+	results, errs = baseTimes(Config{FollowRedirects: true, Scope: []string{from.Hostname(), to.Hostname()}}, from)
+	if len(errs) > 0 || len(results) != 1 || results[0].Final == nil || results[0].Final.String() != to.String() {
+		t.Fatalf("got results %v and errors %v, want one result redirected to %s", results, errs, to)
+	}
+	if results[0].Url != from {
+		t.Errorf("got result for %s, want it for the URL given", results[0].Url)
+	}
+	if _, _, n := received(); n != 1 {
+		t.Errorf("URL redirected to received %d requests when following redirects, want 1", n)
+	}
+}
+
+func TestBaseTimesRedirectCredentials(t *testing.T) {
+	from, to, received, closeAll := redirectServers()
+	defer closeAll()
+
+	conf := Config{FollowRedirects: true, Scope: []string{from.Hostname(), to.Hostname()}}
+	conf.Headers = []string{"Authorization: Bearer secret"}
+	results, errs := baseTimes(conf, from)
+	if len(errs) > 0 || len(results) != 1 {
+		t.Fatalf("got results %v and errors %v, want one result", results, errs)
+	}
+	if results[0].Final == nil || results[0].Final.String() != to.String() {
+		t.Errorf("got final URL %v, want %s", results[0].Final, to)
+	}
+
+	fromAuth, toAuth, _ := received()
+	if fromAuth != "Bearer secret" {
+		t.Errorf("URL given received Authorization %q, want the credentials", fromAuth)
+	}
+	if toAuth != "" {
+		t.Errorf("other host redirected to received Authorization %q, want none", toAuth)
+	}
+}
+
+func TestBaseTimesRedirectScope(t *testing.T) {
+	from, _, received, closeAll := redirectServers()
+	defer closeAll()
+
+	conf := Config{FollowRedirects: true, Scope: []string{from.Hostname()}}
+	results, errs := baseTimes(conf, from)
+	if len(results) != 0 || len(errs) != 1 {
+		t.Fatalf("got results %v and errors %v, want a single error", results, errs)
+	}
+	if _, _, n := received(); n != 0 {
+		t.Errorf("out of scope host received %d requests, want none", n)
+	}
+}
+
+func TestBaseTimesRedirectHost(t *testing.T) {
+	from, _, received, closeAll := redirectServers()
+	defer closeAll()
+
+	// Without a scope, a redirect to another host isn't followed
+	results, errs := baseTimes(Config{FollowRedirects: true}, from)
+	if len(results) != 0 || len(errs) != 1 {
+		t.Fatalf("got results %v and errors %v, want a single error", results, errs)
+	}
+	if _, _, n := received(); n != 0 {
+		t.Errorf("other host received %d requests, want none", n)
+	}
+
+	// A redirect to the same host is followed
+	same := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.Redirect(rw, r, "/app", http.StatusFound)
+		}
+	}))
+	defer same.Close()
+	u, _ := url.Parse(same.URL + "/")
+	results, errs = baseTimes(Config{FollowRedirects: true}, u)
+	if len(errs) > 0 || len(results) != 1 || results[0].Final == nil || results[0].Final.Path != "/app" {
+		t.Fatalf("got results %v and errors %v, want one result redirected to /app", results, errs)
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	from, _ := url.Parse("https://a.example.com/")
+	target := Target{
+		Url:     from.String(),
+		Headers: []string{"Authorization: Bearer secret", "cookie: session=1", "X-Test: 1"},
+		Methods: []string{"POST"},
+	}
+
+	same, _ := url.Parse("http://a.example.com:8080/home")
+	if got := redirectTarget(from, same, target); len(got.Headers) != 3 || got.redirected {
+		t.Errorf("redirect to the same host got %+v, want the target unchanged", got)
+	}
+
+	other, _ := url.Parse("https://b.example.com/")
+	got := redirectTarget(from, other, target)
+	if len(got.Headers) != 1 || got.Headers[0] != "X-Test: 1" || !got.redirected {
+		t.Errorf("redirect to another host got %+v, want only X-Test kept", got)
+	}
+	if len(got.Methods) != 1 || got.Methods[0] != "POST" {
+		t.Errorf("redirect to another host got methods %v, want POST", got.Methods)
+	}
+	if len(target.Headers) != 3 {
+		t.Errorf("original target's headers changed to %v", target.Headers)
+	}
+}
+
+func TestMarkerPath(t *testing.T) {
+	// A server vulnerable to 0.CL desyncs, which answers a marker path it doesn't have with a 410 rather than a 404
+	u := stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(head, "GET /gone ") {
+				respond(conn, 410)
+			} else {
+				respond(conn, 200)
+			}
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   SmuggleType
+	}{
+		{"default marker", "", 0, SAFE},
+		{"configured marker path", "/gone", 0, SAFE},
+		{"configured marker path and status", "/gone", 410, ZEROCL},
+	}
+
+	for _, test := range tests {
+		conf := Config{MarkerStatus: test.status, Mutations: map[string]Mutation{ZeroCLMutation: {}}}
+		conf.Headers = []string{"Connection: close"}
+		conf.MarkerPath = test.path
+		w, errs := testWorker(conf)
+		r := runTest(t, w, SmuggleTest{Url: u, Method: "POST", Mutation: ZeroCLMutation, Timeout: time.Second})
+		if r.Status != test.want {
+			t.Errorf("%s: got status %q, want %q", test.name, r.Status, test.want)
+		}
+		noErrors(t, errs)
+	}
+}
+
+func TestRootCAs(t *testing.T) {
+	// The handshakes which fail verification would otherwise be logged by the server
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/")
+
+	// The test server's certificate is signed by itself, so it is its own CA
+	trusted := x509.NewCertPool()
+	trusted.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name    string
+		pool    *x509.CertPool
+		wantErr bool
+	}{
+		{"no CAs", nil, false},
+		{"the server's CA", trusted, false},
+		{"without the server's CA", x509.NewCertPool(), true},
+	}
+
+	for _, test := range tests {
+		w, _ := testWorker(Config{RootCAs: test.pool})
+		conn, err := w.dial(u, time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// continueServer starts a stub server which answers requests with Expect: 100-continue with a 100 Continue after
+// the given delay before reading their body, or with a 417 without reading it if refuse is set. Requests are
+// answered with a 200 once their body has been read
+func continueServer(t *testing.T, delay time.Duration, refuse bool) *url.URL {
+	return stubServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			head, err := readHead(r)
+			if err != nil {
+				return
+			}
+			if headerValue(head, "Expect") == "100-continue" {
+				if refuse {
+					fmt.Fprint(conn, "HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+					return
+				}
+				time.Sleep(delay)
+				fmt.Fprint(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+			}
+			if n, _ := strconv.Atoi(headerValue(head, "Content-Length")); n > 0 {
+				io.CopyN(ioutil.Discard, r, int64(n))
+			}
+
+			respond(conn, 200)
+			if headerValue(head, "Connection") == "close" {
+				return
+			}
+		}
+	})
+}
+
+func TestExpectContinue(t *testing.T) {
+	const delay = 400 * time.Millisecond
+	tests := []struct {
+		name    string
+		refuse  bool
+		wait    bool
+		conn    string
+		status  int
+		timeout bool
+	}{
+		// Waiting for 100 Continue isn't counted towards the timeout, which is shorter than the delay
+		{"waiting for 100 Continue", false, true, "close", 200, false},
+		{"waiting for 100 Continue on a keep-alive connection", false, true, "keep-alive", 200, false},
+		{"sending the body straight away", false, false, "close", 0, true},
+		{"server refusing the body", true, true, "close", 417, false},
+	}
+
+	for _, test := range tests {
+		u := continueServer(t, delay, test.refuse)
+		w, _ := testWorker(Config{WaitForContinue: test.wait})
+		req := "POST / HTTP/1.1\r\nHost: " + u.Host + "\r\nExpect: 100-continue\r\nConnection: " + test.conn + "\r\nContent-Length: 1\r\n\r\nQ"
+		resp, err, isTimeout := w.SendRequest([]byte(req), u, delay/2)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if isTimeout != test.timeout {
+			t.Errorf("%s: got timeout %t, want %t", test.name, isTimeout, test.timeout)
+		}
+		if status, _ := inspectResponse(resp); status != test.status {
+			t.Errorf("%s: got status %d, want %d in response %q", test.name, status, test.status, resp)
+		}
+		if test.wait && !test.refuse && w.untimed < delay {
+			t.Errorf("%s: got %s waiting for 100 Continue, want at least %s", test.name, w.untimed, delay)
+		}
+	}
+}
+
+func TestReadResponseInterim(t *testing.T) {
+	raw := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 102 Processing\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1 404 Not Found\r\n\r\n"
+	want := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	got, err := readResponse(strings.NewReader(raw), "POST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := stripInterim([]byte(raw[:len(raw)-len("HTTP/1.1 404 Not Found\r\n\r\n")])); string(got) != want {
+		t.Errorf("got %q with interim responses stripped, want %q", got, want)
+	}
+}
+
+func TestReadResponseIncomplete(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"closed without a response", "", ""},
+		{"truncated body", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nok", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nok"},
+		{"unparseable response", "garbage\r\n\r\n", "garbage\r\n\r\n"},
+	}
+
+	for _, test := range tests {
+		got, err := readResponse(strings.NewReader(test.raw), "GET")
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+		} else if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestKeepAliveClosedWithoutResponse(t *testing.T) {
+	// A server which closes each connection without answering, reading whatever is sent so it isn't reset
+	u := stubServer(t, func(conn net.Conn) {
+		readHead(bufio.NewReader(conn))
+		conn.(*net.TCPConn).CloseWrite()
+		io.Copy(ioutil.Discard, conn)
+	})
+
+	w, errs := testWorker(Config{
+		DetectResets:   true,
+		RequestOptions: RequestOptions{Headers: []string{"Connection: keep-alive"}},
+		Mutations:      map[string]Mutation{"standard": generateMutations()["standard"]},
+	})
+	r := runTest(t, w, SmuggleTest{Url: u, Method: "POST", Mutation: "standard", Timeout: time.Second})
+	if r.Status != RESET {
+		t.Errorf("got status %q, want %q", r.Status, RESET)
+	}
+	noErrors(t, errs)
+}